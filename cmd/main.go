@@ -12,13 +12,18 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/handler"
+	"github.com/zgsm-ai/oidc-auth/internal/outbox"
 	"github.com/zgsm-ai/oidc-auth/internal/providers"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
 	"github.com/zgsm-ai/oidc-auth/internal/service"
 	github "github.com/zgsm-ai/oidc-auth/internal/sync"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
 )
 
@@ -70,9 +75,15 @@ func initializeAllConfigurations(cfgFile string) (*config.AppConfig, error) {
 	if err := initLogger(&cfg.Log); err != nil {
 		return nil, fmt.Errorf("failed to initialize logger: %w", err)
 	}
+	if err := phone.SetDefaultRegion(cfg.Phone.DefaultRegion); err != nil {
+		return nil, fmt.Errorf("failed to initialize phone: %w", err)
+	}
 	if err := initDatabase(&cfg.Database); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
+	if err := repository.GetDB().RunDataMigrations(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to run data migrations: %w", err)
+	}
 	return cfg, nil
 }
 
@@ -97,6 +108,31 @@ func initHTTPClient(cfg *config.HTTPClientConfig) *http.Client {
 	return client
 }
 
+func buildProviderConfigs(cfgs map[string]config.ProviderConfig, httpClient *http.Client) map[string]*providers.ProviderConfig {
+	providerCfg := make(map[string]*providers.ProviderConfig, len(cfgs))
+	for name, p := range cfgs {
+		providerCfg[name] = &providers.ProviderConfig{
+			Type:         p.Type,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			BaseURL:      p.BaseURL,
+			Client:       httpClient,
+			InternalURL:  p.InternalURL,
+			Issuer:       p.Issuer,
+			JWKSURL:      p.JWKSURL,
+			UserInfoURL:  p.UserInfoURL,
+			AuthParams: providers.AuthParams{
+				Scopes:    p.Scopes,
+				Prompt:    p.Prompt,
+				AcrValues: p.AcrValues,
+				Extra:     p.ExtraAuthParams,
+			},
+			ClaimMapping: p.ClaimMapping,
+		}
+	}
+	return providerCfg
+}
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start the OIDC authentication server",
@@ -112,23 +148,44 @@ var serveCmd = &cobra.Command{
 			log.Fatal(nil, "Failed to initialize SMS service")
 		}
 		smsc.HTTPClient = httpClient
+		if err := service.InitSMSSender(smsc); err != nil {
+			log.Fatal(nil, "Failed to initialize SMS sender: %v", err)
+		}
+		if err := service.InitMailSender(&globalConfig.Email); err != nil {
+			log.Fatal(nil, "Failed to initialize mail sender: %v", err)
+		}
+		service.InitPasswordService(&globalConfig.Password)
+		service.InitMFAService(&globalConfig.MFA)
+		service.InitSessionLimits(&globalConfig.Session)
+		service.InitDeviceAttestation(&globalConfig.Device, globalConfig.Server.BaseURL, httpClient)
+		if err := service.InitWebAuthnService(&globalConfig.WebAuthn, globalConfig.Server.BaseURL); err != nil {
+			log.Fatal(nil, "Failed to initialize passkeys: %v", err)
+		}
 
 		// Initialize quota service
 		globalConfig.QuotaManager.HTTPClient = httpClient
 		service.InitQuotaService(&globalConfig.QuotaManager)
-		providerCfg := make(map[string]*providers.ProviderConfig)
-		for name, p := range globalConfig.Providers {
-			providerCfg[name] = &providers.ProviderConfig{
-				ClientID:     p.ClientID,
-				ClientSecret: p.ClientSecret,
-				BaseURL:      p.BaseURL,
-				Client:       httpClient,
-				InternalURL:  p.InternalURL,
-			}
+		webhook.Init(&globalConfig.Webhook, httpClient)
+		if err := outbox.Init(&globalConfig.Outbox, httpClient); err != nil {
+			log.Fatal(nil, "Failed to initialize outbox: %v", err)
 		}
-		err = providers.InitializeProviders(providerCfg)
+		outbox.AddSink(service.QuotaMergeSink{}, constants.EventQuotaMergeRequested)
+		outbox.AddSink(webhook.Sink{}, constants.EventAccountMerged)
+		audit.Init(&globalConfig.Audit)
+		err = providers.InitializeProviders(buildProviderConfigs(globalConfig.Providers, httpClient))
 		if err != nil {
-			log.Fatal(err, "Failed to initialize providers")
+			log.Fatal(nil, "Failed to initialize providers: %v", err)
+		}
+		config.WatchConfig(func(cfg *config.AppConfig) {
+			if err := providers.GetManager().ReplaceConfigs(buildProviderConfigs(cfg.Providers, httpClient)); err != nil {
+				log.Error(nil, "Rejected provider config reload, keeping current providers: %v", err)
+				return
+			}
+			log.Info(nil, "Provider configs reloaded: %v", providers.GetManager().ProviderNames())
+		})
+
+		if err := service.InitClientRegistry(context.Background(), globalConfig.Clients); err != nil {
+			log.Fatal(nil, "Failed to initialize client registry: %v", err)
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -139,6 +196,9 @@ var serveCmd = &cobra.Command{
 		syncStar.HTTPClient = initHTTPClient(nil)
 		github.Owner, github.Repo = syncStar.Owner, syncStar.Repo
 		go syncStar.StarSyncTimer(ctx)
+		go webhook.Run(ctx)
+		go outbox.Run(ctx)
+		go audit.Run(ctx)
 
 		go func() {
 			log.Info(nil, "Starting server...")
@@ -147,6 +207,11 @@ var serveCmd = &cobra.Command{
 				BaseURL:    globalConfig.Server.BaseURL,
 				HTTPClient: initHTTPClient(nil),
 				IsPrivate:  globalConfig.Server.IsPrivate,
+				RateLimit:  globalConfig.RateLimit,
+				AdminToken: globalConfig.Admin.Token,
+
+				TrustedProxies:      globalConfig.Server.TrustedProxies,
+				EnableTestEndpoints: globalConfig.Server.EnableTestEndpoints,
 			}
 			if err := server.StartServer(); err != nil {
 				log.Error(nil, "Server error: %v", err)
@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+const (
+	recordTimeout = 5 * time.Second
+	purgeTimeout  = time.Minute
+	maxUserAgent  = 512
+)
+
+var (
+	auditCfg  *config.AuditConfig
+	auditOnce sync.Once
+)
+
+// Init sets the retention of the audit log
+func Init(cfg *config.AuditConfig) {
+	auditOnce.Do(func() {
+		auditCfg = cfg
+	})
+}
+
+// Client the origin of the request an action came from
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+type clientKey struct{}
+
+// WithClient attaches the origin of a request to the context, so the entries recorded while
+// handling it say where the action came from
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientOf(ctx context.Context) Client {
+	client, _ := ctx.Value(clientKey{}).(Client)
+	return client
+}
+
+// Entry an action to record. Nil IDs are stored as empty.
+type Entry struct {
+	Action    string
+	Outcome   string
+	ActorID   uuid.UUID
+	SubjectID uuid.UUID
+	DeviceID  uuid.UUID
+	Reason    string
+	Details   map[string]string
+}
+
+func optionalID(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
+}
+
+// Record appends an entry with the client of the context. The action already happened or was
+// refused, so failures are logged rather than returned.
+func Record(ctx context.Context, entry Entry) {
+	client := clientOf(ctx)
+	if len(client.UserAgent) > maxUserAgent {
+		client.UserAgent = client.UserAgent[:maxUserAgent]
+	}
+	if entry.Details == nil {
+		entry.Details = map[string]string{}
+	}
+	record := repository.AuditLog{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		Action:    entry.Action,
+		Outcome:   entry.Outcome,
+		ActorID:   optionalID(entry.ActorID),
+		SubjectID: optionalID(entry.SubjectID),
+		DeviceID:  optionalID(entry.DeviceID),
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		Reason:    entry.Reason,
+		Details:   entry.Details,
+	}
+	// recorded even when the request that acted is timing out
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	if err := repository.GetDB().CreateAuditLog(ctx, &record); err != nil {
+		log.Error(nil, "failed to record %s (%s) of %s: %v", entry.Action, entry.Outcome, entry.SubjectID, err)
+	}
+}
+
+// Run deletes the entries older than the retention every purge interval until the context is done
+func Run(ctx context.Context) {
+	if auditCfg == nil || auditCfg.Retention <= 0 || auditCfg.PurgeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(auditCfg.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		purge(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purge(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, purgeTimeout)
+	defer cancel()
+	deleted, err := repository.GetDB().DeleteAuditLogsBefore(ctx, time.Now().Add(-auditCfg.Retention))
+	if err != nil {
+		log.Warn(nil, "failed to purge audit logs: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Info(nil, "audit log retention: deleted %d entries", deleted)
+	}
+}
+
+// List lists the most recent entries matching the filter
+func List(ctx context.Context, filter repository.AuditLogFilter, limit int) ([]repository.AuditLog, error) {
+	return repository.GetDB().ListAuditLogs(ctx, filter, limit)
+}
+
+// ExportLimit the most entries one export returns
+func ExportLimit() int {
+	if auditCfg == nil || auditCfg.ExportLimit <= 0 {
+		return 10000
+	}
+	return auditCfg.ExportLimit
+}
@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+func outcome(err error) (string, string) {
+	if err != nil {
+		return constants.AuditFailure, err.Error()
+	}
+	return constants.AuditSuccess, ""
+}
+
+func deviceDetails(device *repository.Device) map[string]string {
+	return map[string]string{
+		"provider":  device.Provider,
+		"platform":  device.Platform,
+		"client_id": device.ClientID,
+	}
+}
+
+// Login records a device of the user signing in
+func Login(ctx context.Context, user *repository.AuthUser, device *repository.Device) {
+	Record(ctx, Entry{
+		Action:    constants.AuditLogin,
+		Outcome:   constants.AuditSuccess,
+		ActorID:   user.ID,
+		SubjectID: user.ID,
+		DeviceID:  device.ID,
+		Details:   deviceDetails(device),
+	})
+}
+
+// LoginFailed records a refused login with the provider it used. The user is nil when the
+// login did not get as far as identifying one.
+func LoginFailed(ctx context.Context, user *repository.AuthUser, provider string, err error) {
+	entry := Entry{
+		Action:  constants.AuditLogin,
+		Outcome: constants.AuditFailure,
+		Reason:  err.Error(),
+		Details: map[string]string{"provider": provider},
+	}
+	if user != nil {
+		entry.SubjectID = user.ID
+	}
+	Record(ctx, entry)
+}
+
+// maxAttemptedLogin bounds the attempted login kept from a request body
+const maxAttemptedLogin = 128
+
+// PasswordLoginFailed records a refused password login with the username, email or phone it was
+// attempted for, so guessing against one account shows up in the log
+func PasswordLoginFailed(ctx context.Context, login string, err error) {
+	if len(login) > maxAttemptedLogin {
+		login = strings.ToValidUTF8(login[:maxAttemptedLogin], "")
+	}
+	Record(ctx, Entry{
+		Action:  constants.AuditLogin,
+		Outcome: constants.AuditFailure,
+		Reason:  err.Error(),
+		Details: map[string]string{"provider": constants.ProviderPassword, "username": login},
+	})
+}
+
+// TokenRefresh records a device refreshing its tokens, refused when err is not nil. The user
+// and device are nil when the refresh token matched none.
+func TokenRefresh(ctx context.Context, user *repository.AuthUser, device *repository.Device, err error) {
+	entry := Entry{Action: constants.AuditTokenRefresh}
+	entry.Outcome, entry.Reason = outcome(err)
+	if user != nil {
+		entry.ActorID, entry.SubjectID = user.ID, user.ID
+	}
+	if device != nil {
+		entry.DeviceID = device.ID
+		entry.Details = deviceDetails(device)
+	}
+	Record(ctx, entry)
+}
+
+// ForcedLogout records a signed in device of the user signed out by another login
+func ForcedLogout(ctx context.Context, user *repository.AuthUser, device *repository.Device, reason string) {
+	Record(ctx, Entry{
+		Action:    constants.AuditForcedLogout,
+		Outcome:   constants.AuditSuccess,
+		SubjectID: user.ID,
+		DeviceID:  device.ID,
+		Reason:    reason,
+		Details:   deviceDetails(device),
+	})
+}
+
+// DeviceSignedOut records a signed in device the user signed out through the session list of a device
+func DeviceSignedOut(ctx context.Context, user *repository.AuthUser, device, from *repository.Device) {
+	details := deviceDetails(device)
+	details["from_device_id"] = from.ID.String()
+	Record(ctx, Entry{
+		Action:    constants.AuditDeviceSignOut,
+		Outcome:   constants.AuditSuccess,
+		ActorID:   user.ID,
+		SubjectID: user.ID,
+		DeviceID:  device.ID,
+		Details:   details,
+	})
+}
+
+// AccountMerge records a merge that completed, or stopped at a step when err is not nil
+func AccountMerge(ctx context.Context, merge *repository.AccountMerge, err error) {
+	entry := Entry{
+		Action:    constants.AuditAccountMerge,
+		ActorID:   merge.MainUserID,
+		SubjectID: merge.MainUserID,
+		Details: map[string]string{
+			"merge_id":       merge.ID.String(),
+			"merged_user_id": merge.OtherUserID.String(),
+			"step":           merge.Step,
+		},
+	}
+	entry.Outcome, entry.Reason = outcome(err)
+	Record(ctx, entry)
+}
+
+// InviteRedeemed records a saved new user that signed up with the invite code of another
+func InviteRedeemed(ctx context.Context, user *repository.AuthUser) {
+	if user.InviterID == nil || *user.InviterID == uuid.Nil {
+		return
+	}
+	Record(ctx, Entry{
+		Action:    constants.AuditInviteRedeemed,
+		Outcome:   constants.AuditSuccess,
+		ActorID:   user.ID,
+		SubjectID: *user.InviterID,
+		Details:   map[string]string{"invitee_id": user.ID.String()},
+	})
+}
+
+// SMSSend records a text sent, or failed to send when err is not nil, to a masked phone number
+func SMSSend(ctx context.Context, maskedPhone, sender string, err error) {
+	entry := Entry{
+		Action:  constants.AuditSMSSend,
+		Details: map[string]string{"phone": maskedPhone, "sender": sender},
+	}
+	entry.Outcome, entry.Reason = outcome(err)
+	Record(ctx, entry)
+}
+
+// DeviceRisk records a refresh of a device that scored as risky, the reasons and the action taken.
+// The outcome is a failure when the action held back the tokens.
+func DeviceRisk(ctx context.Context, user *repository.AuthUser, device *repository.Device, score int,
+	reasons []string, action string) {
+	details := deviceDetails(device)
+	details["score"] = strconv.Itoa(score)
+	details["action"] = action
+	if device.Attestation.Country != "" {
+		details["country"] = device.Attestation.Country
+	}
+	if device.Attestation.ASN != "" {
+		details["asn"] = device.Attestation.ASN
+	}
+	entry := Entry{
+		Action:    constants.AuditDeviceRisk,
+		Outcome:   constants.AuditSuccess,
+		ActorID:   user.ID,
+		SubjectID: user.ID,
+		DeviceID:  device.ID,
+		Reason:    strings.Join(reasons, "; "),
+		Details:   details,
+	}
+	if action == constants.RiskActionStepUp || action == constants.RiskActionRevoke {
+		entry.Outcome = constants.AuditFailure
+	}
+	Record(ctx, entry)
+}
@@ -7,8 +7,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 
+	"github.com/zgsm-ai/oidc-auth/internal/mapping"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
 )
 
@@ -19,8 +21,21 @@ type AppConfig struct {
 	GithubConfig GithubStarConfig          `json:"syncStar" mapstructure:"syncStar" validate:"required"`
 	Encrypt      EncryptConfig             `json:"encrypt" mapstructure:"encrypt" validate:"required"`
 	SMS          SMSConfig                 `json:"sms" mapstructure:"sms" validate:"required"`
+	Phone        PhoneConfig               `json:"phone" mapstructure:"phone"`
 	Providers    map[string]ProviderConfig `json:"providers" mapstructure:"providers"`
 	QuotaManager QuotaConfig               `json:"quotaManager" mapstructure:"quotaManager"`
+	Clients      map[string]ClientConfig   `json:"clients" mapstructure:"clients"`
+	RateLimit    RateLimitConfig           `json:"rateLimit" mapstructure:"rateLimit"`
+	Email        EmailConfig               `json:"email" mapstructure:"email"`
+	Password     PasswordConfig            `json:"password" mapstructure:"password"`
+	MFA          MFAConfig                 `json:"mfa" mapstructure:"mfa"`
+	WebAuthn     WebAuthnConfig            `json:"webauthn" mapstructure:"webauthn"`
+	Admin        AdminConfig               `json:"admin" mapstructure:"admin"`
+	Webhook      WebhookConfig             `json:"webhook" mapstructure:"webhook"`
+	Outbox       OutboxConfig              `json:"outbox" mapstructure:"outbox"`
+	Audit        AuditConfig               `json:"audit" mapstructure:"audit"`
+	Session      SessionConfig             `json:"session" mapstructure:"session"`
+	Device       DeviceConfig              `json:"device" mapstructure:"device"`
 }
 
 type Server struct {
@@ -28,6 +43,11 @@ type Server struct {
 	BaseURL    string            `json:"baseURL" mapstructure:"baseURL"`
 	HTTP       *HTTPClientConfig `json:"http" mapstructure:"http" validate:"required"`
 	IsPrivate  bool              `json:"isPrivate" mapstructure:"isPrivate"`
+	// TrustedProxies are the addresses or CIDRs of the proxies whose X-Forwarded-For is believed;
+	// empty trusts none, so the client IP is the peer address
+	TrustedProxies []string `json:"trustedProxies" mapstructure:"trustedProxies"`
+	// EnableTestEndpoints exposes the mock inboxes and the local outbox to admins, for test deployments only
+	EnableTestEndpoints bool `json:"enableTestEndpoints" mapstructure:"enableTestEndpoints"`
 }
 
 type HTTPClientConfig struct {
@@ -78,25 +98,353 @@ type EncryptConfig struct {
 }
 
 type SMSConfig struct {
-	EnabledTest bool   `json:"enabledTest" mapstructure:"enabledTest" validate:"required"`
-	AppID       string `json:"appID" mapstructure:"appID"`
-	MchID       string `json:"mchID" mapstructure:"mchID"`
-	TemplateID  string `json:"templateID" mapstructure:"templateID"`
-	ApiKey      string `json:"apiKey" mapstructure:"apiKey"`
-	SendURL     string `json:"sendURL" mapstructure:"sendURL"`
-	HTTPClient  *http.Client
+	EnabledTest bool `json:"enabledTest" mapstructure:"enabledTest" validate:"required"`
+	// Provider selects the SMS gateway; empty means the custom vendor, or mock when EnabledTest is set
+	Provider string `json:"provider" mapstructure:"provider" validate:"omitempty,oneof=custom aliyun tencent twilio webhook mock"`
+	// Template is the message body for gateways that send free text, "{code}" is replaced by the code
+	Template string `json:"template" mapstructure:"template"`
+
+	// custom vendor
+	AppID      string `json:"appID" mapstructure:"appID"`
+	MchID      string `json:"mchID" mapstructure:"mchID"`
+	TemplateID string `json:"templateID" mapstructure:"templateID"`
+	ApiKey     string `json:"apiKey" mapstructure:"apiKey"`
+	SendURL    string `json:"sendURL" mapstructure:"sendURL"`
+	HTTPClient *http.Client
+
+	// One-time login codes
+	CodeLength     int           `json:"codeLength" mapstructure:"codeLength" validate:"omitempty,min=4,max=10"`
+	CodeTTL        time.Duration `json:"codeTTL" mapstructure:"codeTTL"`
+	MaxAttempts    int           `json:"maxAttempts" mapstructure:"maxAttempts"`
+	ResendInterval time.Duration `json:"resendInterval" mapstructure:"resendInterval"`
+
+	// Abuse protection
+	CallerSecret   string             `json:"callerSecret" mapstructure:"callerSecret"`
+	AllowedRegions []string           `json:"allowedRegions" mapstructure:"allowedRegions"`
+	RateLimit      SMSRateLimitConfig `json:"rateLimit" mapstructure:"rateLimit"`
+
+	Aliyun  AliyunSMSConfig  `json:"aliyun" mapstructure:"aliyun"`
+	Tencent TencentSMSConfig `json:"tencent" mapstructure:"tencent"`
+	Twilio  TwilioSMSConfig  `json:"twilio" mapstructure:"twilio"`
+	Webhook WebhookSMSConfig `json:"webhook" mapstructure:"webhook"`
+}
+
+// SMSRateLimitConfig limits SMS sends; a zero limit disables that check
+type SMSRateLimitConfig struct {
+	PerPhone       int           `json:"perPhone" mapstructure:"perPhone" validate:"gte=0"`
+	PerPhoneWindow time.Duration `json:"perPhoneWindow" mapstructure:"perPhoneWindow"`
+	PerIP          int           `json:"perIP" mapstructure:"perIP" validate:"gte=0"`
+	PerIPWindow    time.Duration `json:"perIPWindow" mapstructure:"perIPWindow"`
+	Global         int           `json:"global" mapstructure:"global" validate:"gte=0"`
+	GlobalWindow   time.Duration `json:"globalWindow" mapstructure:"globalWindow"`
+	PhoneDailyCap  int           `json:"phoneDailyCap" mapstructure:"phoneDailyCap" validate:"gte=0"`
+	GlobalDailyCap int           `json:"globalDailyCap" mapstructure:"globalDailyCap" validate:"gte=0"`
+}
+
+type AliyunSMSConfig struct {
+	AccessKeyID     string `json:"accessKeyID" mapstructure:"accessKeyID"`
+	AccessKeySecret string `json:"accessKeySecret" mapstructure:"accessKeySecret"`
+	SignName        string `json:"signName" mapstructure:"signName"`
+	TemplateCode    string `json:"templateCode" mapstructure:"templateCode"`
+	RegionID        string `json:"regionID" mapstructure:"regionID"`
+	Endpoint        string `json:"endpoint" mapstructure:"endpoint"`
+}
+
+type TencentSMSConfig struct {
+	SecretID   string `json:"secretID" mapstructure:"secretID"`
+	SecretKey  string `json:"secretKey" mapstructure:"secretKey"`
+	SdkAppID   string `json:"sdkAppID" mapstructure:"sdkAppID"`
+	SignName   string `json:"signName" mapstructure:"signName"`
+	TemplateID string `json:"templateID" mapstructure:"templateID"`
+	Region     string `json:"region" mapstructure:"region"`
+	Endpoint   string `json:"endpoint" mapstructure:"endpoint"`
+}
+
+type TwilioSMSConfig struct {
+	AccountSID          string `json:"accountSID" mapstructure:"accountSID"`
+	AuthToken           string `json:"authToken" mapstructure:"authToken"`
+	From                string `json:"from" mapstructure:"from"`
+	MessagingServiceSID string `json:"messagingServiceSID" mapstructure:"messagingServiceSID"`
+	BaseURL             string `json:"baseURL" mapstructure:"baseURL"`
+}
+
+type WebhookSMSConfig struct {
+	URL     string            `json:"url" mapstructure:"url"`
+	Secret  string            `json:"secret" mapstructure:"secret"`
+	Headers map[string]string `json:"headers" mapstructure:"headers"`
+}
+
+type RateLimitConfig struct {
+	// Enabled turns on the plugin, web and invite_code policies; the token, password and mfa
+	// policies guard credentials and are enforced either way, unless overridden with a burst of 0
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Backend is "memory" (per replica) or "database" (shared by all replicas)
+	Backend string `json:"backend" mapstructure:"backend" validate:"omitempty,oneof=memory database"`
+	// Policies override the built-in policies by name: plugin, web, token, invite_code, password, mfa
+	Policies map[string]RateLimitPolicy `json:"policies" mapstructure:"policies"`
+}
+
+// RateLimitPolicy a token bucket per key; every key dimension gets its own bucket
+type RateLimitPolicy struct {
+	Rate  float64  `json:"rate" mapstructure:"rate" validate:"gte=0"` // tokens per second
+	Burst int      `json:"burst" mapstructure:"burst" validate:"gte=0"`
+	KeyBy []string `json:"keyBy" mapstructure:"keyBy"` // ip, user, machine_code
+}
+
+type EmailConfig struct {
+	// Provider selects the mail sender: "smtp", "file" or "mock"; empty disables email login
+	Provider string `json:"provider" mapstructure:"provider" validate:"omitempty,oneof=smtp file mock"`
+	From     string `json:"from" mapstructure:"from"`
+	FromName string `json:"fromName" mapstructure:"fromName"`
+	// TemplateDir overrides the built-in templates <purpose>_subject.txt, <purpose>.txt and <purpose>.html
+	// of the login and password_reset purposes
+	TemplateDir string `json:"templateDir" mapstructure:"templateDir"`
+	// FileDir is where the file sender writes .eml files
+	FileDir string     `json:"fileDir" mapstructure:"fileDir"`
+	SMTP    SMTPConfig `json:"smtp" mapstructure:"smtp"`
+
+	CodeTTL        time.Duration `json:"codeTTL" mapstructure:"codeTTL"`
+	MaxAttempts    int           `json:"maxAttempts" mapstructure:"maxAttempts"`
+	ResendInterval time.Duration `json:"resendInterval" mapstructure:"resendInterval"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host" mapstructure:"host"`
+	Port     int    `json:"port" mapstructure:"port"`
+	Username string `json:"username" mapstructure:"username"`
+	Password string `json:"password" mapstructure:"password"`
+	// Security is "starttls", "tls" (implicit, usually port 465) or "none"
+	Security string `json:"security" mapstructure:"security" validate:"omitempty,oneof=starttls tls none"`
+}
+
+// PasswordConfig controls first-party username/password accounts
+type PasswordConfig struct {
+	Enabled           bool          `json:"enabled" mapstructure:"enabled"`
+	AllowRegistration bool          `json:"allowRegistration" mapstructure:"allowRegistration"`
+	MinLength         int           `json:"minLength" mapstructure:"minLength" validate:"gte=8"`
+	MaxLength         int           `json:"maxLength" mapstructure:"maxLength"`
+	RequireUpper      bool          `json:"requireUpper" mapstructure:"requireUpper"`
+	RequireLower      bool          `json:"requireLower" mapstructure:"requireLower"`
+	RequireDigit      bool          `json:"requireDigit" mapstructure:"requireDigit"`
+	RequireSymbol     bool          `json:"requireSymbol" mapstructure:"requireSymbol"`
+	MaxFailedAttempts int           `json:"maxFailedAttempts" mapstructure:"maxFailedAttempts"`
+	LockoutDuration   time.Duration `json:"lockoutDuration" mapstructure:"lockoutDuration"`
+	Argon2            Argon2Config  `json:"argon2" mapstructure:"argon2"`
+}
+
+type Argon2Config struct {
+	Memory      uint32 `json:"memory" mapstructure:"memory"` // KiB
+	Iterations  uint32 `json:"iterations" mapstructure:"iterations"`
+	Parallelism uint8  `json:"parallelism" mapstructure:"parallelism"`
+}
+
+// MFAConfig controls TOTP two-factor authentication
+type MFAConfig struct {
+	// Required makes every account enroll a second factor at its next login
+	Required bool `json:"required" mapstructure:"required"`
+	// Issuer is the account label shown by authenticator apps
+	Issuer string `json:"issuer" mapstructure:"issuer"`
+	// ChallengeURL is the page that asks for the code; defaults to /login/mfa on the login frontend
+	ChallengeURL      string        `json:"challengeURL" mapstructure:"challengeURL"`
+	ChallengeTTL      time.Duration `json:"challengeTTL" mapstructure:"challengeTTL"`
+	MaxAttempts       int           `json:"maxAttempts" mapstructure:"maxAttempts"`
+	RecoveryCodeCount int           `json:"recoveryCodeCount" mapstructure:"recoveryCodeCount"`
+	// MaxFailedCodes wrong codes in a row lock the factor of a user across challenges, for
+	// LockoutDuration the first time and twice as long each time after, up to MaxLockoutDuration
+	MaxFailedCodes     int           `json:"maxFailedCodes" mapstructure:"maxFailedCodes"`
+	LockoutDuration    time.Duration `json:"lockoutDuration" mapstructure:"lockoutDuration"`
+	MaxLockoutDuration time.Duration `json:"maxLockoutDuration" mapstructure:"maxLockoutDuration"`
+}
+
+// WebAuthnConfig controls passkeys on the web manager, for login and as a second factor
+type WebAuthnConfig struct {
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// RPID is the domain passkeys are bound to; defaults to the host of server.baseURL
+	RPID   string `json:"rpID" mapstructure:"rpID"`
+	RPName string `json:"rpName" mapstructure:"rpName"`
+	// Origins are the pages allowed to use passkeys; defaults to the origin of server.baseURL
+	Origins []string      `json:"origins" mapstructure:"origins"`
+	Timeout time.Duration `json:"timeout" mapstructure:"timeout"`
+	// UserVerification is "required", "preferred" or "discouraged"
+	UserVerification string `json:"userVerification" mapstructure:"userVerification" validate:"omitempty,oneof=required preferred discouraged"`
+}
+
+// AdminConfig controls the operator API; it is disabled while the token is empty
+type AdminConfig struct {
+	Token string `json:"token" mapstructure:"token"`
+}
+
+// WebhookConfig controls the signed user lifecycle events posted to other services
+type WebhookConfig struct {
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// MaxAttempts of a delivery before it is marked failed; failed deliveries can be replayed
+	MaxAttempts int `json:"maxAttempts" mapstructure:"maxAttempts" validate:"omitempty,min=1"`
+	// InitialBackoff is the delay before the first retry, doubling after each failed attempt up to MaxBackoff
+	InitialBackoff time.Duration `json:"initialBackoff" mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `json:"maxBackoff" mapstructure:"maxBackoff"`
+	// Timeout of one delivery request
+	Timeout time.Duration `json:"timeout" mapstructure:"timeout"`
+	// PollInterval is how often due deliveries are looked up; new events are sent right away
+	PollInterval time.Duration                    `json:"pollInterval" mapstructure:"pollInterval"`
+	Endpoints    map[string]WebhookEndpointConfig `json:"endpoints" mapstructure:"endpoints"`
+}
+
+// WebhookEndpointConfig a service receiving events
+type WebhookEndpointConfig struct {
+	URL string `json:"url" mapstructure:"url" validate:"required,url"`
+	// Secret signs each delivery: X-Signature is sha256=HMAC-SHA256(secret, "<X-Timestamp>.<body>")
+	Secret string `json:"secret" mapstructure:"secret"`
+	// Events the endpoint receives; it receives every event while empty
+	Events  []string          `json:"events" mapstructure:"events"`
+	Headers map[string]string `json:"headers" mapstructure:"headers"`
+}
+
+// OutboxConfig controls the publication of events written to the outbox in the transaction of the
+// change they announce. Events are published at least once, consumers deduplicate by event ID.
+type OutboxConfig struct {
+	// MaxAttempts of an event before it is marked failed; failed events can be retried
+	MaxAttempts int `json:"maxAttempts" mapstructure:"maxAttempts" validate:"omitempty,min=1"`
+	// InitialBackoff is the delay before the first retry, doubling after each failed attempt up to MaxBackoff
+	InitialBackoff time.Duration `json:"initialBackoff" mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `json:"maxBackoff" mapstructure:"maxBackoff"`
+	// PollInterval is how often due events are looked up; events of this instance are published right away
+	PollInterval time.Duration               `json:"pollInterval" mapstructure:"pollInterval"`
+	Sinks        map[string]OutboxSinkConfig `json:"sinks" mapstructure:"sinks"`
+}
+
+// OutboxSinkConfig a broker or service events are published to
+type OutboxSinkConfig struct {
+	// Type is "http", "nats", "kafka" (through a Kafka REST proxy) or "local" (kept in memory, for tests)
+	Type string `json:"type" mapstructure:"type" validate:"required,oneof=http nats kafka local"`
+	// URL of the HTTP endpoint, the NATS server (nats:// or tls://) or the Kafka REST proxy
+	URL string `json:"url" mapstructure:"url"`
+	// Topics the sink receives; it receives every event while empty
+	Topics []string `json:"topics" mapstructure:"topics"`
+	// Subject prefixes the NATS subject or Kafka topic, which is the event topic otherwise
+	Subject string `json:"subject" mapstructure:"subject"`
+	// Secret signs HTTP deliveries like webhooks
+	Secret  string            `json:"secret" mapstructure:"secret"`
+	Headers map[string]string `json:"headers" mapstructure:"headers"`
+	// Username, Password and Token authenticate to NATS; username and password also to the Kafka REST proxy
+	Username string        `json:"username" mapstructure:"username"`
+	Password string        `json:"password" mapstructure:"password"`
+	Token    string        `json:"token" mapstructure:"token"`
+	Timeout  time.Duration `json:"timeout" mapstructure:"timeout"`
+}
+
+// SessionConfig limits how many devices a user is logged in on at once
+type SessionConfig struct {
+	// MaxDevices is the limit of every user; 0 means no limit
+	MaxDevices int `json:"maxDevices" mapstructure:"maxDevices" validate:"omitempty,min=0"`
+	// VipMaxDevices overrides MaxDevices for the users of a Vip level; 0 means no limit
+	VipMaxDevices map[int]int `json:"vipMaxDevices" mapstructure:"vipMaxDevices"`
+	// Policy is "evict_lru" to sign out the least recently used device or "reject" to refuse the login
+	Policy string `json:"policy" mapstructure:"policy" validate:"omitempty,oneof=evict_lru reject"`
+}
+
+// DeviceConfig controls device-bound keys and the anomaly scoring of token refreshes
+type DeviceConfig struct {
+	// RequireKey refuses plugin logins that do not register a device-bound key
+	RequireKey bool `json:"requireKey" mapstructure:"requireKey"`
+	// ProofMaxAge is how old a key proof may be; each proof is accepted once within it
+	ProofMaxAge time.Duration `json:"proofMaxAge" mapstructure:"proofMaxAge" validate:"gt=0"`
+	Geo         GeoConfig     `json:"geo" mapstructure:"geo"`
+	Risk        RiskConfig    `json:"risk" mapstructure:"risk"`
+}
+
+// GeoConfig tells where the country, network and coordinates of client IPs come from
+type GeoConfig struct {
+	// Source is "headers" set by a trusted proxy, "http" for a lookup service, or empty for none
+	Source          string `json:"source" mapstructure:"source" validate:"omitempty,oneof=headers http"`
+	CountryHeader   string `json:"countryHeader" mapstructure:"countryHeader"`
+	ASNHeader       string `json:"asnHeader" mapstructure:"asnHeader"`
+	LatitudeHeader  string `json:"latitudeHeader" mapstructure:"latitudeHeader"`
+	LongitudeHeader string `json:"longitudeHeader" mapstructure:"longitudeHeader"`
+	// URL of the lookup service, {ip} is replaced with the client IP; it answers with a JSON object
+	URL            string        `json:"url" mapstructure:"url"`
+	CountryField   string        `json:"countryField" mapstructure:"countryField"`
+	ASNField       string        `json:"asnField" mapstructure:"asnField"`
+	LatitudeField  string        `json:"latitudeField" mapstructure:"latitudeField"`
+	LongitudeField string        `json:"longitudeField" mapstructure:"longitudeField"`
+	CacheTTL       time.Duration `json:"cacheTTL" mapstructure:"cacheTTL"`
+}
+
+// RiskConfig scores a refresh by what changed since the device was last seen, and acts on the score
+type RiskConfig struct {
+	NewCountry       int `json:"newCountry" mapstructure:"newCountry"`
+	NewASN           int `json:"newASN" mapstructure:"newASN"`
+	ImpossibleTravel int `json:"impossibleTravel" mapstructure:"impossibleTravel"`
+	NewUserAgent     int `json:"newUserAgent" mapstructure:"newUserAgent"`
+	// MaxTravelSpeed in km/h; moving faster between two refreshes is impossible travel
+	MaxTravelSpeed float64 `json:"maxTravelSpeed" mapstructure:"maxTravelSpeed" validate:"gt=0"`
+	// LogScore, StepUpScore and RevokeScore are the scores from which a refresh is audited, needs a
+	// second factor, or signs the device out; 0 disables the action
+	LogScore    int `json:"logScore" mapstructure:"logScore" validate:"min=0"`
+	StepUpScore int `json:"stepUpScore" mapstructure:"stepUpScore" validate:"min=0"`
+	RevokeScore int `json:"revokeScore" mapstructure:"revokeScore" validate:"min=0"`
+}
+
+// AuditConfig controls the audit log of authentication and account events
+type AuditConfig struct {
+	// Retention is how long entries are kept; they are kept forever while it is 0
+	Retention time.Duration `json:"retention" mapstructure:"retention"`
+	// PurgeInterval is how often entries older than Retention are deleted
+	PurgeInterval time.Duration `json:"purgeInterval" mapstructure:"purgeInterval"`
+	// ExportLimit caps the entries of one export
+	ExportLimit int `json:"exportLimit" mapstructure:"exportLimit" validate:"omitempty,min=1"`
+}
+
+type PhoneConfig struct {
+	// DefaultRegion is the ISO 3166 region assumed for numbers without a country code
+	DefaultRegion string `json:"defaultRegion" mapstructure:"defaultRegion"`
 }
 
 type ProviderConfig struct {
+	Type         string `json:"type" mapstructure:"type"`
 	ClientID     string `json:"clientID" mapstructure:"clientID"`
 	ClientSecret string `json:"clientSecret" mapstructure:"clientSecret"`
 	EncryptKey   string `json:"encryptKey" mapstructure:"encryptKey"`
 	BaseURL      string `json:"baseURL" mapstructure:"baseURL"`
 	InternalURL  string `json:"internalURL" mapstructure:"internalURL"`
+	Issuer       string `json:"issuer" mapstructure:"issuer"`
+	JWKSURL      string `json:"jwksURL" mapstructure:"jwksURL"`
+	UserInfoURL  string `json:"userInfoURL" mapstructure:"userInfoURL"`
+
+	Scopes          []string          `json:"scopes" mapstructure:"scopes"`
+	Prompt          string            `json:"prompt" mapstructure:"prompt"`
+	AcrValues       string            `json:"acrValues" mapstructure:"acrValues"`
+	ExtraAuthParams map[string]string `json:"extraAuthParams" mapstructure:"extraAuthParams"`
+
+	// ClaimMapping overrides the provider's built-in claim mapping per attribute
+	ClaimMapping map[string]mapping.Rule `json:"claimMapping" mapstructure:"claimMapping"`
+}
+
+// ClientConfig seeds an OAuth client into the client registry, keyed by client ID
+type ClientConfig struct {
+	ClientSecret    string         `json:"clientSecret" mapstructure:"clientSecret"`
+	Name            string         `json:"name" mapstructure:"name"`
+	Platform        string         `json:"platform" mapstructure:"platform" validate:"omitempty,oneof=plugin web"`
+	RedirectURIs    []string       `json:"redirectURIs" mapstructure:"redirectURIs"`
+	URISchemes      []string       `json:"uriSchemes" mapstructure:"uriSchemes"`
+	AllowedGrants   []string       `json:"allowedGrants" mapstructure:"allowedGrants"`
+	Audience        []string       `json:"audience" mapstructure:"audience"`
+	AccessTokenTTL  time.Duration  `json:"accessTokenTTL" mapstructure:"accessTokenTTL" validate:"gte=0"`
+	RefreshTokenTTL time.Duration  `json:"refreshTokenTTL" mapstructure:"refreshTokenTTL" validate:"gte=0"`
+	Branding        ClientBranding `json:"branding" mapstructure:"branding"`
+	Disabled        bool           `json:"disabled" mapstructure:"disabled"`
+}
+
+type ClientBranding struct {
+	DisplayName  string `json:"displayName" mapstructure:"displayName"`
+	LogoURL      string `json:"logoURL" mapstructure:"logoURL"`
+	HomepageURL  string `json:"homepageURL" mapstructure:"homepageURL"`
+	PrimaryColor string `json:"primaryColor" mapstructure:"primaryColor"`
 }
 
 type QuotaConfig struct {
-	BaseURL    string `json:"baseURL" mapstructure:"baseURL"`
+	BaseURL string `json:"baseURL" mapstructure:"baseURL"`
+	// Token is the service credential the quota manager is called with, never the token of a user
+	Token      string `json:"token" mapstructure:"token"`
 	HTTPClient *http.Client
 }
 
@@ -115,6 +463,88 @@ func InitConfig(cfgFile string) (*AppConfig, error) {
 	viper.SetDefault("database.maxIdleConns", 50)
 	viper.SetDefault("database.maxOpenConns", 300)
 
+	viper.SetDefault("phone.defaultRegion", "CN")
+
+	viper.SetDefault("email.fileDir", "mail")
+	viper.SetDefault("email.smtp.port", 587)
+	viper.SetDefault("email.smtp.security", "starttls")
+	viper.SetDefault("email.codeTTL", "15m")
+	viper.SetDefault("email.maxAttempts", 5)
+	viper.SetDefault("email.resendInterval", "60s")
+
+	viper.SetDefault("password.allowRegistration", true)
+	viper.SetDefault("password.minLength", 10)
+	viper.SetDefault("password.maxLength", 128)
+	viper.SetDefault("password.maxFailedAttempts", 5)
+	viper.SetDefault("password.lockoutDuration", "15m")
+	viper.SetDefault("password.argon2.memory", 64*1024)
+	viper.SetDefault("password.argon2.iterations", 3)
+	viper.SetDefault("password.argon2.parallelism", 2)
+
+	viper.SetDefault("mfa.issuer", "CoStrict")
+	viper.SetDefault("mfa.challengeTTL", "5m")
+	viper.SetDefault("mfa.maxAttempts", 5)
+	viper.SetDefault("mfa.recoveryCodeCount", 10)
+	viper.SetDefault("mfa.maxFailedCodes", 5)
+	viper.SetDefault("mfa.lockoutDuration", "1m")
+	viper.SetDefault("mfa.maxLockoutDuration", "1h")
+
+	viper.SetDefault("webauthn.rpName", "CoStrict")
+	viper.SetDefault("webauthn.timeout", "5m")
+	viper.SetDefault("webauthn.userVerification", "preferred")
+
+	viper.SetDefault("webhook.maxAttempts", 8)
+	viper.SetDefault("webhook.initialBackoff", "10s")
+	viper.SetDefault("webhook.maxBackoff", "1h")
+	viper.SetDefault("webhook.timeout", "10s")
+	viper.SetDefault("webhook.pollInterval", "5s")
+
+	viper.SetDefault("outbox.maxAttempts", 10)
+	viper.SetDefault("outbox.initialBackoff", "5s")
+	viper.SetDefault("outbox.maxBackoff", "10m")
+	viper.SetDefault("outbox.pollInterval", "2s")
+
+	viper.SetDefault("session.maxDevices", 0)
+	viper.SetDefault("session.policy", "evict_lru")
+
+	viper.SetDefault("device.proofMaxAge", "5m")
+	viper.SetDefault("device.geo.countryHeader", "CF-IPCountry")
+	viper.SetDefault("device.geo.asnHeader", "X-Client-ASN")
+	viper.SetDefault("device.geo.latitudeHeader", "CF-IPLatitude")
+	viper.SetDefault("device.geo.longitudeHeader", "CF-IPLongitude")
+	viper.SetDefault("device.geo.countryField", "countryCode")
+	viper.SetDefault("device.geo.asnField", "as")
+	viper.SetDefault("device.geo.latitudeField", "lat")
+	viper.SetDefault("device.geo.longitudeField", "lon")
+	viper.SetDefault("device.geo.cacheTTL", "1h")
+	viper.SetDefault("device.risk.newCountry", 40)
+	viper.SetDefault("device.risk.newASN", 20)
+	viper.SetDefault("device.risk.impossibleTravel", 60)
+	viper.SetDefault("device.risk.newUserAgent", 10)
+	viper.SetDefault("device.risk.maxTravelSpeed", 1000)
+	viper.SetDefault("device.risk.logScore", 20)
+	viper.SetDefault("device.risk.stepUpScore", 50)
+	viper.SetDefault("device.risk.revokeScore", 90)
+
+	viper.SetDefault("audit.retention", "2160h")
+	viper.SetDefault("audit.purgeInterval", "1h")
+	viper.SetDefault("audit.exportLimit", 10000)
+
+	viper.SetDefault("rateLimit.enabled", true)
+	viper.SetDefault("rateLimit.backend", "memory")
+
+	viper.SetDefault("sms.codeLength", 6)
+	viper.SetDefault("sms.codeTTL", "5m")
+	viper.SetDefault("sms.maxAttempts", 5)
+	viper.SetDefault("sms.resendInterval", "60s")
+	viper.SetDefault("sms.template", "Your verification code is {code}")
+	viper.SetDefault("sms.rateLimit.perPhone", 5)
+	viper.SetDefault("sms.rateLimit.perPhoneWindow", "1h")
+	viper.SetDefault("sms.rateLimit.perIP", 20)
+	viper.SetDefault("sms.rateLimit.perIPWindow", "1h")
+	viper.SetDefault("sms.rateLimit.globalWindow", "1m")
+	viper.SetDefault("sms.rateLimit.phoneDailyCap", 10)
+
 	viper.SetEnvPrefix(EnvPrefix)
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_")) // eg: DATABASE_HOST for database.host
@@ -143,3 +573,22 @@ func InitConfig(cfgFile string) (*AppConfig, error) {
 	log.Info(nil, "Configuration initialized and validated successfully.")
 	return cfg, nil
 }
+
+// WatchConfig reloads the config file when it changes and hands the new config to onChange.
+// onChange is responsible for validating the parts it applies; a config that fails to unmarshal is dropped.
+func WatchConfig(onChange func(cfg *AppConfig)) {
+	if viper.ConfigFileUsed() == "" {
+		log.Info(nil, "No config file in use, config hot reload is disabled.")
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		cfg := new(AppConfig)
+		if err := viper.Unmarshal(cfg); err != nil {
+			log.Error(nil, "Failed to unmarshal changed config %s: %v", e.Name, err)
+			return
+		}
+		log.Info(nil, "Configuration file changed: %s", e.Name)
+		onChange(cfg)
+	})
+	viper.WatchConfig()
+}
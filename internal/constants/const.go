@@ -1,6 +1,9 @@
 package constants
 
-import "crypto/aes"
+import (
+	"crypto/aes"
+	"time"
+)
 
 // DBIndexField database default constants
 const (
@@ -26,11 +29,31 @@ const (
 	LoginStatusLoggedIn      = "logged_in"      // out -> in
 	LoginStatusLoggedOut     = "logged_out"     // Initial state
 	LoginStatusLoggedOffline = "logged_offline" // in -> offline
+	LoginStatusPendingMFA    = "pending_mfa"    // waiting for the second factor, tokens are not handed out
+	LoginStatusEvicted       = "evicted"        // in -> evicted by the session limit, told by the status endpoint
+)
+
+// Session limit policies, applied when a login would exceed the devices a user may be logged in on
+const (
+	SessionPolicyEvictLRU = "evict_lru" // sign out the least recently used device
+	SessionPolicyReject   = "reject"    // refuse the new login
+)
+
+// Actions on a token refresh by its risk score, from the least to the most severe
+const (
+	RiskActionNone   = ""
+	RiskActionLog    = "log"     // audit the refresh
+	RiskActionStepUp = "step_up" // hold the device behind a second factor challenge
+	RiskActionRevoke = "revoke"  // sign the device out
 )
 
+// DeviceProofHeader the header carrying the proof of possession of a device-bound key
+const DeviceProofHeader = "DPoP"
+
 // Binding account related
 const (
 	LoginSuccessPath       = "/login/success"
+	MFAChallengePath       = "/login/mfa"
 	LoginCallbackURI       = "/oidc-auth/api/v1/plugin/login/callback"
 	WebLoginCallbackURI    = "/oidc-auth/api/v1/manager/login/callback"
 	BindAccountBindURI     = "/credit/manager/"
@@ -43,6 +66,9 @@ const (
 	CasdoorTokenURI        = "/api/login/oauth/access_token"
 	CasdoorRefreshTokenURI = "/api/login/oauth/refresh_token"
 	CasdoorMergeURI        = "/api/identity/merge"
+	CasdoorUnbindURI       = "/api/identity/unbind"
+	CasdoorJWKSURI         = "/.well-known/jwks"
+	CasdoorUserInfoURI     = "/api/userinfo"
 )
 
 // Invite code related constants
@@ -56,3 +82,135 @@ const (
 const (
 	QuotaMergeURI = "/quota-manager/api/v1/quota/merge"
 )
+
+// OAuth client registry related constants
+const (
+	DefaultPluginClientID  = "plugin" // implicit client for the IDE plugin route group
+	DefaultWebClientID     = "web"    // implicit client for the web manager route group
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantSMSCode           = "sms_code" // first-party login with an SMS one-time code
+	GrantEmail             = "email"    // first-party login with an email code or magic link
+	GrantPassword          = "password" // first-party login with a username and password
+	GrantWebAuthn          = "webauthn" // first-party login with a passkey
+	DefaultAccessTokenTTL  = 8 * time.Hour
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// SMS one-time code related constants
+const (
+	SMSPurposeLogin = "login"
+	ProviderSMS     = "sms" // provider of devices that logged in with an SMS code
+)
+
+// Email login related constants
+const (
+	EmailPurposeLogin = "login"
+	ProviderEmail     = "email" // provider of devices that logged in with an email code or link
+)
+
+// Password account related constants
+const (
+	PasswordPurposeReset = "password_reset" // also the name of the reset email templates
+	ProviderPassword     = "password"       // provider of devices that logged in with a password
+)
+
+// WebAuthn related constants, the purposes of ceremony sessions
+const (
+	WebAuthnPurposeRegister = "register"
+	WebAuthnPurposeLogin    = "login"
+	WebAuthnPurposeMFA      = "mfa"
+	ProviderWebAuthn        = "webauthn" // provider of devices that logged in with a passkey
+)
+
+// Identity related constants, the providers of login identities linked to users
+const (
+	IdentityGitHub      = "github"        // subject is the GitHub user ID
+	IdentityPhone       = "phone"         // subject is the E.164 phone number
+	IdentityEmail       = "email"         // subject is the lowercase email address
+	IdentityPurposeLink = "identity_link" // also the name of the link email templates
+)
+
+// Account merge saga steps, in the order they run, and statuses
+const (
+	MergeStepCasdoor    = "casdoor_merge"   // merge the upstream Casdoor users
+	MergeStepQuota      = "quota_merge"     // not a step: the idempotency key suffix of the quota merge event
+	MergeStepAccounts   = "merge_accounts"  // fold the other account into the main one locally
+	MergeStepIdentities = "link_identities" // link the identities of the merged profile
+	MergeStepDone       = "done"
+
+	MergeStatusPending   = "pending"
+	MergeStatusRunning   = "running"
+	MergeStatusFailed    = "failed" // a step failed and can be resumed
+	MergeStatusCompleted = "completed"
+	MergeStatusCancelled = "cancelled" // only before the upstream merge, when nothing has changed yet
+)
+
+// Identity unbind saga steps, in the order they run; an unbind takes the pending, running and
+// failed merge statuses and is deleted by its last step
+const (
+	UnbindStepUpstream = "upstream_unbind" // remove the identity from the upstream account
+	UnbindStepLocal    = "local_unbind"    // remove the identity or split it off into a new account
+)
+
+// DefaultPluginURISchemes custom URI schemes of the IDEs the plugin client may deep-link back to
+var DefaultPluginURISchemes = []string{"vscode", "vscode-insiders", "cursor", "vscodium"}
+
+// DefaultPluginRedirectPath the URI handler of the plugin extension, registered under every
+// default scheme as "<scheme>://" + DefaultPluginRedirectPath
+const DefaultPluginRedirectPath = "zgsm-ai.zgsm/callback"
+
+// DefaultPluginRedirectURIs redirect URIs deep-linking each default IDE scheme back to the plugin
+func DefaultPluginRedirectURIs() []string {
+	uris := make([]string, 0, len(DefaultPluginURISchemes))
+	for _, scheme := range DefaultPluginURISchemes {
+		uris = append(uris, scheme+"://"+DefaultPluginRedirectPath)
+	}
+	return uris
+}
+
+// Webhook events
+const (
+	EventUserCreated     = "user.created"
+	EventUserLogin       = "user.login"
+	EventDeviceLoggedOut = "device.logged_out"
+	EventAccountMerged   = "account.merged"
+	EventStarChanged     = "star.changed"
+	EventInviteRedeemed  = "invite.redeemed"
+
+	// EventQuotaMergeRequested asks the quota manager to move the quota of a merged account;
+	// published from the outbox only, it carries the bearer token of the main account
+	EventQuotaMergeRequested = "quota.merge_requested"
+)
+
+// Webhook delivery statuses
+const (
+	WebhookStatusPending   = "pending"
+	WebhookStatusDelivered = "delivered"
+	WebhookStatusFailed    = "failed"
+)
+
+// Outbox event statuses
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusPublished = "published"
+	OutboxStatusFailed    = "failed"
+)
+
+// Audit log actions
+const (
+	AuditLogin          = "login"
+	AuditTokenRefresh   = "token.refresh"
+	AuditForcedLogout   = "device.forced_logout"
+	AuditDeviceSignOut  = "device.sign_out"
+	AuditAccountMerge   = "account.merge"
+	AuditInviteRedeemed = "invite.redeemed"
+	AuditSMSSend        = "sms.send"
+	AuditDeviceRisk     = "device.risk"
+)
+
+// Audit log outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
@@ -0,0 +1,346 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/outbox"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+)
+
+const (
+	adminDefaultListLimit = 50
+	adminMaxListLimit     = 500
+)
+
+type mergeResumeRequest struct {
+	// SkipStep marks the failed upstream step done, after checking it went through
+	SkipStep bool `json:"skip_step"`
+}
+
+// mergeErrorStatus maps account merge errors to HTTP status codes
+func mergeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, service.ErrMergeNotFound):
+		return http.StatusNotFound, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrMergeBusy),
+		errors.Is(err, service.ErrMergeNotCancellable),
+		errors.Is(err, service.ErrMergeStepNotSkippable):
+		return http.StatusConflict, errs.ErrBadRequestParam
+	default:
+		return http.StatusInternalServerError, errs.ErrBindAccount
+	}
+}
+
+func handleMergeError(c *gin.Context, err error) {
+	status, code := mergeErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// adminListLimit reads the limit query parameter of list endpoints
+func adminListLimit(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", ""))
+	if err != nil || limit <= 0 {
+		return adminDefaultListLimit
+	}
+	return min(limit, adminMaxListLimit)
+}
+
+// adminMergeListHandler lists account merges, filtered by the status query parameter
+func adminMergeListHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	merges, err := service.ListAccountMerges(ctx, c.DefaultQuery("status", ""), adminListLimit(c))
+	if err != nil {
+		handleMergeError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", merges)
+}
+
+// adminMergeGetHandler shows the step, status and last error of an account merge
+func adminMergeGetHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	merge, err := service.GetAccountMerge(ctx, c.Param("id"))
+	if err != nil {
+		handleMergeError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", merge)
+}
+
+// adminMergeResumeHandler runs the remaining steps of a stopped account merge
+func (s *Server) adminMergeResumeHandler(c *gin.Context) {
+	var req mergeResumeRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+			return
+		}
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	merge, err := service.ResumeAccountMerge(ctx, c.Param("id"), req.SkipStep, s.HTTPClient)
+	if err != nil {
+		handleMergeError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", merge)
+}
+
+// adminMergeCancelHandler cancels an account merge that has not merged the upstream accounts yet
+func adminMergeCancelHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	merge, err := service.CancelAccountMerge(ctx, c.Param("id"))
+	if err != nil {
+		handleMergeError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", merge)
+}
+
+func handleWebhookError(c *gin.Context, err error) {
+	if errors.Is(err, webhook.ErrDeliveryNotFound) {
+		response.HandleError(c, http.StatusNotFound, errs.ErrBadRequestParam, err)
+		return
+	}
+	response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+}
+
+// adminWebhookListHandler lists webhook deliveries, filtered by the status, event and endpoint
+// query parameters
+func adminWebhookListHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	deliveries, err := webhook.ListDeliveries(ctx, repository.WebhookDeliveryFilter{
+		Status:    c.DefaultQuery("status", ""),
+		EventType: c.DefaultQuery("event", ""),
+		Endpoint:  c.DefaultQuery("endpoint", ""),
+	}, adminListLimit(c))
+	if err != nil {
+		handleWebhookError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", deliveries)
+}
+
+// adminWebhookGetHandler shows a webhook delivery with its payload and last error
+func adminWebhookGetHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	delivery, err := webhook.GetDelivery(ctx, c.Param("id"))
+	if err != nil {
+		handleWebhookError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", delivery)
+}
+
+// adminWebhookReplayHandler sends a webhook delivery again with fresh attempts
+func adminWebhookReplayHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	delivery, err := webhook.Replay(ctx, c.Param("id"))
+	if err != nil {
+		handleWebhookError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", delivery)
+}
+
+// adminOutboxListHandler lists outbox events, filtered by the status and topic query parameters
+func adminOutboxListHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	events, err := outbox.ListEvents(ctx, c.DefaultQuery("status", ""), c.DefaultQuery("topic", ""), adminListLimit(c))
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	response.JSONSuccess(c, "", events)
+}
+
+// adminOutboxRetryHandler publishes a failed outbox event again to the sinks it did not reach
+func adminOutboxRetryHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	event, err := outbox.Retry(ctx, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, outbox.ErrEventNotFound) {
+			response.HandleError(c, http.StatusNotFound, errs.ErrBadRequestParam, err)
+			return
+		}
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	response.JSONSuccess(c, "", event)
+}
+
+// localOutboxSinks the local sinks of the outbox, which keep published events for tests
+func localOutboxSinks() []*outbox.LocalSink {
+	var local []*outbox.LocalSink
+	for _, sink := range outbox.Sinks() {
+		if l, ok := sink.(*outbox.LocalSink); ok {
+			local = append(local, l)
+		}
+	}
+	return local
+}
+
+// localOutboxEventsHandler lists the events the local outbox sinks received, for integration tests
+func localOutboxEventsHandler(c *gin.Context) {
+	events := []outbox.Event{}
+	for _, sink := range localOutboxSinks() {
+		events = append(events, sink.Events(c.DefaultQuery("topic", ""))...)
+	}
+	response.JSONSuccess(c, "", gin.H{"events": events})
+}
+
+// auditLogFilter reads the filters of the audit log endpoints: action, outcome, actor_id,
+// subject_id, device_id, ip, and since and until as RFC 3339 times
+func auditLogFilter(c *gin.Context) (repository.AuditLogFilter, error) {
+	filter := repository.AuditLogFilter{
+		Action:  c.DefaultQuery("action", ""),
+		Outcome: c.DefaultQuery("outcome", ""),
+		IP:      c.DefaultQuery("ip", ""),
+	}
+	for param, id := range map[string]*uuid.UUID{
+		"actor_id":   &filter.ActorID,
+		"subject_id": &filter.SubjectID,
+		"device_id":  &filter.DeviceID,
+	} {
+		if value := c.DefaultQuery(param, ""); value != "" {
+			parsed, err := uuid.Parse(value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %w", param, err)
+			}
+			*id = parsed
+		}
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.DefaultQuery(param, ""); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s, expected an RFC 3339 time: %w", param, err)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// adminAuditListHandler lists the most recent audit log entries matching the filters
+func adminAuditListHandler(c *gin.Context) {
+	filter, err := auditLogFilter(c)
+	if err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	entries, err := audit.List(ctx, filter, adminListLimit(c))
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	response.JSONSuccess(c, "", entries)
+}
+
+// adminAuditExportHandler downloads the audit log entries matching the filters as CSV or JSON,
+// chosen by the format query parameter, up to the configured export limit
+func adminAuditExportHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, "format must be csv or json")
+		return
+	}
+	filter, err := auditLogFilter(c)
+	if err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	limit := audit.ExportLimit()
+	if requested, err := strconv.Atoi(c.DefaultQuery("limit", "")); err == nil && requested > 0 {
+		limit = min(requested, limit)
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	entries, err := audit.List(ctx, filter, limit)
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	filename := fmt.Sprintf("audit-log-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "json" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"id", "created_at", "action", "outcome", "actor_id", "subject_id", "device_id",
+		"ip", "user_agent", "reason", "details"})
+	for _, entry := range entries {
+		details, _ := json.Marshal(entry.Details)
+		_ = w.Write(csvSafe(
+			entry.ID.String(),
+			entry.CreatedAt.UTC().Format(time.RFC3339),
+			entry.Action,
+			entry.Outcome,
+			optionalUUID(entry.ActorID),
+			optionalUUID(entry.SubjectID),
+			optionalUUID(entry.DeviceID),
+			entry.IP,
+			entry.UserAgent,
+			entry.Reason,
+			string(details),
+		))
+	}
+	w.Flush()
+}
+
+// csvSafe escapes the fields a spreadsheet would run as a formula, such as a user agent or
+// reason starting with "=", by prefixing them with a quote
+func csvSafe(fields ...string) []string {
+	for i, field := range fields {
+		if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+			fields[i] = "'" + field
+		}
+	}
+	return fields
+}
+
+func optionalUUID(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
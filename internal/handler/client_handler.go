@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+)
+
+// defaultClientID maps a route group platform to its implicit client
+func defaultClientID(platform string) string {
+	if platform == "web" {
+		return constants.DefaultWebClientID
+	}
+	return constants.DefaultPluginClientID
+}
+
+// resolveClient loads the requested client and checks that it may use the route group and grant
+func resolveClient(c *gin.Context, clientID, platform, grant string) (*repository.OAuthClient, error) {
+	if clientID == "" {
+		clientID = defaultClientID(platform)
+	}
+	client, err := service.GetClient(c.Request.Context(), clientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client %s: %w", clientID, err)
+	}
+	if platform != "" && client.Platform != platform {
+		return nil, fmt.Errorf("client %s is not registered for the %s platform", clientID, platform)
+	}
+	if grant != "" && !client.AllowsGrant(grant) {
+		return nil, fmt.Errorf("client %s is not allowed to use the %s grant", clientID, grant)
+	}
+	return client, nil
+}
+
+// deviceClient returns the client a device logged in through
+func deviceClient(ctx context.Context, device *repository.Device) (*repository.OAuthClient, error) {
+	clientID := device.ClientID
+	if clientID == "" {
+		clientID = defaultClientID(device.Platform)
+	}
+	return service.GetClient(ctx, clientID)
+}
+
+// validateClientRedirect checks the requested deep link scheme and redirect URI against the client allowlists
+func validateClientRedirect(client *repository.OAuthClient, uriScheme, redirectURI string) error {
+	if uriScheme != "" && !client.AllowsURIScheme(uriScheme) {
+		return fmt.Errorf("uri_scheme %s is not allowed for client %s", uriScheme, client.ClientID)
+	}
+	if redirectURI != "" && !client.AllowsRedirectURI(redirectURI) {
+		return fmt.Errorf("redirect_uri is not registered for client %s", client.ClientID)
+	}
+	return nil
+}
+
+// clientRedirectURL picks the final redirect of a login: the explicit redirect_uri, then the redirect URI
+// registered for the uri_scheme so the IDE is deep-linked back, then the fallback page.
+// The allowlists are checked again because the client may have changed since the login started.
+func clientRedirectURL(ctx context.Context, clientID, uriScheme, redirectURI, fallback string, params url.Values) (string, error) {
+	target := fallback
+	if clientID != "" && (uriScheme != "" || redirectURI != "") {
+		client, err := service.GetClient(ctx, clientID)
+		if err != nil {
+			return "", err
+		}
+		if err := validateClientRedirect(client, uriScheme, redirectURI); err != nil {
+			return "", err
+		}
+		if redirectURI != "" {
+			target = redirectURI
+		} else if uri := client.RedirectURIForScheme(uriScheme); uri != "" {
+			target = uri
+		}
+	}
+
+	return withQuery(target, params)
+}
+
+// withQuery sets query parameters on a URL, keeping the ones it has
+func withQuery(target string, params url.Values) (string, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect target: %w", err)
+	}
+	query := parsed.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// getClientSecret reads the client secret from HTTP basic auth or the client_secret form field.
+// Secrets in the query string end up in access logs, so they are not accepted there.
+func getClientSecret(c *gin.Context) string {
+	if _, secret, ok := c.Request.BasicAuth(); ok {
+		return secret
+	}
+	return c.PostForm("client_secret")
+}
+
+// clientInfoHandler returns the public branding of a client for login pages
+func clientInfoHandler(c *gin.Context) {
+	client, err := service.GetClient(c.Request.Context(), c.Param("client_id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrClientNotFound) || errors.Is(err, service.ErrClientDisabled) {
+			status = http.StatusNotFound
+		}
+		response.HandleError(c, status, errs.ErrInvalidClient, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"client_id":     client.ClientID,
+		"name":          client.Name,
+		"platform":      client.Platform,
+		"display_name":  client.DisplayName,
+		"logo_url":      client.LogoURL,
+		"homepage_url":  client.HomepageURL,
+		"primary_color": client.PrimaryColor,
+	})
+}
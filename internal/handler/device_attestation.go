@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// maxObservedUserAgent bounds the user agent kept on a device
+const maxObservedUserAgent = 512
+
+// deviceEvidence what a token request shows of the device making it
+type deviceEvidence struct {
+	keyThumbprint string // of the key the request proved, empty without a proof
+	ip            string
+	userAgent     string
+	header        http.Header
+}
+
+// stepUpError a refresh held back until the device passes the second factor challenge
+type stepUpError struct {
+	challenge *repository.MFAChallenge
+}
+
+func (e *stepUpError) Error() string {
+	return service.ErrStepUpRequired.Error()
+}
+
+func (e *stepUpError) Unwrap() error {
+	return service.ErrStepUpRequired
+}
+
+// requestDeviceEvidence verifies the key proof of a token request, when it carries one
+func requestDeviceEvidence(c *gin.Context) (deviceEvidence, error) {
+	evidence := deviceEvidence{
+		ip:        c.ClientIP(),
+		userAgent: c.Request.UserAgent(),
+		header:    c.Request.Header,
+	}
+	if len(evidence.userAgent) > maxObservedUserAgent {
+		evidence.userAgent = evidence.userAgent[:maxObservedUserAgent]
+	}
+	if proof := c.GetHeader(constants.DeviceProofHeader); proof != "" {
+		thumbprint, err := service.VerifyDeviceProof(c.Request.Context(), proof, c.Request.Method, c.Request.URL.Path)
+		if err != nil {
+			return evidence, err
+		}
+		evidence.keyThumbprint = thumbprint
+	}
+	return evidence, nil
+}
+
+// getAccessTokenFromHeader returns the access token of a request. A token bound to a device key
+// is only accepted with a proof of that key made for this request and this token.
+func getAccessTokenFromHeader(c *gin.Context) (string, error) {
+	token, err := getTokenFromHeader(c)
+	if err != nil {
+		return "", err
+	}
+	thumbprint := utils.TokenKeyThumbprint(token)
+	if thumbprint == "" {
+		return token, nil
+	}
+	if proof := c.GetHeader(constants.DeviceProofHeader); proof == "" {
+		err = service.ErrDeviceKeyRequired
+	} else {
+		err = service.VerifyTokenProof(c.Request.Context(), proof, c.Request.Method, service.ProofURL(c.Request.URL.Path), token, thumbprint)
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+		return "", err
+	}
+	return token, nil
+}
+
+// checkTokenBinding checks a token bound to a device key was presented with a proof of that key
+func checkTokenBinding(token, thumbprint string) error {
+	bound := utils.TokenKeyThumbprint(token)
+	switch {
+	case bound == "":
+		return nil
+	case thumbprint == "":
+		return service.ErrDeviceKeyRequired
+	case subtle.ConstantTimeCompare([]byte(bound), []byte(thumbprint)) != 1:
+		return service.ErrDeviceKeyMismatch
+	}
+	return nil
+}
+
+// observation locates the request, only once a device is found for it
+func (e deviceEvidence) observation(ctx context.Context) service.Observation {
+	return service.Observation{
+		IP:        e.ip,
+		UserAgent: e.userAgent,
+		Location:  service.LocateIP(ctx, e.ip, e.header),
+		At:        time.Now(),
+	}
+}
+
+// loginDeviceKey verifies the device_proof a plugin starts its login with and returns the
+// thumbprint of the proven key, empty when the login carries none
+func loginDeviceKey(c *gin.Context) (string, error) {
+	proof := c.Query("device_proof")
+	if proof == "" {
+		if service.DeviceKeyRequired() {
+			return "", errs.ParamNeedErr("device_proof")
+		}
+		return "", nil
+	}
+	return service.VerifyDeviceProof(c.Request.Context(), proof, http.MethodGet, c.Request.URL.Path)
+}
+
+// attestDevice checks the key of a device getting its first tokens and records where it is seen
+// from; the device is saved with its tokens
+func attestDevice(ctx context.Context, device *repository.Device, evidence deviceEvidence) error {
+	if err := service.BindDeviceKey(device, evidence.keyThumbprint); err != nil {
+		return err
+	}
+	service.ObserveDevice(device, evidence.observation(ctx))
+	return nil
+}
+
+// assessRefresh checks the key of a refreshing device and scores where it is seen from. A device
+// without a key stays without one, or is signed out to log in again when keys are required. A
+// risky refresh is audited, held behind a second factor challenge, or signs the device out; the
+// returned error then tells the device what to do.
+func assessRefresh(ctx context.Context, user *repository.AuthUser, index int, evidence deviceEvidence) error {
+	device := &user.Devices[index]
+	if err := service.CheckDeviceKey(device, evidence.keyThumbprint); err != nil {
+		if errors.Is(err, service.ErrDeviceKeyLogin) {
+			// the refresh token is given up, the login that follows registers a key
+			signedOut := func(d *repository.Device) bool { return d.ID == device.ID }
+			if _, signOutErr := signOutDevicesWhere(ctx, user, signedOut); signOutErr != nil {
+				return signOutErr
+			}
+			audit.ForcedLogout(ctx, user, device, "refresh without a device key while keys are required")
+		}
+		return err
+	}
+	seen := evidence.observation(ctx)
+	assessment := service.AssessDeviceRisk(device, seen)
+	service.ObserveDevice(device, seen)
+	if assessment.Action == constants.RiskActionNone {
+		return nil
+	}
+	audit.DeviceRisk(ctx, user, device, assessment.Score, assessment.Reasons, assessment.Action)
+	switch assessment.Action {
+	case constants.RiskActionStepUp:
+		challenge, err := requireMFA(ctx, user, index, repository.MFAChallenge{IssueTokens: true})
+		if err != nil {
+			return err
+		}
+		if challenge != nil {
+			return &stepUpError{challenge: challenge}
+		}
+		// a user without a second factor steps up by logging in again, the refresh token is given up
+		if _, err := signOutDevicesWhere(ctx, user, func(d *repository.Device) bool { return d.ID == device.ID }); err != nil {
+			return err
+		}
+		audit.ForcedLogout(ctx, user, device, fmt.Sprintf("risk score %d without a second factor to step up: %s",
+			assessment.Score, strings.Join(assessment.Reasons, "; ")))
+		return service.ErrStepUpLogin
+	case constants.RiskActionRevoke:
+		if _, err := signOutDevicesWhere(ctx, user, func(d *repository.Device) bool { return d.ID == device.ID }); err != nil {
+			return err
+		}
+		audit.ForcedLogout(ctx, user, device, fmt.Sprintf("risk score %d: %s",
+			assessment.Score, strings.Join(assessment.Reasons, "; ")))
+		return service.ErrDeviceRevoked
+	}
+	return nil
+}
+
+// deviceRejected reports whether a token request failed for what it showed of the device,
+// rather than on the side of the server
+func deviceRejected(err error) bool {
+	return errors.Is(err, service.ErrDeviceKeyRequired) || errors.Is(err, service.ErrDeviceKeyMismatch) ||
+		errors.Is(err, service.ErrDeviceKeyLogin) || errors.Is(err, service.ErrStepUpRequired) ||
+		errors.Is(err, service.ErrStepUpLogin) || errors.Is(err, service.ErrDeviceRevoked)
+}
+
+// writeDeviceRejection writes the error of a token request refused for its device, with the
+// challenge to pass when the refresh has to step up
+func writeDeviceRejection(c *gin.Context, err error) {
+	var stepUp *stepUpError
+	switch {
+	case errors.As(err, &stepUp):
+		response.JSONErrorWithData(c, http.StatusUnauthorized, errs.ErrStepUpRequired, err.Error(), gin.H{
+			"mfa_required": true,
+			"challenge":    stepUp.challenge.ID.String(),
+			"expires_at":   stepUp.challenge.ExpiresAt.Unix(),
+		})
+	case errors.Is(err, service.ErrStepUpLogin), errors.Is(err, service.ErrDeviceKeyLogin):
+		response.JSONError(c, http.StatusUnauthorized, errs.ErrReauthRequired, err.Error())
+	case errors.Is(err, service.ErrDeviceRevoked):
+		response.JSONError(c, http.StatusUnauthorized, errs.ErrDeviceRevoked, err.Error())
+	default:
+		response.JSONError(c, http.StatusUnauthorized, errs.ErrDeviceProof, err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+)
+
+// otherDevices the device ID that signs out every device but the current one
+const otherDevices = "others"
+
+// deviceView a device of the user as the session list shows it, without its tokens
+type deviceView struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastAccessAt  time.Time `json:"last_access_at"`
+	MachineCode   string    `json:"machine_code"`
+	VSCodeVersion string    `json:"vscode_version"`
+	PluginVersion string    `json:"plugin_version"`
+	Platform      string    `json:"platform"`
+	Provider      string    `json:"provider"`
+	ClientID      string    `json:"client_id"`
+	Status        string    `json:"status"`
+	Current       bool      `json:"current"` // the device of the access token of the request
+	KeyBound      bool      `json:"key_bound"`
+	IP            string    `json:"ip,omitempty"`
+	Country       string    `json:"country,omitempty"`
+}
+
+// deviceViews lists the devices of the user, the most recently used first
+func deviceViews(user *repository.AuthUser, current int) []deviceView {
+	views := make([]deviceView, 0, len(user.Devices))
+	for i, device := range user.Devices {
+		lastAccess := device.UpdatedAt // of devices saved before the last access was tracked
+		if device.LastAccessAt != nil {
+			lastAccess = *device.LastAccessAt
+		}
+		views = append(views, deviceView{
+			ID:            device.ID,
+			CreatedAt:     device.CreatedAt,
+			LastAccessAt:  lastAccess,
+			MachineCode:   device.MachineCode,
+			VSCodeVersion: device.VSCodeVersion,
+			PluginVersion: device.PluginVersion,
+			Platform:      device.Platform,
+			Provider:      device.Provider,
+			ClientID:      device.ClientID,
+			Status:        device.Status,
+			Current:       i == current,
+			KeyBound:      device.Attestation.KeyThumbprint != "",
+			IP:            device.Attestation.IP,
+			Country:       device.Attestation.Country,
+		})
+	}
+	slices.SortStableFunc(views, func(a, b deviceView) int {
+		return b.LastAccessAt.Compare(a.LastAccessAt)
+	})
+	return views
+}
+
+// deviceListHandler lists the devices the signed in user has logged in from, filtered by the
+// status query parameter
+func deviceListHandler(c *gin.Context) {
+	ctx, cancel := getRequestContextWithTimeout(c, shortTimeout)
+	defer cancel()
+
+	user, index, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	views := deviceViews(user, index)
+	if status := c.DefaultQuery("status", ""); status != "" {
+		views = slices.DeleteFunc(views, func(view deviceView) bool { return view.Status != status })
+	}
+	response.JSONSuccess(c, "", views)
+}
+
+// deviceSignOutHandler signs out a device of the signed in user and revokes its tokens.
+// The ID "others" signs out every device but the one making the request.
+func deviceSignOutHandler(c *gin.Context) {
+	ctx, cancel := getRequestContextWithTimeout(c, shortTimeout)
+	defer cancel()
+
+	user, current, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	currentID := user.Devices[current].ID
+	selected := func(device *repository.Device) bool { return device.ID != currentID }
+	if id := c.Param("id"); id != otherDevices {
+		deviceID, err := uuid.Parse(id)
+		if err != nil || !slices.ContainsFunc(user.Devices, func(device repository.Device) bool { return device.ID == deviceID }) {
+			response.JSONError(c, http.StatusNotFound, errs.ErrBadRequestParam, "device not found")
+			return
+		}
+		selected = func(device *repository.Device) bool { return device.ID == deviceID }
+	}
+	signedIn, err := signOutDevicesWhere(ctx, user, selected)
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	for _, i := range signedIn {
+		audit.DeviceSignedOut(ctx, user, &user.Devices[i], &user.Devices[current])
+	}
+	response.JSONSuccess(c, "", deviceViews(user, current))
+}
@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+type emailSendRequest struct {
+	Email         string `json:"email" binding:"required"`
+	ClientID      string `json:"client_id"`
+	MachineCode   string `json:"machine_code"`
+	VscodeVersion string `json:"vscode_version"`
+	PluginVersion string `json:"plugin_version"`
+	UriScheme     string `json:"uri_scheme"`
+	RedirectURI   string `json:"redirect_uri"`
+	State         string `json:"state"`
+	InviterCode   string `json:"inviter_code"`
+}
+
+type emailVerifyRequest struct {
+	Email         string `json:"email" binding:"required"`
+	Code          string `json:"code" binding:"required"`
+	ClientID      string `json:"client_id"`
+	MachineCode   string `json:"machine_code"`
+	VscodeVersion string `json:"vscode_version"`
+	PluginVersion string `json:"plugin_version"`
+	UriScheme     string `json:"uri_scheme"`
+	InviterCode   string `json:"inviter_code"`
+}
+
+// emailErrorStatus maps email login errors to HTTP status codes
+func emailErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, service.ErrInvalidEmail):
+		return http.StatusBadRequest, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrEmailLoginDisabled):
+		return http.StatusNotFound, errs.ErrEmailSend
+	case errors.Is(err, service.ErrEmailResendTooSoon):
+		return http.StatusTooManyRequests, errs.ErrTooManyRequests
+	case errors.Is(err, service.ErrEmailCodeInvalid),
+		errors.Is(err, service.ErrEmailCodeTooManyTries),
+		errors.Is(err, service.ErrEmailLinkInvalid):
+		return http.StatusUnauthorized, errs.ErrEmailCode
+	default:
+		return http.StatusInternalServerError, errs.ErrEmailSend
+	}
+}
+
+func handleEmailError(c *gin.Context, err error) {
+	status, code := emailErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// emailLoginClient resolves and authenticates the client of an email login and checks its redirect
+func emailLoginClient(c *gin.Context, clientID, platform, uriScheme, redirectURI string) (*repository.OAuthClient, bool) {
+	client, err := resolveClient(c, clientID, platform, constants.GrantEmail)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return nil, false
+	}
+	if err := service.AuthenticateClient(client, getClientSecret(c)); err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrInvalidClient, err)
+		return nil, false
+	}
+	if err := validateClientRedirect(client, uriScheme, redirectURI); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return nil, false
+	}
+	return client, true
+}
+
+// emailSendHandler emails a one-time login code and a magic link
+func (s *Server) emailSendHandler(c *gin.Context) {
+	var req emailSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	platform := c.DefaultQuery("platform", "")
+	if platform == "plugin" && (req.MachineCode == "" || req.VscodeVersion == "" || req.State == "") {
+		// the plugin polls for the tokens of a magic link login with the state
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			errs.ParamNeedErr("machine_code, vscode_version and state").Error())
+		return
+	}
+	client, ok := emailLoginClient(c, req.ClientID, platform, req.UriScheme, req.RedirectURI)
+	if !ok {
+		return
+	}
+
+	group := "plugin"
+	if platform == "web" {
+		group = "manager"
+	}
+	linkURL := s.BaseURL + "/oidc-auth/api/v1/" + group + "/login/email/callback"
+
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	issue, err := service.IssueEmailVerification(ctx, req.Email, constants.EmailPurposeLogin, linkURL,
+		repository.EmailLoginContext{
+			ClientID:      client.ClientID,
+			Platform:      platform,
+			MachineCode:   req.MachineCode,
+			VscodeVersion: req.VscodeVersion,
+			PluginVersion: req.PluginVersion,
+			UriScheme:     req.UriScheme,
+			RedirectURI:   req.RedirectURI,
+			State:         req.State,
+			InviterCode:   req.InviterCode,
+		})
+	if err != nil {
+		handleEmailError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"email":      issue.Email,
+		"expires_at": issue.ExpiresAt.Unix(),
+	})
+}
+
+// emailVerifyHandler logs in with the code of a login email, creating the account on first login
+func emailVerifyHandler(c *gin.Context) {
+	var req emailVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	platform := c.DefaultQuery("platform", "")
+	if platform == "plugin" && (req.MachineCode == "" || req.VscodeVersion == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			errs.ParamNeedErr("machine_code and vscode_version").Error())
+		return
+	}
+	client, ok := emailLoginClient(c, req.ClientID, platform, req.UriScheme, "")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	verification, err := service.VerifyEmailCode(ctx, req.Email, constants.EmailPurposeLogin, req.Code)
+	if err != nil {
+		audit.LoginFailed(ctx, nil, constants.ProviderEmail, err)
+		handleEmailError(c, err)
+		return
+	}
+	user, err := findOrNewEmailUser(ctx, verification.Email, req.InviterCode)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrUserNotFound, err)
+		return
+	}
+	tokenPair, challenge, err := issueSession(ctx, user, loginDevice{
+		ClientID:      client.ClientID,
+		Platform:      platform,
+		Provider:      constants.ProviderEmail,
+		MachineCode:   req.MachineCode,
+		VscodeVersion: req.VscodeVersion,
+		PluginVersion: req.PluginVersion,
+		UriScheme:     req.UriScheme,
+	})
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	writeSession(c, tokenPair, challenge)
+}
+
+// emailCallbackHandler completes a login from its magic link. The plugin collects its tokens by
+// polling with the state, the web manager is redirected to the bind page like after an OAuth login.
+func (s *Server) emailCallbackHandler(c *gin.Context) {
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	verification, err := service.VerifyEmailLink(ctx, constants.EmailPurposeLogin, c.DefaultQuery("token", ""))
+	if err != nil {
+		handleEmailError(c, err)
+		return
+	}
+	login := verification.Login
+	if platform := c.DefaultQuery("platform", ""); login.Platform != platform {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			fmt.Sprintf("the link was issued for the %s platform", login.Platform))
+		return
+	}
+	user, err := findOrNewEmailUser(ctx, verification.Email, login.InviterCode)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrUserNotFound, err)
+		return
+	}
+	device := loginDevice{
+		ClientID:      login.ClientID,
+		Platform:      login.Platform,
+		Provider:      constants.ProviderEmail,
+		MachineCode:   login.MachineCode,
+		VscodeVersion: login.VscodeVersion,
+		PluginVersion: login.PluginVersion,
+		UriScheme:     login.UriScheme,
+	}
+
+	if login.Platform == "plugin" {
+		if err := startPendingSession(ctx, user, device, login.State); err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+			return
+		}
+		redirectURL, err := clientRedirectURL(ctx, login.ClientID, login.UriScheme, login.RedirectURI,
+			s.BaseURL+constants.LoginSuccessPath, url.Values{"state": {login.State}, "status": {"success"}})
+		if err != nil {
+			response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+			return
+		}
+		index := findDeviceIndex(user, device.MachineCode, device.VscodeVersion)
+		challenge, err := requireMFA(ctx, user, index, repository.MFAChallenge{
+			ResumeStatus: constants.LoginStatusLoggedOut,
+			RedirectURL:  redirectURL,
+		})
+		if err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+			return
+		}
+		if challenge != nil {
+			redirectURL = service.MFAChallengeURL(s.BaseURL+constants.MFAChallengePath, challenge.ID.String(), login.Platform)
+		}
+		c.Redirect(http.StatusFound, redirectURL)
+		return
+	}
+
+	// the state of the bind page is only known once the tokens are issued, after the second factor
+	redirectURL, err := clientRedirectURL(ctx, login.ClientID, login.UriScheme, login.RedirectURI,
+		s.BaseURL+constants.BindAccountBindURI, nil)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return
+	}
+	tokenPair, challenge, err := issueSessionWithChallenge(ctx, user, device, repository.MFAChallenge{
+		RedirectURL:    redirectURL,
+		StateFromToken: true,
+	})
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	if challenge != nil {
+		redirectURL = service.MFAChallengeURL(s.BaseURL+constants.MFAChallengePath, challenge.ID.String(), login.Platform)
+	} else if redirectURL, err = withQuery(redirectURL, url.Values{"state": {utils.HashToken(tokenPair.AccessToken)}}); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// findOrNewEmailUser returns the account owning a verified email, or a new unsaved one.
+// An inviter code is only accepted for new accounts.
+func findOrNewEmailUser(ctx context.Context, email, inviterCode string) (*repository.AuthUser, error) {
+	user, err := repository.GetDB().GetUserByVerifiedEmail(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, err)
+	}
+	if user != nil {
+		if inviterCode != "" {
+			return nil, fmt.Errorf("you have registered")
+		}
+		return user, nil
+	}
+
+	user = &repository.AuthUser{
+		Name:          email,
+		Email:         email,
+		EmailVerified: true,
+	}
+	if inviterCode != "" {
+		inviter, err := utils.ValidateInviteCode(ctx, inviterCode)
+		if err != nil {
+			return nil, err
+		}
+		user.InviterID = &inviter.ID
+	}
+	return user, nil
+}
+
+// mockEmailMessagesHandler lists the emails recorded by the mock mail sender, for integration tests
+func mockEmailMessagesHandler(c *gin.Context) {
+	sender, ok := service.GetMailSender().(*service.MockMailSender)
+	if !ok {
+		response.JSONError(c, http.StatusNotFound, "", "mock mail sender is not enabled")
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{"messages": sender.Messages(c.DefaultQuery("email", ""))})
+}
+
+// mockEmailResetHandler clears the emails recorded by the mock mail sender
+func mockEmailResetHandler(c *gin.Context) {
+	sender, ok := service.GetMailSender().(*service.MockMailSender)
+	if !ok {
+		response.JSONError(c, http.StatusNotFound, "", "mock mail sender is not enabled")
+		return
+	}
+	sender.Reset()
+	response.JSONSuccess(c, "", nil)
+}
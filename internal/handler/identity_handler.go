@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+)
+
+type identitySendRequest struct {
+	Phone string `json:"phone"`
+	Email string `json:"email"`
+}
+
+type identityLinkRequest struct {
+	Phone string `json:"phone"`
+	Email string `json:"email"`
+	Code  string `json:"code" binding:"required"`
+}
+
+type identityUnbindRequest struct {
+	Split      bool     `json:"split"`
+	DeviceIDs  []string `json:"device_ids"`
+	InviteeIDs []string `json:"invitee_ids"`
+}
+
+// identityErrorStatus maps identity errors to HTTP status codes
+func identityErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, service.ErrIdentityNotFound):
+		return http.StatusNotFound, errs.ErrBadRequestParam
+	case errors.Is(err, repository.ErrIdentityLinked):
+		return http.StatusConflict, errs.ErrIdentityLinked
+	case errors.Is(err, service.ErrLastLoginMethod):
+		return http.StatusConflict, errs.ErrLastLoginMethod
+	case errors.Is(err, service.ErrInvalidSplit):
+		return http.StatusBadRequest, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrUpstreamSession):
+		return http.StatusConflict, errs.ErrUpstreamUnbind
+	case errors.Is(err, service.ErrUpstreamUnbind):
+		return http.StatusBadGateway, errs.ErrUpstreamUnbind
+	case errors.Is(err, service.ErrUnbindBusy):
+		return http.StatusConflict, errs.ErrBadRequestParam
+	default:
+		return http.StatusInternalServerError, errs.ErrUpdateInfo
+	}
+}
+
+func handleIdentityError(c *gin.Context, err error) {
+	status, code := identityErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// identityListHandler lists the GitHub accounts, phone numbers and emails linked to the signed in user
+func identityListHandler(c *gin.Context) {
+	ctx, cancel := getRequestContextWithTimeout(c, shortTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	identities, err := service.ListIdentities(ctx, user.ID)
+	if err != nil {
+		handleIdentityError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", identities)
+}
+
+// identitySendCodeHandler sends a code by SMS or email proving the ownership of the phone
+// number or email the signed in user wants to link
+func identitySendCodeHandler(c *gin.Context) {
+	var req identitySendRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Phone == "") == (req.Email == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"exactly one of phone and email needs to be provided")
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	if _, _, ok := bearerUser(c, ctx); !ok {
+		return
+	}
+	if req.Phone != "" {
+		phoneNumber, err := phone.Normalize(req.Phone)
+		if err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		if err := service.GuardSMS(ctx, phoneNumber, c.ClientIP()); err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		issue, err := service.IssueSMSCode(ctx, phoneNumber, constants.IdentityPurposeLink)
+		if err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		response.JSONSuccess(c, "", gin.H{
+			"phone":      issue.Phone,
+			"expires_at": issue.ExpiresAt.Unix(),
+		})
+		return
+	}
+
+	issue, err := service.IssueEmailVerification(ctx, req.Email, constants.IdentityPurposeLink, "",
+		repository.EmailLoginContext{})
+	if err != nil {
+		handleEmailError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"email":      issue.Email,
+		"expires_at": issue.ExpiresAt.Unix(),
+	})
+}
+
+// identityLinkHandler links a phone number or email to the signed in user with the code sent to it.
+// GitHub accounts are linked through bind/account.
+func identityLinkHandler(c *gin.Context) {
+	var req identityLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Phone == "") == (req.Email == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"exactly one of phone and email, and a code need to be provided")
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	var identity *repository.UserIdentity
+	var err error
+	if req.Phone != "" {
+		identity, err = service.LinkPhoneIdentity(ctx, user.ID, req.Phone, req.Code)
+	} else {
+		identity, err = service.LinkEmailIdentity(ctx, user.ID, req.Email, req.Code)
+	}
+	switch {
+	case err == nil:
+		response.JSONSuccess(c, "", identity)
+	case errors.Is(err, repository.ErrIdentityLinked):
+		handleIdentityError(c, err)
+	case req.Phone != "":
+		handleSMSError(c, err)
+	default:
+		handleEmailError(c, err)
+	}
+}
+
+// identityUnbindHandler removes an identity of the signed in user, keeping at least one way to sign
+// in, and from the upstream account. The optional body splits the identity off into a new account
+// together with devices and invitees, instead of removing it.
+func (s *Server) identityUnbindHandler(c *gin.Context) {
+	var req identityUnbindRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+			return
+		}
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	user, index, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	splitUser, err := service.UnbindIdentity(ctx, user, index, c.Param("id"), service.UnbindOptions{
+		Split:      req.Split,
+		DeviceIDs:  req.DeviceIDs,
+		InviteeIDs: req.InviteeIDs,
+	}, s.HTTPClient)
+	if err != nil {
+		handleIdentityError(c, err)
+		return
+	}
+	if splitUser == nil {
+		response.JSONSuccess(c, "", nil)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"split_user_id": splitUser.ID,
+		"devices":       len(splitUser.Devices),
+	})
+}
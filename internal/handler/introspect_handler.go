@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// tokenPresentation the request a resource server got a token with, for checking the proof of a bound token
+type tokenPresentation struct {
+	proof  string
+	method string
+	url    string
+}
+
+// introspectionHandler tells a resource server whether a token is active and what it stands for
+// (RFC 7662). Only confidential clients may ask. A token bound to a device key is only active with
+// the proof the resource server got along with it, forwarded as dpop_proof with the htm and htu
+// of the request it came with.
+func introspectionHandler(c *gin.Context) {
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID, clientSecret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, err := service.GetClient(c.Request.Context(), clientID)
+	if err == nil && !client.IsConfidential() {
+		err = service.ErrClientUnauthorized
+	}
+	if err == nil {
+		err = service.AuthenticateClient(client, clientSecret)
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="oidc-auth"`)
+		response.JSONError(c, http.StatusUnauthorized, errs.ErrInvalidClient, err.Error())
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, errs.ParamNeedErr("token").Error())
+		return
+	}
+
+	ctx, cancel := getRequestContextWithTimeout(c, shortTimeout)
+	defer cancel()
+	c.JSON(http.StatusOK, introspect(ctx, token, c.PostForm("token_type_hint"), tokenPresentation{
+		proof:  c.PostForm("dpop_proof"),
+		method: c.PostForm("htm"),
+		url:    c.PostForm("htu"),
+	}))
+}
+
+// introspect describes the token of a signed in device, or reports it inactive
+func introspect(ctx context.Context, token, hint string, presented tokenPresentation) gin.H {
+	inactive := gin.H{"active": false}
+	indexNames := []string{"access_token_hash", "refresh_token_hash"}
+	if hint == "refresh_token" {
+		indexNames = []string{"refresh_token_hash", "access_token_hash"}
+	}
+	for _, indexName := range indexNames {
+		user, index, err := utils.GetUserByTokenHash(ctx, token, indexName)
+		if err != nil || user == nil {
+			continue
+		}
+		device := &user.Devices[index]
+		if device.Status != constants.LoginStatusLoggedIn {
+			return inactive
+		}
+		result := gin.H{
+			"active":     true,
+			"sub":        user.ID.String(),
+			"client_id":  device.ClientID,
+			"username":   user.Name,
+			"device_id":  device.ID.String(),
+			"token_type": utils.TokenTypeBearer,
+		}
+		if result["client_id"] == "" {
+			result["client_id"] = defaultClientID(device.Platform)
+		}
+		// tokens of an upstream provider are not JWTs of this server and carry no times
+		if payload, err := utils.DecodeJWTPayloadUnverified(token); err == nil {
+			if payload.Exp != 0 && time.Now().Unix() >= payload.Exp {
+				return inactive
+			}
+			result["exp"] = payload.Exp
+			result["iat"] = payload.Iat
+		}
+		if thumbprint := utils.TokenKeyThumbprint(token); thumbprint != "" {
+			// refresh tokens are only presented to the token endpoint, which checks their proof itself
+			if indexName == "access_token_hash" {
+				if err := service.CheckTokenProof(presented.proof, presented.method, presented.url,
+					token, thumbprint); err != nil {
+					log.Info(ctx, "introspected token of device %s without a valid proof: %v", device.ID, err)
+					return inactive
+				}
+			}
+			result["token_type"] = utils.TokenTypeDPoP
+			result["cnf"] = gin.H{"jkt": thumbprint}
+		}
+		return result
+	}
+	return inactive
+}
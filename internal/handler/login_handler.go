@@ -4,15 +4,19 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/providers"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 	"github.com/zgsm-ai/oidc-auth/pkg/response"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
@@ -25,6 +29,26 @@ type requestQuery struct {
 	UriScheme     string `form:"uri_scheme"`
 	PluginVersion string `form:"plugin_version"`
 	VscodeVersion string `form:"vscode_version"`
+	ClientID      string `form:"client_id"`
+	RedirectURI   string `form:"redirect_uri"`
+	authQuery
+}
+
+// authQuery the authorization parameters a login request may pass through to the provider
+type authQuery struct {
+	LoginHint string `form:"login_hint"`
+	Prompt    string `form:"prompt" binding:"omitempty,oneof=none login consent select_account"`
+}
+
+func (r *authQuery) authURLOptions() []providers.AuthURLOption {
+	var opts []providers.AuthURLOption
+	if r.Prompt != "" {
+		opts = append(opts, providers.WithPrompt(r.Prompt))
+	}
+	if r.LoginHint != "" {
+		opts = append(opts, providers.WithLoginHint(r.LoginHint))
+	}
+	return opts
 }
 
 func (r *requestQuery) validLoginParams(isPlugin bool) error {
@@ -53,22 +77,42 @@ func (s *Server) loginHandler(c *gin.Context) {
 		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
 		return
 	}
+	var keyThumbprint string
+	if isPlugin {
+		if keyThumbprint, err = loginDeviceKey(c); err != nil {
+			response.JSONError(c, http.StatusBadRequest, errs.ErrDeviceProof, err.Error())
+			return
+		}
+	}
 	provider := c.DefaultQuery("provider", "") // Get the OAuth provider, such as GitHub or Casdoor.
 	if provider == "" {
 		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
 			"please select a provider, such as casdoor.")
 		return
 	}
+	platform := c.DefaultQuery("platform", "")
+	client, err := resolveClient(c, queryParams.ClientID, platform, constants.GrantAuthorizationCode)
+	if err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrInvalidClient, err.Error())
+		return
+	}
+	if err := validateClientRedirect(client, queryParams.UriScheme, queryParams.RedirectURI); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err.Error())
+		return
+	}
 	oauthManager := providers.GetManager()
 	// Due to cross-origin (CORS) issues, we are encrypting the required information to pass it to the next stage.
 	encryptedData, err := getEncryptedData(ParameterCarrier{
 		Provider:      provider,
-		Platform:      c.DefaultQuery("platform", ""),
+		Platform:      platform,
+		ClientID:      client.ClientID,
 		MachineCode:   queryParams.MachineCode,
 		VscodeVersion: queryParams.VscodeVersion,
 		UriScheme:     queryParams.UriScheme,
+		RedirectURI:   queryParams.RedirectURI,
 		PluginVersion: queryParams.PluginVersion,
 		State:         queryParams.State,
+		KeyThumbprint: keyThumbprint,
 	})
 	if err != nil {
 		response.JSONError(c, http.StatusInternalServerError, errs.ErrDataEncryption,
@@ -81,7 +125,8 @@ func (s *Server) loginHandler(c *gin.Context) {
 			"this login method is not supported, please choose SMS or GitHub.")
 		return
 	}
-	authURL := providerInstance.GetAuthURL(encryptedData, s.BaseURL+constants.LoginCallbackURI)
+	authURL := providerInstance.GetAuthURL(encryptedData, s.BaseURL+constants.LoginCallbackURI,
+		queryParams.authURLOptions()...)
 	c.Redirect(http.StatusFound, authURL)
 }
 
@@ -129,9 +174,21 @@ func (s *Server) callbackHandler(c *gin.Context) {
 	oauthManager := providers.GetManager()
 	providerInstance, err := oauthManager.GetProvider(provider)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := getRequestContextWithTimeout(c, 15*time.Second)
 	defer cancel()
 
+	// Use the code to get the token and user info.
+	user, err := GetUserByOauth(ctx, platform, code, &parameterCarrier)
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, err))
+		return
+	}
+	if user == nil || len(user.Devices) == 0 {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrTokenInvalid, errs.ErrInfoInvalidToken)
+		return
+	}
+	user.Devices[0].State = state
+
 	userAlreadyExist, err := repository.GetDB().GetUserByDeviceConditions(ctx, map[string]any{
 		"machine_code":   parameterCarrier.MachineCode,
 		"vscode_version": parameterCarrier.VscodeVersion,
@@ -149,7 +206,25 @@ func (s *Server) callbackHandler(c *gin.Context) {
 			response.HandleError(c, http.StatusUnauthorized, errs.ErrUserNotFound, errs.ErrInfoQueryUserInfo)
 			return
 		} else {
+			// A device bound to a key is only taken over by a login the device started with it.
+			// Its owner may log in again without the key, after reinstalling, and registers a new one.
+			attestation := &userAlreadyExist.Devices[index].Attestation
+			if attestation.KeyThumbprint != "" && attestation.KeyThumbprint != parameterCarrier.KeyThumbprint {
+				owner, err := ownsDevice(ctx, user, userAlreadyExist)
+				if err != nil {
+					response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+					return
+				}
+				if !owner {
+					err := fmt.Errorf("this device is bound to the key of another account, log in from the device itself")
+					audit.LoginFailed(ctx, nil, provider, err)
+					response.HandleError(c, http.StatusForbidden, errs.ErrDeviceProof, err)
+					return
+				}
+				attestation.KeyThumbprint, attestation.KeyRegisteredAt = "", nil
+			}
 			// There will be no concurrent logins on the same device
+			wasSignedIn := userAlreadyExist.Devices[index].Status == constants.LoginStatusLoggedIn
 			userAlreadyExist.Devices[index].Status = constants.LoginStatusLoggedOffline
 			userAlreadyExist.Devices[index].AccessTokenHash = ""
 			userAlreadyExist.Devices[index].AccessToken = ""
@@ -164,31 +239,18 @@ func (s *Server) callbackHandler(c *gin.Context) {
 				response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, errMsg)
 				return
 			}
+			if wasSignedIn {
+				webhook.DeviceLoggedOut(ctx, userAlreadyExist, &userAlreadyExist.Devices[index])
+				audit.ForcedLogout(ctx, userAlreadyExist, &userAlreadyExist.Devices[index],
+					"the device logged in again")
+			}
 		}
 	}
-	// Use the code to get the token and user info.
-	user, err := GetUserByOauth(ctx, platform, code, &parameterCarrier)
-	if err != nil {
-		response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, err))
-		return
-	}
-	if user == nil || len(user.Devices) == 0 {
-		response.HandleError(c, http.StatusUnauthorized, errs.ErrTokenInvalid, errs.ErrInfoInvalidToken)
-		return
-	}
-	user.Devices[0].State = state
 
 	// Handle inviter code validation based on user status
 	if inviterCode != "" {
 		// Check if this is a new user (first time login)
-		var existingUser *repository.AuthUser
-		if user.GithubID != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "github_id", user.GithubID)
-		} else if user.Phone != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "phone", user.Phone)
-		} else if user.Email != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "email", user.Email)
-		}
+		existingUser, err := repository.GetDB().GetUserByIdentities(ctx, user.Identities())
 
 		if err != nil {
 			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound,
@@ -218,7 +280,40 @@ func (s *Server) callbackHandler(c *gin.Context) {
 			fmt.Errorf("%s: %v", errs.ErrInfoUpdateUserInfo, err))
 		return
 	}
-	c.Redirect(http.StatusFound, providerInstance.GetEndpoint(false)+constants.LoginSuccessPath)
+	redirectURL, err := clientRedirectURL(ctx, parameterCarrier.ClientID, parameterCarrier.UriScheme,
+		parameterCarrier.RedirectURI, providerInstance.GetEndpoint(false)+constants.LoginSuccessPath,
+		url.Values{"state": {state}, "status": {"success"}})
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return
+	}
+	// the plugin cannot collect its tokens with the state until the second factor is passed
+	challenge, err := holdProviderLogin(ctx, map[string]any{
+		"machine_code":   parameterCarrier.MachineCode,
+		"vscode_version": parameterCarrier.VscodeVersion,
+		"state":          state,
+	}, constants.LoginStatusLoggedOut, redirectURL)
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	if challenge != nil {
+		redirectURL = service.MFAChallengeURL(providerInstance.GetEndpoint(false)+constants.MFAChallengePath,
+			challenge.ID.String(), platform)
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// ownsDevice reports whether the user logging in is the account a device is saved on
+func ownsDevice(ctx context.Context, user, owner *repository.AuthUser) (bool, error) {
+	if user.ID == owner.ID {
+		return true, nil
+	}
+	existing, err := repository.GetDB().GetUserByIdentities(ctx, user.Identities())
+	if err != nil {
+		return false, fmt.Errorf("failed to check the owner of the device: %w", err)
+	}
+	return existing != nil && existing.ID == owner.ID, nil
 }
 
 // GetUserByOauth Use the code to exchange for a token and generate user information
@@ -233,7 +328,7 @@ func GetUserByOauth(ctx context.Context, typ, code string, parm *ParameterCarrie
 	if err != nil {
 		return nil, fmt.Errorf("%v", err)
 	}
-	user, userErr := providerInstance.GetUserInfo(ctx, token.AccessToken)
+	user, userErr := providerInstance.GetUserInfo(ctx, token)
 	if userErr != nil {
 		return nil, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, userErr)
 	}
@@ -266,7 +361,11 @@ func GetUserByOauth(ctx context.Context, typ, code string, parm *ParameterCarrie
 			Platform:      "plugin",
 			Status:        constants.LoginStatusLoggedOut,
 			TokenProvider: tokenProvider,
+			ClientID:      coalesceString(parm.ClientID, constants.DefaultPluginClientID),
 		})
+		if parm.KeyThumbprint != "" {
+			user.Devices[0].Attestation.RegisterKey(parm.KeyThumbprint, time.Now())
+		}
 	}
 	return user, nil
 }
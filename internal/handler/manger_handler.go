@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/providers"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
@@ -29,6 +31,17 @@ func getContextWithTimeout(timeout time.Duration) (context.Context, context.Canc
 	return context.WithTimeout(context.Background(), timeout)
 }
 
+// requestClient the origin of the request, for the audit log
+func requestClient(c *gin.Context) audit.Client {
+	return audit.Client{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// getRequestContextWithTimeout is getContextWithTimeout carrying the client of the request,
+// for the audit log entries recorded while handling it
+func getRequestContextWithTimeout(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(audit.WithClient(context.Background(), requestClient(c)), timeout)
+}
+
 func getEncryptedData(data any) (string, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -58,7 +71,7 @@ func getDecryptedData(encryptedData string, result any) error {
 }
 
 func (s *Server) bindAccount(c *gin.Context) {
-	token, err := getTokenFromHeader(c)
+	token, err := getAccessTokenFromHeader(c)
 	if err != nil {
 		response.HandleError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err)
 		return
@@ -79,8 +92,21 @@ func (s *Server) bindAccount(c *gin.Context) {
 		return
 	}
 
+	client, err := resolveClient(c, "", "web", "")
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return
+	}
+	redirectURI := c.DefaultQuery("redirect_uri", "")
+	if err := validateClientRedirect(client, "", redirectURI); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return
+	}
+
 	encryptedData, err := getEncryptedData(ParameterCarrier{
-		TokenHash: tokenHash,
+		TokenHash:   tokenHash,
+		ClientID:    client.ClientID,
+		RedirectURI: redirectURI,
 	})
 	if err != nil {
 		response.HandleError(c, http.StatusInternalServerError, errs.ErrDataEncryption, err)
@@ -89,17 +115,18 @@ func (s *Server) bindAccount(c *gin.Context) {
 
 	redirectURL := fmt.Sprintf("%s%s", s.BaseURL, constants.BindAccountCallbackURI)
 	bindType := c.DefaultQuery("bindType", "")
-	var bindParm string
-	if bindType == "github" {
-		bindParm = "&bindType=github"
-	} else {
-		bindParm = "&bindType=sms"
+	if bindType != "github" {
+		bindType = "sms"
 	}
-	url := providerInstance.GetAuthURL(encryptedData, redirectURL) + bindParm
+	// Binding must prove control of the other account, so always force re-authentication
+	authURL := providerInstance.GetAuthURL(encryptedData, redirectURL,
+		providers.WithPrompt("login"),
+		providers.WithExtraParam("bindType", bindType),
+	)
 
 	response.JSONSuccess(c, "", map[string]interface{}{
 		"state": c.DefaultQuery("state", ""),
-		"url":   url,
+		"url":   authURL,
 	})
 }
 
@@ -127,7 +154,7 @@ func (s *Server) bindAccountCallback(c *gin.Context) {
 		response.HandleError(c, http.StatusInternalServerError, errs.ErrBadRequestParam, err)
 		return
 	}
-	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
 	defer cancel()
 
 	parameterCarrier.Provider = "casdoor"
@@ -158,12 +185,12 @@ func (s *Server) bindAccountCallback(c *gin.Context) {
 	// Get a new user and first determine whether it exists in the database
 	var userNewExist *repository.AuthUser
 
-	ctx, cancel = getContextWithTimeout(defaultTimeout)
+	ctx, cancel = getRequestContextWithTimeout(c, defaultTimeout)
 	defer cancel()
 	if userOld.GithubID != "" {
-		userNewExist, err = repository.GetDB().GetUserByField(ctx, "phone", userNew.Phone)
+		userNewExist, err = repository.GetDB().GetUserByPhone(ctx, userNew.Phone)
 	} else if userOld.Phone != "" {
-		userNewExist, err = repository.GetDB().GetUserByField(ctx, "github_id", userNew.GithubID)
+		userNewExist, err = repository.GetDB().GetUserByIdentity(ctx, constants.IdentityGitHub, userNew.GithubID)
 	} else {
 		// custom types are not considered
 		response.HandleError(c, http.StatusInternalServerError, errs.ErrTokenInvalid,
@@ -189,26 +216,37 @@ func (s *Server) bindAccountCallback(c *gin.Context) {
 		userMarge = userOld
 		otherUser = userNew
 		mainToken = useroldToken
-		otherToken = userNew.Devices[0].AccessToken
+		otherToken = service.UpstreamToken(userNew, 0)
 	} else {
 		// Scenario 2: Binding account exists - GitHub account becomes main account
 		if userNewExist.GithubID != "" {
 			// Existing account has GitHub info, use it as main account
 			userMarge = userNewExist
 			otherUser = userOld
-			mainToken = userNewExist.Devices[0].AccessToken
+			mainToken = service.UpstreamToken(userNewExist, -1)
 			otherToken = useroldToken
 		} else {
 			// Current account becomes main
 			userMarge = userOld
 			otherUser = userNewExist
 			mainToken = useroldToken
-			otherToken = userNewExist.Devices[0].AccessToken
+			otherToken = service.UpstreamToken(userNewExist, -1)
 		}
 	}
+	if mainToken == "" || otherToken == "" {
+		response.HandleError(c, http.StatusConflict, errs.ErrBindAccount,
+			fmt.Errorf("both accounts need an upstream session to be bound, sign in to them again"))
+		return
+	}
 
 	// Merge fields from otherUser into userMarge
+	if userMarge.Email == "" {
+		userMarge.EmailVerified = otherUser.EmailVerified
+	}
 	userMarge.Email = coalesceString(userMarge.Email, otherUser.Email)
+	if userMarge.Phone == "" {
+		userMarge.PhoneVerified = otherUser.PhoneVerified
+	}
 	userMarge.Phone = coalesceString(userMarge.Phone, otherUser.Phone)
 	userMarge.GithubID = coalesceString(userMarge.GithubID, otherUser.GithubID)
 	userMarge.GithubName = coalesceString(userMarge.GithubName, otherUser.GithubName)
@@ -237,40 +275,23 @@ func (s *Server) bindAccountCallback(c *gin.Context) {
 		}
 	}
 
-	// Call Casdoor merge API
-	resp, err := service.MergeByCasdoor(providerInstance, mainToken, otherToken, s.HTTPClient)
+	// Merge the accounts as a saga that can be resumed if it stops halfway
+	merge, err := service.StartAccountMerge(ctx, service.AccountMergeRequest{
+		MainUserID:  userMarge.ID,
+		OtherUserID: otherUser.ID,
+		OtherSaved:  userNewExist != nil,
+		MainToken:   mainToken,
+		OtherToken:  otherToken,
+		Profile:     mergeProfileOf(userMarge),
+	})
 	if err != nil {
 		response.HandleError(c, http.StatusInternalServerError, errs.ErrBindAccount,
 			fmt.Errorf("account linking failed, %w", err))
 		return
 	}
-	if resp.Status != "ok" {
+	if _, err := service.RunAccountMerge(ctx, merge.ID, s.HTTPClient); err != nil {
 		response.HandleError(c, http.StatusInternalServerError, errs.ErrBindAccount,
-			fmt.Errorf("failed to merge account"))
-		return
-	}
-
-	// Handle existing account deletion and quota merge
-	if userNewExist != nil {
-		// Merge quota before deleting account
-		err = service.MergeUserQuota(userMarge.ID.String(), otherUser.ID.String(), mainToken)
-		if err != nil {
-			response.HandleError(c, http.StatusInternalServerError, errs.ErrBindAccount,
-				fmt.Errorf("failed to merge user quota: %w", err))
-			return
-		}
-
-		// Delete the existing duplicate account
-		if delNum, err := repository.GetDB().DeleteUserByField(ctx, constants.DBIndexField, otherUser.ID); err != nil || delNum == 0 {
-			response.HandleError(c, http.StatusInternalServerError, errs.ErrBindAccount,
-				fmt.Errorf("failed to delete old user, %w", err))
-			return
-		}
-	}
-
-	if err := repository.GetDB().Upsert(ctx, userMarge, constants.DBIndexField, userMarge.ID); err != nil {
-		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo,
-			fmt.Errorf("%s: %w", errs.ErrInfoUpdateUserInfo, err))
+			fmt.Errorf("account linking failed, %w", err))
 		return
 	}
 
@@ -287,29 +308,53 @@ func (s *Server) bindAccountCallback(c *gin.Context) {
 		tokenHash = userMarge.Devices[0].AccessTokenHash
 	}
 
-	url := providerInstance.GetEndpoint(false) + constants.BindAccountBindURI + "?state=" + tokenHash
-	url = url + "&bind=true"
-	c.Redirect(http.StatusFound, url)
+	redirectURL, err := clientRedirectURL(ctx, parameterCarrier.ClientID, "", parameterCarrier.RedirectURI,
+		providerInstance.GetEndpoint(false)+constants.BindAccountBindURI,
+		url.Values{"state": {tokenHash}, "bind": {"true"}})
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// mergeProfileOf returns the profile fields of a merged account
+func mergeProfileOf(user *repository.AuthUser) repository.MergeProfile {
+	return repository.MergeProfile{
+		Name:           user.Name,
+		Email:          user.Email,
+		EmailVerified:  user.EmailVerified,
+		Phone:          user.Phone,
+		PhoneVerified:  user.PhoneVerified,
+		GithubID:       user.GithubID,
+		GithubName:     user.GithubName,
+		GithubStar:     user.GithubStar,
+		Company:        user.Company,
+		Location:       user.Location,
+		EmployeeNumber: user.EmployeeNumber,
+		Vip:            user.Vip,
+		InviteCode:     user.InviteCode,
+		InviterID:      user.InviterID,
+	}
 }
 
 func (s *Server) userInfoHandler(c *gin.Context) {
-	token, err := getTokenFromHeader(c)
+	token, err := getAccessTokenFromHeader(c)
 	if err != nil {
 		response.HandleError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err)
 		return
 	}
 
-	tokenHash := utils.HashToken(token)
 	ctx, cancel := getContextWithTimeout(shortTimeout)
 	defer cancel()
 
-	user, err := repository.GetDB().GetUserByDeviceConditions(ctx, map[string]any{
-		"access_token_hash": tokenHash,
-	})
+	// a device waiting for its second factor is not logged in yet
+	user, index, err := utils.GetUserByTokenHash(ctx, token, "access_token_hash")
 	if err != nil || user == nil {
 		response.HandleError(c, http.StatusBadRequest, errs.ErrTokenInvalid, errs.ErrInfoInvalidToken)
 		return
 	}
+	touchDevice(ctx, user, index)
 
 	isStar := true
 	starProject := user.GithubStar
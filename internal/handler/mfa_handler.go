@@ -0,0 +1,394 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+type mfaVerifyRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+type mfaCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func mfaErrorStatus(err error) (int, string) {
+	var lockedErr *service.MFALockedError
+	switch {
+	case errors.As(err, &lockedErr):
+		return http.StatusLocked, errs.ErrAccountLocked
+	case errors.Is(err, service.ErrMFACodeInvalid),
+		errors.Is(err, service.ErrMFAChallengeInvalid),
+		errors.Is(err, service.ErrMFAChallengeTooManyTries),
+		errors.Is(err, service.ErrPasskeyInvalid),
+		errors.Is(err, service.ErrWebAuthnSessionInvalid):
+		return http.StatusUnauthorized, errs.ErrMFACode
+	case errors.Is(err, service.ErrWebAuthnDisabled),
+		errors.Is(err, service.ErrPasskeyNotFound):
+		return http.StatusNotFound, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrPasskeyExists):
+		return http.StatusConflict, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrMFARequired):
+		return http.StatusForbidden, errs.ErrMFARequired
+	case errors.Is(err, service.ErrMFAUseExistingFactor):
+		return http.StatusForbidden, errs.ErrMFACode
+	case errors.Is(err, service.ErrReauthRequired):
+		return http.StatusForbidden, errs.ErrReauthRequired
+	case errors.Is(err, service.ErrTOTPAlreadyEnabled):
+		return http.StatusConflict, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrTOTPNotEnabled),
+		errors.Is(err, service.ErrTOTPNotEnrolling):
+		return http.StatusBadRequest, errs.ErrBadRequestParam
+	default:
+		return http.StatusInternalServerError, errs.ErrAuthentication
+	}
+}
+
+func handleMFAError(c *gin.Context, err error) {
+	var lockedErr *service.MFALockedError
+	if errors.As(err, &lockedErr) {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(lockedErr.Until).Seconds())+1))
+	}
+	status, code := mfaErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// requireMFA holds a device that just logged in behind a second factor challenge when the user
+// needs one. It returns nil when no second factor is needed.
+func requireMFA(ctx context.Context, user *repository.AuthUser, index int,
+	challenge repository.MFAChallenge) (*repository.MFAChallenge, error) {
+	if index < 0 || index >= len(user.Devices) {
+		return nil, errs.ErrInfoUpdateUserInfo
+	}
+	needed, err := service.MFANeeded(ctx, user.ID)
+	if err != nil || !needed {
+		return nil, err
+	}
+	device := &user.Devices[index]
+	device.Status = constants.LoginStatusPendingMFA
+	device.UpdatedAt = time.Now()
+	if challenge.IssueTokens {
+		device.AccessToken = ""
+		device.AccessTokenHash = ""
+		device.RefreshToken = ""
+		device.RefreshTokenHash = ""
+	}
+	user.UpdatedAt = time.Now()
+	if err := repository.GetDB().Upsert(ctx, user, constants.DBIndexField, user.ID); err != nil {
+		return nil, fmt.Errorf("failed to save session: %w", err)
+	}
+	challenge.UserID = user.ID
+	challenge.DeviceID = device.ID
+	if err := service.NewMFAChallenge(ctx, &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// holdProviderLogin puts a device saved by an OAuth provider behind a second factor challenge.
+// The provider may have merged the login into another account, so the user is looked up again.
+func holdProviderLogin(ctx context.Context, conditions map[string]any, resumeStatus,
+	redirectURL string) (*repository.MFAChallenge, error) {
+	user, err := repository.GetDB().GetUserByDeviceConditions(ctx, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errs.ErrInfoQueryUserInfo
+	}
+	index := -1
+	for i, device := range user.Devices {
+		if deviceMatches(device, conditions) {
+			index = i
+			break
+		}
+	}
+	return requireMFA(ctx, user, index, repository.MFAChallenge{
+		ResumeStatus: resumeStatus,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// deviceMatches reports whether a device has the fields the conditions ask for
+func deviceMatches(device repository.Device, conditions map[string]any) bool {
+	fields := map[string]string{
+		"machine_code":      device.MachineCode,
+		"vscode_version":    device.VSCodeVersion,
+		"state":             device.State,
+		"access_token_hash": device.AccessTokenHash,
+	}
+	for key, value := range conditions {
+		if field, ok := fields[key]; !ok || field != value {
+			return false
+		}
+	}
+	return true
+}
+
+// mfaAccountName the account name shown in authenticator apps
+func mfaAccountName(user *repository.AuthUser) string {
+	if user.Username != nil {
+		return *user.Username
+	}
+	return coalesceString(user.Email, user.Phone, user.Name, user.ID.String())
+}
+
+// mfaVerifyHandler completes the second factor challenge of a login with a TOTP or recovery code
+func mfaVerifyHandler(c *gin.Context) {
+	var req mfaVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"a challenge and exactly one of code and recovery_code need to be provided")
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	challenge, recoveryCodes, err := service.CompleteMFAChallenge(ctx, req.Challenge, req.Code, req.RecoveryCode)
+	if err != nil {
+		audit.LoginFailed(ctx, nil, "mfa", err)
+		handleMFAError(c, err)
+		return
+	}
+	completeMFALogin(c, ctx, challenge, recoveryCodes)
+}
+
+// completeMFALogin releases the device of a completed challenge: it gets its tokens, or returns
+// to the status it had so the login continues at the redirect_url of the response
+func completeMFALogin(c *gin.Context, ctx context.Context, challenge *repository.MFAChallenge, recoveryCodes []string) {
+	user, err := repository.GetDB().GetUserByField(ctx, "id", challenge.UserID)
+	if err != nil || user == nil {
+		response.HandleError(c, http.StatusNotFound, errs.ErrUserNotFound, errs.ErrInfoQueryUserInfo)
+		return
+	}
+	index := -1
+	for i, device := range user.Devices {
+		if device.ID == challenge.DeviceID && device.Status == constants.LoginStatusPendingMFA {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrMFACode,
+			fmt.Errorf("the login of this challenge is no longer pending"))
+		return
+	}
+
+	data := gin.H{}
+	if len(recoveryCodes) > 0 {
+		data["recovery_codes"] = recoveryCodes
+	}
+	redirectURL := challenge.RedirectURL
+	if challenge.IssueTokens {
+		tokenPair, err := generateTokenPair(ctx, user, index)
+		if err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrTokenGenerate, err)
+			return
+		}
+		if index, err = admitDevice(ctx, user, index, tokenPair); err != nil {
+			handleSessionError(c, err)
+			return
+		}
+		webhook.UserLogin(ctx, user, &user.Devices[index])
+		audit.Login(ctx, user, &user.Devices[index])
+		data["access_token"] = tokenPair.AccessToken
+		data["refresh_token"] = tokenPair.RefreshToken
+		if challenge.StateFromToken && redirectURL != "" {
+			redirectURL, err = withQuery(redirectURL, url.Values{"state": {utils.HashToken(tokenPair.AccessToken)}})
+			if err != nil {
+				response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+				return
+			}
+		}
+	} else if challenge.ResumeStatus == constants.LoginStatusLoggedIn {
+		// the device got its tokens upstream, it is logged in with them
+		if index, err = admitDevice(ctx, user, index, nil); err != nil {
+			handleSessionError(c, err)
+			return
+		}
+		webhook.UserLogin(ctx, user, &user.Devices[index])
+		audit.Login(ctx, user, &user.Devices[index])
+	} else {
+		user.Devices[index].Status = challenge.ResumeStatus
+		user.Devices[index].UpdatedAt = time.Now()
+		user.UpdatedAt = time.Now()
+		if err := repository.GetDB().Upsert(ctx, user, constants.DBIndexField, user.ID); err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+			return
+		}
+	}
+	if redirectURL != "" {
+		data["redirect_url"] = redirectURL
+	}
+	response.JSONSuccess(c, "", data)
+}
+
+// mfaChallengeEnrollHandler starts a TOTP enrollment for a user who has to set up the second factor
+// the organization requires while logging in and has none yet; the first code then completes the challenge
+func mfaChallengeEnrollHandler(c *gin.Context) {
+	var req mfaChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	challenge, err := service.GetOpenMFAChallenge(ctx, req.Challenge)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	user, err := repository.GetDB().GetUserByField(ctx, "id", challenge.UserID)
+	if err != nil || user == nil {
+		response.HandleError(c, http.StatusNotFound, errs.ErrUserNotFound, errs.ErrInfoQueryUserInfo)
+		return
+	}
+	enrollment, err := service.StartChallengeEnrollment(ctx, challenge, mfaAccountName(user))
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", enrollment)
+}
+
+// bearerUser returns the user of the access token in the Authorization header,
+// writing the error response when there is none
+func bearerUser(c *gin.Context, ctx context.Context) (*repository.AuthUser, int, bool) {
+	token, err := getAccessTokenFromHeader(c)
+	if err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrBadRequestParam, err)
+		return nil, -1, false
+	}
+	user, index, err := utils.GetUserByTokenHash(ctx, token, "access_token_hash")
+	if err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrTokenInvalid, errs.ErrInfoInvalidToken)
+		return nil, -1, false
+	}
+	touchDevice(ctx, user, index)
+	return user, index, true
+}
+
+// mfaStatusHandler returns the second factor state of the signed in user
+func mfaStatusHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	status, err := service.GetMFAStatus(ctx, user.ID)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", status)
+}
+
+// totpEnrollHandler starts a TOTP enrollment for the signed in user
+func totpEnrollHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	enrollment, err := service.StartTOTPEnrollment(ctx, user.ID, mfaAccountName(user))
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", enrollment)
+}
+
+// totpConfirmHandler enables the factor being enrolled and returns the recovery codes
+func totpConfirmHandler(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, errs.ParamNeedErr("code").Error())
+		return
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	recoveryCodes, err := service.ConfirmTOTPEnrollment(ctx, user.ID, req.Code)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{"recovery_codes": recoveryCodes})
+}
+
+// totpDisableHandler removes the factor of the signed in user after checking a code
+func totpDisableHandler(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"exactly one of code and recovery_code needs to be provided")
+		return
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	if err := service.DisableTOTP(ctx, user.ID, req.Code, req.RecoveryCode); err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", nil)
+}
+
+// recoveryCodesHandler replaces the recovery codes of the signed in user
+func recoveryCodesHandler(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, errs.ParamNeedErr("code").Error())
+		return
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	recoveryCodes, err := service.RegenerateRecoveryCodes(ctx, user.ID, req.Code)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{"recovery_codes": recoveryCodes})
+}
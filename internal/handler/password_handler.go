@@ -0,0 +1,379 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/password"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+type passwordLoginRequest struct {
+	Username      string `json:"username" binding:"required"` // username, verified email or phone number
+	Password      string `json:"password" binding:"required"`
+	ClientID      string `json:"client_id"`
+	MachineCode   string `json:"machine_code"`
+	VscodeVersion string `json:"vscode_version"`
+	PluginVersion string `json:"plugin_version"`
+	UriScheme     string `json:"uri_scheme"`
+}
+
+type passwordRegisterRequest struct {
+	passwordLoginRequest
+	InviterCode string `json:"inviter_code"`
+}
+
+type passwordChangeRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password" binding:"required"`
+	// Code a password reset code sent to the phone or verified email of the account, to set the
+	// first password of an account from a device that did not log in recently
+	Code string `json:"code"`
+}
+
+type passwordResetSendRequest struct {
+	Phone string `json:"phone"`
+	Email string `json:"email"`
+}
+
+type passwordResetRequest struct {
+	Phone       string `json:"phone"`
+	Email       string `json:"email"`
+	Code        string `json:"code" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// passwordErrorStatus maps password account errors to HTTP status codes
+func passwordErrorStatus(err error) (int, string) {
+	var lockedErr *service.AccountLockedError
+	var policyErr *password.PolicyError
+	switch {
+	case errors.Is(err, service.ErrPasswordLoginDisabled), errors.Is(err, service.ErrRegistrationDisabled):
+		return http.StatusNotFound, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrInvalidCredentials):
+		return http.StatusUnauthorized, errs.ErrCredentials
+	case errors.As(err, &lockedErr):
+		return http.StatusLocked, errs.ErrAccountLocked
+	case errors.As(err, &policyErr):
+		return http.StatusBadRequest, errs.ErrPasswordPolicy
+	case errors.Is(err, service.ErrInvalidUsername):
+		return http.StatusBadRequest, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrUsernameTaken):
+		return http.StatusConflict, errs.ErrUsernameTaken
+	default:
+		return http.StatusInternalServerError, errs.ErrAuthentication
+	}
+}
+
+// handlePasswordError writes a password error response, telling locked out callers when to retry
+func handlePasswordError(c *gin.Context, err error) {
+	var lockedErr *service.AccountLockedError
+	if errors.As(err, &lockedErr) {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(lockedErr.Until).Seconds())+1))
+	}
+	status, code := passwordErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// passwordLoginClient resolves and authenticates the client of a password login
+func passwordLoginClient(c *gin.Context, req *passwordLoginRequest, platform string) (*repository.OAuthClient, bool) {
+	if platform == "plugin" && (req.MachineCode == "" || req.VscodeVersion == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			errs.ParamNeedErr("machine_code and vscode_version").Error())
+		return nil, false
+	}
+	client, err := resolveClient(c, req.ClientID, platform, constants.GrantPassword)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return nil, false
+	}
+	if err := service.AuthenticateClient(client, getClientSecret(c)); err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrInvalidClient, err)
+		return nil, false
+	}
+	if err := validateClientRedirect(client, req.UriScheme, ""); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+		return nil, false
+	}
+	return client, true
+}
+
+// issuePasswordSession issues the tokens of a password login and writes them to the response
+func issuePasswordSession(c *gin.Context, ctx context.Context, user *repository.AuthUser,
+	client *repository.OAuthClient, req *passwordLoginRequest, platform string) {
+	tokenPair, challenge, err := issueSession(ctx, user, loginDevice{
+		ClientID:      client.ClientID,
+		Platform:      platform,
+		Provider:      constants.ProviderPassword,
+		MachineCode:   req.MachineCode,
+		VscodeVersion: req.VscodeVersion,
+		PluginVersion: req.PluginVersion,
+		UriScheme:     req.UriScheme,
+	})
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	writeSession(c, tokenPair, challenge)
+}
+
+// passwordLoginHandler logs in with a username, verified email or phone number and a password
+func passwordLoginHandler(c *gin.Context) {
+	var req passwordLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	platform := c.DefaultQuery("platform", "")
+	client, ok := passwordLoginClient(c, &req, platform)
+	if !ok {
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	user, err := service.AuthenticatePassword(ctx, req.Username, req.Password)
+	if err != nil {
+		audit.PasswordLoginFailed(ctx, req.Username, err)
+		handlePasswordError(c, err)
+		return
+	}
+	issuePasswordSession(c, ctx, user, client, &req, platform)
+}
+
+// passwordRegisterHandler creates a password account and logs it in
+func passwordRegisterHandler(c *gin.Context) {
+	var req passwordRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	platform := c.DefaultQuery("platform", "")
+	client, ok := passwordLoginClient(c, &req.passwordLoginRequest, platform)
+	if !ok {
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	username, err := service.CheckRegistration(ctx, req.Username)
+	if err != nil {
+		handlePasswordError(c, err)
+		return
+	}
+	user := &repository.AuthUser{
+		Name:     username,
+		Username: &username,
+	}
+	hash, err := service.NewPasswordHash(user, req.Password)
+	if err != nil {
+		handlePasswordError(c, err)
+		return
+	}
+	now := time.Now()
+	user.Password = hash
+	user.PasswordChangedAt = &now
+	if req.InviterCode != "" {
+		inviter, err := utils.ValidateInviteCode(ctx, req.InviterCode)
+		if err != nil {
+			response.HandleError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err)
+			return
+		}
+		user.InviterID = &inviter.ID
+	}
+	issuePasswordSession(c, ctx, user, client, &req.passwordLoginRequest, platform)
+}
+
+// passwordChangeHandler changes the password of the signed in user and signs out its other devices.
+// Accounts created through another login method set their first password without an old one,
+// but only from a device that logged in recently or with a reset code sent to the account.
+func passwordChangeHandler(c *gin.Context) {
+	var req passwordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	token, err := getAccessTokenFromHeader(c)
+	if err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrBadRequestParam, err)
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	user, index, err := utils.GetUserByTokenHash(ctx, token, "access_token_hash")
+	if err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrTokenInvalid, errs.ErrInfoInvalidToken)
+		return
+	}
+	if user.Password != "" {
+		if err := service.CheckUserPassword(ctx, user, req.OldPassword); err != nil {
+			handlePasswordError(c, err)
+			return
+		}
+	} else if !service.RecentlyAuthenticated(&user.Devices[index]) {
+		if !verifyAccountCode(c, ctx, user, req.Code) {
+			return
+		}
+	}
+	if err := service.SetUserPassword(ctx, user, req.NewPassword); err != nil {
+		handlePasswordError(c, err)
+		return
+	}
+	if err := signOutDevices(ctx, user, index); err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	response.JSONSuccess(c, "", nil)
+}
+
+// verifyAccountCode checks a password reset code sent to the phone linked to the user, or to its
+// verified email when no phone is linked, and writes the error response when it does not match
+func verifyAccountCode(c *gin.Context, ctx context.Context, user *repository.AuthUser, code string) bool {
+	if code == "" {
+		response.HandleError(c, http.StatusForbidden, errs.ErrReauthRequired, service.ErrReauthRequired)
+		return false
+	}
+	db := repository.GetDB()
+	if user.Phone != "" {
+		owner, err := db.GetUserByPhone(ctx, user.Phone)
+		if err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+			return false
+		}
+		if owner != nil && owner.ID == user.ID {
+			if _, err := service.VerifySMSCode(ctx, user.Phone, constants.PasswordPurposeReset, code); err != nil {
+				handleSMSError(c, err)
+				return false
+			}
+			return true
+		}
+	}
+	if user.Email != "" && user.EmailVerified {
+		if _, err := service.VerifyEmailCode(ctx, user.Email, constants.PasswordPurposeReset, code); err != nil {
+			handleEmailError(c, err)
+			return false
+		}
+		return true
+	}
+	response.HandleError(c, http.StatusForbidden, errs.ErrReauthRequired, service.ErrReauthRequired)
+	return false
+}
+
+// passwordResetSendHandler sends a password reset code by SMS or email. The response does not
+// tell whether an account exists, and no code is sent when none does.
+func passwordResetSendHandler(c *gin.Context) {
+	var req passwordResetSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Phone == "") == (req.Email == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"exactly one of phone and email needs to be provided")
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	if req.Phone != "" {
+		phoneNumber, err := phone.Normalize(req.Phone)
+		if err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		if err := service.GuardSMS(ctx, phoneNumber, c.ClientIP()); err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		user, err := repository.GetDB().GetUserByPhone(ctx, phoneNumber)
+		if err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+			return
+		}
+		if user != nil {
+			if _, err := service.IssueSMSCode(ctx, phoneNumber, constants.PasswordPurposeReset); err != nil {
+				handleSMSError(c, err)
+				return
+			}
+		}
+		response.JSONSuccess(c, "", nil)
+		return
+	}
+
+	email, err := service.NormalizeEmail(req.Email)
+	if err != nil {
+		handleEmailError(c, err)
+		return
+	}
+	user, err := repository.GetDB().GetUserByVerifiedEmail(ctx, email)
+	if err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+		return
+	}
+	if user != nil {
+		if _, err := service.IssueEmailVerification(ctx, email, constants.PasswordPurposeReset, "",
+			repository.EmailLoginContext{}); err != nil {
+			handleEmailError(c, err)
+			return
+		}
+	}
+	response.JSONSuccess(c, "", nil)
+}
+
+// passwordResetHandler sets a new password with a reset code and signs out every device
+func passwordResetHandler(c *gin.Context) {
+	var req passwordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Phone == "") == (req.Email == "") {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+			"exactly one of phone and email, a code and a new password need to be provided")
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	var user *repository.AuthUser
+	if req.Phone != "" {
+		phoneNumber, err := service.VerifySMSCode(ctx, req.Phone, constants.PasswordPurposeReset, req.Code)
+		if err != nil {
+			handleSMSError(c, err)
+			return
+		}
+		if user, err = repository.GetDB().GetUserByPhone(ctx, phoneNumber); err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+			return
+		}
+	} else {
+		verification, err := service.VerifyEmailCode(ctx, req.Email, constants.PasswordPurposeReset, req.Code)
+		if err != nil {
+			handleEmailError(c, err)
+			return
+		}
+		if user, err = repository.GetDB().GetUserByVerifiedEmail(ctx, verification.Email); err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound, err)
+			return
+		}
+	}
+	if user == nil {
+		response.HandleError(c, http.StatusNotFound, errs.ErrUserNotFound, fmt.Errorf("account no longer exists"))
+		return
+	}
+	if err := service.SetUserPassword(ctx, user, req.NewPassword); err != nil {
+		handlePasswordError(c, err)
+		return
+	}
+	if err := signOutDevices(ctx, user, -1); err != nil {
+		response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+		return
+	}
+	response.JSONSuccess(c, "", nil)
+}
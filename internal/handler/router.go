@@ -1,11 +1,16 @@
 package handler
 
 import (
-	"github.com/gin-gonic/gin"
+	"fmt"
 	"net/http"
 
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
 	"github.com/zgsm-ai/oidc-auth/internal/middleware"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/metrics"
 )
 
 type Server struct {
@@ -13,6 +18,11 @@ type Server struct {
 	BaseURL    string
 	HTTPClient *http.Client
 	IsPrivate  bool
+	RateLimit  config.RateLimitConfig
+	AdminToken string // enables the operator API when not empty
+
+	TrustedProxies      []string // may set X-Forwarded-For; otherwise the client IP is the peer address
+	EnableTestEndpoints bool     // exposes the test endpoints to admins
 }
 
 type ParameterCarrier struct {
@@ -24,24 +34,47 @@ type ParameterCarrier struct {
 	UriScheme     string `form:"uri_scheme"`
 	PluginVersion string `form:"plugin_version"`
 	VscodeVersion string `form:"vscode_version"`
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	KeyThumbprint string `json:"key_thumbprint"` // of the device key proven when the login started
 }
 
 func (s *Server) SetupRouter(r *gin.Engine) {
 	r.Use(middleware.SecurityHeaders())
 	r.Use(middleware.RequestLogger())
 
+	limiter := middleware.NewRateLimiter(&s.RateLimit)
 	pluginOauthServer := r.Group("/oidc-auth/api/v1/plugin",
 		middleware.SetPlatform("plugin"),
+		limiter.Policy("plugin"),
 	)
 	{
 		pluginOauthServer.GET("login", s.loginHandler)
 		pluginOauthServer.GET("login/callback", s.callbackHandler)
-		pluginOauthServer.GET("login/token", tokenHandler)
+		pluginOauthServer.GET("login/token", limiter.Policy("token"), tokenHandler)
 		pluginOauthServer.GET("login/logout", logoutHandler)
 		pluginOauthServer.GET("login/status", statusHandler)
+		pluginOauthServer.POST("login/sms/send", smsSendCodeHandler)
+		pluginOauthServer.POST("login/sms/verify", smsVerifyCodeHandler)
+		pluginOauthServer.POST("login/email/send", s.emailSendHandler)
+		pluginOauthServer.POST("login/email/verify", emailVerifyHandler)
+		pluginOauthServer.GET("login/email/callback", s.emailCallbackHandler)
+		pluginOauthServer.POST("login/password", limiter.Policy("password"), passwordLoginHandler)
+		pluginOauthServer.POST("login/password/register", limiter.Policy("password"), passwordRegisterHandler)
+		pluginOauthServer.POST("login/password/reset/send", passwordResetSendHandler)
+		pluginOauthServer.POST("login/password/reset", passwordResetHandler)
+		pluginOauthServer.POST("password/change", limiter.Policy("password"), passwordChangeHandler)
+		pluginOauthServer.POST("login/mfa/verify", limiter.Policy("mfa"), mfaVerifyHandler)
+		pluginOauthServer.POST("login/mfa/enroll", limiter.Policy("mfa"), mfaChallengeEnrollHandler)
+		pluginOauthServer.GET("mfa/totp", mfaStatusHandler)
+		pluginOauthServer.POST("mfa/totp/enroll", limiter.Policy("mfa"), totpEnrollHandler)
+		pluginOauthServer.POST("mfa/totp/confirm", limiter.Policy("mfa"), totpConfirmHandler)
+		pluginOauthServer.POST("mfa/totp/disable", limiter.Policy("mfa"), totpDisableHandler)
+		pluginOauthServer.POST("mfa/recovery-codes", limiter.Policy("mfa"), recoveryCodesHandler)
 	}
 	webOauthServer := r.Group("/oidc-auth/api/v1/manager",
 		middleware.SetPlatform("web"),
+		limiter.Policy("web"),
 	)
 	{
 		webOauthServer.GET("token", getTokenByHash)
@@ -50,17 +83,96 @@ func (s *Server) SetupRouter(r *gin.Engine) {
 		webOauthServer.GET("userinfo", s.userInfoHandler)
 		webOauthServer.GET("login", s.webLoginHandler)
 		webOauthServer.GET("login/callback", s.webLoginCallbackHandler)
-		webOauthServer.GET("invite-code", s.getUserInviteCodeHandler)
+		webOauthServer.POST("login/sms/send", smsSendCodeHandler)
+		webOauthServer.POST("login/sms/verify", smsVerifyCodeHandler)
+		webOauthServer.POST("login/email/send", s.emailSendHandler)
+		webOauthServer.POST("login/email/verify", emailVerifyHandler)
+		webOauthServer.GET("login/email/callback", s.emailCallbackHandler)
+		webOauthServer.POST("login/password", limiter.Policy("password"), passwordLoginHandler)
+		webOauthServer.POST("login/password/register", limiter.Policy("password"), passwordRegisterHandler)
+		webOauthServer.POST("login/password/reset/send", passwordResetSendHandler)
+		webOauthServer.POST("login/password/reset", passwordResetHandler)
+		webOauthServer.POST("password/change", limiter.Policy("password"), passwordChangeHandler)
+		webOauthServer.POST("login/mfa/verify", limiter.Policy("mfa"), mfaVerifyHandler)
+		webOauthServer.POST("login/mfa/enroll", limiter.Policy("mfa"), mfaChallengeEnrollHandler)
+		webOauthServer.GET("mfa/totp", mfaStatusHandler)
+		webOauthServer.POST("mfa/totp/enroll", limiter.Policy("mfa"), totpEnrollHandler)
+		webOauthServer.POST("mfa/totp/confirm", limiter.Policy("mfa"), totpConfirmHandler)
+		webOauthServer.POST("mfa/totp/disable", limiter.Policy("mfa"), totpDisableHandler)
+		webOauthServer.POST("mfa/recovery-codes", limiter.Policy("mfa"), recoveryCodesHandler)
+		webOauthServer.POST("login/webauthn/begin", limiter.Policy("mfa"), passkeyLoginBeginHandler)
+		webOauthServer.POST("login/webauthn/finish", limiter.Policy("mfa"), passkeyLoginFinishHandler)
+		webOauthServer.POST("login/mfa/webauthn/begin", limiter.Policy("mfa"), passkeyMFABeginHandler)
+		webOauthServer.POST("login/mfa/webauthn/finish", limiter.Policy("mfa"), passkeyMFAFinishHandler)
+		webOauthServer.POST("webauthn/register/begin", limiter.Policy("mfa"), passkeyRegisterBeginHandler)
+		webOauthServer.POST("webauthn/register/finish", limiter.Policy("mfa"), passkeyRegisterFinishHandler)
+		webOauthServer.GET("webauthn/credentials", passkeyListHandler)
+		webOauthServer.DELETE("webauthn/credentials/:id", passkeyDeleteHandler)
+		webOauthServer.GET("devices", deviceListHandler)
+		webOauthServer.DELETE("devices/:id", deviceSignOutHandler)
+		webOauthServer.GET("identities", identityListHandler)
+		webOauthServer.POST("identities/send", identitySendCodeHandler)
+		webOauthServer.POST("identities/link", identityLinkHandler)
+		webOauthServer.DELETE("identities/:id", s.identityUnbindHandler)
+		webOauthServer.GET("invite-code", limiter.Policy("invite_code"), s.getUserInviteCodeHandler)
+	}
+	if s.AdminToken != "" {
+		admin := r.Group("/oidc-auth/api/v1/admin", middleware.AdminAuth(s.AdminToken))
+		{
+			admin.GET("merges", adminMergeListHandler)
+			admin.GET("merges/:id", adminMergeGetHandler)
+			admin.POST("merges/:id/resume", s.adminMergeResumeHandler)
+			admin.POST("merges/:id/cancel", adminMergeCancelHandler)
+			admin.GET("webhooks/deliveries", adminWebhookListHandler)
+			admin.GET("webhooks/deliveries/:id", adminWebhookGetHandler)
+			admin.POST("webhooks/deliveries/:id/replay", adminWebhookReplayHandler)
+			admin.GET("outbox/events", adminOutboxListHandler)
+			admin.POST("outbox/events/:id/retry", adminOutboxRetryHandler)
+			admin.GET("audit/logs", adminAuditListHandler)
+			admin.GET("audit/logs/export", adminAuditExportHandler)
+		}
 	}
 	r.POST("/oidc-auth/api/v1/send/sms", s.SMSHandler)
+	r.GET("/oidc-auth/api/v1/clients/:client_id", clientInfoHandler)
+	r.POST("/oidc-auth/api/v1/introspect", introspectionHandler)
+	if s.EnableTestEndpoints {
+		s.setupTestRouter(r)
+	}
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
 	health := r.Group("/health")
 	{
 		health.GET("ready", readinessHandler)
 	}
 }
 
+// setupTestRouter exposes what the server would have sent, so end-to-end tests can read the codes.
+// The endpoints hand out login codes, so they are only served to admins.
+func (s *Server) setupTestRouter(r *gin.Engine) {
+	if s.AdminToken == "" {
+		log.Warn(nil, "test endpoints are enabled but no admin token is set, not exposing them")
+		return
+	}
+	test := r.Group("/oidc-auth/api/v1/test", middleware.AdminAuth(s.AdminToken))
+	if _, ok := service.GetSMSSender().(*service.MockSMSSender); ok {
+		// only exposed when codes are not really sent
+		test.GET("sms/messages", mockSMSMessagesHandler)
+		test.DELETE("sms/messages", mockSMSResetHandler)
+	}
+	if _, ok := service.GetMailSender().(*service.MockMailSender); ok {
+		test.GET("email/messages", mockEmailMessagesHandler)
+		test.DELETE("email/messages", mockEmailResetHandler)
+	}
+	if len(localOutboxSinks()) > 0 {
+		test.GET("outbox/events", localOutboxEventsHandler)
+	}
+}
+
 func (s *Server) StartServer() error {
 	r := gin.Default()
+	// gin trusts every proxy by default, which would let any client pick the IP it is limited and audited by
+	if err := r.SetTrustedProxies(s.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
 	s.SetupRouter(r)
 
 	port := ":" + s.ServerPort
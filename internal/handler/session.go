@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// deviceAccessResolution how stale the saved last access of a device may get
+const deviceAccessResolution = 5 * time.Minute
+
+// loginDevice identifies the device a first-party login (SMS code, email, password...) signs in
+type loginDevice struct {
+	ClientID      string
+	Platform      string
+	Provider      string
+	MachineCode   string
+	VscodeVersion string
+	PluginVersion string
+	UriScheme     string
+	// MultiFactor the login proved a second factor itself, like a passkey with user verification
+	MultiFactor bool
+}
+
+// issueSession attaches the device to the user, issues its token pair and marks it logged in.
+// A user without an ID is created. When the user needs a second factor no tokens are issued;
+// the device waits behind the returned challenge instead.
+func issueSession(ctx context.Context, user *repository.AuthUser, login loginDevice) (*utils.TokenPair, *repository.MFAChallenge, error) {
+	return issueSessionWithChallenge(ctx, user, login, repository.MFAChallenge{})
+}
+
+// issueSessionWithChallenge is issueSession with the redirect of the second factor challenge
+func issueSessionWithChallenge(ctx context.Context, user *repository.AuthUser, login loginDevice,
+	challenge repository.MFAChallenge) (*utils.TokenPair, *repository.MFAChallenge, error) {
+	created := user.ID == uuid.Nil
+	index, err := attachDevice(user, login)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !login.MultiFactor {
+		challenge.IssueTokens = true
+		pending, err := requireMFA(ctx, user, index, challenge)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pending != nil {
+			return nil, pending, sessionSaved(ctx, user, created)
+		}
+	}
+	tokenPair, err := generateTokenPair(ctx, user, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index, err = admitDevice(ctx, user, index, tokenPair); err != nil {
+		return nil, nil, err
+	}
+	if err := sessionSaved(ctx, user, created); err != nil {
+		return nil, nil, err
+	}
+	webhook.UserLogin(ctx, user, &user.Devices[index])
+	audit.Login(ctx, user, &user.Devices[index])
+	return tokenPair, nil, nil
+}
+
+// admitDevice logs in the device at index with its token pair, or with the tokens it has when
+// the pair is nil, and saves it. The session limit of the user is applied while the user is
+// locked, so concurrent logins cannot exceed it together; the devices evicted to make room are
+// announced once saved. It returns the index of the device on the saved user.
+func admitDevice(ctx context.Context, user *repository.AuthUser, index int, tokenPair *utils.TokenPair) (int, error) {
+	var evicted []int
+	provider := user.Devices[index].Provider
+	index, err := repository.GetDB().SaveUserDevice(ctx, user, index,
+		func(user *repository.AuthUser, index int, _ *repository.Device) error {
+			var err error
+			if evicted, err = service.EnforceSessionLimit(user, index); err != nil {
+				return err
+			}
+			now := time.Now()
+			user.Devices[index].Status = constants.LoginStatusLoggedIn
+			user.Devices[index].AuthenticatedAt = &now
+			if tokenPair != nil {
+				updateUserInfoMid(user, index, tokenPair)
+			}
+			return nil
+		})
+	if errors.Is(err, service.ErrSessionLimit) {
+		audit.LoginFailed(ctx, user, provider, err)
+		return -1, err
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to save session: %w", err)
+	}
+	announceEvictions(ctx, user, evicted)
+	return index, nil
+}
+
+// announceEvictions emits the logout of the devices the session limit evicted
+func announceEvictions(ctx context.Context, user *repository.AuthUser, evicted []int) {
+	for _, i := range evicted {
+		webhook.DeviceLoggedOut(ctx, user, &user.Devices[i])
+		audit.ForcedLogout(ctx, user, &user.Devices[i], "session limit reached")
+	}
+}
+
+// handleSessionError writes the error of a login that could not issue its session
+func handleSessionError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrSessionLimit) {
+		response.HandleError(c, http.StatusConflict, errs.ErrSessionLimit, err)
+		return
+	}
+	response.HandleError(c, http.StatusInternalServerError, errs.ErrTokenGenerate, err)
+}
+
+// writeSession responds with the tokens of a first-party login, or with the challenge
+// the client has to complete at login/mfa/verify to get them
+func writeSession(c *gin.Context, tokenPair *utils.TokenPair, challenge *repository.MFAChallenge) {
+	if challenge != nil {
+		response.JSONSuccess(c, "", gin.H{
+			"mfa_required": true,
+			"challenge":    challenge.ID.String(),
+			"expires_at":   challenge.ExpiresAt.Unix(),
+		})
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"access_token":  tokenPair.AccessToken,
+		"refresh_token": tokenPair.RefreshToken,
+		"token_type":    tokenType(tokenPair),
+	})
+}
+
+// startPendingSession attaches the device to the user as logged out with the login state,
+// so the plugin collects its tokens by polling the token endpoint like after an OAuth login.
+// A user without an ID is created.
+func startPendingSession(ctx context.Context, user *repository.AuthUser, login loginDevice, state string) error {
+	created := user.ID == uuid.Nil
+	index, err := attachDevice(user, login)
+	if err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	// saved while the user is locked like a login, so concurrent logins of other devices are kept
+	_, err = repository.GetDB().SaveUserDevice(ctx, user, index,
+		func(user *repository.AuthUser, index int, _ *repository.Device) error {
+			device := &user.Devices[index]
+			device.Status = constants.LoginStatusLoggedOut
+			device.State = state
+			device.AccessToken = ""
+			device.AccessTokenHash = ""
+			device.RefreshToken = ""
+			device.RefreshTokenHash = ""
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return sessionSaved(ctx, user, created)
+}
+
+// sessionSaved links the identities of a user saved by a login and announces a created user
+func sessionSaved(ctx context.Context, user *repository.AuthUser, created bool) error {
+	if err := linkIdentities(ctx, user); err != nil {
+		return err
+	}
+	if created {
+		webhook.UserCreated(ctx, user)
+		audit.InviteRedeemed(ctx, user)
+	}
+	return nil
+}
+
+// linkIdentities links the phone number or email a saved user logged in with, so the next login
+// with it finds the same account
+func linkIdentities(ctx context.Context, user *repository.AuthUser) error {
+	if err := repository.GetDB().SyncUserIdentities(ctx, user); err != nil {
+		return fmt.Errorf("failed to link identities: %w", err)
+	}
+	return nil
+}
+
+// attachDevice finds or appends the login device on the user and returns its index.
+// A user without an ID gets one.
+func attachDevice(user *repository.AuthUser, login loginDevice) (int, error) {
+	now := time.Now()
+	if user.ID == uuid.Nil {
+		userCode, err := utils.GenerateRandomString(16)
+		if err != nil {
+			return -1, err
+		}
+		user.ID = uuid.New()
+		user.CreatedAt = now
+		user.UserCode = userCode
+	}
+	if login.Platform == "web" {
+		// the same identifiers as web devices created by the OAuth login
+		login.MachineCode = "web-" + user.ID.String()[:8]
+		login.VscodeVersion = "web-browser"
+		login.PluginVersion = "1.0.0"
+		login.UriScheme = "https"
+	}
+
+	index := findDeviceIndex(user, login.MachineCode, login.VscodeVersion)
+	if index == -1 {
+		deviceCode, err := utils.GenerateRandomString(16)
+		if err != nil {
+			return -1, err
+		}
+		user.Devices = append(user.Devices, repository.Device{
+			ID:            uuid.New(),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			MachineCode:   login.MachineCode,
+			VSCodeVersion: login.VscodeVersion,
+			DeviceCode:    deviceCode,
+		})
+		index = len(user.Devices) - 1
+	}
+	device := &user.Devices[index]
+	device.UpdatedAt = now
+	device.PluginVersion = login.PluginVersion
+	device.UriScheme = login.UriScheme
+	device.Provider = login.Provider
+	device.Platform = login.Platform
+	device.ClientID = login.ClientID
+	device.TokenProvider = "" // tokens are issued by this server
+	device.State = ""
+	return index, nil
+}
+
+// signOutDevices logs out every device of the user except the one at keep (-1 keeps none)
+// and revokes their tokens
+func signOutDevices(ctx context.Context, user *repository.AuthUser, keep int) error {
+	var kept uuid.UUID
+	if keep >= 0 {
+		kept = user.Devices[keep].ID
+	}
+	_, err := signOutDevicesWhere(ctx, user, func(device *repository.Device) bool {
+		return keep < 0 || device.ID != kept
+	})
+	return err
+}
+
+// signOutDevicesWhere logs out the selected devices of the user and revokes their tokens. The
+// devices are selected among the stored ones while the user is locked, so a device logging in
+// meanwhile is not missed and nothing else of the user is overwritten. It returns the indexes
+// of the selected devices that were logged in.
+func signOutDevicesWhere(ctx context.Context, user *repository.AuthUser, selected func(device *repository.Device) bool) ([]int, error) {
+	var signedIn []int
+	err := repository.GetDB().UpdateUserDevices(ctx, user, func(devices []repository.Device) error {
+		now := time.Now()
+		signedIn = nil
+		for i := range devices {
+			device := &devices[i]
+			if !selected(device) {
+				continue
+			}
+			if device.Status == constants.LoginStatusLoggedIn {
+				signedIn = append(signedIn, i)
+			}
+			device.Status = constants.LoginStatusLoggedOffline
+			device.AccessToken = ""
+			device.AccessTokenHash = ""
+			device.RefreshToken = ""
+			device.RefreshTokenHash = ""
+			device.State = ""
+			device.UpdatedAt = now
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign out devices: %w", err)
+	}
+	for _, i := range signedIn {
+		webhook.DeviceLoggedOut(ctx, user, &user.Devices[i])
+	}
+	return signedIn, nil
+}
+
+// touchDevice saves the last access of a device using its access token, at most once per
+// deviceAccessResolution so reads do not each write the user
+func touchDevice(ctx context.Context, user *repository.AuthUser, index int) {
+	now := time.Now()
+	device := user.Devices[index]
+	if device.LastAccessAt != nil && now.Sub(*device.LastAccessAt) < deviceAccessResolution {
+		return
+	}
+	err := repository.GetDB().UpdateUserDevices(ctx, user, func(devices []repository.Device) error {
+		for i := range devices {
+			if devices[i].ID == device.ID {
+				devices[i].LastAccessAt = &now
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn(nil, "failed to save the last access of device %s: %v", device.ID, err)
+	}
+}
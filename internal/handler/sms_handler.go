@@ -1,13 +1,26 @@
 package handler
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
 	"github.com/zgsm-ai/oidc-auth/pkg/response"
 )
 
@@ -16,7 +29,55 @@ type ResponseBody struct {
 	Msg    string `json:"msg,omitempty"`
 }
 
+// smsCallerMaxSkew how far the X-Timestamp of a signed SMS request may be from now
+const smsCallerMaxSkew = 5 * time.Minute
+
+// authenticateSMSCaller checks the shared secret or HMAC signature of a /send/sms request.
+// It must run before the form is parsed, because the signature covers the raw body.
+func authenticateSMSCaller(c *gin.Context, secret string) error {
+	if signature := c.GetHeader("X-Signature"); signature != "" {
+		timestamp := c.GetHeader("X-Timestamp")
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("invalid X-Timestamp")
+		}
+		if skew := time.Since(time.Unix(unix, 0)); skew > smsCallerMaxSkew || skew < -smsCallerMaxSkew {
+			return errors.New("X-Timestamp is too old")
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + string(body)))
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	provided := c.GetHeader("X-SMS-Secret")
+	if provided == "" {
+		provided = c.Query("secret")
+	}
+	if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) != 1 {
+		return errors.New("invalid caller secret")
+	}
+	return nil
+}
+
 func (s *Server) SMSHandler(c *gin.Context) {
+	if secret := service.GetSMSCfg(nil).CallerSecret; secret != "" {
+		if err := authenticateSMSCaller(c, secret); err != nil {
+			service.RecordSMSRejected("auth")
+			log.Warn(c, "rejected sms request from %s: %v", c.ClientIP(), err)
+			response.JSONError(c, http.StatusUnauthorized, errs.ErrAuthentication, "sms caller authentication failed")
+			return
+		}
+	}
 	contentType := c.ContentType()
 
 	var phoneNumber string
@@ -51,18 +112,52 @@ func (s *Server) SMSHandler(c *gin.Context) {
 		response.JSONError(c, http.StatusBadRequest, "", errmsg)
 		return
 	}
-	SMSCfg := service.GetSMSCfg(nil)
-	if SMSCfg.EnabledTest {
-		log.Info(c, "processed request to send SMS to: %s, content: %s", phoneNumber, messageContent)
-		log.Info(c, "simulating SMS sent to %s with content: %s", phoneNumber, messageContent)
-	} else {
-		err := service.SendSMS(phoneNumber, messageContent)
+	normalized, err := phone.Normalize(phoneNumber)
+	if err != nil {
+		log.Error(c, "invalid phone number %s: %v", phoneNumber, err)
+		response.JSONError(c, http.StatusBadRequest, "", "invalid phone number")
+		return
+	}
+	phoneNumber = normalized
+	if err := service.GuardSMS(c.Request.Context(), phoneNumber, c.ClientIP()); err != nil {
+		handleSMSError(c, err)
+		return
+	}
+	if err := service.SendSMS(audit.WithClient(c.Request.Context(), requestClient(c)), phoneNumber, messageContent); err != nil {
+		log.Error(c, "failed to send SMS to %s, error: %v", phoneNumber, err)
+		response.JSONError(c, http.StatusInternalServerError, "", "failed to send sms")
+		return
+	}
+	log.Info(c, "successfully sent SMS to %s for verification", phoneNumber)
+	c.JSON(http.StatusOK, ResponseBody{Status: "ok", Msg: "SMS sent successfully"})
+}
+
+// mockSMSMessagesHandler lists the messages recorded by the mock SMS sender, for integration tests
+func mockSMSMessagesHandler(c *gin.Context) {
+	sender, ok := service.GetSMSSender().(*service.MockSMSSender)
+	if !ok {
+		response.JSONError(c, http.StatusNotFound, "", "mock sms sender is not enabled")
+		return
+	}
+	phoneNumber := c.DefaultQuery("phone", "")
+	if phoneNumber != "" {
+		normalized, err := phone.Normalize(phoneNumber)
 		if err != nil {
-			log.Error(c, "failed to send SMS to %s, error: %v", phoneNumber, err)
-			response.JSONError(c, http.StatusInternalServerError, "", "failed to send sms")
+			response.JSONError(c, http.StatusBadRequest, "", "invalid phone number")
 			return
 		}
-		log.Info(c, "successfully sent SMS to %s for verification", phoneNumber)
+		phoneNumber = normalized
+	}
+	response.JSONSuccess(c, "", gin.H{"messages": sender.Messages(phoneNumber)})
+}
+
+// mockSMSResetHandler clears the messages recorded by the mock SMS sender
+func mockSMSResetHandler(c *gin.Context) {
+	sender, ok := service.GetSMSSender().(*service.MockSMSSender)
+	if !ok {
+		response.JSONError(c, http.StatusNotFound, "", "mock sms sender is not enabled")
+		return
 	}
-	c.JSON(http.StatusOK, ResponseBody{Status: "ok", Msg: "simulated SMS sent successfully"})
+	sender.Reset()
+	response.JSONSuccess(c, "", nil)
 }
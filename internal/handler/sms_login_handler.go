@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+type smsSendRequest struct {
+	Phone string `json:"phone" binding:"required"`
+}
+
+type smsVerifyRequest struct {
+	Phone         string `json:"phone" binding:"required"`
+	Code          string `json:"code" binding:"required"`
+	ClientID      string `json:"client_id"`
+	MachineCode   string `json:"machine_code"`
+	VscodeVersion string `json:"vscode_version"`
+	PluginVersion string `json:"plugin_version"`
+	UriScheme     string `json:"uri_scheme"`
+	InviterCode   string `json:"inviter_code"`
+}
+
+// smsCodeErrorStatus maps SMS code errors to HTTP status codes
+func smsCodeErrorStatus(err error) (int, string) {
+	var rateLimitErr *service.SMSRateLimitError
+	switch {
+	case errors.Is(err, phone.ErrInvalid):
+		return http.StatusBadRequest, errs.ErrBadRequestParam
+	case errors.Is(err, service.ErrSMSRegionNotAllowed):
+		return http.StatusForbidden, errs.ErrSMSSend
+	case errors.Is(err, service.ErrSMSCodeResendTooSoon), errors.As(err, &rateLimitErr):
+		return http.StatusTooManyRequests, errs.ErrTooManyRequests
+	case errors.Is(err, service.ErrSMSCodeInvalid),
+		errors.Is(err, service.ErrSMSCodeExpired),
+		errors.Is(err, service.ErrSMSCodeTooManyTries):
+		return http.StatusUnauthorized, errs.ErrSMSCode
+	default:
+		return http.StatusInternalServerError, errs.ErrSMSSend
+	}
+}
+
+// handleSMSError writes an SMS error response, telling rate limited callers when to retry
+func handleSMSError(c *gin.Context, err error) {
+	var rateLimitErr *service.SMSRateLimitError
+	if errors.As(err, &rateLimitErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+	}
+	status, code := smsCodeErrorStatus(err)
+	response.HandleError(c, status, code, err)
+}
+
+// smsSendCodeHandler sends a one-time login code to a phone number
+func smsSendCodeHandler(c *gin.Context) {
+	var req smsSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	phoneNumber, err := phone.Normalize(req.Phone)
+	if err != nil {
+		handleSMSError(c, err)
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+	if err := service.GuardSMS(ctx, phoneNumber, c.ClientIP()); err != nil {
+		handleSMSError(c, err)
+		return
+	}
+
+	issue, err := service.IssueSMSCode(ctx, phoneNumber, constants.SMSPurposeLogin)
+	if err != nil {
+		handleSMSError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", gin.H{
+		"phone":      issue.Phone,
+		"expires_at": issue.ExpiresAt.Unix(),
+	})
+}
+
+// smsVerifyCodeHandler logs in with a one-time code, creating the account on first login
+func smsVerifyCodeHandler(c *gin.Context) {
+	var req smsVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	platform := c.DefaultQuery("platform", "")
+	if platform == "plugin" {
+		if req.MachineCode == "" || req.VscodeVersion == "" {
+			response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
+				errs.ParamNeedErr("machine_code and vscode_version").Error())
+			return
+		}
+	}
+	client, err := resolveClient(c, req.ClientID, platform, constants.GrantSMSCode)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return
+	}
+	if err := service.AuthenticateClient(client, getClientSecret(c)); err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrInvalidClient, err)
+		return
+	}
+	if req.UriScheme != "" {
+		if err := validateClientRedirect(client, req.UriScheme, ""); err != nil {
+			response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidRedirect, err)
+			return
+		}
+	}
+
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	phoneNumber, err := service.VerifySMSCode(ctx, req.Phone, constants.SMSPurposeLogin, req.Code)
+	if err != nil {
+		audit.LoginFailed(ctx, nil, constants.ProviderSMS, err)
+		handleSMSError(c, err)
+		return
+	}
+
+	user, err := findOrNewPhoneUser(ctx, phoneNumber, req.InviterCode)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrUserNotFound, err)
+		return
+	}
+	tokenPair, challenge, err := issueSession(ctx, user, loginDevice{
+		ClientID:      client.ClientID,
+		Platform:      platform,
+		Provider:      constants.ProviderSMS,
+		MachineCode:   req.MachineCode,
+		VscodeVersion: req.VscodeVersion,
+		PluginVersion: req.PluginVersion,
+		UriScheme:     req.UriScheme,
+	})
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	writeSession(c, tokenPair, challenge)
+}
+
+// findOrNewPhoneUser returns the account of a verified phone number, or a new unsaved one.
+// An inviter code is only accepted for new accounts.
+func findOrNewPhoneUser(ctx context.Context, phoneNumber, inviterCode string) (*repository.AuthUser, error) {
+	user, err := repository.GetDB().GetUserByPhone(ctx, phoneNumber)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, err)
+	}
+	if user != nil {
+		if inviterCode != "" {
+			return nil, fmt.Errorf("you have registered")
+		}
+		return user, nil
+	}
+
+	user = &repository.AuthUser{
+		Name:          phoneNumber,
+		Phone:         phoneNumber,
+		PhoneVerified: true,
+	}
+	if inviterCode != "" {
+		inviter, err := utils.ValidateInviteCode(ctx, inviterCode)
+		if err != nil {
+			return nil, err
+		}
+		user.InviterID = &inviter.ID
+	}
+	return user, nil
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 	"github.com/zgsm-ai/oidc-auth/pkg/response"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
@@ -19,7 +21,7 @@ import (
 func logoutHandler(c *gin.Context) {
 	platform := c.DefaultQuery("platform", "")
 	if platform == "plugin" {
-		accessToken, err := getTokenFromHeader(c)
+		accessToken, err := getAccessTokenFromHeader(c)
 		if err != nil {
 			response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
 			return
@@ -27,7 +29,9 @@ func logoutHandler(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		user, index, err := utils.GetUserByTokenHash(ctx, accessToken, "access_token_hash")
-		if err != nil {
+		// an evicted device is already signed out and only clears what is left of its session
+		evicted := errors.Is(err, utils.ErrSessionEvicted)
+		if err != nil && !evicted {
 			response.HandleError(c, http.StatusBadRequest, errs.ErrTokenInvalid,
 				fmt.Errorf("%s, %s", errs.ErrInfoQueryUserInfo, err))
 			return
@@ -48,6 +52,9 @@ func logoutHandler(c *gin.Context) {
 				fmt.Errorf("%s, %s", errs.ErrInfoUpdateUserInfo, err))
 			return
 		}
+		if !evicted {
+			webhook.DeviceLoggedOut(ctx, user, &user.Devices[index])
+		}
 	}
 	response.JSONSuccess(c, "", gin.H{
 		"state":  c.DefaultQuery("state", ""),
@@ -64,7 +71,7 @@ func statusHandler(c *gin.Context) {
 			"device must be vscode plugin")
 		return
 	}
-	accessToken, err := getTokenFromHeader(c)
+	accessToken, err := getAccessTokenFromHeader(c)
 	if err != nil {
 		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam,
 			errs.ParamNeedErr("access_token").Error())
@@ -78,9 +85,15 @@ func statusHandler(c *gin.Context) {
 			errs.ErrInfoInvalidToken)
 		return
 	}
-	status := user.Devices[index].Status
-	response.JSONSuccess(c, fmt.Sprintf("the user is %s", status), gin.H{
+	data := gin.H{
 		"state":  c.DefaultQuery("state", ""),
-		"status": status,
-	})
+		"status": user.Devices[index].Status,
+	}
+	if errors.Is(err, utils.ErrSessionEvicted) {
+		// tells the plugin why it was signed out rather than just failing its next request
+		data["reason"] = err.Error()
+	} else {
+		touchDevice(ctx, user, index)
+	}
+	response.JSONSuccess(c, fmt.Sprintf("the user is %s", data["status"]), data)
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -9,9 +10,12 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/providers"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 	"github.com/zgsm-ai/oidc-auth/pkg/response"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
@@ -34,10 +38,26 @@ func tokenHandler(c *gin.Context) {
 			errs.ParamNeedErr("state").Error())
 		return
 	}
+	evidence, err := requestDeviceEvidence(c)
+	if err != nil {
+		response.JSONError(c, http.StatusUnauthorized, errs.ErrDeviceProof, err.Error())
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, shortTimeout)
+	defer cancel()
 	// if MachineCode is provided, get the token for the first time
 	// the account should have been pre-registered.
 	if query.MachineCode != "" {
-		tokenPair, code, err := firstGetToken(query.MachineCode, query.VscodeVersion, query.State)
+		tokenPair, code, err := firstGetToken(ctx, query.MachineCode, query.VscodeVersion, query.State,
+			getClientSecret(c), evidence)
+		if errors.Is(err, service.ErrSessionLimit) {
+			response.JSONError(c, code, errs.ErrSessionLimit, err.Error())
+			return
+		}
+		if deviceRejected(err) {
+			writeDeviceRejection(c, err)
+			return
+		}
 		if err != nil {
 			response.JSONError(c, code, errs.ErrTokenGenerate, err.Error())
 			return
@@ -50,6 +70,7 @@ func tokenHandler(c *gin.Context) {
 		response.JSONSuccess(c, "", gin.H{
 			"access_token":  tokenPair.AccessToken,
 			"refresh_token": tokenPair.RefreshToken,
+			"token_type":    tokenPair.TokenType,
 			"state":         c.DefaultQuery("state", ""),
 		})
 		return
@@ -59,7 +80,11 @@ func tokenHandler(c *gin.Context) {
 		response.JSONError(c, http.StatusUnauthorized, errs.ErrAuthentication, err.Error())
 		return
 	}
-	tokenPair, code, err := tokenRefresh(refreshToken)
+	tokenPair, code, err := tokenRefresh(ctx, refreshToken, getClientSecret(c), evidence)
+	if deviceRejected(err) {
+		writeDeviceRejection(c, err)
+		return
+	}
 	if err != nil {
 		response.JSONError(c, code, errs.ErrTokenInvalid, err.Error())
 		return
@@ -72,16 +97,16 @@ func tokenHandler(c *gin.Context) {
 	response.JSONSuccess(c, "", gin.H{
 		"access_token":  tokenPair.AccessToken,
 		"refresh_token": tokenPair.RefreshToken,
+		"token_type":    tokenPair.TokenType,
 		"state":         c.DefaultQuery("state", ""),
 	})
 }
 
-func firstGetToken(machineCode, vscodeVersion, state string) (*utils.TokenPair, int, error) {
+func firstGetToken(ctx context.Context, machineCode, vscodeVersion, state, clientSecret string,
+	evidence deviceEvidence) (*utils.TokenPair, int, error) {
 	if vscodeVersion == "" {
 		return nil, http.StatusUnauthorized, errs.ParamNeedErr("vscode_version")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 	db := repository.GetDB()
 	user, err := db.GetUserByDeviceConditions(ctx, map[string]any{
 		"machine_code":   machineCode,
@@ -104,6 +129,18 @@ func firstGetToken(machineCode, vscodeVersion, state string) (*utils.TokenPair,
 	if index == -1 {
 		return nil, http.StatusUnauthorized, errs.ErrInfoInvalidToken
 	}
+	client, err := deviceClient(ctx, &user.Devices[index])
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := service.AuthenticateClient(client, clientSecret); err != nil {
+		audit.LoginFailed(ctx, user, user.Devices[index].Provider, err)
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := attestDevice(ctx, &user.Devices[index], evidence); err != nil {
+		audit.LoginFailed(ctx, user, user.Devices[index].Provider, err)
+		return nil, http.StatusUnauthorized, err
+	}
 
 	tokenPair, err := generateTokenPair(ctx, user, index)
 	if err != nil {
@@ -112,51 +149,94 @@ func firstGetToken(machineCode, vscodeVersion, state string) (*utils.TokenPair,
 	if tokenPair == nil {
 		return nil, http.StatusInternalServerError, errs.ErrInfoGenerateToken
 	}
-
-	user.Devices[index].Status = constants.LoginStatusLoggedIn
-	if err := updateUserAndSave(ctx, user, index, tokenPair); err != nil {
+	if index, err = admitDevice(ctx, user, index, tokenPair); err != nil {
+		if errors.Is(err, service.ErrSessionLimit) {
+			return nil, http.StatusConflict, err
+		}
 		return nil, http.StatusInternalServerError, err
 	}
+	webhook.UserLogin(ctx, user, &user.Devices[index])
+	audit.Login(ctx, user, &user.Devices[index])
 
 	return &utils.TokenPair{
 		AccessToken:  tokenPair.AccessToken,
 		RefreshToken: tokenPair.RefreshToken,
+		TokenType:    tokenType(tokenPair),
 	}, http.StatusOK, nil
 }
 
-func tokenRefresh(refreshToken string) (*utils.TokenPair, int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
+func tokenRefresh(ctx context.Context, refreshToken, clientSecret string, evidence deviceEvidence) (*utils.TokenPair, int, error) {
 	user, index, err := utils.GetUserByTokenHash(ctx, refreshToken, "refresh_token_hash")
 	if err != nil {
 		return nil, http.StatusUnauthorized, err
 	}
 	if user == nil {
+		audit.TokenRefresh(ctx, nil, nil, errs.ErrInfoInvalidToken)
 		return nil, http.StatusUnauthorized, errs.ErrInfoInvalidToken
 	}
+	device := &user.Devices[index]
+	client, err := deviceClient(ctx, device)
+	if err != nil {
+		audit.TokenRefresh(ctx, user, device, err)
+		return nil, http.StatusUnauthorized, err
+	}
+	if !client.AllowsGrant(constants.GrantRefreshToken) {
+		err := fmt.Errorf("client %s is not allowed to refresh tokens", client.ClientID)
+		audit.TokenRefresh(ctx, user, device, err)
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := service.AuthenticateClient(client, clientSecret); err != nil {
+		audit.TokenRefresh(ctx, user, device, err)
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := checkTokenBinding(refreshToken, evidence.keyThumbprint); err != nil {
+		audit.TokenRefresh(ctx, user, device, err)
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := assessRefresh(ctx, user, index, evidence); err != nil {
+		audit.TokenRefresh(ctx, user, device, err)
+		if deviceRejected(err) {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
 
 	tokenPair, err := generateTokenPair(ctx, user, index)
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
-	if err := updateUserAndSave(ctx, user, index, tokenPair); err != nil {
+	if index, err = updateUserAndSave(ctx, user, index, tokenPair); err != nil {
+		if errors.Is(err, errs.ErrInfoInvalidToken) {
+			audit.TokenRefresh(ctx, user, device, err)
+			return nil, http.StatusUnauthorized, err
+		}
 		return nil, http.StatusInternalServerError, err
 	}
+	audit.TokenRefresh(ctx, user, &user.Devices[index], nil)
 
 	return &utils.TokenPair{
 		AccessToken:  tokenPair.AccessToken,
 		RefreshToken: tokenPair.RefreshToken,
+		TokenType:    tokenType(tokenPair),
 	}, http.StatusOK, nil
 }
 
 func generateTokenPair(ctx context.Context, user *repository.AuthUser, index int) (*utils.TokenPair, error) {
-	if user.Devices[index].TokenProvider == "custom" {
-		return GenerateTokenPairByCustom(ctx, user, index)
+	if device := &user.Devices[index]; device.TokenProvider == "custom" {
+		if device.Attestation.KeyThumbprint == "" {
+			return GenerateTokenPairByCustom(ctx, user, index)
+		}
+		// the tokens of the upstream provider cannot carry the thumbprint of the device key,
+		// a device bound to one gets the tokens of this server from now on
+		device.TokenProvider = ""
 	}
 
-	tokenPair, err := utils.GenerateTokenPairByUser(user, index)
+	client, err := deviceClient(ctx, &user.Devices[index])
+	if err != nil {
+		return nil, fmt.Errorf("%s, %v", errs.ErrInfoGenerateToken, err)
+	}
+	tokenPair, err := utils.GenerateTokenPairByClient(user, index, client)
 	if err != nil || tokenPair == nil {
 		return nil, fmt.Errorf("%s, %v", errs.ErrInfoGenerateToken, err)
 	}
@@ -176,12 +256,21 @@ func findDeviceIndex(user *repository.AuthUser, machineCode, vscodeVersion strin
 	return -1
 }
 
-func updateUserAndSave(ctx context.Context, user *repository.AuthUser, index int, tokenPair *utils.TokenPair) error {
+// updateUserAndSave saves the refreshed token pair of the device at index, unless the device was
+// signed out, evicted or refreshed meanwhile, which the stored refresh token hash tells. It returns
+// the index of the device on the saved user.
+func updateUserAndSave(ctx context.Context, user *repository.AuthUser, index int, tokenPair *utils.TokenPair) (int, error) {
 	if user == nil || len(user.Devices) <= index {
-		return errs.ErrInfoUpdateUserInfo
-	}
-	updateUserInfoMid(user, index, tokenPair)
-	return repository.GetDB().Upsert(ctx, user, constants.DBIndexField, user.ID)
+		return -1, errs.ErrInfoUpdateUserInfo
+	}
+	return repository.GetDB().SaveUserDevice(ctx, user, index,
+		func(user *repository.AuthUser, index int, stored *repository.Device) error {
+			if stored == nil || stored.RefreshTokenHash != user.Devices[index].RefreshTokenHash {
+				return errs.ErrInfoInvalidToken
+			}
+			updateUserInfoMid(user, index, tokenPair)
+			return nil
+		})
 }
 
 func updateUserInfoMid(user *repository.AuthUser, index int, tokenPair *utils.TokenPair) {
@@ -189,9 +278,11 @@ func updateUserInfoMid(user *repository.AuthUser, index int, tokenPair *utils.To
 	refreshTokenNew := tokenPair.RefreshToken
 	refreshTokenHash := utils.HashToken(refreshTokenNew)
 	accessTokenHash := utils.HashToken(accessTokenNew)
-	user.UpdatedAt = time.Now()
-	user.AccessTime = time.Now()
-	user.Devices[index].UpdatedAt = time.Now()
+	now := time.Now()
+	user.UpdatedAt = now
+	user.AccessTime = now
+	user.Devices[index].UpdatedAt = now
+	user.Devices[index].LastAccessAt = &now
 	user.Devices[index].AccessToken = accessTokenNew
 	user.Devices[index].RefreshToken = refreshTokenNew
 	user.Devices[index].AccessTokenHash = accessTokenHash
@@ -229,7 +320,7 @@ func getTokenFromHeader(c *gin.Context) (string, error) {
 	if len(parts) == 1 {
 		return parts[0], nil
 	}
-	if !(len(parts) == 2 && parts[0] == "Bearer") {
+	if !(len(parts) == 2 && (parts[0] == utils.TokenTypeBearer || parts[0] == utils.TokenTypeDPoP)) {
 		return "", errs.ParamNeedErr("Bearer")
 	}
 
@@ -237,6 +328,14 @@ func getTokenFromHeader(c *gin.Context) (string, error) {
 	return tokenString, nil
 }
 
+// tokenType the scheme a token pair is presented with; tokens of an upstream provider are bearer tokens
+func tokenType(tokenPair *utils.TokenPair) string {
+	if tokenPair.TokenType == "" {
+		return utils.TokenTypeBearer
+	}
+	return tokenPair.TokenType
+}
+
 func GenerateTokenPairByCustom(ctx context.Context, user *repository.AuthUser, index int) (*utils.TokenPair, error) {
 	if user == nil {
 		return nil, fmt.Errorf("parameter user is nil")
@@ -244,6 +343,9 @@ func GenerateTokenPairByCustom(ctx context.Context, user *repository.AuthUser, i
 	if len(user.Devices) <= index {
 		return nil, fmt.Errorf("device not found")
 	}
+	if user.Devices[index].Attestation.KeyThumbprint != "" {
+		return nil, fmt.Errorf("the device is bound to a key, which upstream tokens cannot carry")
+	}
 	refreshToken := user.Devices[index].RefreshToken
 	provider := user.Devices[index].Provider
 	oauthManager := providers.GetManager()
@@ -4,14 +4,18 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/providers"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/errs"
 	"github.com/zgsm-ai/oidc-auth/pkg/response"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
@@ -26,6 +30,16 @@ type WebParameterCarrier struct {
 func (s *Server) webLoginHandler(c *gin.Context) {
 	provider := c.DefaultQuery("provider", "casdoor")
 	inviterCode := c.DefaultQuery("inviter_code", "")
+	var authQuery authQuery
+	if err := c.ShouldBindQuery(&authQuery); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err)
+		return
+	}
+
+	if _, err := resolveClient(c, constants.DefaultWebClientID, "web", constants.GrantAuthorizationCode); err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return
+	}
 
 	oauthManager := providers.GetManager()
 	providerInstance, err := oauthManager.GetProvider(provider)
@@ -36,7 +50,8 @@ func (s *Server) webLoginHandler(c *gin.Context) {
 
 	// Use inviterCode as state parameter
 	state := inviterCode
-	authURL := providerInstance.GetAuthURL(state, s.BaseURL+constants.WebLoginCallbackURI)
+	authURL := providerInstance.GetAuthURL(state, s.BaseURL+constants.WebLoginCallbackURI,
+		authQuery.authURLOptions()...)
 
 	response.JSONSuccess(c, "", map[string]interface{}{
 		"state":        state,
@@ -66,7 +81,7 @@ func (s *Server) webLoginCallbackHandler(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := getRequestContextWithTimeout(c, 15*time.Second)
 	defer cancel()
 
 	// Get user info from OAuth provider
@@ -85,14 +100,7 @@ func (s *Server) webLoginCallbackHandler(c *gin.Context) {
 	// Handle inviter code validation based on user status
 	if inviterCode != "" {
 		// Check if this is a new user (first time login)
-		var existingUser *repository.AuthUser
-		if user.GithubID != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "github_id", user.GithubID)
-		} else if user.Phone != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "phone", user.Phone)
-		} else if user.Email != "" {
-			existingUser, err = repository.GetDB().GetUserByField(ctx, "email", user.Email)
-		}
+		existingUser, err := repository.GetDB().GetUserByIdentities(ctx, user.Identities())
 
 		if err != nil {
 			response.HandleError(c, http.StatusInternalServerError, errs.ErrUserNotFound,
@@ -132,9 +140,49 @@ func (s *Server) webLoginCallbackHandler(c *gin.Context) {
 
 	// Redirect to bind account page with tokenHash as state parameter
 	redirectURL := providerInstance.GetEndpoint(false) + constants.BindAccountBindURI + "?state=" + tokenHash
+	if tokenHash != "" {
+		// the bind page cannot exchange the state for the tokens until the second factor is passed
+		challenge, err := holdProviderLogin(ctx, map[string]any{"access_token_hash": tokenHash},
+			constants.LoginStatusLoggedIn, redirectURL)
+		if err != nil {
+			response.HandleError(c, http.StatusInternalServerError, errs.ErrUpdateInfo, err)
+			return
+		}
+		if challenge != nil {
+			redirectURL = service.MFAChallengeURL(providerInstance.GetEndpoint(false)+constants.MFAChallengePath,
+				challenge.ID.String(), "web")
+		} else if err := admitProviderLogin(ctx, map[string]any{"access_token_hash": tokenHash}); err != nil {
+			handleSessionError(c, err)
+			return
+		}
+	}
 	c.Redirect(http.StatusFound, redirectURL)
 }
 
+// admitProviderLogin logs in the saved device an upstream login signed in with the tokens it got,
+// within the session limit of the user, and announces the login
+func admitProviderLogin(ctx context.Context, conditions map[string]any) error {
+	user, err := repository.GetDB().GetUserByDeviceConditions(ctx, conditions)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errs.ErrInfoQueryUserInfo
+	}
+	index := slices.IndexFunc(user.Devices, func(device repository.Device) bool {
+		return deviceMatches(device, conditions)
+	})
+	if index == -1 {
+		return errs.ErrInfoQueryUserInfo
+	}
+	if index, err = admitDevice(ctx, user, index, nil); err != nil {
+		return err
+	}
+	webhook.UserLogin(ctx, user, &user.Devices[index])
+	audit.Login(ctx, user, &user.Devices[index])
+	return nil
+}
+
 // GetWebUserByOauth gets user info from OAuth provider and processes inviter code for web login
 func GetWebUserByOauth(ctx context.Context, code, provider string) (*repository.AuthUser, error) {
 	oauthManager := providers.GetManager()
@@ -150,7 +198,7 @@ func GetWebUserByOauth(ctx context.Context, code, provider string) (*repository.
 	}
 
 	// Get user info from provider
-	user, err := providerInstance.GetUserInfo(ctx, token.AccessToken)
+	user, err := providerInstance.GetUserInfo(ctx, token)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", errs.ErrInfoQueryUserInfo, err)
 	}
@@ -195,6 +243,7 @@ func GetWebUserByOauth(ctx context.Context, code, provider string) (*repository.
 		AccessTokenHash:  accessTokenHash,
 		State:            "", // Will be set during callback if needed
 		DeviceCode:       "",
+		ClientID:         constants.DefaultWebClientID,
 	})
 
 	// Note: User's own invite code will be generated when they first access the invite-code endpoint
@@ -204,7 +253,7 @@ func GetWebUserByOauth(ctx context.Context, code, provider string) (*repository.
 // getUserInviteCodeHandler gets current user's invite code
 func (s *Server) getUserInviteCodeHandler(c *gin.Context) {
 	// Get token from request header
-	token, err := getTokenFromHeader(c)
+	token, err := getAccessTokenFromHeader(c)
 	if err != nil {
 		response.JSONError(c, http.StatusUnauthorized, errs.ErrAuthentication, "authentication failed: "+err.Error())
 		return
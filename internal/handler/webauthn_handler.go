@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/service"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+)
+
+type passkeyRegisterRequest struct {
+	Session    string                     `json:"session" binding:"required"`
+	Name       string                     `json:"name" binding:"max=100"`
+	Credential service.PasskeyAttestation `json:"credential" binding:"required"`
+}
+
+type passkeyLoginRequest struct {
+	Session    string                   `json:"session" binding:"required"`
+	Credential service.PasskeyAssertion `json:"credential" binding:"required"`
+	ClientID   string                   `json:"client_id"`
+}
+
+type passkeyMFARequest struct {
+	Challenge  string                   `json:"challenge" binding:"required"`
+	Session    string                   `json:"session" binding:"required"`
+	Credential service.PasskeyAssertion `json:"credential" binding:"required"`
+}
+
+// passkeyRegisterBeginHandler returns the options to create a passkey for the signed in user.
+// A passkey is a second factor too, so the device has to have logged in recently.
+func passkeyRegisterBeginHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, index, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	if !service.RecentlyAuthenticated(&user.Devices[index]) {
+		handleMFAError(c, service.ErrReauthRequired)
+		return
+	}
+	ceremony, err := service.BeginPasskeyRegistration(ctx, user.ID, mfaAccountName(user),
+		coalesceString(user.Name, mfaAccountName(user)))
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", ceremony)
+}
+
+// passkeyRegisterFinishHandler stores the passkey created by the browser
+func passkeyRegisterFinishHandler(c *gin.Context) {
+	var req passkeyRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	user, index, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	if !service.RecentlyAuthenticated(&user.Devices[index]) {
+		handleMFAError(c, service.ErrReauthRequired)
+		return
+	}
+	credential, err := service.FinishPasskeyRegistration(ctx, user.ID, req.Session, req.Name, &req.Credential)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", credential)
+}
+
+// passkeyListHandler lists the passkeys of the signed in user
+func passkeyListHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	credentials, err := service.ListPasskeys(ctx, user.ID)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", credentials)
+}
+
+// passkeyDeleteHandler removes a passkey of the signed in user
+func passkeyDeleteHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(shortTimeout)
+	defer cancel()
+
+	user, _, ok := bearerUser(c, ctx)
+	if !ok {
+		return
+	}
+	if err := service.DeletePasskey(ctx, user.ID, c.Param("id")); err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", nil)
+}
+
+// passkeyLoginBeginHandler returns the options of a passwordless login with a discoverable passkey
+func passkeyLoginBeginHandler(c *gin.Context) {
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	ceremony, err := service.BeginPasskeyLogin(ctx)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", ceremony)
+}
+
+// passkeyLoginFinishHandler logs the web manager in with a passkey. A passkey that verified its
+// user is both factors; otherwise the login continues with a second factor challenge.
+func passkeyLoginFinishHandler(c *gin.Context) {
+	var req passkeyLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	client, err := resolveClient(c, req.ClientID, "web", constants.GrantWebAuthn)
+	if err != nil {
+		response.HandleError(c, http.StatusBadRequest, errs.ErrInvalidClient, err)
+		return
+	}
+	if err := service.AuthenticateClient(client, getClientSecret(c)); err != nil {
+		response.HandleError(c, http.StatusUnauthorized, errs.ErrInvalidClient, err)
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	user, userVerified, err := service.FinishPasskeyLogin(ctx, req.Session, &req.Credential)
+	if err != nil {
+		audit.LoginFailed(ctx, nil, constants.ProviderWebAuthn, err)
+		handleMFAError(c, err)
+		return
+	}
+	tokenPair, challenge, err := issueSession(ctx, user, loginDevice{
+		ClientID:    client.ClientID,
+		Platform:    "web",
+		Provider:    constants.ProviderWebAuthn,
+		MultiFactor: userVerified,
+	})
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	writeSession(c, tokenPair, challenge)
+}
+
+// passkeyMFABeginHandler returns the options to pass a login challenge with a passkey of its user
+func passkeyMFABeginHandler(c *gin.Context) {
+	var req mfaChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	ctx, cancel := getContextWithTimeout(defaultTimeout)
+	defer cancel()
+
+	ceremony, err := service.BeginPasskeyMFA(ctx, req.Challenge)
+	if err != nil {
+		handleMFAError(c, err)
+		return
+	}
+	response.JSONSuccess(c, "", ceremony)
+}
+
+// passkeyMFAFinishHandler completes the second factor challenge of a login with a passkey
+func passkeyMFAFinishHandler(c *gin.Context) {
+	var req passkeyMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.JSONError(c, http.StatusBadRequest, errs.ErrBadRequestParam, err.Error())
+		return
+	}
+	ctx, cancel := getRequestContextWithTimeout(c, defaultTimeout)
+	defer cancel()
+
+	challenge, err := service.CompleteMFAChallengeWithPasskey(ctx, req.Challenge, req.Session, &req.Credential)
+	if err != nil {
+		audit.LoginFailed(ctx, nil, "mfa", err)
+		handleMFAError(c, err)
+		return
+	}
+	completeMFALogin(c, ctx, challenge, nil)
+}
@@ -0,0 +1,202 @@
+// Package mapping turns upstream identity claims into AuthUser attributes using declarative rules,
+// so a new identity provider can be onboarded through configuration instead of code.
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Attribute names a mapping can produce
+const (
+	AttrID             = "id"
+	AttrName           = "name"
+	AttrPhone          = "phone"
+	AttrEmail          = "email"
+	AttrGithubID       = "github_id"
+	AttrGithubName     = "github_name"
+	AttrEmployeeNumber = "employee_number"
+	AttrCompany        = "company"
+	AttrLocation       = "location"
+)
+
+var knownAttributes = map[string]struct{}{
+	AttrID: {}, AttrName: {}, AttrPhone: {}, AttrEmail: {}, AttrGithubID: {},
+	AttrGithubName: {}, AttrEmployeeNumber: {}, AttrCompany: {}, AttrLocation: {},
+}
+
+// Rule maps one attribute. Sources are tried in order and the first non-empty value wins;
+// Transforms are then applied to the winning value.
+type Rule struct {
+	Sources    []Source `json:"sources" mapstructure:"sources"`
+	Transforms []string `json:"transforms" mapstructure:"transforms"`
+}
+
+// Source reads a value from the claims.
+// Paths are dot separated, e.g. "properties.oauth_GitHub_id".
+type Source struct {
+	Path       string   `json:"path" mapstructure:"path"`
+	Concat     []string `json:"concat" mapstructure:"concat"` // concatenates several claims instead of reading Path
+	Separator  string   `json:"separator" mapstructure:"separator"`
+	When       string   `json:"when" mapstructure:"when"`     // only used when this claim is present
+	Unless     string   `json:"unless" mapstructure:"unless"` // only used when this claim is absent
+	Transforms []string `json:"transforms" mapstructure:"transforms"`
+}
+
+// Mapper is a compiled set of rules, safe for concurrent use
+type Mapper struct {
+	rules map[string]compiledRule
+}
+
+type compiledRule struct {
+	sources    []compiledSource
+	transforms []transform
+}
+
+type compiledSource struct {
+	Source
+	transforms []transform
+}
+
+// Merge returns base with the attributes in overrides replaced
+func Merge(base, overrides map[string]Rule) map[string]Rule {
+	merged := make(map[string]Rule, len(base)+len(overrides))
+	for attr, rule := range base {
+		merged[attr] = rule
+	}
+	for attr, rule := range overrides {
+		merged[attr] = rule
+	}
+	return merged
+}
+
+// Compile validates the rules and prepares them for Apply
+func Compile(rules map[string]Rule) (*Mapper, error) {
+	m := &Mapper{rules: make(map[string]compiledRule, len(rules))}
+	for attr, rule := range rules {
+		if _, ok := knownAttributes[attr]; !ok {
+			return nil, fmt.Errorf("unknown attribute %q", attr)
+		}
+		if len(rule.Sources) == 0 {
+			return nil, fmt.Errorf("attribute %s: at least one source is required", attr)
+		}
+		compiled := compiledRule{}
+		for i, source := range rule.Sources {
+			if (source.Path == "") == (len(source.Concat) == 0) {
+				return nil, fmt.Errorf("attribute %s source %d: exactly one of path or concat is required", attr, i)
+			}
+			transforms, err := compileTransforms(source.Transforms)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s source %d: %w", attr, i, err)
+			}
+			compiled.sources = append(compiled.sources, compiledSource{Source: source, transforms: transforms})
+		}
+		transforms, err := compileTransforms(rule.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", attr, err)
+		}
+		compiled.transforms = transforms
+		m.rules[attr] = compiled
+	}
+	return m, nil
+}
+
+// Apply maps the claims into attributes; attributes without a value are left out
+func (m *Mapper) Apply(claims map[string]any) (map[string]string, error) {
+	attrs := make(map[string]string, len(m.rules))
+	for attr, rule := range m.rules {
+		value, err := rule.apply(claims)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", attr, err)
+		}
+		if value != "" {
+			attrs[attr] = value
+		}
+	}
+	return attrs, nil
+}
+
+func (r compiledRule) apply(claims map[string]any) (string, error) {
+	for _, source := range r.sources {
+		if source.When != "" && !present(claims, source.When) {
+			continue
+		}
+		if source.Unless != "" && present(claims, source.Unless) {
+			continue
+		}
+		value, err := applyTransforms(source.read(claims), source.transforms)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			return applyTransforms(value, r.transforms)
+		}
+	}
+	return "", nil
+}
+
+func (s compiledSource) read(claims map[string]any) string {
+	if s.Path != "" {
+		value, _ := lookup(claims, s.Path)
+		return stringify(value)
+	}
+	parts := make([]string, 0, len(s.Concat))
+	for _, path := range s.Concat {
+		value, _ := lookup(claims, path)
+		if str := stringify(value); str != "" {
+			parts = append(parts, str)
+		}
+	}
+	return strings.Join(parts, s.Separator)
+}
+
+func lookup(claims map[string]any, path string) (any, bool) {
+	var current any = claims
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// present reports whether the claim exists and is not empty
+func present(claims map[string]any, path string) bool {
+	value, ok := lookup(claims, path)
+	if !ok || value == nil {
+		return false
+	}
+	switch v := value.(type) {
+	case string:
+		return v != ""
+	case map[string]any:
+		return len(v) > 0
+	case []any:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+func stringify(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64) // numeric IDs such as GitHub's must not use exponents
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,281 @@
+package mapping
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+// applyRule maps the claims with a single rule for AttrName and returns its value
+func applyRule(t *testing.T, rule Rule, claims map[string]any) string {
+	t.Helper()
+	m, err := Compile(map[string]Rule{AttrName: rule})
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	attrs, err := m.Apply(claims)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	return attrs[AttrName]
+}
+
+func TestPathLookup(t *testing.T) {
+	claims := map[string]any{
+		"name":    "alice",
+		"number":  float64(12345678901),
+		"json":    json.Number("42"),
+		"active":  true,
+		"list":    []any{"a"},
+		"nothing": nil,
+		"properties": map[string]any{
+			"oauth_GitHub_id": "1001",
+			"nested":          map[string]any{"deep": "value"},
+		},
+	}
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"top level", "name", "alice"},
+		{"nested", "properties.oauth_GitHub_id", "1001"},
+		{"deeply nested", "properties.nested.deep", "value"},
+		{"large number without exponent", "number", "12345678901"},
+		{"json number", "json", "42"},
+		{"bool", "active", "true"},
+		{"missing", "missing", ""},
+		{"missing nested", "properties.missing", ""},
+		{"through a non-object", "name.first", ""},
+		{"null", "nothing", ""},
+		{"object is not a value", "properties", ""},
+		{"list is not a value", "list", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyRule(t, Rule{Sources: []Source{{Path: tt.path}}}, claims)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcat(t *testing.T) {
+	tests := []struct {
+		name   string
+		source Source
+		claims map[string]any
+		want   string
+	}{
+		{"without separator", Source{Concat: []string{"first", "last"}},
+			map[string]any{"first": "ada", "last": "lovelace"}, "adalovelace"},
+		{"with separator", Source{Concat: []string{"first", "last"}, Separator: " "},
+			map[string]any{"first": "ada", "last": "lovelace"}, "ada lovelace"},
+		{"nested and numeric parts", Source{Concat: []string{"user.name", "user.id"}, Separator: "-"},
+			map[string]any{"user": map[string]any{"name": "ada", "id": float64(7)}}, "ada-7"},
+		{"empty parts skipped", Source{Concat: []string{"first", "middle", "last"}, Separator: " "},
+			map[string]any{"first": "ada", "middle": "", "last": "lovelace"}, "ada lovelace"},
+		{"all parts missing", Source{Concat: []string{"first", "last"}, Separator: " "},
+			map[string]any{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyRule(t, Rule{Sources: []Source{tt.source}}, tt.claims); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhenUnless(t *testing.T) {
+	rule := Rule{Sources: []Source{
+		{Path: "github", When: "properties.github"},
+		{Path: "name", Unless: "properties"},
+		{Path: "fallback"},
+	}}
+	claims := func(properties any) map[string]any {
+		c := map[string]any{"github": "octocat", "name": "alice", "fallback": "fallback"}
+		if properties != nil {
+			c["properties"] = properties
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"when present", claims(map[string]any{"github": "1"}), "octocat"},
+		{"when false is still present", claims(map[string]any{"github": false}), "octocat"},
+		{"when empty string is absent", claims(map[string]any{"github": ""}), "fallback"},
+		{"unless absent", claims(nil), "alice"},
+		{"unless empty object is absent", claims(map[string]any{}), "alice"},
+		{"unless empty list is absent", claims([]any{}), "alice"},
+		{"unless present", claims(map[string]any{"other": "x"}), "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyRule(t, rule, tt.claims); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	previous := phone.DefaultRegion()
+	t.Cleanup(func() { _ = phone.SetDefaultRegion(previous) })
+	if err := phone.SetDefaultRegion("CN"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		transforms []string
+		value      string
+		want       string
+		wantErr    error
+	}{
+		{"trim", []string{"trim"}, "  alice \t", "alice", nil},
+		{"lowercase", []string{"lowercase"}, "Alice@Example.COM", "alice@example.com", nil},
+		{"uppercase", []string{"uppercase"}, "cn", "CN", nil},
+		{"trim_prefix", []string{"trim_prefix:gh_"}, "gh_octocat", "octocat", nil},
+		{"trim_prefix without the prefix", []string{"trim_prefix:gh_"}, "octocat", "octocat", nil},
+		{"trim_suffix", []string{"trim_suffix:@corp"}, "alice@corp", "alice", nil},
+		{"remove", []string{"remove:-"}, "a-b-c", "abc", nil},
+		{"argument containing a colon", []string{"trim_prefix:urn:"}, "urn:alice", "alice", nil},
+		{"applied in order", []string{"trim", "trim_prefix:x", "uppercase"}, " xab ", "AB", nil},
+		{"e164 in the default region", []string{"e164"}, "138 0013 8000", "+8613800138000", nil},
+		{"e164 with a region", []string{"e164:US"}, "(202) 555-0143", "+12025550143", nil},
+		{"e164 with a lowercase region", []string{"e164:us"}, "2025550143", "+12025550143", nil},
+		{"e164 keeps international numbers", []string{"e164:US"}, "+8613800138000", "+8613800138000", nil},
+		{"e164 rejects invalid numbers", []string{"e164"}, "not a number", "", phone.ErrInvalid},
+		{"empty value skips transforms", []string{"e164"}, "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Compile(map[string]Rule{AttrPhone: {Sources: []Source{{Path: "value"}}, Transforms: tt.transforms}})
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			attrs, err := m.Apply(map[string]any{"value": tt.value})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if attrs[AttrPhone] != tt.want {
+				t.Errorf("got %q, want %q", attrs[AttrPhone], tt.want)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	rule := Rule{
+		Sources: []Source{
+			{Path: "preferred", Transforms: []string{"trim"}},
+			{Path: "second", Transforms: []string{"trim_prefix:id_"}},
+			{Path: "third"},
+		},
+		Transforms: []string{"uppercase"},
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{"first source wins", map[string]any{"preferred": "a", "second": "id_b", "third": "c"}, "A"},
+		{"empty source skipped", map[string]any{"preferred": "", "second": "id_b", "third": "c"}, "B"},
+		{"source empty after its transforms skipped", map[string]any{"preferred": "   ", "second": "id_b"}, "B"},
+		{"later source", map[string]any{"third": "c"}, "C"},
+		{"nothing matches", map[string]any{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyRule(t, rule, tt.claims); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyLeavesOutEmptyAttributes(t *testing.T) {
+	m, err := Compile(map[string]Rule{
+		AttrID:    {Sources: []Source{{Path: "sub"}}},
+		AttrEmail: {Sources: []Source{{Path: "email"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := m.Apply(map[string]any{"sub": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{AttrID: "u1"}; !maps.Equal(attrs, want) {
+		t.Errorf("got %v, want %v", attrs, want)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules map[string]Rule
+		want  string
+	}{
+		{"unknown attribute", map[string]Rule{"nickname": {Sources: []Source{{Path: "nick"}}}},
+			`unknown attribute "nickname"`},
+		{"no sources", map[string]Rule{AttrName: {}}, "at least one source"},
+		{"neither path nor concat", map[string]Rule{AttrName: {Sources: []Source{{When: "x"}}}},
+			"exactly one of path or concat"},
+		{"both path and concat", map[string]Rule{AttrName: {Sources: []Source{{Path: "a", Concat: []string{"b"}}}}},
+			"exactly one of path or concat"},
+		{"unknown transform", map[string]Rule{AttrName: {Sources: []Source{{Path: "a"}}, Transforms: []string{"reverse"}}},
+			`unknown transform "reverse"`},
+		{"unknown source transform", map[string]Rule{AttrName: {Sources: []Source{{Path: "a", Transforms: []string{"reverse"}}}}},
+			"source 0"},
+		{"argument not taken", map[string]Rule{AttrName: {Sources: []Source{{Path: "a"}}, Transforms: []string{"trim:x"}}},
+			"takes no argument"},
+		{"argument missing", map[string]Rule{AttrName: {Sources: []Source{{Path: "a"}}, Transforms: []string{"remove"}}},
+			"needs an argument"},
+		{"unknown e164 region", map[string]Rule{AttrPhone: {Sources: []Source{{Path: "a"}}, Transforms: []string{"e164:XX"}}},
+			"expects a region code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := map[string]Rule{
+		AttrID:   {Sources: []Source{{Path: "sub"}}},
+		AttrName: {Sources: []Source{{Path: "name"}}},
+	}
+	merged := Merge(base, map[string]Rule{
+		AttrName:  {Sources: []Source{{Path: "preferred_username"}}},
+		AttrEmail: {Sources: []Source{{Path: "email"}}},
+	})
+	m, err := Compile(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := m.Apply(map[string]any{"sub": "u1", "name": "Alice", "preferred_username": "alice", "email": "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{AttrID: "u1", AttrName: "alice", AttrEmail: "a@example.com"}
+	if !maps.Equal(attrs, want) {
+		t.Errorf("got %v, want %v", attrs, want)
+	}
+	if base[AttrName].Sources[0].Path != "name" || len(base) != 2 {
+		t.Error("Merge changed the base rules")
+	}
+}
@@ -0,0 +1,82 @@
+package mapping
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+// transform changes a mapped value; it may reject values it cannot handle
+type transform func(value string) (string, error)
+
+// Transforms are written as "name" or "name:argument", e.g. "trim_prefix:+86"
+var transformFactories = map[string]func(arg string) (transform, error){
+	"trim":        noArg(func(v string) (string, error) { return strings.TrimSpace(v), nil }),
+	"lowercase":   noArg(func(v string) (string, error) { return strings.ToLower(v), nil }),
+	"uppercase":   noArg(func(v string) (string, error) { return strings.ToUpper(v), nil }),
+	"trim_prefix": withArg(func(arg, v string) (string, error) { return strings.TrimPrefix(v, arg), nil }),
+	"trim_suffix": withArg(func(arg, v string) (string, error) { return strings.TrimSuffix(v, arg), nil }),
+	"remove":      withArg(func(arg, v string) (string, error) { return strings.ReplaceAll(v, arg, ""), nil }),
+	"e164": func(arg string) (transform, error) {
+		if arg != "" {
+			if _, ok := phone.RegionCallingCode(arg); !ok {
+				return nil, fmt.Errorf("e164 expects a region code such as CN, got %q", arg)
+			}
+		}
+		return func(v string) (string, error) {
+			if arg == "" {
+				return phone.Normalize(v)
+			}
+			return phone.NormalizeIn(v, arg)
+		}, nil
+	},
+}
+
+func noArg(fn transform) func(string) (transform, error) {
+	return func(arg string) (transform, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("transform takes no argument")
+		}
+		return fn, nil
+	}
+}
+
+func withArg(fn func(arg, value string) (string, error)) func(string) (transform, error) {
+	return func(arg string) (transform, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("transform needs an argument")
+		}
+		return func(v string) (string, error) { return fn(arg, v) }, nil
+	}
+}
+
+func compileTransforms(specs []string) ([]transform, error) {
+	transforms := make([]transform, 0, len(specs))
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		factory, ok := transformFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		t, err := factory(arg)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s: %w", name, err)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+func applyTransforms(value string, transforms []transform) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	var err error
+	for _, t := range transforms {
+		if value, err = t(value); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
@@ -1,12 +1,18 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
 )
 
 func SetPlatform(platform string) gin.HandlerFunc {
@@ -33,6 +39,19 @@ func SecurityHeaders() gin.HandlerFunc {
 	}
 }
 
+// AdminAuth only lets through requests bearing the operator token
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			response.JSONError(c, http.StatusUnauthorized, errs.ErrAuthentication, "admin authentication failed")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 func RequestLogger() gin.HandlerFunc {
 	return gin.LoggerWithConfig(gin.LoggerConfig{
 		Formatter: func(param gin.LogFormatterParams) string {
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/ratelimit"
+	"github.com/zgsm-ai/oidc-auth/pkg/response"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// Rate limit key dimensions
+const (
+	RateLimitByIP          = "ip"
+	RateLimitByUser        = "user"
+	RateLimitByMachineCode = "machine_code"
+)
+
+// defaultRateLimitPolicies the policies applied when the config does not override them
+func defaultRateLimitPolicies() map[string]config.RateLimitPolicy {
+	return map[string]config.RateLimitPolicy{
+		"plugin":      {Rate: 5, Burst: 30, KeyBy: []string{RateLimitByIP}},
+		"web":         {Rate: 5, Burst: 30, KeyBy: []string{RateLimitByIP, RateLimitByUser}},
+		"token":       {Rate: 2, Burst: 10, KeyBy: []string{RateLimitByIP, RateLimitByMachineCode}},
+		"invite_code": {Rate: 0.2, Burst: 5, KeyBy: []string{RateLimitByIP, RateLimitByUser}},
+		"password":    {Rate: 0.2, Burst: 10, KeyBy: []string{RateLimitByIP}},
+		"mfa":         {Rate: 0.2, Burst: 10, KeyBy: []string{RateLimitByIP, RateLimitByUser}},
+	}
+}
+
+// credentialRateLimitPolicies guard logins and second factors against guessing, so they are
+// enforced even when rate limiting is not enabled
+var credentialRateLimitPolicies = map[string]bool{
+	"token":    true,
+	"password": true,
+	"mfa":      true,
+}
+
+// RateLimiter builds rate limiting middlewares from named token bucket policies
+type RateLimiter struct {
+	enabled  bool
+	store    ratelimit.Store
+	policies map[string]config.RateLimitPolicy
+}
+
+// NewRateLimiter creates a rate limiter with the configured backend and policies
+func NewRateLimiter(cfg *config.RateLimitConfig) *RateLimiter {
+	policies := defaultRateLimitPolicies()
+	for name, policy := range cfg.Policies {
+		policies[name] = policy
+	}
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.Backend == "database" {
+		store = newDBRateLimitStore(repository.GetDB())
+	}
+	return &RateLimiter{enabled: cfg.Enabled, store: store, policies: policies}
+}
+
+// Policy returns a middleware enforcing the named policy; unknown or disabled policies allow everything
+func (l *RateLimiter) Policy(name string) gin.HandlerFunc {
+	policy, ok := l.policies[name]
+	if (!l.enabled && !credentialRateLimitPolicies[name]) || !ok || policy.Burst <= 0 {
+		return func(c *gin.Context) {}
+	}
+	bucket := ratelimit.Policy{Rate: policy.Rate, Burst: policy.Burst}
+	return func(c *gin.Context) {
+		for _, dimension := range policy.KeyBy {
+			value := rateLimitKeyValue(c, dimension)
+			if value == "" {
+				continue
+			}
+			key := "rl:" + name + ":" + dimension + ":" + value
+			allowed, retryAfter, err := l.store.Take(c.Request.Context(), key, bucket)
+			if err != nil {
+				// fail open: an unavailable backend must not lock everybody out
+				log.Error(c, "rate limiter backend failed: %v", err)
+				return
+			}
+			if !allowed {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				response.JSONError(c, http.StatusTooManyRequests, errs.ErrTooManyRequests,
+					"too many requests, please retry later")
+				c.Abort()
+				return
+			}
+		}
+	}
+}
+
+// rateLimitKeyValue extracts a key dimension from the request, or "" if it is absent
+func rateLimitKeyValue(c *gin.Context, dimension string) string {
+	switch dimension {
+	case RateLimitByIP:
+		return c.ClientIP()
+	case RateLimitByUser:
+		// the bearer token stands for its user without a database lookup; the subject inside
+		// the token is not used because an unverified subject could drain someone else's bucket
+		token := c.GetHeader("Authorization")
+		token = strings.TrimPrefix(strings.TrimPrefix(token, "Bearer "), "DPoP ")
+		token = strings.TrimSpace(token)
+		if token == "" {
+			return ""
+		}
+		return utils.HashToken(token)
+	case RateLimitByMachineCode:
+		return c.Query("machine_code")
+	default:
+		return ""
+	}
+}
+
+// dbRateLimitSweepInterval how often buckets that have been idle long enough are deleted
+const dbRateLimitSweepInterval = time.Hour
+
+// dbRateLimitStore shares buckets between replicas through the database
+type dbRateLimitStore struct {
+	db        *repository.Database
+	lastSweep atomic.Int64
+}
+
+func newDBRateLimitStore(db *repository.Database) *dbRateLimitStore {
+	s := &dbRateLimitStore{db: db}
+	s.lastSweep.Store(time.Now().Unix())
+	return s
+}
+
+func (s *dbRateLimitStore) Take(ctx context.Context, key string, p ratelimit.Policy) (bool, time.Duration, error) {
+	now := time.Now()
+	if last := s.lastSweep.Load(); now.Unix()-last >= int64(dbRateLimitSweepInterval.Seconds()) &&
+		s.lastSweep.CompareAndSwap(last, now.Unix()) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			// every bucket refills within an hour with any practical policy
+			if _, err := s.db.DeleteStaleRateLimitBuckets(ctx, now.Add(-dbRateLimitSweepInterval)); err != nil {
+				log.Warn(nil, "failed to sweep rate limit buckets: %v", err)
+			}
+		}()
+	}
+	return s.db.TakeRateLimitToken(ctx, key, p)
+}
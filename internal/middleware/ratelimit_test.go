@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/repository/repositorytest"
+	"github.com/zgsm-ai/oidc-auth/pkg/errs"
+)
+
+// newTestRateLimiter a limiter keeping its buckets in a fresh test database
+func newTestRateLimiter(t *testing.T, enabled bool, policies map[string]config.RateLimitPolicy) *RateLimiter {
+	t.Helper()
+	db := repository.NewDatabase(repositorytest.Open(t, &repository.RateLimitBucket{}))
+	return &RateLimiter{enabled: enabled, store: newDBRateLimitStore(db), policies: policies}
+}
+
+// rateLimitedRouter serves GET /ping behind the named policy
+func rateLimitedRouter(l *RateLimiter, policy string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ping", l.Policy(policy), func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func ping(r http.Handler, ip, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/ping?machine_code=m1", nil)
+	req.RemoteAddr = ip + ":1234"
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimiterRejectsWithRetryAfter(t *testing.T) {
+	l := newTestRateLimiter(t, true, map[string]config.RateLimitPolicy{
+		"web": {Rate: 0.5, Burst: 2, KeyBy: []string{RateLimitByIP}},
+	})
+	r := rateLimitedRouter(l, "web")
+	for i := 0; i < 2; i++ {
+		if w := ping(r, "10.0.0.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, w.Code)
+		}
+	}
+	w := ping(r, "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if !strings.Contains(w.Body.String(), errs.ErrTooManyRequests) {
+		t.Errorf("body %s does not carry %s", w.Body.String(), errs.ErrTooManyRequests)
+	}
+	if w := ping(r, "10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Errorf("another IP: status %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newTestRateLimiter(t, true, map[string]config.RateLimitPolicy{
+		"web": {Rate: 20, Burst: 1, KeyBy: []string{RateLimitByIP}},
+	})
+	r := rateLimitedRouter(l, "web")
+	if w := ping(r, "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	w := ping(r, "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429 before the refill", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want a partial second rounded up to 1", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if w := ping(r, "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Errorf("status %d after the refill, want 200", w.Code)
+	}
+}
+
+func TestRateLimiterKeyDimensions(t *testing.T) {
+	l := newTestRateLimiter(t, true, map[string]config.RateLimitPolicy{
+		"token": {Rate: 0.001, Burst: 1, KeyBy: []string{RateLimitByIP, RateLimitByUser}},
+	})
+	r := rateLimitedRouter(l, "token")
+	if w := ping(r, "10.0.0.1", "token-a"); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	// every dimension has its own bucket: a new IP with the same token is still limited by the token
+	if w := ping(r, "10.0.0.2", "token-a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same token from another IP: status %d, want 429", w.Code)
+	}
+	// a request without a token is limited by its IP only
+	if w := ping(r, "10.0.0.3", ""); w.Code != http.StatusOK {
+		t.Errorf("no token: status %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimiterFailsOpen(t *testing.T) {
+	db := repositorytest.Open(t, &repository.RateLimitBucket{})
+	l := &RateLimiter{enabled: true, store: newDBRateLimitStore(repository.NewDatabase(db)), policies: map[string]config.RateLimitPolicy{
+		"web": {Rate: 0.001, Burst: 1, KeyBy: []string{RateLimitByIP}},
+	}}
+	r := rateLimitedRouter(l, "web")
+	if w := ping(r, "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+
+	// the backend goes away: requests pass instead of being locked out
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if w := ping(r, "10.0.0.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d with the backend down: status %d, want 200", i, w.Code)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	policies := map[string]config.RateLimitPolicy{
+		"web":      {Rate: 0.001, Burst: 1, KeyBy: []string{RateLimitByIP}},
+		"password": {Rate: 0.001, Burst: 1, KeyBy: []string{RateLimitByIP}},
+		"mfa":      {Rate: 0.001, Burst: 0, KeyBy: []string{RateLimitByIP}},
+	}
+	tests := []struct {
+		policy     string
+		wantStatus int
+	}{
+		{"web", http.StatusOK},                   // only enforced when enabled
+		{"password", http.StatusTooManyRequests}, // credentials are guarded either way
+		{"mfa", http.StatusOK},                   // a burst of 0 turns the policy off
+		{"unknown", http.StatusOK},               // unknown policies allow everything
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			r := rateLimitedRouter(newTestRateLimiter(t, false, policies), tt.policy)
+			ping(r, "10.0.0.1", "")
+			if w := ping(r, "10.0.0.1", ""); w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
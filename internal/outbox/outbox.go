@@ -0,0 +1,277 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+const (
+	claimBatch  = 50
+	saveTimeout = 5 * time.Second
+	sinkTimeout = 10 * time.Second // of one publication, unless the sink config sets another
+	leaseMargin = time.Minute      // on top of the time the sinks may take for an event
+)
+
+// ErrEventNotFound no failed event with the ID
+var ErrEventNotFound = errors.New("failed outbox event not found")
+
+// Event an outbox event as sinks publish it
+type Event struct {
+	ID          uuid.UUID       `json:"id"`
+	Type        string          `json:"type"`
+	CreatedAt   time.Time       `json:"created_at"`
+	AggregateID uuid.UUID       `json:"aggregate_id"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Sink publishes events to a broker or service. Publishing an event again must be harmless,
+// an event is published at least once.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, event Event) error
+}
+
+// registeredSink a sink, the topics it receives, every topic while empty, and how long one of
+// its publications may take
+type registeredSink struct {
+	sink    Sink
+	topics  []string
+	timeout time.Duration
+}
+
+var (
+	outboxCfg  *config.OutboxConfig
+	sinksMu    sync.RWMutex
+	sinks      []registeredSink
+	wake       = make(chan struct{}, 1)
+	outboxOnce sync.Once
+)
+
+var sinkFactories = map[string]func(name string, cfg config.OutboxSinkConfig, client *http.Client) (Sink, error){
+	"http":  newHTTPSink,
+	"nats":  newNATSSink,
+	"kafka": newKafkaSink,
+	"local": func(name string, _ config.OutboxSinkConfig, _ *http.Client) (Sink, error) {
+		return NewLocalSink(name), nil
+	},
+}
+
+// Init sets the outbox config and creates its configured sinks
+func Init(cfg *config.OutboxConfig, httpClient *http.Client) error {
+	var err error
+	outboxOnce.Do(func() {
+		outboxCfg = cfg
+		for name, sinkCfg := range cfg.Sinks {
+			factory, ok := sinkFactories[sinkCfg.Type]
+			if !ok {
+				err = fmt.Errorf("unsupported outbox sink type %q of sink %s", sinkCfg.Type, name)
+				return
+			}
+			var sink Sink
+			if sink, err = factory(name, sinkCfg, httpClient); err != nil {
+				err = fmt.Errorf("outbox sink %s: %w", name, err)
+				return
+			}
+			timeout := sinkCfg.Timeout
+			if timeout <= 0 {
+				timeout = sinkTimeout
+			}
+			addSink(sink, timeout, sinkCfg.Topics...)
+		}
+	})
+	return err
+}
+
+// AddSink publishes the events of the topics, or every event when none are given, to the sink
+func AddSink(sink Sink, topics ...string) {
+	addSink(sink, sinkTimeout, topics...)
+}
+
+func addSink(sink Sink, timeout time.Duration, topics ...string) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks = append(sinks, registeredSink{sink: sink, topics: topics, timeout: timeout})
+	log.Info(nil, "outbox sink added: %s", sink.Name())
+}
+
+// Sinks returns the registered sinks
+func Sinks() []Sink {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	registered := make([]Sink, 0, len(sinks))
+	for _, s := range sinks {
+		registered = append(registered, s.sink)
+	}
+	return registered
+}
+
+// Notify wakes the dispatcher after a transaction wrote events, so they are published right away
+func Notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes due events until the context is done, looking for them every poll interval and
+// whenever Notify is called
+func Run(ctx context.Context) {
+	if outboxCfg == nil {
+		return
+	}
+	ticker := time.NewTicker(outboxCfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		publishDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// publishDue publishes the due events in batches until none are left. Each event is claimed right
+// before it is published, so its lease only has to cover its own publication.
+func publishDue(ctx context.Context) {
+	db := repository.GetDB()
+	lease := publishLease()
+	for ctx.Err() == nil {
+		due, err := db.ListDueOutboxEvents(ctx, time.Now(), claimBatch)
+		if err != nil {
+			log.Error(nil, "failed to list due outbox events: %v", err)
+			return
+		}
+		for i := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			claimed, err := db.ClaimOutboxEvent(ctx, &due[i], time.Now().Add(lease))
+			if err != nil {
+				log.Error(nil, "outbox event %s: %v", due[i].ID, err)
+				return
+			}
+			if claimed {
+				publish(ctx, &due[i])
+			}
+		}
+		if len(due) < claimBatch {
+			return
+		}
+	}
+}
+
+// publishLease how long a claimed event is kept from other replicas: long enough for every sink
+// to time out on it, with the largest sink timeout
+func publishLease() time.Duration {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	largest := sinkTimeout
+	for _, s := range sinks {
+		largest = max(largest, s.timeout)
+	}
+	return largest*time.Duration(max(len(sinks), 1)) + leaseMargin
+}
+
+// publish hands an event to every sink of its topic it has not reached yet. The event is published
+// once all of them took it; otherwise it is retried with exponential backoff.
+func publish(ctx context.Context, stored *repository.OutboxEvent) {
+	event := Event{
+		ID:          stored.ID,
+		Type:        stored.Topic,
+		CreatedAt:   stored.CreatedAt,
+		AggregateID: stored.AggregateID,
+		Data:        json.RawMessage(stored.Payload),
+	}
+	var failures []string
+	sinksMu.RLock()
+	registered := slices.Clone(sinks)
+	sinksMu.RUnlock()
+	for _, s := range registered {
+		name := s.sink.Name()
+		if (len(s.topics) > 0 && !slices.Contains(s.topics, event.Type)) || slices.Contains(stored.PublishedSinks, name) {
+			continue
+		}
+		if err := publishTo(ctx, s, event); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		stored.PublishedSinks = append(stored.PublishedSinks, name)
+	}
+
+	now := time.Now()
+	stored.Attempts++
+	switch {
+	case len(failures) == 0:
+		stored.Status = constants.OutboxStatusPublished
+		stored.PublishedAt = &now
+		stored.LastError = ""
+	case stored.Attempts >= outboxCfg.MaxAttempts:
+		stored.Status = constants.OutboxStatusFailed
+		stored.LastError = strings.Join(failures, "; ")
+		log.Warn(nil, "outbox event %s (%s) failed after %d attempts: %s",
+			stored.ID, stored.Topic, stored.Attempts, stored.LastError)
+	default:
+		stored.NextAttemptAt = now.Add(backoff(stored.Attempts))
+		stored.LastError = strings.Join(failures, "; ")
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), saveTimeout)
+	defer cancel()
+	if err := repository.GetDB().SaveOutboxEventResult(ctx, stored); err != nil {
+		log.Error(nil, "outbox event %s: %v", stored.ID, err)
+	}
+}
+
+// publishTo hands an event to a sink, giving up after the timeout of the sink
+func publishTo(ctx context.Context, s registeredSink, event Event) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.sink.Publish(ctx, event)
+}
+
+// backoff the delay after a number of failed attempts: InitialBackoff doubled each time, up to MaxBackoff
+func backoff(attempts int) time.Duration {
+	delay := outboxCfg.InitialBackoff
+	for i := 1; i < attempts && delay < outboxCfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxCfg.MaxBackoff)
+}
+
+// Retry queues a failed event again with fresh attempts; the sinks it reached are not published to again
+func Retry(ctx context.Context, id string) (*repository.OutboxEvent, error) {
+	eventID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrEventNotFound
+	}
+	db := repository.GetDB()
+	retried, err := db.RetryOutboxEvent(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if !retried {
+		return nil, ErrEventNotFound
+	}
+	Notify()
+	return db.GetOutboxEvent(ctx, eventID)
+}
+
+// ListEvents lists the most recently created events, of one status and topic when not empty
+func ListEvents(ctx context.Context, status, topic string, limit int) ([]repository.OutboxEvent, error) {
+	return repository.GetDB().ListOutboxEvents(ctx, status, topic, limit)
+}
@@ -0,0 +1,261 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+// maxLocalEvents bounds the memory a long running test instance uses
+const maxLocalEvents = 1000
+
+// subject the NATS subject or Kafka topic of an event: its type, under the configured prefix
+func subject(cfg config.OutboxSinkConfig, event Event) string {
+	if cfg.Subject == "" {
+		return event.Type
+	}
+	return cfg.Subject + "." + event.Type
+}
+
+// httpSink posts events as JSON, signed like webhooks
+type httpSink struct {
+	name   string
+	cfg    config.OutboxSinkConfig
+	client *http.Client
+}
+
+func newHTTPSink(name string, cfg config.OutboxSinkConfig, client *http.Client) (Sink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("http sink requires url")
+	}
+	return &httpSink{name: name, cfg: cfg, client: client}, nil
+}
+
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+func (s *httpSink) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create outbox request: %w", err)
+	}
+	for key, value := range s.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Event-ID", event.ID.String())
+	if s.cfg.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(s.cfg.Secret))
+		mac.Write([]byte(timestamp + "." + string(payload)))
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("outbox http sink failed with status %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// natsSink publishes events to a NATS server over one connection shared by every publication,
+// which reconnects by itself. A publication is flushed, so it only succeeds once the server
+// processed it; while the connection is down publications fail and are retried.
+type natsSink struct {
+	name string
+	cfg  config.OutboxSinkConfig
+	conn *nats.Conn
+}
+
+func newNATSSink(name string, cfg config.OutboxSinkConfig, _ *http.Client) (Sink, error) {
+	server, err := url.Parse(cfg.URL)
+	if err != nil || server.Host == "" || (server.Scheme != "nats" && server.Scheme != "tls") {
+		return nil, fmt.Errorf("nats sink requires a nats:// or tls:// url")
+	}
+	options := []nats.Option{
+		nats.Name("oidc-auth"),
+		// the server may come up after this instance; until then publications fail and are retried
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		// publications are not buffered while disconnected, the outbox retries them instead
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Warn(nil, "outbox nats sink %s disconnected: %v", name, err)
+			}
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			log.Info(nil, "outbox nats sink %s reconnected", name)
+		}),
+	}
+	if cfg.Username != "" {
+		options = append(options, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if cfg.Token != "" {
+		options = append(options, nats.Token(cfg.Token))
+	}
+	conn, err := nats.Connect(cfg.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	return &natsSink{name: name, cfg: cfg, conn: conn}, nil
+}
+
+func (s *natsSink) Name() string {
+	return s.name
+}
+
+func (s *natsSink) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := s.conn.Publish(subject(s.cfg, event), payload); err != nil {
+		return fmt.Errorf("failed to publish to nats: %w", err)
+	}
+	if err := s.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("nats did not confirm the publication: %w", err)
+	}
+	return nil
+}
+
+// kafkaSink produces events through a Kafka REST proxy (the Confluent v2 API), keyed by the user
+// the event is about so the events of a user stay in order
+type kafkaSink struct {
+	name   string
+	cfg    config.OutboxSinkConfig
+	client *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		Offset    int64   `json:"offset"`
+		ErrorCode *int    `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+func newKafkaSink(name string, cfg config.OutboxSinkConfig, client *http.Client) (Sink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("kafka sink requires the url of a kafka rest proxy")
+	}
+	return &kafkaSink{name: name, cfg: cfg, client: client}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return s.name
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(map[string][]kafkaRecord{
+		"records": {{Key: event.AggregateID.String(), Value: event}},
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimRight(s.cfg.URL, "/") + "/topics/" + url.PathEscape(subject(s.cfg, event))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create kafka request: %w", err)
+	}
+	for key, value := range s.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kafka rest proxy failed with status %s: %s", resp.Status, body)
+	}
+	var produced kafkaProduceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("failed to decode kafka rest proxy response: %w", err)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.Error != nil {
+			return fmt.Errorf("kafka rejected the record: %s", *offset.Error)
+		}
+	}
+	return nil
+}
+
+// LocalSink keeps published events in memory instead of sending them, so tests can read them
+type LocalSink struct {
+	name   string
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewLocalSink(name string) *LocalSink {
+	return &LocalSink{name: name}
+}
+
+func (s *LocalSink) Name() string {
+	return s.name
+}
+
+func (s *LocalSink) Publish(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) >= maxLocalEvents {
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the published events, oldest first; an empty topic returns all of them
+func (s *LocalSink) Events(topic string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		if topic == "" || event.Type == topic {
+			events = append(events, event)
+		}
+	}
+	return events
+}
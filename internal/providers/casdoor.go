@@ -9,10 +9,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/mapping"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
 	"github.com/zgsm-ai/oidc-auth/pkg/utils"
 )
 
@@ -23,12 +29,17 @@ type casdoorConfig struct {
 	ClientSecret string
 	BaseURL      string
 	InternalURL  string
-	Scopes       []string
+	Issuer       string
+	JWKSURL      string
+	UserInfoURL  string
+	AuthParams   AuthParams
 }
 
 type CasdoorProvider struct {
 	config     *casdoorConfig
 	httpClient *http.Client
+	mapper     *mapping.Mapper
+	mapperErr  error
 }
 
 func NewCasdoorFactory() *CasdoorFactory {
@@ -44,17 +55,100 @@ func (f *CasdoorFactory) CreateProvider(config *ProviderConfig) OAuthProvider {
 }
 
 func NewCasdoorProvider(config *ProviderConfig) *CasdoorProvider {
+	mapper, mapperErr := config.claimMapper(casdoorClaimMapping)
 	return &CasdoorProvider{
+		mapper:     mapper,
+		mapperErr:  mapperErr,
 		httpClient: config.Client,
 		config: &casdoorConfig{
 			ClientID:     config.ClientID,
 			ClientSecret: config.ClientSecret,
 			BaseURL:      config.BaseURL,
 			InternalURL:  config.InternalURL,
+			Issuer:       config.Issuer,
+			JWKSURL:      config.JWKSURL,
+			UserInfoURL:  config.UserInfoURL,
+			AuthParams:   config.AuthParams,
 		},
 	}
 }
 
+// upstreamSigningMethods the algorithms accepted for upstream tokens; "none" and HMAC are never accepted
+var upstreamSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+func (s *CasdoorProvider) issuer() string {
+	return coalesce(s.config.Issuer, s.config.BaseURL)
+}
+
+func (s *CasdoorProvider) jwksURL() string {
+	return coalesce(s.config.JWKSURL, s.GetEndpoint(true)+constants.CasdoorJWKSURI)
+}
+
+func (s *CasdoorProvider) userInfoURL() string {
+	return coalesce(s.config.UserInfoURL, s.GetEndpoint(true)+constants.CasdoorUserInfoURI)
+}
+
+// verifyToken checks the signature, issuer, audience and expiry of an upstream token and returns its claims
+func (s *CasdoorProvider) verifyToken(ctx context.Context, accessToken string) (map[string]any, error) {
+	keys := getJWKSCache(s.jwksURL(), s.httpClient)
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods(upstreamSigningMethods),
+		jwt.WithIssuer(s.issuer()),
+		jwt.WithAudience(s.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// fetchUserInfo asks the upstream provider for the claims of a token it issued
+func (s *CasdoorProvider) fetchUserInfo(ctx context.Context, accessToken string) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.userInfoURL(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request userinfo: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get userinfo, status: %d", resp.StatusCode)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode userinfo response: %w", err)
+	}
+	// Casdoor answers invalid tokens with 200 and {"status": "error", "msg": ...}
+	if status, _ := claims["status"].(string); status == "error" {
+		msg, _ := claims["msg"].(string)
+		return nil, fmt.Errorf("userinfo rejected the token: %s", msg)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("userinfo response has no subject")
+	}
+	return claims, nil
+}
+
+func coalesce(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func (s *CasdoorProvider) GetName() string {
 	return "casdoor"
 }
@@ -96,18 +190,26 @@ func (s *CasdoorProvider) Update(ctx context.Context, data *repository.AuthUser)
 	}
 	var existingUser *repository.AuthUser
 	var err error
-	if data.GithubID != "" {
-		existingUser, err = repository.GetDB().GetUserByField(ctx, "github_id", data.GithubID)
-		if err != nil {
-			return fmt.Errorf("failed to get user: %w", err)
-		}
-	} else if data.Phone != "" {
-		existingUser, err = repository.GetDB().GetUserByField(ctx, "phone", data.Phone)
-		if err != nil {
-			return fmt.Errorf("failed to get user: %w", err)
+	if data.Phone != "" {
+		// a number that cannot be normalized is kept as it is, it is just not matched against
+		// other accounts; the upstream profile is not something the user can fix at login
+		if normalized, err := phone.Normalize(data.Phone); err != nil {
+			log.Warn(ctx, "user %s has an invalid phone number, not matching it: %v", data.ID, err)
+		} else {
+			data.Phone = normalized
 		}
-	} else {
-		return fmt.Errorf("user must have either github_id, phone, or email")
+	}
+	if data.GithubID == "" && data.Phone == "" {
+		return fmt.Errorf("user must have either github_id or phone")
+	}
+	db := repository.GetDB()
+	// the user owning any of the identities, or one saved before under the same upstream ID
+	existingUser, err = db.GetUserByIdentities(ctx, data.Identities())
+	if err == nil && existingUser == nil && data.ID != uuid.Nil {
+		existingUser, err = db.GetUserByField(ctx, constants.DBIndexField, data.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
 	}
 
 	if existingUser == nil {
@@ -123,47 +225,54 @@ func (s *CasdoorProvider) Update(ctx context.Context, data *repository.AuthUser)
 				return err
 			}
 		}
-		if data.GithubID != "" {
-			err = repository.GetDB().Upsert(ctx, data, "github_id", data.GithubID)
-		} else if data.Phone != "" {
-			err = repository.GetDB().Upsert(ctx, data, "phone", data.Phone)
-		} else {
-			return fmt.Errorf("user must have either github_id, phone, or email")
+		if data.ID == uuid.Nil {
+			data.ID = uuid.New()
 		}
-		if err != nil {
+		if err := db.Upsert(ctx, data, constants.DBIndexField, data.ID); err != nil {
 			return fmt.Errorf("failed to create user: %w", err)
 		}
+		if err := db.SyncUserIdentities(ctx, data); err != nil {
+			return err
+		}
+		webhook.UserCreated(ctx, data)
+		audit.InviteRedeemed(ctx, data)
 		return nil
 	}
+	if data.GithubID != "" {
+		existingUser.GithubID = data.GithubID
+	}
 	existingUser.GithubName = data.GithubName
 	existingUser.Name = data.Name
+	if strings.EqualFold(existingUser.Email, data.Email) {
+		existingUser.EmailVerified = existingUser.EmailVerified || data.EmailVerified
+	} else {
+		existingUser.EmailVerified = data.EmailVerified
+	}
 	existingUser.Email = data.Email
 	existingUser.Location = data.Location
 	existingUser.Company = data.Company
+	// a changed number has to be proved again, the upstream profile does not prove it
+	existingUser.PhoneVerified = existingUser.PhoneVerified && existingUser.Phone == data.Phone
 	existingUser.Phone = data.Phone
 	existingUser.Vip = data.Vip
 	existingUser.EmployeeNumber = data.EmployeeNumber
-	existingUser.ID = data.ID
+	// the local ID is kept even when the upstream one differs, identities and second factors reference it
 
 	newDevice := data.Devices[0]
 	newDevice.UpdatedAt = time.Now()
 
-	if existingUser.ID == uuid.Nil {
-		existingUser.ID = uuid.New()
-		existingUser.CreatedAt = time.Now()
-		existingUser.UpdatedAt = time.Now()
-	}
-
 	if newDevice.ID == uuid.Nil {
 		newDevice.ID = uuid.New()
 		newDevice.CreatedAt = time.Now()
 		newDevice.UpdatedAt = time.Now()
 	}
 
-	deviceFound := false
+	index := -1
 	for i, device := range existingUser.Devices {
 		if device.MachineCode == newDevice.MachineCode && device.VSCodeVersion == newDevice.VSCodeVersion {
 			newDevice.CreatedAt = device.CreatedAt
+			newDevice.LastAccessAt = device.LastAccessAt
+			newDevice.Attestation.Inherit(device.Attestation)
 			if newDevice.DeviceCode == "" {
 				newDevice.DeviceCode = existingUser.Devices[i].DeviceCode
 			}
@@ -171,98 +280,90 @@ func (s *CasdoorProvider) Update(ctx context.Context, data *repository.AuthUser)
 				newDevice.ID = existingUser.Devices[i].ID
 			}
 			existingUser.Devices[i] = newDevice
-			deviceFound = true
+			index = i
 			break
 		}
 	}
-	if !deviceFound {
+	if index == -1 {
 		newDevice.DeviceCode, err = utils.GenerateRandomString(16)
 		if err != nil {
 			return err
 		}
 		existingUser.Devices = append(existingUser.Devices, newDevice)
+		index = len(existingUser.Devices) - 1
 	}
 
-	if data.GithubID != "" {
-		err = repository.GetDB().Upsert(ctx, *existingUser, "github_id", existingUser.GithubID)
-		if err != nil {
-			return fmt.Errorf("failed to get user: %w", err)
-		}
-	} else if data.Phone != "" {
-		err = repository.GetDB().Upsert(ctx, *existingUser, "phone", existingUser.Phone)
-		if err != nil {
-			return fmt.Errorf("failed to get user: %w", err)
-		}
-	} else {
-		return fmt.Errorf("user must have either github_id, phone, or email")
+	// only the device of this login is written, the others are kept as stored: a concurrent login
+	// may have signed in or evicted one of them since the user was read
+	if _, err := db.SaveUserDevice(ctx, existingUser, index, nil); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
 	}
-	return nil
+	return db.SyncUserIdentities(ctx, existingUser)
 }
 
-func (s *CasdoorProvider) GetUserInfo(ctx context.Context, accessToken string) (*repository.AuthUser, error) {
-	payload, err := utils.DecodeJWTPayloadUnverified(accessToken)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode AESEncrypt payload: %w", err)
-	}
-	/*
-		Meeting the following conditions indicates that custom login is used
-		casdoor -> /providers/admin/customAuth -> User mapping
-			{
-			   "id": "employee_number",
-			   "username": "username",
-			   "displayName": "username",
-			   "email": "phone_number",
-			   "avatarUrl": ""
-			  }
-	*/
-	name, _ := payload.CustomClaims["name"].(string)
-	phone, _ := payload.CustomClaims["phone"].(string)
-	universalID, _ := payload.CustomClaims["universal_id"].(string)
-
-	var githubID, githubName, customName, employeeNum, email string
-
-	id, err := uuid.Parse(universalID)
-	if err != nil {
-		return nil, err
-	}
-
-	customPayload, ok := payload.CustomClaims["properties"].(map[string]any)
-	if ok && len(customPayload) != 0 {
-		githubID, _ = customPayload["oauth_GitHub_id"].(string)
-		githubName, _ = customPayload["oauth_GitHub_username"].(string)
-		customName, _ = customPayload["oauth_Custom_username"].(string)
-		employeeNum, _ = customPayload["oauth_Custom_id"].(string)
-		customPhone, _ := customPayload["oauth_Custom_email"].(string)
-		if githubID != "" {
-			email, _ = payload.CustomClaims["email"].(string)
-		}
-		if customPhone != "" {
-			phone = customPhone
+// GetUserInfo reads the user from the ID token of the token response, verified against the
+// provider's JWKS; an ID token that fails verification rejects the login. Only when the provider
+// returned no ID token is the access token verified instead, with the upstream userinfo endpoint
+// deciding whether it is genuine if it cannot be verified locally.
+func (s *CasdoorProvider) GetUserInfo(ctx context.Context, token *TokenResponse) (*repository.AuthUser, error) {
+	var claims map[string]any
+	var err error
+	signed := true
+	if token.IDToken != "" {
+		if claims, err = s.verifyToken(ctx, token.IDToken); err != nil {
+			return nil, fmt.Errorf("invalid id token: %w", err)
 		}
-		if githubName != "" {
-			name = githubName
-		} else if customName != "" {
-			name = customName + employeeNum
+	} else if claims, err = s.verifyToken(ctx, token.AccessToken); err != nil {
+		log.Warn(nil, "upstream returned no id token and the access token cannot be verified locally, falling back to userinfo: %v", err)
+		var userInfoErr error
+		claims, userInfoErr = s.fetchUserInfo(ctx, token.AccessToken)
+		if userInfoErr != nil {
+			return nil, fmt.Errorf("failed to verify token: %v, userinfo fallback: %w", err, userInfoErr)
 		}
-	} else {
-		name = phone
+		signed = false
 	}
-
-	if strings.Contains(phone, "+86") {
-		phone = strings.ReplaceAll(phone, "+86", "")
+	if s.mapperErr != nil {
+		return nil, fmt.Errorf("invalid claim mapping: %w", s.mapperErr)
 	}
-	user := &repository.AuthUser{
-		ID:             id,
-		Phone:          phone,
-		GithubID:       githubID,
-		Email:          email,
-		Name:           name,
-		GithubName:     githubName,
-		EmployeeNumber: employeeNum,
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
+	return userFromClaims(s.mapper, claims, signed)
+}
+
+/*
+casdoorClaimMapping is the built-in mapping of Casdoor claims, overridable per attribute through claimMapping.
+
+Linked GitHub and custom accounts show up in "properties". Custom login is configured in
+casdoor -> /providers/admin/customAuth -> User mapping
+
+	{
+	   "id": "employee_number",
+	   "username": "username",
+	   "displayName": "username",
+	   "email": "phone_number",
+	   "avatarUrl": ""
 	}
-	return user, nil
+*/
+var casdoorClaimMapping = map[string]mapping.Rule{
+	mapping.AttrID: {Sources: []mapping.Source{
+		{Path: "universal_id"},
+		{Path: "sub"}, // the userinfo endpoint may only return the standard subject
+	}},
+	// normalized leniently in Update, so an invalid number does not fail the login
+	mapping.AttrPhone: {Sources: []mapping.Source{
+		{Path: "properties.oauth_Custom_email"},
+		{Path: "phone"},
+	}},
+	mapping.AttrName: {Sources: []mapping.Source{
+		{Path: "properties.oauth_GitHub_username"},
+		{Concat: []string{"properties.oauth_Custom_username", "properties.oauth_Custom_id"}, When: "properties.oauth_Custom_username"},
+		{Path: "name", When: "properties"},
+		{Path: "phone", Unless: "properties"},
+	}},
+	mapping.AttrEmail: {Sources: []mapping.Source{
+		{Path: "email", When: "properties.oauth_GitHub_id"},
+	}},
+	mapping.AttrGithubID:       {Sources: []mapping.Source{{Path: "properties.oauth_GitHub_id"}}},
+	mapping.AttrGithubName:     {Sources: []mapping.Source{{Path: "properties.oauth_GitHub_username"}}},
+	mapping.AttrEmployeeNumber: {Sources: []mapping.Source{{Path: "properties.oauth_Custom_id"}}},
 }
 
 func (s *CasdoorProvider) RefreshToken(ctx context.Context, refreshToken string) (*TokenResponse, error) {
@@ -296,9 +397,14 @@ func (s *CasdoorProvider) RefreshToken(ctx context.Context, refreshToken string)
 	return &tokenResp, nil
 }
 
-func (s *CasdoorProvider) GetAuthURL(state, redirectURL string) string {
-	return s.config.BaseURL + constants.CasdoorAuthURI + "?client_id=" +
-		s.config.ClientID + "&state=" + state + "&redirect_uri=" + redirectURL + "&response_type=code"
+func (s *CasdoorProvider) GetAuthURL(state, redirectURL string, opts ...AuthURLOption) string {
+	values := url.Values{}
+	s.config.AuthParams.Encode(values, opts...)
+	values.Set("client_id", s.config.ClientID)
+	values.Set("state", state)
+	values.Set("redirect_uri", redirectURL)
+	values.Set("response_type", "code")
+	return s.config.BaseURL + constants.CasdoorAuthURI + "?" + values.Encode()
 }
 
 func (s *CasdoorProvider) GetEndpoint(isInternal bool) string {
@@ -0,0 +1,39 @@
+package providers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/mapping"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+// userFromClaims maps upstream claims into a new AuthUser; every provider goes through here.
+// The email counts as verified only when signed claims, not a userinfo response, say so.
+func userFromClaims(mapper *mapping.Mapper, claims map[string]any, signed bool) (*repository.AuthUser, error) {
+	attrs, err := mapper.Apply(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map claims: %w", err)
+	}
+	id, err := uuid.Parse(attrs[mapping.AttrID])
+	if err != nil {
+		return nil, fmt.Errorf("invalid user id %q: %w", attrs[mapping.AttrID], err)
+	}
+	emailVerified, _ := claims["email_verified"].(bool)
+	return &repository.AuthUser{
+		ID:             id,
+		Name:           attrs[mapping.AttrName],
+		Phone:          attrs[mapping.AttrPhone],
+		Email:          attrs[mapping.AttrEmail],
+		EmailVerified:  signed && emailVerified && attrs[mapping.AttrEmail] != "",
+		GithubID:       attrs[mapping.AttrGithubID],
+		GithubName:     attrs[mapping.AttrGithubName],
+		EmployeeNumber: attrs[mapping.AttrEmployeeNumber],
+		Company:        attrs[mapping.AttrCompany],
+		Location:       attrs[mapping.AttrLocation],
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/zgsm-ai/oidc-auth/internal/mapping"
+)
+
+// TestCasdoorClaimMapping pins the built-in Casdoor mapping to the attributes GetUserInfo
+// produced before the mapping became configurable
+func TestCasdoorClaimMapping(t *testing.T) {
+	mapper, err := mapping.Compile(casdoorClaimMapping)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	const id = "0b7f6c1e-3a52-4c53-9d2b-6f0a3c1e2d4f"
+	type user struct {
+		name, phone, email, githubID, githubName, employeeNumber string
+		emailVerified                                            bool
+	}
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		signed  bool
+		want    user
+		wantErr bool
+	}{
+		{
+			name: "github account",
+			claims: map[string]any{
+				"universal_id": id, "name": "casdoor-name", "phone": "13800138000",
+				"email": "octo@example.com", "email_verified": true,
+				"properties": map[string]any{"oauth_GitHub_id": "1001", "oauth_GitHub_username": "octocat"},
+			},
+			signed: true,
+			want: user{name: "octocat", phone: "13800138000", email: "octo@example.com",
+				githubID: "1001", githubName: "octocat", emailVerified: true},
+		},
+		{
+			name: "email from userinfo is not verified",
+			claims: map[string]any{
+				"sub": id, "email": "octo@example.com", "email_verified": true,
+				"properties": map[string]any{"oauth_GitHub_id": "1001", "oauth_GitHub_username": "octocat"},
+			},
+			want: user{name: "octocat", email: "octo@example.com", githubID: "1001", githubName: "octocat"},
+		},
+		{
+			name: "custom login",
+			claims: map[string]any{
+				"universal_id": id, "name": "casdoor-name", "phone": "13800138000", "email": "ignored@example.com",
+				"properties": map[string]any{
+					"oauth_Custom_username": "alice", "oauth_Custom_id": "E1024", "oauth_Custom_email": "13900139000",
+				},
+			},
+			signed: true,
+			want:   user{name: "aliceE1024", phone: "13900139000", employeeNumber: "E1024"},
+		},
+		{
+			name: "other linked account keeps the casdoor name",
+			claims: map[string]any{
+				"universal_id": id, "name": "casdoor-name", "phone": "13800138000",
+				"properties": map[string]any{"oauth_Other_id": "x"},
+			},
+			signed: true,
+			want:   user{name: "casdoor-name", phone: "13800138000"},
+		},
+		{
+			name: "phone account is named after the phone",
+			claims: map[string]any{
+				"universal_id": id, "name": "casdoor-name", "phone": "13800138000", "properties": map[string]any{},
+			},
+			signed: true,
+			want:   user{name: "13800138000", phone: "13800138000"},
+		},
+		{
+			name:   "universal id preferred over sub",
+			claims: map[string]any{"universal_id": id, "sub": "not-a-uuid", "phone": "13800138000"},
+			signed: true,
+			want:   user{name: "13800138000", phone: "13800138000"},
+		},
+		{
+			name:    "id is not a uuid",
+			claims:  map[string]any{"sub": "alice", "phone": "13800138000"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userFromClaims(mapper, tt.claims, tt.signed)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("userFromClaims: %v", err)
+			}
+			if got.ID.String() != id {
+				t.Errorf("ID = %s, want %s", got.ID, id)
+			}
+			gotUser := user{got.Name, got.Phone, got.Email, got.GithubID, got.GithubName, got.EmployeeNumber, got.EmailVerified}
+			if gotUser != tt.want {
+				t.Errorf("got %+v, want %+v", gotUser, tt.want)
+			}
+		})
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/zgsm-ai/oidc-auth/internal/mapping"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
 )
 
@@ -16,6 +21,7 @@ type TokenResponse struct {
 	RefreshToken string    `json:"refresh_token,omitempty"`
 	ExpiresIn    int64     `json:"expires_in,omitempty"`
 	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	IDToken      string    `json:"id_token,omitempty"`
 }
 
 type OAuthProvider interface {
@@ -23,11 +29,11 @@ type OAuthProvider interface {
 
 	GetEndpoint(isInternal bool) string
 
-	GetAuthURL(state, redirectURL string) string
+	GetAuthURL(state, redirectURL string, opts ...AuthURLOption) string
 
 	ExchangeToken(ctx context.Context, code string) (*TokenResponse, error)
 
-	GetUserInfo(ctx context.Context, accessToken string) (*repository.AuthUser, error)
+	GetUserInfo(ctx context.Context, token *TokenResponse) (*repository.AuthUser, error)
 
 	RefreshToken(ctx context.Context, refreshToken string) (*TokenResponse, error)
 
@@ -35,18 +41,121 @@ type OAuthProvider interface {
 }
 
 type ProviderConfig struct {
+	Type         string // factory name, defaults to the provider name
 	ClientID     string
 	ClientSecret string
 	BaseURL      string
 	InternalURL  string
+	Issuer       string // expected "iss" of upstream tokens, defaults to BaseURL
+	JWKSURL      string // upstream signing keys, defaults to the provider's well-known JWKS endpoint
+	UserInfoURL  string // used when there is no ID token and the access token cannot be verified locally
 	Client       *http.Client
+	AuthParams   AuthParams // defaults for every authorization request
+	ClaimMapping map[string]mapping.Rule
+
+	mapperOnce sync.Once
+	mapper     *mapping.Mapper
+	mapperErr  error
+}
+
+// claimMapper compiles the configured claim mapping on top of the provider's defaults, once per config
+func (c *ProviderConfig) claimMapper(defaults map[string]mapping.Rule) (*mapping.Mapper, error) {
+	c.mapperOnce.Do(func() {
+		c.mapper, c.mapperErr = mapping.Compile(mapping.Merge(defaults, c.ClaimMapping))
+	})
+	return c.mapper, c.mapperErr
+}
+
+// AuthParams are the optional parameters of an authorization request
+type AuthParams struct {
+	Scopes    []string
+	Prompt    string
+	LoginHint string
+	AcrValues string
+	Extra     map[string]string
+}
+
+// AuthURLOption overrides an authorization parameter for a single request
+type AuthURLOption func(*AuthParams)
+
+// WithScopes replaces the configured scopes
+func WithScopes(scopes ...string) AuthURLOption {
+	return func(p *AuthParams) { p.Scopes = scopes }
+}
+
+// WithPrompt sets prompt, e.g. "login" to force re-authentication
+func WithPrompt(prompt string) AuthURLOption {
+	return func(p *AuthParams) { p.Prompt = prompt }
+}
+
+// WithLoginHint pre-fills the login identifier, e.g. a phone number for SMS login
+func WithLoginHint(hint string) AuthURLOption {
+	return func(p *AuthParams) { p.LoginHint = hint }
+}
+
+// WithAcrValues requests an authentication context class
+func WithAcrValues(acrValues string) AuthURLOption {
+	return func(p *AuthParams) { p.AcrValues = acrValues }
+}
+
+// WithExtraParam adds a provider specific parameter
+func WithExtraParam(key, value string) AuthURLOption {
+	return func(p *AuthParams) {
+		extra := make(map[string]string, len(p.Extra)+1)
+		for k, v := range p.Extra {
+			extra[k] = v
+		}
+		extra[key] = value
+		p.Extra = extra
+	}
+}
+
+// reservedAuthParams are set by the provider itself and cannot be overridden by extra parameters
+var reservedAuthParams = map[string]struct{}{
+	"client_id":     {},
+	"redirect_uri":  {},
+	"response_type": {},
+	"state":         {},
+}
+
+// Encode applies the options on top of the defaults and writes the parameters into values
+func (p AuthParams) Encode(values url.Values, opts ...AuthURLOption) {
+	for _, opt := range opts {
+		opt(&p)
+	}
+	for key, value := range p.Extra {
+		if _, reserved := reservedAuthParams[key]; reserved || value == "" {
+			continue
+		}
+		values.Set(key, value)
+	}
+	if len(p.Scopes) > 0 {
+		values.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	if p.Prompt != "" {
+		values.Set("prompt", p.Prompt)
+	}
+	if p.LoginHint != "" {
+		values.Set("login_hint", p.LoginHint)
+	}
+	if p.AcrValues != "" {
+		values.Set("acr_values", p.AcrValues)
+	}
 }
 
 type ProviderFactory interface {
 	CreateProvider(config *ProviderConfig) OAuthProvider
 }
 
+// ConfigValidator is implemented by factories that need checks beyond the common ones
+type ConfigValidator interface {
+	ValidateConfig(config *ProviderConfig) error
+}
+
+// OAuthManager holds provider factories and configs; it is safe for concurrent use
+// so provider configs can be changed while requests are being served.
 type OAuthManager struct {
+	mu        sync.RWMutex
 	factories map[string]ProviderFactory
 	configs   map[string]*ProviderConfig
 }
@@ -59,23 +168,156 @@ func NewOAuthManager() *OAuthManager {
 }
 
 func (m *OAuthManager) RegisterFactory(name string, factory ProviderFactory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.factories[name] = factory
 }
 
 func (m *OAuthManager) SetConfig(name string, config *ProviderConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.configs[name] = config
 }
 
-func (m *OAuthManager) GetProvider(name string) (OAuthProvider, error) {
-	factory, exists := m.factories[name]
+// ValidateConfig checks a provider config before it goes live
+func (m *OAuthManager) ValidateConfig(name string, config *ProviderConfig) error {
+	if config == nil {
+		return fmt.Errorf("provider %s: config is nil", name)
+	}
+	m.mu.RLock()
+	factory, exists := m.factories[factoryName(name, config)]
+	m.mu.RUnlock()
 	if !exists {
-		return nil, fmt.Errorf("provider factory not found: %s", name)
+		return fmt.Errorf("provider %s: factory not found: %s", name, factoryName(name, config))
+	}
+	if config.ClientID == "" {
+		return fmt.Errorf("provider %s: clientID is required", name)
+	}
+	if config.ClientSecret == "" {
+		return fmt.Errorf("provider %s: clientSecret is required", name)
+	}
+	if err := validateEndpoint(config.BaseURL, true); err != nil {
+		return fmt.Errorf("provider %s: baseURL: %w", name, err)
+	}
+	if err := validateEndpoint(config.InternalURL, false); err != nil {
+		return fmt.Errorf("provider %s: internalURL: %w", name, err)
 	}
+	if _, err := mapping.Compile(config.ClaimMapping); err != nil {
+		return fmt.Errorf("provider %s: claimMapping: %w", name, err)
+	}
+	if validator, ok := factory.(ConfigValidator); ok {
+		if err := validator.ValidateConfig(config); err != nil {
+			return fmt.Errorf("provider %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// AddProvider validates and registers the config of a new provider
+func (m *OAuthManager) AddProvider(name string, config *ProviderConfig) error {
+	if err := m.ValidateConfig(name, config); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.configs[name]; exists {
+		return fmt.Errorf("provider %s already exists", name)
+	}
+	m.configs[name] = config
+	return nil
+}
+
+// UpdateProvider validates and replaces the config of an existing provider, e.g. to rotate its client secret
+func (m *OAuthManager) UpdateProvider(name string, config *ProviderConfig) error {
+	if err := m.ValidateConfig(name, config); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.configs[name]; !exists {
+		return fmt.Errorf("provider config not found: %s", name)
+	}
+	m.configs[name] = config
+	return nil
+}
 
+// RemoveProvider stops offering a provider; logins already in flight with it will fail at the callback
+func (m *OAuthManager) RemoveProvider(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.configs[name]; !exists {
+		return fmt.Errorf("provider config not found: %s", name)
+	}
+	delete(m.configs, name)
+	return nil
+}
+
+// ReplaceConfigs validates every config and then swaps the whole set at once.
+// If any config is invalid, the current set stays live.
+func (m *OAuthManager) ReplaceConfigs(configs map[string]*ProviderConfig) error {
+	for name, config := range configs {
+		if err := m.ValidateConfig(name, config); err != nil {
+			return err
+		}
+	}
+	next := make(map[string]*ProviderConfig, len(configs))
+	for name, config := range configs {
+		next[name] = config
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configs = next
+	return nil
+}
+
+// ProviderNames returns the names of the configured providers
+func (m *OAuthManager) ProviderNames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *OAuthManager) GetProvider(name string) (OAuthProvider, error) {
+	m.mu.RLock()
 	config, exists := m.configs[name]
 	if !exists {
+		m.mu.RUnlock()
 		return nil, fmt.Errorf("provider config not found: %s", name)
 	}
+	factory, exists := m.factories[factoryName(name, config)]
+	m.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("provider factory not found: %s", name)
+	}
 
 	return factory.CreateProvider(config), nil
 }
+
+func factoryName(name string, config *ProviderConfig) string {
+	if config.Type != "" {
+		return config.Type
+	}
+	return name
+}
+
+func validateEndpoint(endpoint string, required bool) error {
+	if endpoint == "" {
+		if required {
+			return fmt.Errorf("is required")
+		}
+		return nil
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q must be an absolute http(s) URL", endpoint)
+	}
+	return nil
+}
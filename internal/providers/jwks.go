@@ -0,0 +1,117 @@
+package providers
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+const (
+	jwksCacheTTL        = time.Hour
+	jwksMinRefreshDelay = time.Minute // an unknown kid may trigger a refresh at most this often
+)
+
+// jwksCache caches the signing keys of an upstream provider.
+// Provider instances are created per request, so caches are shared by JWKS URL.
+type jwksCache struct {
+	url        string
+	httpClient *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+var jwksCaches sync.Map // JWKS URL -> *jwksCache
+
+func getJWKSCache(url string, httpClient *http.Client) *jwksCache {
+	cache, _ := jwksCaches.LoadOrStore(url, &jwksCache{url: url, httpClient: httpClient})
+	return cache.(*jwksCache)
+}
+
+// Key returns the key with the given kid, refreshing the set when it is stale or the kid is unknown.
+// An empty kid matches the only key of a single-key set.
+func (c *jwksCache) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.RLock()
+	key, found := c.lookup(kid)
+	fresh := time.Since(c.fetchedAt) < jwksCacheTTL
+	canRefresh := time.Since(c.fetchedAt) >= jwksMinRefreshDelay
+	c.mu.RUnlock()
+
+	if found && (fresh || !canRefresh) {
+		return key, nil
+	}
+	if !found && !canRefresh {
+		return nil, fmt.Errorf("signing key %q not found in JWKS", kid)
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		if found {
+			log.Warn(nil, "failed to refresh JWKS from %s, using cached keys: %v", c.url, err)
+			return key, nil
+		}
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if key, found = c.lookup(kid); !found {
+		return nil, fmt.Errorf("signing key %q not found in JWKS", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *jwksCache) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS, status: %d", resp.StatusCode)
+	}
+
+	var set utils.JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i := range set.Keys {
+		if set.Keys[i].Use != "" && set.Keys[i].Use != "sig" {
+			continue
+		}
+		key, err := set.Keys[i].PublicKey()
+		if err != nil {
+			log.Warn(nil, "skipping JWKS key %q from %s: %v", set.Keys[i].Kid, c.url, err)
+			continue
+		}
+		keys[set.Keys[i].Kid] = key
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
@@ -23,8 +23,5 @@ func InitializeProviders(configs map[string]*ProviderConfig) error {
 	if manager == nil {
 		return errors.New("GetManager failed")
 	}
-	for name, config := range configs {
-		manager.SetConfig(name, config)
-	}
-	return nil
+	return manager.ReplaceConfigs(configs)
 }
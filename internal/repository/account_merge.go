@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// CreateAccountMerge stores a new merge, or returns the merge already stored under its idempotency key
+func (d *Database) CreateAccountMerge(ctx context.Context, merge *AccountMerge) (*AccountMerge, error) {
+	if err := d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(merge).Error; err != nil {
+		return nil, fmt.Errorf("failed to create account merge: %w", err)
+	}
+	var stored AccountMerge
+	if err := d.db.WithContext(ctx).Where("idempotency_key = ?", merge.IdempotencyKey).First(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to query account merge: %w", err)
+	}
+	return &stored, nil
+}
+
+// GetAccountMerge gets a merge by ID
+func (d *Database) GetAccountMerge(ctx context.Context, id uuid.UUID) (*AccountMerge, error) {
+	var merge AccountMerge
+	if err := d.db.WithContext(ctx).Where("id = ?", id).First(&merge).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query account merge: %w", err)
+	}
+	return &merge, nil
+}
+
+// ListAccountMerges lists the most recently updated merges, of one status when it is not empty
+func (d *Database) ListAccountMerges(ctx context.Context, status string, limit int) ([]AccountMerge, error) {
+	query := d.db.WithContext(ctx).Order("updated_at DESC").Limit(limit)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var merges []AccountMerge
+	if err := query.Find(&merges).Error; err != nil {
+		return nil, fmt.Errorf("failed to list account merges: %w", err)
+	}
+	return merges, nil
+}
+
+// ClaimAccountMerge marks a pending or failed merge running so only one caller runs its steps.
+// A merge left running since staleBefore is claimed again, its runner is assumed to be gone.
+func (d *Database) ClaimAccountMerge(ctx context.Context, id uuid.UUID, staleBefore time.Time) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&AccountMerge{}).
+		Where("id = ? AND (status IN ? OR (status = ? AND updated_at < ?))", id,
+			[]string{constants.MergeStatusPending, constants.MergeStatusFailed}, constants.MergeStatusRunning, staleBefore).
+		Updates(map[string]any{"status": constants.MergeStatusRunning, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim account merge: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// SaveAccountMergeProgress stores the step, status and tokens of a merge, zero values included
+func (d *Database) SaveAccountMergeProgress(ctx context.Context, merge *AccountMerge) error {
+	merge.UpdatedAt = time.Now()
+	if err := d.db.WithContext(ctx).Model(merge).
+		Select("updated_at", "step", "status", "attempts", "last_error", "completed_at",
+			"main_token", "other_token", "profile").
+		Updates(merge).Error; err != nil {
+		return fmt.Errorf("failed to save account merge: %w", err)
+	}
+	return nil
+}
+
+// CancelAccountMerge cancels a merge that has not merged the upstream accounts yet and is not running,
+// dropping its upstream tokens. It reports false when the merge cannot be cancelled.
+func (d *Database) CancelAccountMerge(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&AccountMerge{}).
+		Where("id = ? AND step = ? AND status IN ?", id, constants.MergeStepCasdoor,
+			[]string{constants.MergeStatusPending, constants.MergeStatusFailed}).
+		Updates(map[string]any{
+			"status":      constants.MergeStatusCancelled,
+			"main_token":  "",
+			"other_token": "",
+			"updated_at":  time.Now(),
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to cancel account merge: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// MergedEvent the data of an account.merged event
+type MergedEvent struct {
+	MergeID      uuid.UUID `json:"merge_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	MergedUserID uuid.UUID `json:"merged_user_id"`
+}
+
+// QuotaMergeEvent the data of a quota.merge_requested event
+type QuotaMergeEvent struct {
+	MergeID        uuid.UUID `json:"merge_id"`
+	MainUserID     uuid.UUID `json:"main_user_id"`
+	OtherUserID    uuid.UUID `json:"other_user_id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+}
+
+// MergeAccounts applies the merged profile to the main user and, when the other account is saved,
+// moves its identities and passkeys to the main user, deletes it and asks for its quota to be
+// merged. It runs in one transaction with the events announcing it, and can be repeated: a deleted
+// other account has nothing left to move and the events are only written once.
+func (d *Database) MergeAccounts(ctx context.Context, merge *AccountMerge) error {
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		profile := merge.Profile
+		result := tx.Model(&AuthUser{}).Where("id = ?", merge.MainUserID).Updates(map[string]any{
+			"name":            profile.Name,
+			"email":           profile.Email,
+			"email_verified":  profile.EmailVerified,
+			"phone":           profile.Phone,
+			"phone_verified":  profile.PhoneVerified,
+			"github_id":       profile.GithubID,
+			"github_name":     profile.GithubName,
+			"github_star":     profile.GithubStar,
+			"company":         profile.Company,
+			"location":        profile.Location,
+			"employee_number": profile.EmployeeNumber,
+			"vip":             profile.Vip,
+			"invite_code":     profile.InviteCode,
+			"inviter_id":      profile.InviterID,
+			"updated_at":      time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("main user %s no longer exists", merge.MainUserID)
+		}
+		merged := MergedEvent{MergeID: merge.ID, UserID: merge.MainUserID, MergedUserID: merge.OtherUserID}
+		if err := addOutboxEvent(tx, mergeEventID(merge, constants.EventAccountMerged), constants.EventAccountMerged,
+			merge.MainUserID, merged); err != nil {
+			return err
+		}
+		if !merge.OtherSaved {
+			return nil
+		}
+		if err := addOutboxEvent(tx, mergeEventID(merge, constants.EventQuotaMergeRequested),
+			constants.EventQuotaMergeRequested, merge.MainUserID, QuotaMergeEvent{
+				MergeID:        merge.ID,
+				MainUserID:     merge.MainUserID,
+				OtherUserID:    merge.OtherUserID,
+				IdempotencyKey: merge.ID.String() + ":" + constants.MergeStepQuota,
+			}); err != nil {
+			return err
+		}
+		moved := map[string]any{"user_id": merge.MainUserID, "updated_at": time.Now()}
+		if err := tx.Model(&UserIdentity{}).Where("user_id = ?", merge.OtherUserID).Updates(moved).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&WebAuthnCredential{}).Where("user_id = ?", merge.OtherUserID).Updates(moved).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", merge.OtherUserID).Delete(&UserTOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", merge.OtherUserID).Delete(&AuthUser{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge accounts: %w", err)
+	}
+	return nil
+}
+
+// mergeEventID the ID of an event of a merge, the same each time the merge is repeated
+func mergeEventID(merge *AccountMerge, topic string) uuid.UUID {
+	return uuid.NewSHA1(merge.ID, []byte(topic))
+}
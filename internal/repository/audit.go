@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditLogFilter narrows a list of audit log entries; empty fields match every entry
+type AuditLogFilter struct {
+	Action    string
+	Outcome   string
+	ActorID   uuid.UUID
+	SubjectID uuid.UUID
+	DeviceID  uuid.UUID
+	IP        string
+	Since     time.Time
+	Until     time.Time
+}
+
+// CreateAuditLog appends an entry to the audit log
+func (d *Database) CreateAuditLog(ctx context.Context, entry *AuditLog) error {
+	if err := d.db.WithContext(ctx).Create(entry).Error; err != nil {
+		return fmt.Errorf("failed to create audit log: %w", err)
+	}
+	return nil
+}
+
+// ListAuditLogs lists the most recent entries matching the filter
+func (d *Database) ListAuditLogs(ctx context.Context, filter AuditLogFilter, limit int) ([]AuditLog, error) {
+	query := d.db.WithContext(ctx).Order("created_at DESC").Limit(limit)
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	if filter.ActorID != uuid.Nil {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.SubjectID != uuid.Nil {
+		query = query.Where("subject_id = ?", filter.SubjectID)
+	}
+	if filter.DeviceID != uuid.Nil {
+		query = query.Where("device_id = ?", filter.DeviceID)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	var entries []AuditLog
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to list audit logs: %w", err)
+	}
+	return entries, nil
+}
+
+// DeleteAuditLogsBefore removes the entries created before the retention cutoff
+func (d *Database) DeleteAuditLogsBefore(ctx context.Context, before time.Time) (int64, error) {
+	result := d.db.WithContext(ctx).Where("created_at < ?", before).Delete(&AuditLog{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete expired audit logs: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// GetClientByID gets a registered OAuth client by its client_id
+func (d *Database) GetClientByID(ctx context.Context, clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	if err := d.db.WithContext(ctx).
+		Where("client_id = ?", clientID).
+		First(&client).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query client: %w", err)
+	}
+	return &client, nil
+}
+
+// SaveClient creates or fully overwrites a client, including zero-valued fields
+func (d *Database) SaveClient(ctx context.Context, client *OAuthClient) error {
+	if err := d.db.WithContext(ctx).Save(client).Error; err != nil {
+		return fmt.Errorf("failed to save client: %w", err)
+	}
+	return nil
+}
+
+// ListClients returns every registered OAuth client
+func (d *Database) ListClients(ctx context.Context) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	if err := d.db.WithContext(ctx).Order("client_id").Find(&clients).Error; err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+	return clients, nil
+}
+
+// AllowsGrant reports whether the client may use the given grant type
+func (c *OAuthClient) AllowsGrant(grant string) bool {
+	return slices.Contains(c.AllowedGrants, grant)
+}
+
+// AllowsURIScheme reports whether the client may be deep-linked back through the given custom scheme
+func (c *OAuthClient) AllowsURIScheme(scheme string) bool {
+	return slices.Contains(c.URISchemes, strings.ToLower(scheme))
+}
+
+// AllowsRedirectURI reports whether the URI exactly matches one of the registered redirect URIs
+func (c *OAuthClient) AllowsRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// RedirectURIForScheme returns the first registered redirect URI using the given scheme
+func (c *OAuthClient) RedirectURIForScheme(scheme string) string {
+	for _, uri := range c.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err == nil && strings.EqualFold(parsed.Scheme, scheme) {
+			return uri
+		}
+	}
+	return ""
+}
+
+// IsConfidential reports whether the client has a secret and must authenticate itself
+func (c *OAuthClient) IsConfidential() bool {
+	return c.ClientSecretHash != ""
+}
+
+// TokenAudience returns the audience for tokens issued to this client
+func (c *OAuthClient) TokenAudience() []string {
+	if len(c.Audience) > 0 {
+		return c.Audience
+	}
+	return []string{c.Platform + "-app"}
+}
+
+// AccessTokenExpiry returns the access token lifetime for this client
+func (c *OAuthClient) AccessTokenExpiry() time.Duration {
+	if c.AccessTokenTTL > 0 {
+		return time.Duration(c.AccessTokenTTL) * time.Second
+	}
+	return constants.DefaultAccessTokenTTL
+}
+
+// RefreshTokenExpiry returns the refresh token lifetime for this client
+func (c *OAuthClient) RefreshTokenExpiry() time.Duration {
+	if c.RefreshTokenTTL > 0 {
+		return time.Duration(c.RefreshTokenTTL) * time.Second
+	}
+	return constants.DefaultRefreshTokenTTL
+}
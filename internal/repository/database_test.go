@@ -0,0 +1,13 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository/repositorytest"
+)
+
+// newTestDatabase opens an empty in-memory database with the given models migrated
+func newTestDatabase(t *testing.T, models ...any) *Database {
+	t.Helper()
+	return NewDatabase(repositorytest.Open(t, models...))
+}
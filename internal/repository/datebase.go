@@ -53,6 +53,11 @@ func GetDB() *Database {
 	return globalDb
 }
 
+// NewDatabase wraps an open connection that is already migrated, e.g. a test database
+func NewDatabase(db *gorm.DB) *Database {
+	return &Database{db: db}
+}
+
 // newDatabaseImpl creates a new Database globalDb
 func newDatabaseImpl(cfg *DBConfig) (*Database, error) {
 	newLogger := logger.New(
@@ -95,6 +100,24 @@ func newDatabaseImpl(cfg *DBConfig) (*Database, error) {
 	if err := db_.AutoMigrate(
 		&AuthUser{},
 		&SyncLock{},
+		&OAuthClient{},
+		&SchemaMigration{},
+		&SmsVerificationCode{},
+		&RateLimitBucket{},
+		&RateLimitWindow{},
+		&UsedDeviceProof{},
+		&EmailVerification{},
+		&UserTOTP{},
+		&MFAChallenge{},
+		&WebAuthnCredential{},
+		&WebAuthnSession{},
+		&UserIdentity{},
+		&PhoneConflict{},
+		&IdentityUnbind{},
+		&AccountMerge{},
+		&WebhookDelivery{},
+		&OutboxEvent{},
+		&AuditLog{},
 	); err != nil {
 		return nil, fmt.Errorf("failed to auto migrate: %v", err)
 	}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxKnownOrigins bounds the countries, networks and plugin versions remembered per device
+const maxKnownOrigins = 20
+
+// RegisterKey binds the device to a key by its thumbprint
+func (a *DeviceAttestation) RegisterKey(thumbprint string, at time.Time) {
+	a.KeyThumbprint = thumbprint
+	a.KeyRegisteredAt = &at
+}
+
+// Inherit keeps what was known of the device a login replaces, and its key unless the login
+// registered another one
+func (a *DeviceAttestation) Inherit(previous DeviceAttestation) {
+	key, registeredAt := a.KeyThumbprint, a.KeyRegisteredAt
+	*a = previous
+	if key != "" {
+		a.KeyThumbprint, a.KeyRegisteredAt = key, registeredAt
+	}
+}
+
+// RememberPluginVersion adds a version to the plugin version history
+func (a *DeviceAttestation) RememberPluginVersion(version string, at time.Time) {
+	if version == "" {
+		return
+	}
+	if slices.ContainsFunc(a.PluginVersions, func(seen PluginVersionSeen) bool { return seen.Version == version }) {
+		return
+	}
+	a.PluginVersions = appendBounded(a.PluginVersions, PluginVersionSeen{Version: version, FirstSeenAt: at})
+}
+
+// RememberOrigin adds a country and network to those the device was seen from
+func (a *DeviceAttestation) RememberOrigin(country, asn string) {
+	if country != "" && !slices.Contains(a.Countries, country) {
+		a.Countries = appendBounded(a.Countries, country)
+	}
+	if asn != "" && !slices.Contains(a.ASNs, asn) {
+		a.ASNs = appendBounded(a.ASNs, asn)
+	}
+}
+
+func appendBounded[T any](values []T, value T) []T {
+	values = append(values, value)
+	if len(values) > maxKnownOrigins {
+		values = values[len(values)-maxKnownOrigins:]
+	}
+	return values
+}
+
+// SaveUserDevice saves the user with the device at index while holding a lock on the stored user,
+// so concurrent logins of its other devices are neither lost nor missed: the other devices are
+// taken as stored, only the one at index, matched by its ID or machine, comes from the user.
+// check runs under the lock on the merged user with the stored copy of the device, nil for a new
+// one, and may change the user before it is saved; an error from it saves nothing. A user not
+// stored yet is created. The user is left with the merged devices and the returned index is the
+// one of the device among them.
+func (d *Database) SaveUserDevice(ctx context.Context, user *AuthUser, index int,
+	check func(user *AuthUser, index int, stored *Device) error) (int, error) {
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var locked AuthUser
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", user.ID).First(&locked).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		exists := err == nil
+		var stored *Device
+		if exists {
+			device := user.Devices[index]
+			devices := slices.Clone(locked.Devices)
+			index = slices.IndexFunc(devices, func(candidate Device) bool {
+				return candidate.ID == device.ID ||
+					(candidate.MachineCode == device.MachineCode && candidate.VSCodeVersion == device.VSCodeVersion)
+			})
+			if index == -1 {
+				devices = append(devices, device)
+				index = len(devices) - 1
+			} else {
+				stored = &locked.Devices[index]
+				device.ID = stored.ID
+				devices[index] = device
+			}
+			user.Devices = devices
+		}
+		if check != nil {
+			if err := check(user, index, stored); err != nil {
+				return err
+			}
+		}
+		if !exists {
+			return tx.Create(user).Error
+		}
+		return tx.Model(&locked).Updates(user).Error
+	})
+	if err != nil {
+		return -1, err
+	}
+	return index, nil
+}
+
+// UpdateUserDevices changes the stored devices of a user while holding a lock on it and saves
+// only the devices, so neither a concurrent login of another device nor a profile change is
+// overwritten. update gets the stored devices and may change them in place; an error from it
+// saves nothing. The user is left with the devices as saved.
+func (d *Database) UpdateUserDevices(ctx context.Context, user *AuthUser, update func(devices []Device) error) error {
+	return d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var locked AuthUser
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "devices").
+			Where("id = ?", user.ID).First(&locked).Error; err != nil {
+			return err
+		}
+		if err := update(locked.Devices); err != nil {
+			return err
+		}
+		locked.UpdatedAt = time.Now()
+		if err := tx.Model(&locked).Select("devices", "updated_at").Updates(&locked).Error; err != nil {
+			return err
+		}
+		user.Devices, user.UpdatedAt = locked.Devices, locked.UpdatedAt
+		return nil
+	})
+}
+
+// UseDeviceProof records a device key proof by the hash of its key and jti, reporting false when
+// it was recorded before, by any replica
+func (d *Database) UseDeviceProof(ctx context.Context, proofHash string, expiresAt time.Time) (bool, error) {
+	result := d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&UsedDeviceProof{ProofHash: proofHash, ExpiresAt: expiresAt})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record device proof: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// DeleteExpiredDeviceProofs removes the used proofs expired before, which are refused for their age by then
+func (d *Database) DeleteExpiredDeviceProofs(ctx context.Context, before time.Time) (int64, error) {
+	result := d.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&UsedDeviceProof{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete expired device proofs: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+var errTooManyDevices = errors.New("too many devices")
+
+// admitWithin logs in the device at index unless the user is logged in on limit devices already
+func admitWithin(limit int) func(*AuthUser, int, *Device) error {
+	return func(user *AuthUser, index int, _ *Device) error {
+		signedIn := 0
+		for i, device := range user.Devices {
+			if i != index && device.Status == constants.LoginStatusLoggedIn {
+				signedIn++
+			}
+		}
+		if signedIn >= limit {
+			return errTooManyDevices
+		}
+		user.Devices[index].Status = constants.LoginStatusLoggedIn
+		return nil
+	}
+}
+
+func storedDevices(t *testing.T, db *Database, userID uuid.UUID) []Device {
+	t.Helper()
+	var user AuthUser
+	if err := db.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.Devices
+}
+
+func TestSaveUserDeviceKeepsOtherDevices(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{})
+	ctx := context.Background()
+	userID := uuid.New()
+	now := time.Now()
+	stored := &AuthUser{ID: userID, Name: "user", Devices: []Device{
+		{ID: uuid.New(), MachineCode: "a", VSCodeVersion: "1", Status: constants.LoginStatusLoggedIn, UpdatedAt: now},
+	}}
+	if err := db.db.Create(stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	// read before the first device was evicted and another one logged in
+	stale := *stored
+	stale.Devices = []Device{stored.Devices[0], {ID: uuid.New(), MachineCode: "c", VSCodeVersion: "1", UpdatedAt: now}}
+	stored.Devices[0].Status = constants.LoginStatusEvicted
+	stored.Devices = append(stored.Devices, Device{ID: uuid.New(), MachineCode: "b", VSCodeVersion: "1",
+		Status: constants.LoginStatusLoggedIn, UpdatedAt: now})
+	if err := db.db.Model(stored).Select("devices").Updates(stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := db.SaveUserDevice(ctx, &stale, 1, nil)
+	if err != nil {
+		t.Fatalf("SaveUserDevice: %v", err)
+	}
+	devices := storedDevices(t, db, userID)
+	if index != 2 || len(devices) != 3 {
+		t.Fatalf("index = %d with %d devices, want 2 with 3", index, len(devices))
+	}
+	if devices[0].Status != constants.LoginStatusEvicted || devices[1].MachineCode != "b" || devices[2].MachineCode != "c" {
+		t.Errorf("devices = %+v, want the eviction and the other login kept", devices)
+	}
+}
+
+func TestSaveUserDeviceCheckFailureSavesNothing(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{})
+	ctx := context.Background()
+	user := &AuthUser{ID: uuid.New(), Name: "user", Devices: []Device{
+		{ID: uuid.New(), MachineCode: "a", VSCodeVersion: "1", Status: constants.LoginStatusLoggedIn},
+	}}
+	if err := db.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	login := *user
+	login.Devices = append(login.Devices, Device{ID: uuid.New(), MachineCode: "b", VSCodeVersion: "1"})
+	if _, err := db.SaveUserDevice(ctx, &login, 1, admitWithin(1)); !errors.Is(err, errTooManyDevices) {
+		t.Fatalf("SaveUserDevice error = %v, want %v", err, errTooManyDevices)
+	}
+	if devices := storedDevices(t, db, user.ID); len(devices) != 1 {
+		t.Errorf("%d devices stored, want the refused login not saved", len(devices))
+	}
+}
+
+func TestSaveUserDeviceConcurrentLogins(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{})
+	ctx := context.Background()
+	user := &AuthUser{ID: uuid.New(), Name: "user"}
+	if err := db.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const limit = 3
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every login read the user before any other one saved
+			login := *user
+			login.Devices = []Device{{ID: uuid.New(), MachineCode: uuid.NewString(), VSCodeVersion: "1"}}
+			if _, err := db.SaveUserDevice(ctx, &login, 0, admitWithin(limit)); err != nil && !errors.Is(err, errTooManyDevices) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	devices := storedDevices(t, db, user.ID)
+	if len(devices) != limit {
+		t.Fatalf("%d devices stored, want %d", len(devices), limit)
+	}
+	for _, device := range devices {
+		if device.Status != constants.LoginStatusLoggedIn {
+			t.Errorf("device %s status = %s, want logged in", device.ID, device.Status)
+		}
+	}
+}
+
+func TestUpdateUserDevicesKeepsConcurrentChanges(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{})
+	ctx := context.Background()
+	user := &AuthUser{ID: uuid.New(), Name: "user", Devices: []Device{
+		{ID: uuid.New(), MachineCode: "a", VSCodeVersion: "1", Status: constants.LoginStatusLoggedIn},
+	}}
+	if err := db.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale := *user
+	// another device logged in and the profile changed after the user was read
+	login := *user
+	login.Devices = []Device{{ID: uuid.New(), MachineCode: "b", VSCodeVersion: "1"}}
+	if _, err := db.SaveUserDevice(ctx, &login, 0, admitWithin(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Model(&AuthUser{}).Where("id = ?", user.ID).Update("name", "renamed").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Name = "stale"
+	err := db.UpdateUserDevices(ctx, &stale, func(devices []Device) error {
+		for i := range devices {
+			devices[i].Status = constants.LoginStatusLoggedOffline
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUserDevices: %v", err)
+	}
+	var stored AuthUser
+	if err := db.db.Where("id = ?", user.ID).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "renamed" {
+		t.Errorf("name = %q, want the concurrent change kept", stored.Name)
+	}
+	if len(stored.Devices) != 2 || len(stale.Devices) != 2 {
+		t.Fatalf("%d devices stored and %d on the user, want both logins", len(stored.Devices), len(stale.Devices))
+	}
+	for _, device := range stored.Devices {
+		if device.Status != constants.LoginStatusLoggedOffline {
+			t.Errorf("device %s status = %s, want signed out", device.MachineCode, device.Status)
+		}
+	}
+
+	if err := db.UpdateUserDevices(ctx, &stale, func(devices []Device) error {
+		devices[0].Status = constants.LoginStatusLoggedIn
+		return errTooManyDevices
+	}); !errors.Is(err, errTooManyDevices) {
+		t.Fatalf("UpdateUserDevices error = %v, want %v", err, errTooManyDevices)
+	}
+	if devices := storedDevices(t, db, user.ID); devices[0].Status != constants.LoginStatusLoggedOffline {
+		t.Errorf("a failed update saved status %s", devices[0].Status)
+	}
+}
+
+func TestUseDeviceProof(t *testing.T) {
+	db := newTestDatabase(t, &UsedDeviceProof{})
+	ctx := context.Background()
+	now := time.Now()
+
+	var unused atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.UseDeviceProof(ctx, "proof", now.Add(time.Minute))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				unused.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := unused.Load(); got != 1 {
+		t.Errorf("proof accepted %d times, want once", got)
+	}
+
+	if _, err := db.UseDeviceProof(ctx, "expired", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := db.DeleteExpiredDeviceProofs(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("%d proofs deleted, want the expired one", deleted)
+	}
+	if ok, err := db.UseDeviceProof(ctx, "proof", now.Add(time.Minute)); err != nil || ok {
+		t.Errorf("UseDeviceProof of an unexpired used proof = %v, %v, want false", ok, err)
+	}
+}
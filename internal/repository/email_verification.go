@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// CreateEmailVerification stores a new login email and invalidates the unused ones of the same address and purpose
+func (d *Database) CreateEmailVerification(ctx context.Context, v *EmailVerification) error {
+	return d.withTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(&EmailVerification{}).
+			Where("email = ? AND purpose = ? AND is_used = ?", v.Email, v.Purpose, false).
+			Update("is_used", true).Error; err != nil {
+			return fmt.Errorf("failed to invalidate previous email verifications: %w", err)
+		}
+		if err := tx.Create(v).Error; err != nil {
+			return fmt.Errorf("failed to create email verification: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetLatestEmailVerification gets the most recent login email of an address and purpose, used or not
+func (d *Database) GetLatestEmailVerification(ctx context.Context, email, purpose string) (*EmailVerification, error) {
+	var v EmailVerification
+	if err := d.db.WithContext(ctx).
+		Where("email = ? AND purpose = ?", email, purpose).
+		Order("created_at DESC").
+		First(&v).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query email verification: %w", err)
+	}
+	return &v, nil
+}
+
+// GetEmailVerificationByToken gets a login email by the hash of its magic link token
+func (d *Database) GetEmailVerificationByToken(ctx context.Context, tokenHash string) (*EmailVerification, error) {
+	var v EmailVerification
+	if err := d.db.WithContext(ctx).Where("token_hash = ?", tokenHash).First(&v).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query email verification: %w", err)
+	}
+	return &v, nil
+}
+
+// ClaimEmailVerificationAttempt counts a code attempt against an unused login email in a single
+// conditional update, so concurrent guesses cannot all pass the limit. It reports false when the
+// code has already been tried maxAttempts times or the email was consumed.
+func (d *Database) ClaimEmailVerificationAttempt(ctx context.Context, v *EmailVerification, maxAttempts int) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&EmailVerification{}).
+		Where("id = ? AND is_used = ? AND attempts < ?", v.ID, false, maxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update email verification attempts: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ConsumeEmailVerification marks a login email used; it reports false if it was consumed concurrently
+func (d *Database) ConsumeEmailVerification(ctx context.Context, v *EmailVerification) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&EmailVerification{}).
+		Where("id = ? AND is_used = ?", v.ID, false).
+		UpdateColumn("is_used", true)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to consume email verification: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// GetUserByVerifiedEmail gets the user a verified email is linked to
+func (d *Database) GetUserByVerifiedEmail(ctx context.Context, email string) (*AuthUser, error) {
+	return d.GetUserByIdentity(ctx, constants.IdentityEmail, strings.ToLower(email))
+}
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimEmailVerificationAttempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		used     bool
+		want     bool
+	}{
+		{"first attempt", 0, false, true},
+		{"last attempt", 4, false, true},
+		{"attempts used up", 5, false, false},
+		{"consumed code", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t, &EmailVerification{})
+			ctx := context.Background()
+			v := &EmailVerification{ID: uuid.New(), Email: "user@example.com", Purpose: "login",
+				TokenHash: uuid.NewString(), Attempts: tt.attempts, IsUsed: tt.used, ExpiresAt: time.Now().Add(time.Minute)}
+			if err := db.db.Create(v).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.ClaimEmailVerificationAttempt(ctx, v, 5)
+			if err != nil {
+				t.Fatalf("ClaimEmailVerificationAttempt: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ClaimEmailVerificationAttempt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+// ErrIdentityLinked the identity already belongs to another user
+var ErrIdentityLinked = errors.New("the identity is linked to another account")
+
+// Identities returns the login identities the profile of the user carries: its GitHub account,
+// phone number and verified email. Only a phone proved with an SMS code is verified, a phone the
+// upstream profile carries is not.
+func (u *AuthUser) Identities() []UserIdentity {
+	var identities []UserIdentity
+	if u.GithubID != "" {
+		identities = append(identities, UserIdentity{Provider: constants.IdentityGitHub, Subject: u.GithubID, Verified: true})
+	}
+	if u.Phone != "" {
+		if normalized, err := phone.Normalize(u.Phone); err == nil {
+			identities = append(identities, UserIdentity{Provider: constants.IdentityPhone, Subject: normalized, Verified: u.PhoneVerified})
+		}
+	}
+	if u.Email != "" && u.EmailVerified {
+		identities = append(identities, UserIdentity{
+			Provider: constants.IdentityEmail,
+			Subject:  strings.ToLower(strings.TrimSpace(u.Email)),
+			Verified: true,
+		})
+	}
+	return identities
+}
+
+// GetUserByIdentity gets the user a verified identity is linked to; an unverified identity
+// never signs anyone in to the account holding it
+func (d *Database) GetUserByIdentity(ctx context.Context, provider, subject string) (*AuthUser, error) {
+	var user AuthUser
+	linked := d.db.Model(&UserIdentity{}).Select("user_id").
+		Where("provider = ? AND subject = ? AND verified = ?", provider, subject, true)
+	if err := d.db.WithContext(ctx).Where("id IN (?)", linked).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query user by identity: %w", err)
+	}
+	return &user, nil
+}
+
+// GetUserByIdentities gets the user the first verified identity of the list is linked to
+func (d *Database) GetUserByIdentities(ctx context.Context, identities []UserIdentity) (*AuthUser, error) {
+	for _, identity := range identities {
+		if !identity.Verified {
+			continue
+		}
+		user, err := d.GetUserByIdentity(ctx, identity.Provider, identity.Subject)
+		if err != nil || user != nil {
+			return user, err
+		}
+	}
+	return nil, nil
+}
+
+// ListUserIdentities lists the identities of a user, in the order they were linked
+func (d *Database) ListUserIdentities(ctx context.Context, userID uuid.UUID) ([]UserIdentity, error) {
+	var identities []UserIdentity
+	if err := d.db.WithContext(ctx).Where("user_id = ?", userID).Order("linked_at").Find(&identities).Error; err != nil {
+		return nil, fmt.Errorf("failed to list user identities: %w", err)
+	}
+	return identities, nil
+}
+
+// LinkUserIdentity links an identity to a user and fills the matching profile field when the user
+// has none. Linking an identity the user has already only updates whether it is verified. A
+// verified identity takes over the same identity linked unverified to another user.
+func (d *Database) LinkUserIdentity(ctx context.Context, userID uuid.UUID, identity UserIdentity) (*UserIdentity, error) {
+	var linked UserIdentity
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&linked).Error
+		switch {
+		case err == nil:
+			if linked.UserID != userID {
+				if linked.Verified || !identity.Verified {
+					return ErrIdentityLinked
+				}
+				log.Warn(nil, "verified %s identity of user %s takes over the unverified link of user %s",
+					identity.Provider, userID, linked.UserID)
+				if err := clearProfileField(tx, linked.UserID, &linked); err != nil {
+					return err
+				}
+				now := time.Now()
+				linked.UserID = userID
+				linked.Verified = true
+				linked.UpdatedAt = now
+				linked.LinkedAt = now
+				if err := tx.Model(&linked).Updates(map[string]any{
+					"user_id": userID, "verified": true, "updated_at": now, "linked_at": now,
+				}).Error; err != nil {
+					return err
+				}
+				return fillProfileField(tx, userID, &linked)
+			}
+			if identity.Verified && !linked.Verified {
+				linked.Verified = true
+				return tx.Model(&linked).Updates(map[string]any{"verified": true, "updated_at": time.Now()}).Error
+			}
+			return nil
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			now := time.Now()
+			linked = identity
+			linked.ID = uuid.New()
+			linked.UserID = userID
+			linked.CreatedAt = now
+			linked.UpdatedAt = now
+			linked.LinkedAt = now
+			if err := tx.Create(&linked).Error; err != nil {
+				return err
+			}
+			return fillProfileField(tx, userID, &linked)
+		default:
+			return err
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to link %s identity: %w", identity.Provider, err)
+	}
+	return &linked, nil
+}
+
+// SyncUserIdentities links the identities the profile of a saved user carries. An identity linked
+// to another user stays with it and is logged; the accounts need to be merged to move it.
+func (d *Database) SyncUserIdentities(ctx context.Context, user *AuthUser) error {
+	for _, identity := range user.Identities() {
+		if _, err := d.LinkUserIdentity(ctx, user.ID, identity); err != nil {
+			if errors.Is(err, ErrIdentityLinked) {
+				log.Warn(nil, "%s identity of user %s is linked to another user, not linked", identity.Provider, user.ID)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// UnlinkUserIdentity removes the identity of an unbind and clears the profile field holding it,
+// deleting the unbind in the same transaction. It returns nil when the user has no such identity.
+func (d *Database) UnlinkUserIdentity(ctx context.Context, unbind *IdentityUnbind) (*UserIdentity, error) {
+	var removed *UserIdentity
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", unbind.ID).Delete(&IdentityUnbind{}).Error; err != nil {
+			return err
+		}
+		var identity UserIdentity
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", unbind.IdentityID, unbind.UserID).First(&identity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		if err := tx.Delete(&identity).Error; err != nil {
+			return err
+		}
+		if err := clearProfileField(tx, unbind.UserID, &identity); err != nil {
+			return err
+		}
+		removed = &identity
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlink identity: %w", err)
+	}
+	return removed, nil
+}
+
+// SplitUserIdentity moves the identity of an unbind to the new user splitUser, together with the
+// devices and invitees of the unbind, deleting the unbind in the same transaction. Moved devices
+// are signed out, their tokens were issued to the old account. It returns nil when the user has
+// no such identity.
+func (d *Database) SplitUserIdentity(ctx context.Context, unbind *IdentityUnbind, splitUser *AuthUser) (*UserIdentity, error) {
+	userID := unbind.UserID
+	var moved *UserIdentity
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", unbind.ID).Delete(&IdentityUnbind{}).Error; err != nil {
+			return err
+		}
+		var user AuthUser
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+		var identity UserIdentity
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", unbind.IdentityID, userID).First(&identity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		// the profile field is cleared first, the split user takes it over
+		if err := clearProfileField(tx, userID, &identity); err != nil {
+			return err
+		}
+		now := time.Now()
+		kept := make([]Device, 0, len(user.Devices))
+		for _, device := range user.Devices {
+			if !slices.Contains(unbind.DeviceIDs, device.ID) {
+				kept = append(kept, device)
+				continue
+			}
+			device.Status = constants.LoginStatusLoggedOffline
+			device.AccessToken, device.AccessTokenHash = "", ""
+			device.RefreshToken, device.RefreshTokenHash = "", ""
+			device.State = ""
+			device.UpdatedAt = now
+			splitUser.Devices = append(splitUser.Devices, device)
+		}
+		if err := tx.Create(splitUser).Error; err != nil {
+			return err
+		}
+		user.Devices = kept
+		user.UpdatedAt = now
+		if err := tx.Model(&user).Select("devices", "updated_at").Updates(&user).Error; err != nil {
+			return err
+		}
+
+		identity.UserID = splitUser.ID
+		identity.UpdatedAt = now
+		if err := tx.Model(&identity).Updates(map[string]any{"user_id": splitUser.ID, "updated_at": now}).Error; err != nil {
+			return err
+		}
+		if len(unbind.InviteeIDs) > 0 {
+			if err := tx.Model(&AuthUser{}).Where("id IN ? AND inviter_id = ?", unbind.InviteeIDs, userID).
+				Update("inviter_id", splitUser.ID).Error; err != nil {
+				return err
+			}
+		}
+		moved = &identity
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to split identity: %w", err)
+	}
+	return moved, nil
+}
+
+// fillProfileField copies a newly linked identity to the profile of the user when the field is empty
+func fillProfileField(tx *gorm.DB, userID uuid.UUID, identity *UserIdentity) error {
+	users := tx.Model(&AuthUser{}).Where("id = ?", userID)
+	switch identity.Provider {
+	case constants.IdentityGitHub:
+		return users.Where("github_id IS NULL OR github_id = ''").UpdateColumn("github_id", identity.Subject).Error
+	case constants.IdentityPhone:
+		return users.Where("phone IS NULL OR phone = '' OR phone = ?", identity.Subject).
+			UpdateColumns(map[string]any{"phone": identity.Subject, "phone_verified": identity.Verified}).Error
+	case constants.IdentityEmail:
+		return users.Where("email IS NULL OR email = '' OR LOWER(email) = ?", identity.Subject).
+			UpdateColumns(map[string]any{"email": identity.Subject, "email_verified": identity.Verified}).Error
+	}
+	return nil
+}
+
+// clearProfileField removes an unlinked identity from the profile of the user, so it is not linked again
+func clearProfileField(tx *gorm.DB, userID uuid.UUID, identity *UserIdentity) error {
+	users := tx.Model(&AuthUser{}).Where("id = ?", userID)
+	switch identity.Provider {
+	case constants.IdentityGitHub:
+		return users.Where("github_id = ?", identity.Subject).
+			UpdateColumns(map[string]any{"github_id": "", "github_name": ""}).Error
+	case constants.IdentityPhone:
+		return users.Where("phone = ?", identity.Subject).
+			UpdateColumns(map[string]any{"phone": "", "phone_verified": false}).Error
+	case constants.IdentityEmail:
+		return users.Where("LOWER(email) = ?", identity.Subject).UpdateColumn("email_verified", false).Error
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+func TestLinkUserIdentityVerifiedTakesOver(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{}, &UserIdentity{})
+	ctx := context.Background()
+	const number = "+8613800000000"
+	profileOwner := &AuthUser{ID: uuid.New(), Name: "profile", Phone: number}
+	prover := &AuthUser{ID: uuid.New(), Name: "prover"}
+	third := &AuthUser{ID: uuid.New(), Name: "third"}
+	for _, user := range []*AuthUser{profileOwner, prover, third} {
+		if err := db.db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the number an upstream profile carries is linked unverified and signs nobody in
+	if err := db.SyncUserIdentities(ctx, profileOwner); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := db.GetUserByPhone(ctx, number); err != nil || user != nil {
+		t.Fatalf("GetUserByPhone = %v, %v, want no user for an unverified number", user, err)
+	}
+	if _, err := db.LinkUserIdentity(ctx, third.ID, UserIdentity{Provider: constants.IdentityPhone, Subject: number}); !errors.Is(err, ErrIdentityLinked) {
+		t.Errorf("unverified link of a linked number: err = %v, want ErrIdentityLinked", err)
+	}
+
+	linked, err := db.LinkUserIdentity(ctx, prover.ID, UserIdentity{Provider: constants.IdentityPhone, Subject: number, Verified: true})
+	if err != nil {
+		t.Fatalf("LinkUserIdentity: %v", err)
+	}
+	if linked.UserID != prover.ID || !linked.Verified {
+		t.Errorf("linked = %+v, want a verified link of the prover", linked)
+	}
+	var phones []string
+	if err := db.db.Model(&AuthUser{}).Where("id = ?", profileOwner.ID).Pluck("phone", &phones).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(phones) != 1 || phones[0] != "" {
+		t.Errorf("phone of the previous owner = %v, want it cleared", phones)
+	}
+	if ids, err := db.ListUserIdentities(ctx, profileOwner.ID); err != nil || len(ids) != 0 {
+		t.Errorf("identities of the previous owner = %v, %v, want none", ids, err)
+	}
+
+	if _, err := db.LinkUserIdentity(ctx, third.ID, UserIdentity{Provider: constants.IdentityPhone, Subject: number, Verified: true}); !errors.Is(err, ErrIdentityLinked) {
+		t.Errorf("verified link of a verified number: err = %v, want ErrIdentityLinked", err)
+	}
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// CreateIdentityUnbind stores a new unbind, or returns the unbind of the same identity and user
+// already stored
+func (d *Database) CreateIdentityUnbind(ctx context.Context, unbind *IdentityUnbind) (*IdentityUnbind, error) {
+	if err := d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(unbind).Error; err != nil {
+		return nil, fmt.Errorf("failed to create identity unbind: %w", err)
+	}
+	var stored IdentityUnbind
+	if err := d.db.WithContext(ctx).Where("identity_id = ? AND user_id = ?", unbind.IdentityID, unbind.UserID).
+		First(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to query identity unbind: %w", err)
+	}
+	return &stored, nil
+}
+
+// GetIdentityUnbind gets an unbind by ID
+func (d *Database) GetIdentityUnbind(ctx context.Context, id uuid.UUID) (*IdentityUnbind, error) {
+	var unbind IdentityUnbind
+	if err := d.db.WithContext(ctx).Where("id = ?", id).First(&unbind).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query identity unbind: %w", err)
+	}
+	return &unbind, nil
+}
+
+// ClaimIdentityUnbind marks a pending or failed unbind running so only one caller runs its steps,
+// and stores the split options of unbind with it. An unbind left running since staleBefore is
+// claimed again, its runner is assumed to be gone.
+func (d *Database) ClaimIdentityUnbind(ctx context.Context, unbind *IdentityUnbind, staleBefore time.Time) (bool, error) {
+	claimed := IdentityUnbind{
+		UpdatedAt:  time.Now(),
+		Split:      unbind.Split,
+		DeviceIDs:  unbind.DeviceIDs,
+		InviteeIDs: unbind.InviteeIDs,
+		Status:     constants.MergeStatusRunning,
+	}
+	result := d.db.WithContext(ctx).Model(&IdentityUnbind{}).
+		Where("id = ? AND (status IN ? OR (status = ? AND updated_at < ?))", unbind.ID,
+			[]string{constants.MergeStatusPending, constants.MergeStatusFailed}, constants.MergeStatusRunning, staleBefore).
+		Select("updated_at", "split", "device_ids", "invitee_ids", "status").
+		Updates(&claimed)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim identity unbind: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// SaveIdentityUnbindProgress stores the step and status of an unbind, zero values included
+func (d *Database) SaveIdentityUnbindProgress(ctx context.Context, unbind *IdentityUnbind) error {
+	unbind.UpdatedAt = time.Now()
+	if err := d.db.WithContext(ctx).Model(unbind).
+		Select("updated_at", "step", "status", "attempts", "last_error").
+		Updates(unbind).Error; err != nil {
+		return fmt.Errorf("failed to save identity unbind: %w", err)
+	}
+	return nil
+}
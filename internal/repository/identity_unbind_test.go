@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+func TestIdentityUnbindClaim(t *testing.T) {
+	db := newTestDatabase(t, &IdentityUnbind{})
+	ctx := context.Background()
+	now := time.Now()
+	first, err := db.CreateIdentityUnbind(ctx, &IdentityUnbind{
+		ID: uuid.New(), CreatedAt: now, UpdatedAt: now, IdentityID: uuid.New(), UserID: uuid.New(),
+		Step: constants.UnbindStepUpstream, Status: constants.MergeStatusPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unbinding the identity again returns the stored unbind
+	again, err := db.CreateIdentityUnbind(ctx, &IdentityUnbind{
+		ID: uuid.New(), IdentityID: first.IdentityID, UserID: first.UserID,
+		Step: constants.UnbindStepUpstream, Status: constants.MergeStatusPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("second unbind %s, want the stored %s", again.ID, first.ID)
+	}
+
+	deviceID := uuid.New()
+	again.Split, again.DeviceIDs = true, []uuid.UUID{deviceID}
+	if claimed, err := db.ClaimIdentityUnbind(ctx, again, now.Add(-time.Minute)); err != nil || !claimed {
+		t.Fatalf("ClaimIdentityUnbind = %v, %v, want it claimed", claimed, err)
+	}
+	if claimed, err := db.ClaimIdentityUnbind(ctx, again, now.Add(-time.Minute)); err != nil || claimed {
+		t.Fatalf("claim of a running unbind = %v, %v, want it refused", claimed, err)
+	}
+	stored, err := db.GetIdentityUnbind(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != constants.MergeStatusRunning || !stored.Split ||
+		len(stored.DeviceIDs) != 1 || stored.DeviceIDs[0] != deviceID {
+		t.Errorf("claimed unbind = %+v, want it running with the split options", stored)
+	}
+	// a runner that stopped saving is assumed to be gone
+	if claimed, err := db.ClaimIdentityUnbind(ctx, again, time.Now().Add(time.Minute)); err != nil || !claimed {
+		t.Errorf("claim of a stale unbind = %v, %v, want it claimed", claimed, err)
+	}
+}
+
+func TestSplitUserIdentityDeletesUnbind(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{}, &UserIdentity{}, &IdentityUnbind{})
+	ctx := context.Background()
+	moving, staying := uuid.New(), uuid.New()
+	user := &AuthUser{ID: uuid.New(), Name: "user", GithubID: "1001", Devices: []Device{
+		{ID: moving, Status: constants.LoginStatusLoggedIn, AccessToken: "token"},
+		{ID: staying, Status: constants.LoginStatusLoggedIn},
+	}}
+	if err := db.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	identity, err := db.LinkUserIdentity(ctx, user.ID, UserIdentity{Provider: constants.IdentityGitHub, Subject: "1001", Verified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbind, err := db.CreateIdentityUnbind(ctx, &IdentityUnbind{
+		ID: uuid.New(), IdentityID: identity.ID, UserID: user.ID, Split: true, SplitUserID: uuid.New(),
+		DeviceIDs: []uuid.UUID{moving}, Step: constants.UnbindStepLocal, Status: constants.MergeStatusRunning,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	splitUser := &AuthUser{ID: unbind.SplitUserID, Name: "split", GithubID: "1001"}
+	moved, err := db.SplitUserIdentity(ctx, unbind, splitUser)
+	if err != nil {
+		t.Fatalf("SplitUserIdentity: %v", err)
+	}
+	if moved == nil || moved.UserID != splitUser.ID {
+		t.Fatalf("moved = %+v, want the identity of the split user", moved)
+	}
+	if len(splitUser.Devices) != 1 || splitUser.Devices[0].ID != moving || splitUser.Devices[0].AccessToken != "" {
+		t.Errorf("devices of the split user = %+v, want the moved device signed out", splitUser.Devices)
+	}
+	var kept AuthUser
+	if err := db.db.First(&kept, "id = ?", user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(kept.Devices) != 1 || kept.Devices[0].ID != staying || kept.GithubID != "" {
+		t.Errorf("user = %+v, want only the staying device and no GitHub account", kept)
+	}
+	if stored, err := db.GetIdentityUnbind(ctx, unbind.ID); err != nil || stored != nil {
+		t.Errorf("unbind after the split = %+v, %v, want it deleted", stored, err)
+	}
+}
+
+func TestUnlinkUserIdentityDeletesUnbind(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{}, &UserIdentity{}, &IdentityUnbind{})
+	ctx := context.Background()
+	user := &AuthUser{ID: uuid.New(), Name: "user"}
+	if err := db.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	identity, err := db.LinkUserIdentity(ctx, user.ID, UserIdentity{Provider: constants.IdentityPhone, Subject: "+8613800000000", Verified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		unbind, err := db.CreateIdentityUnbind(ctx, &IdentityUnbind{
+			ID: uuid.New(), IdentityID: identity.ID, UserID: user.ID,
+			Step: constants.UnbindStepLocal, Status: constants.MergeStatusRunning,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the second time the identity is gone, the unbind is deleted all the same
+		removed, err := db.UnlinkUserIdentity(ctx, unbind)
+		if err != nil {
+			t.Fatalf("UnlinkUserIdentity %d: %v", i, err)
+		}
+		if (removed != nil) != want {
+			t.Errorf("UnlinkUserIdentity %d removed %+v, want an identity removed: %v", i, removed, want)
+		}
+		if stored, err := db.GetIdentityUnbind(ctx, unbind.ID); err != nil || stored != nil {
+			t.Errorf("unbind %d after the unlink = %+v, %v, want it deleted", i, stored, err)
+		}
+	}
+	var phones []string
+	if err := db.db.Model(&AuthUser{}).Where("id = ?", user.ID).Pluck("phone", &phones).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(phones) != 1 || phones[0] != "" {
+		t.Errorf("phone of the user = %v, want it cleared", phones)
+	}
+}
@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetUserTOTP gets the TOTP factor of a user, enabled or still being enrolled
+func (d *Database) GetUserTOTP(ctx context.Context, userID uuid.UUID) (*UserTOTP, error) {
+	var t UserTOTP
+	if err := d.db.WithContext(ctx).Where("user_id = ?", userID).First(&t).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query totp: %w", err)
+	}
+	return &t, nil
+}
+
+// SaveUserTOTP creates or replaces the TOTP factor of a user
+func (d *Database) SaveUserTOTP(ctx context.Context, t *UserTOTP) error {
+	t.UpdatedAt = time.Now()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = t.UpdatedAt
+	}
+	if err := d.db.WithContext(ctx).Save(t).Error; err != nil {
+		return fmt.Errorf("failed to save totp: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserTOTP removes the TOTP factor of a user
+func (d *Database) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	if err := d.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&UserTOTP{}).Error; err != nil {
+		return fmt.Errorf("failed to delete totp: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code; it reports false when that step or
+// a later one was used already, i.e. the code is a replay
+func (d *Database) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&UserTOTP{}).
+		Where("user_id = ? AND last_used_step < ?", userID, step).
+		Updates(map[string]any{"last_used_step": step, "updated_at": time.Now()})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update totp step: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RecordTOTPFailure counts a wrong code for the factor of a user. From maxFailed wrong codes in a
+// row on, every wrong code locks the factor, for lockout the first time and twice as long each
+// time after, up to maxLockout; the lock end is returned then.
+func (d *Database) RecordTOTPFailure(ctx context.Context, userID uuid.UUID, maxFailed int, lockout, maxLockout time.Duration) (*time.Time, error) {
+	var lockedUntil *time.Time
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var t UserTOTP
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("user_id", "failed_codes").Where("user_id = ?", userID).First(&t).Error; err != nil {
+			return fmt.Errorf("failed to lock totp: %w", err)
+		}
+		failed := t.FailedCodes + 1
+		updates := map[string]any{"failed_codes": failed}
+		if maxFailed > 0 && failed >= maxFailed {
+			duration := lockout
+			for i := maxFailed; i < failed && duration < maxLockout; i++ {
+				duration *= 2
+			}
+			if maxLockout > 0 {
+				duration = min(duration, maxLockout)
+			}
+			until := time.Now().Add(duration)
+			lockedUntil = &until
+			updates["locked_until"] = until
+		}
+		return tx.Model(&UserTOTP{}).Where("user_id = ?", userID).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record totp failure: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+// ResetTOTPFailures clears the wrong code count and lockout of the factor of a user
+func (d *Database) ResetTOTPFailures(ctx context.Context, userID uuid.UUID) error {
+	if err := d.db.WithContext(ctx).Model(&UserTOTP{}).Where("user_id = ?", userID).
+		Updates(map[string]any{"failed_codes": 0, "locked_until": nil}).Error; err != nil {
+		return fmt.Errorf("failed to reset totp failures: %w", err)
+	}
+	return nil
+}
+
+// ConsumeRecoveryCode removes a recovery code hash; it reports false when the user has no such code
+func (d *Database) ConsumeRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	var consumed bool
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var t UserTOTP
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND enabled = ?", userID, true).First(&t).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		index := slices.Index(t.RecoveryCodes, codeHash)
+		if index == -1 {
+			return nil
+		}
+		consumed = true
+		t.RecoveryCodes = slices.Delete(t.RecoveryCodes, index, index+1)
+		t.UpdatedAt = time.Now()
+		// a struct update so the codes go through the json serializer
+		return tx.Model(&t).Select("recovery_codes", "updated_at").Updates(&t).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to consume recovery code: %w", err)
+	}
+	return consumed, nil
+}
+
+// CreateMFAChallenge stores a new second factor challenge
+func (d *Database) CreateMFAChallenge(ctx context.Context, c *MFAChallenge) error {
+	if err := d.db.WithContext(ctx).Create(c).Error; err != nil {
+		return fmt.Errorf("failed to create mfa challenge: %w", err)
+	}
+	return nil
+}
+
+// GetMFAChallenge gets a challenge by ID
+func (d *Database) GetMFAChallenge(ctx context.Context, id uuid.UUID) (*MFAChallenge, error) {
+	var c MFAChallenge
+	if err := d.db.WithContext(ctx).Where("id = ?", id).First(&c).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query mfa challenge: %w", err)
+	}
+	return &c, nil
+}
+
+// ClaimMFAChallengeAttempt counts an attempt at an open challenge in a single conditional update,
+// so concurrent attempts cannot all pass the limit. It reports false when the challenge has
+// already been tried maxAttempts times or was completed.
+func (d *Database) ClaimMFAChallengeAttempt(ctx context.Context, id uuid.UUID, maxAttempts int) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&MFAChallenge{}).
+		Where("id = ? AND is_used = ? AND attempts < ?", id, false, maxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update mfa challenge attempts: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ConsumeMFAChallenge marks a challenge completed; it reports false if it was completed concurrently
+func (d *Database) ConsumeMFAChallenge(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&MFAChallenge{}).
+		Where("id = ? AND is_used = ?", id, false).
+		UpdateColumn("is_used", true)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to consume mfa challenge: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
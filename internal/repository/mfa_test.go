@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimMFAChallengeAttempt(t *testing.T) {
+	db := newTestDatabase(t, &MFAChallenge{})
+	ctx := context.Background()
+	challenge := &MFAChallenge{ID: uuid.New(), UserID: uuid.New(), ExpiresAt: time.Now().Add(time.Minute)}
+	if err := db.CreateMFAChallenge(ctx, challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	const maxAttempts = 3
+	for i := range maxAttempts + 2 {
+		got, err := db.ClaimMFAChallengeAttempt(ctx, challenge.ID, maxAttempts)
+		if err != nil {
+			t.Fatalf("ClaimMFAChallengeAttempt: %v", err)
+		}
+		if want := i < maxAttempts; got != want {
+			t.Errorf("attempt %d: ClaimMFAChallengeAttempt = %v, want %v", i+1, got, want)
+		}
+	}
+
+	other := &MFAChallenge{ID: uuid.New(), UserID: challenge.UserID, ExpiresAt: time.Now().Add(time.Minute)}
+	if err := db.CreateMFAChallenge(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.ConsumeMFAChallenge(ctx, other.ID); err != nil || !ok {
+		t.Fatalf("ConsumeMFAChallenge = %v, %v", ok, err)
+	}
+	if ok, err := db.ClaimMFAChallengeAttempt(ctx, other.ID, maxAttempts); err != nil || ok {
+		t.Errorf("ClaimMFAChallengeAttempt on a completed challenge = %v, %v, want false", ok, err)
+	}
+}
+
+func TestRecordTOTPFailure(t *testing.T) {
+	db := newTestDatabase(t, &UserTOTP{})
+	ctx := context.Background()
+	userID := uuid.New()
+	if err := db.db.Create(&UserTOTP{UserID: userID, Secret: "secret", Enabled: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// three wrong codes are allowed, then each one doubles the lockout up to the cap
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute}
+	for i, lockout := range want {
+		before := time.Now()
+		until, err := db.RecordTOTPFailure(ctx, userID, 3, time.Minute, 4*time.Minute)
+		if err != nil {
+			t.Fatalf("RecordTOTPFailure: %v", err)
+		}
+		if lockout == 0 {
+			if until != nil {
+				t.Errorf("failure %d: locked until %v, want no lockout", i+1, until)
+			}
+			continue
+		}
+		if until == nil {
+			t.Fatalf("failure %d: no lockout, want %v", i+1, lockout)
+		}
+		if got := until.Sub(before); got < lockout || got > lockout+time.Second {
+			t.Errorf("failure %d: locked for %v, want %v", i+1, got, lockout)
+		}
+	}
+
+	if err := db.ResetTOTPFailures(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	until, err := db.RecordTOTPFailure(ctx, userID, 3, time.Minute, 4*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until != nil {
+		t.Errorf("first failure after a reset: locked until %v, want no lockout", until)
+	}
+}
@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+// SchemaMigration records a data migration that has been applied
+type SchemaMigration struct {
+	Name      string    `gorm:"primaryKey;size:100" json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+type dataMigration struct {
+	name string
+	run  func(tx *gorm.DB) error
+}
+
+// dataMigrations run once each, in order, after the schema has been migrated
+var dataMigrations = []dataMigration{
+	{name: "20261019_backfill_phone_e164", run: backfillPhoneE164},
+	{name: "20261019_clear_unhashed_passwords", run: clearUnhashedPasswords},
+	{name: "20261019_backfill_user_identities", run: backfillUserIdentities},
+}
+
+// RunDataMigrations applies the data migrations that have not been applied yet.
+// Each migration and its record are committed in one transaction, so a concurrent
+// instance running the same migration fails on the record instead of applying it twice.
+func (d *Database) RunDataMigrations(ctx context.Context) error {
+	for _, m := range dataMigrations {
+		var applied SchemaMigration
+		err := d.db.WithContext(ctx).Where("name = ?", m.name).First(&applied).Error
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("failed to query migration %s: %w", m.name, err)
+		}
+
+		err = d.withTransaction(ctx, func(tx *gorm.DB) error {
+			if err := m.run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("data migration %s failed: %w", m.name, err)
+		}
+		log.Info(nil, "data migration %s applied", m.name)
+	}
+	return nil
+}
+
+// backfillPhoneE164 rewrites stored phone numbers to E.164.
+// When several users normalize to the same number, the most recently updated gets it and the
+// others keep their number unchanged and are recorded as phone conflicts, to be merged or fixed.
+// Numbers that cannot be parsed are left as they are and logged.
+func backfillPhoneE164(tx *gorm.DB) error {
+	var users []AuthUser
+	if err := tx.Select("id", "phone").
+		Where("phone IS NOT NULL AND phone != ''").
+		Order("updated_at DESC").
+		Find(&users).Error; err != nil {
+		return fmt.Errorf("failed to load phone numbers: %w", err)
+	}
+
+	owners := make(map[string]uuid.UUID, len(users)) // normalized phone -> user id
+	updated, conflicts := 0, 0
+	for _, user := range users {
+		normalized, err := phone.Normalize(user.Phone)
+		if err != nil {
+			log.Warn(nil, "phone backfill: user %s has an invalid phone number %q, skipped", user.ID, user.Phone)
+			continue
+		}
+		if owner, ok := owners[normalized]; ok {
+			log.Warn(nil, "phone backfill: user %s phone %q duplicates user %s, recorded as a conflict", user.ID, user.Phone, owner)
+			if err := recordPhoneConflict(tx, user.ID, owner, normalized, user.Phone); err != nil {
+				return err
+			}
+			conflicts++
+			continue
+		}
+		owners[normalized] = user.ID
+		if normalized == user.Phone {
+			continue
+		}
+		if err := tx.Model(&AuthUser{}).Where("id = ?", user.ID).
+			UpdateColumn("phone", normalized).Error; err != nil {
+			return fmt.Errorf("failed to update phone of user %s: %w", user.ID, err)
+		}
+		updated++
+	}
+	log.Info(nil, "phone backfill: normalized %d and recorded %d conflicting of %d phone numbers", updated, conflicts, len(users))
+	return nil
+}
+
+// recordPhoneConflict records that the number of a user is the number of owner; recording it again does nothing
+func recordPhoneConflict(tx *gorm.DB, userID, ownerID uuid.UUID, normalized, original string) error {
+	conflict := PhoneConflict{
+		ID:            uuid.New(),
+		CreatedAt:     time.Now(),
+		UserID:        userID,
+		OwnerID:       ownerID,
+		Phone:         normalized,
+		OriginalPhone: original,
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&conflict).Error; err != nil {
+		return fmt.Errorf("failed to record phone conflict of user %s: %w", userID, err)
+	}
+	return nil
+}
+
+// clearUnhashedPasswords empties password values that are not argon2id or bcrypt hashes.
+// The column was never written by the server, so such values cannot be trusted as credentials.
+func clearUnhashedPasswords(tx *gorm.DB) error {
+	result := tx.Model(&AuthUser{}).
+		Where("password IS NOT NULL AND password != ''").
+		Where("password NOT LIKE ? AND password NOT LIKE ? AND password NOT LIKE ? AND password NOT LIKE ?",
+			"$argon2id$%", "$2a$%", "$2b$%", "$2y$%").
+		UpdateColumn("password", "")
+	if result.Error != nil {
+		return fmt.Errorf("failed to clear unhashed passwords: %w", result.Error)
+	}
+	log.Info(nil, "password cleanup: cleared %d unhashed passwords", result.RowsAffected)
+	return nil
+}
+
+// backfillUserIdentities links the GitHub accounts, phone numbers and verified emails of existing
+// users as identities. A phone counts as verified when the user signed in with an SMS code to it.
+// When several users share one identity, a verified link wins over an unverified one and otherwise
+// the most recently updated user keeps it; it is removed from the profile of the others, except
+// a phone number, which they keep and are recorded as phone conflicts for.
+func backfillUserIdentities(tx *gorm.DB) error {
+	var users []AuthUser
+	if err := tx.Select("id", "created_at", "github_id", "phone", "email", "email_verified", "devices").
+		Order("updated_at DESC").
+		Find(&users).Error; err != nil {
+		return fmt.Errorf("failed to load users: %w", err)
+	}
+
+	owners := make(map[string]int) // provider:subject -> index in identities
+	var identities []UserIdentity
+	var losers []UserIdentity
+	now := time.Now()
+	for _, user := range users {
+		user.PhoneVerified = user.Phone != "" && slices.ContainsFunc(user.Devices, func(device Device) bool {
+			return device.Provider == constants.ProviderSMS
+		})
+		if user.PhoneVerified {
+			if err := tx.Model(&AuthUser{}).Where("id = ?", user.ID).UpdateColumn("phone_verified", true).Error; err != nil {
+				return fmt.Errorf("failed to mark phone of user %s verified: %w", user.ID, err)
+			}
+		}
+		for _, identity := range user.Identities() {
+			identity.UserID = user.ID
+			key := identity.Provider + ":" + identity.Subject
+			if i, ok := owners[key]; ok {
+				if identities[i].UserID == user.ID {
+					continue
+				}
+				if identity.Verified && !identities[i].Verified {
+					identities[i], identity = identity, identities[i]
+					identities[i].LinkedAt = user.CreatedAt
+				}
+				log.Warn(nil, "identity backfill: %s identity of user %s duplicates user %s, not linked",
+					identity.Provider, identity.UserID, identities[i].UserID)
+				losers = append(losers, identity)
+				continue
+			}
+			owners[key] = len(identities)
+			identity.LinkedAt = user.CreatedAt
+			identities = append(identities, identity)
+		}
+	}
+	phones := make(map[uuid.UUID]string, len(users))
+	for _, user := range users {
+		phones[user.ID] = user.Phone
+	}
+	for _, loser := range losers {
+		if loser.Provider == constants.IdentityPhone {
+			owner := identities[owners[loser.Provider+":"+loser.Subject]].UserID
+			if err := recordPhoneConflict(tx, loser.UserID, owner, loser.Subject, phones[loser.UserID]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := clearProfileField(tx, loser.UserID, &loser); err != nil {
+			return fmt.Errorf("failed to remove duplicate identity of user %s: %w", loser.UserID, err)
+		}
+	}
+	for i := range identities {
+		identities[i].ID = uuid.New()
+		identities[i].CreatedAt = now
+		identities[i].UpdatedAt = now
+		if identities[i].LinkedAt.IsZero() {
+			identities[i].LinkedAt = now
+		}
+	}
+	if len(identities) > 0 {
+		if err := tx.CreateInBatches(identities, 500).Error; err != nil {
+			return fmt.Errorf("failed to create user identities: %w", err)
+		}
+	}
+	log.Info(nil, "identity backfill: linked %d identities of %d users, left %d duplicates unlinked",
+		len(identities), len(users), len(losers))
+	return nil
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+func TestBackfillPhoneE164KeepsConflictingNumbers(t *testing.T) {
+	db := newTestDatabase(t, &AuthUser{}, &UserIdentity{}, &PhoneConflict{})
+	now := time.Now()
+	owner := &AuthUser{ID: uuid.New(), Phone: "138 0013 8000", UpdatedAt: now}
+	legacy := &AuthUser{ID: uuid.New(), Phone: "+86 13800138000", UpdatedAt: now.Add(-time.Hour)}
+	stored := &AuthUser{ID: uuid.New(), Phone: "+8613800138000", UpdatedAt: now.Add(-2 * time.Hour)}
+	other := &AuthUser{ID: uuid.New(), Phone: "13900139000", UpdatedAt: now}
+	for _, user := range []*AuthUser{owner, legacy, stored, other} {
+		if err := db.db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, run := range []func() error{
+		func() error { return backfillPhoneE164(db.db) },
+		func() error { return backfillUserIdentities(db.db) },
+	} {
+		if err := run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[uuid.UUID]string{
+		owner.ID:  "+8613800138000",
+		legacy.ID: "+86 13800138000",
+		stored.ID: "+8613800138000",
+		other.ID:  "+8613900139000",
+	}
+	for id, phone := range want {
+		var user AuthUser
+		if err := db.db.First(&user, "id = ?", id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if user.Phone != phone {
+			t.Errorf("phone of user %s = %q, want %q", id, user.Phone, phone)
+		}
+	}
+
+	var conflicts []PhoneConflict
+	if err := db.db.Order("original_phone").Find(&conflicts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("recorded %d conflicts, want 2: %+v", len(conflicts), conflicts)
+	}
+	for i, user := range []*AuthUser{legacy, stored} {
+		c := conflicts[i]
+		if c.UserID != user.ID || c.OwnerID != owner.ID || c.Phone != "+8613800138000" || c.OriginalPhone != user.Phone {
+			t.Errorf("conflict %d = %+v, want user %s conflicting with %s", i, c, user.ID, owner.ID)
+		}
+	}
+
+	var linked []UserIdentity
+	if err := db.db.Where("provider = ? AND subject = ?", constants.IdentityPhone, "+8613800138000").Find(&linked).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 1 || linked[0].UserID != owner.ID {
+		t.Errorf("number linked to %+v, want only the owner", linked)
+	}
+}
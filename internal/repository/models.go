@@ -22,44 +22,363 @@ type SyncLock struct {
 }
 
 type AuthUser struct {
-	ID               uuid.UUID  `gorm:"type:uuid; primaryKey" json:"id"`
-	CreatedAt        time.Time  `gorm:"type:timestamptz" json:"created_at"`
-	UpdatedAt        time.Time  `gorm:"type:timestamptz" json:"updated_at"`
-	Name             string     `gorm:"index; size:100" json:"name"`
-	GithubID         string     `gorm:"size:100;" json:"github_id"`
-	GithubName       string     `gorm:"size:100" json:"github_name"`
-	Vip              int        `gorm:"default:0" json:"vip"`
-	Phone            string     `gorm:"size:20" json:"phone"`
-	Email            string     `gorm:"size:100;index" json:"email"`
-	Password         string     `gorm:"size:100" json:"password"`
-	Company          string     `gorm:"size:100" json:"company"`
-	Location         string     `gorm:"size:100" json:"location"`
-	UserCode         string     `gorm:"size:100" json:"user_code"`
-	ExternalAccounts uuid.UUID  `gorm:"size:100" json:"external_accounts"`
-	EmployeeNumber   string     `gorm:"size:100" json:"employee_number"`
-	GithubStar       string     `gorm:"type:text" json:"github_star"`
-	Devices          []Device   `gorm:"type:jsonb;serializer:json" json:"devices"`
-	AccessTime       time.Time  `gorm:"type:timestamptz" json:"access_time"`
-	InviteCode       string     `gorm:"size:10;index" json:"invite_code"`
-	InviterID        *uuid.UUID `gorm:"type:uuid" json:"inviter_id"`
+	ID                uuid.UUID  `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt         time.Time  `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt         time.Time  `gorm:"type:timestamptz" json:"updated_at"`
+	Name              string     `gorm:"index; size:100" json:"name"`
+	GithubID          string     `gorm:"size:100;" json:"github_id"`
+	GithubName        string     `gorm:"size:100" json:"github_name"`
+	Vip               int        `gorm:"default:0" json:"vip"`
+	Phone             string     `gorm:"size:20" json:"phone"`
+	PhoneVerified     bool       `gorm:"default:false" json:"phone_verified"` // proved with an SMS code
+	Email             string     `gorm:"size:100;index" json:"email"`
+	EmailVerified     bool       `gorm:"default:false" json:"email_verified"`
+	Username          *string    `gorm:"size:64;uniqueIndex" json:"username,omitempty"` // login name of a password account
+	Password          string     `gorm:"size:255" json:"-"`                             // argon2id or bcrypt hash
+	PasswordChangedAt *time.Time `gorm:"type:timestamptz" json:"-"`
+	FailedLogins      int        `gorm:"default:0" json:"-"`
+	LockedUntil       *time.Time `gorm:"type:timestamptz" json:"-"`
+	Company           string     `gorm:"size:100" json:"company"`
+	Location          string     `gorm:"size:100" json:"location"`
+	UserCode          string     `gorm:"size:100" json:"user_code"`
+	EmployeeNumber    string     `gorm:"size:100" json:"employee_number"`
+	GithubStar        string     `gorm:"type:text" json:"github_star"`
+	Devices           []Device   `gorm:"type:jsonb;serializer:json" json:"devices"`
+	AccessTime        time.Time  `gorm:"type:timestamptz" json:"access_time"`
+	InviteCode        string     `gorm:"size:10;index" json:"invite_code"`
+	InviterID         *uuid.UUID `gorm:"type:uuid" json:"inviter_id"`
 }
 
 type Device struct {
-	ID               uuid.UUID `json:"id"`
-	CreatedAt        time.Time `gorm:"type:timestamp" json:"created_at"`
-	UpdatedAt        time.Time `gorm:"type:timestamp" json:"updated_at"`
-	MachineCode      string    `json:"machine_code"`
-	VSCodeVersion    string    `json:"vscode_version"`
-	PluginVersion    string    `json:"plugin_version"`
-	State            string    `json:"state"`
-	RefreshTokenHash string    `json:"refresh_token_hash"`
-	RefreshToken     string    `json:"refresh_token"`
-	AccessToken      string    `json:"access_token"`
-	AccessTokenHash  string    `json:"access_token_hash"`
-	UriScheme        string    `json:"uri_scheme"`
-	Status           string    `json:"status"`
-	Provider         string    `json:"provider"`
-	Platform         string    `json:"platform"`
-	DeviceCode       string    `json:"device_code"`
-	TokenProvider    string    `gorm:"size:20" json:"token_provider"`
+	ID               uuid.UUID         `json:"id"`
+	CreatedAt        time.Time         `gorm:"type:timestamp" json:"created_at"`
+	UpdatedAt        time.Time         `gorm:"type:timestamp" json:"updated_at"`
+	MachineCode      string            `json:"machine_code"`
+	VSCodeVersion    string            `json:"vscode_version"`
+	PluginVersion    string            `json:"plugin_version"`
+	State            string            `json:"state"`
+	RefreshTokenHash string            `json:"refresh_token_hash"`
+	RefreshToken     string            `json:"refresh_token"`
+	AccessToken      string            `json:"access_token"`
+	AccessTokenHash  string            `json:"access_token_hash"`
+	UriScheme        string            `json:"uri_scheme"`
+	Status           string            `json:"status"`
+	Provider         string            `json:"provider"`
+	Platform         string            `json:"platform"`
+	DeviceCode       string            `json:"device_code"`
+	TokenProvider    string            `gorm:"size:20" json:"token_provider"`
+	ClientID         string            `json:"client_id"`
+	LastAccessAt     *time.Time        `json:"last_access_at"`             // tokens last issued or used, saved every few minutes at most
+	AuthenticatedAt  *time.Time        `json:"authenticated_at,omitempty"` // last login, refreshes do not count
+	Attestation      DeviceAttestation `json:"attestation"`
+}
+
+// DeviceAttestation what the server knows of a device beyond the identifiers the client supplies:
+// the key it registered and where it was last seen from
+type DeviceAttestation struct {
+	// KeyThumbprint is the RFC 7638 thumbprint of the device-bound public key, empty while none is registered
+	KeyThumbprint   string     `json:"key_thumbprint,omitempty"`
+	KeyRegisteredAt *time.Time `json:"key_registered_at,omitempty"`
+	IP              string     `json:"ip,omitempty"`
+	UserAgent       string     `json:"user_agent,omitempty"`
+	Country         string     `json:"country,omitempty"`
+	ASN             string     `json:"asn,omitempty"`
+	Latitude        *float64   `json:"latitude,omitempty"`
+	Longitude       *float64   `json:"longitude,omitempty"`
+	SeenAt          *time.Time `json:"seen_at,omitempty"`
+	// Countries and ASNs the device was seen from, oldest first
+	Countries      []string            `json:"countries,omitempty"`
+	ASNs           []string            `json:"asns,omitempty"`
+	PluginVersions []PluginVersionSeen `json:"plugin_versions,omitempty"`
+	RiskScore      int                 `json:"risk_score,omitempty"` // of the last refresh
+	RiskReasons    []string            `json:"risk_reasons,omitempty"`
+}
+
+// PluginVersionSeen a plugin version a device logged in with
+type PluginVersionSeen struct {
+	Version     string    `json:"version"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+// OAuthClient An application registered to authenticate users through this server
+type OAuthClient struct {
+	ID               uuid.UUID `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt        time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt        time.Time `gorm:"type:timestamptz" json:"updated_at"`
+	ClientID         string    `gorm:"size:100;uniqueIndex;not null" json:"client_id"`
+	ClientSecretHash string    `gorm:"size:100" json:"-"`
+	Name             string    `gorm:"size:100" json:"name"`
+	Platform         string    `gorm:"size:20" json:"platform"`
+	RedirectURIs     []string  `gorm:"type:jsonb;serializer:json" json:"redirect_uris"`
+	URISchemes       []string  `gorm:"type:jsonb;serializer:json" json:"uri_schemes"`
+	AllowedGrants    []string  `gorm:"type:jsonb;serializer:json" json:"allowed_grants"`
+	Audience         []string  `gorm:"type:jsonb;serializer:json" json:"audience"`
+	AccessTokenTTL   int64     `json:"access_token_ttl"`  // seconds, 0 means the server default
+	RefreshTokenTTL  int64     `json:"refresh_token_ttl"` // seconds, 0 means the server default
+	DisplayName      string    `gorm:"size:100" json:"display_name"`
+	LogoURL          string    `gorm:"size:255" json:"logo_url"`
+	HomepageURL      string    `gorm:"size:255" json:"homepage_url"`
+	PrimaryColor     string    `gorm:"size:20" json:"primary_color"`
+	Disabled         bool      `gorm:"default:false" json:"disabled"`
+}
+
+// SmsVerificationCode A one-time code sent by SMS; only a keyed hash of the code is stored
+type SmsVerificationCode struct {
+	ID        uuid.UUID `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"type:timestamptz" json:"created_at"`
+	Phone     string    `gorm:"size:20;index:idx_sms_code_phone_purpose" json:"phone"`
+	Purpose   string    `gorm:"size:20;index:idx_sms_code_phone_purpose" json:"purpose"`
+	Code      string    `gorm:"size:64" json:"-"`
+	IsUsed    bool      `gorm:"default:false" json:"is_used"`
+	Attempts  int       `gorm:"default:0" json:"attempts"`
+	ExpiresAt time.Time `gorm:"type:timestamptz" json:"expires_at"`
+}
+
+// RateLimitBucket A token bucket shared by all replicas
+type RateLimitBucket struct {
+	BucketKey string    `gorm:"primaryKey;size:191" json:"bucket_key"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `gorm:"type:timestamptz;index" json:"updated_at"`
+}
+
+// UsedDeviceProof A device key proof accepted once, kept until it is too old to be accepted anyway
+type UsedDeviceProof struct {
+	ProofHash string    `gorm:"primaryKey;size:64" json:"proof_hash"` // of the key thumbprint and the jti
+	ExpiresAt time.Time `gorm:"type:timestamptz;index" json:"expires_at"`
+}
+
+// RateLimitWindow A fixed window counter shared by all replicas
+type RateLimitWindow struct {
+	WindowKey string    `gorm:"primaryKey;size:191" json:"window_key"`
+	Start     time.Time `gorm:"type:timestamptz" json:"start"`
+	Count     int       `json:"count"`
+	UpdatedAt time.Time `gorm:"type:timestamptz;index" json:"updated_at"`
+}
+
+// EmailVerification A login email holding both a one-time code and a magic link; only keyed
+// hashes of the code and link token are stored
+type EmailVerification struct {
+	ID        uuid.UUID         `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt time.Time         `gorm:"type:timestamptz" json:"created_at"`
+	Email     string            `gorm:"size:100;index:idx_email_verification_email_purpose" json:"email"`
+	Purpose   string            `gorm:"size:20;index:idx_email_verification_email_purpose" json:"purpose"`
+	CodeHash  string            `gorm:"size:64" json:"-"`
+	TokenHash string            `gorm:"size:64;uniqueIndex" json:"-"`
+	IsUsed    bool              `gorm:"default:false" json:"is_used"`
+	Attempts  int               `gorm:"default:0" json:"attempts"`
+	ExpiresAt time.Time         `gorm:"type:timestamptz" json:"expires_at"`
+	Login     EmailLoginContext `gorm:"type:jsonb;serializer:json" json:"login"`
+}
+
+// EmailLoginContext the login request a magic link completes
+type EmailLoginContext struct {
+	ClientID      string `json:"client_id"`
+	Platform      string `json:"platform"`
+	MachineCode   string `json:"machine_code"`
+	VscodeVersion string `json:"vscode_version"`
+	PluginVersion string `json:"plugin_version"`
+	UriScheme     string `json:"uri_scheme"`
+	RedirectURI   string `json:"redirect_uri"`
+	State         string `json:"state"`
+	InviterCode   string `json:"inviter_code"`
+}
+
+// UserTOTP the TOTP second factor of a user. The secret is encrypted with the AES key and
+// only keyed hashes of the unused recovery codes are kept.
+type UserTOTP struct {
+	UserID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"user_id"`
+	CreatedAt     time.Time  `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"type:timestamptz" json:"updated_at"`
+	Secret        string     `gorm:"size:255" json:"-"`
+	Enabled       bool       `gorm:"default:false" json:"enabled"` // false until the first code confirms the enrollment
+	ConfirmedAt   *time.Time `gorm:"type:timestamptz" json:"confirmed_at"`
+	LastUsedStep  int64      `gorm:"default:0" json:"-"` // codes of this step or earlier are replays
+	RecoveryCodes []string   `gorm:"type:jsonb;serializer:json" json:"-"`
+	// wrong codes in a row, over all challenges, and the lockout they caused
+	FailedCodes int        `gorm:"default:0" json:"-"`
+	LockedUntil *time.Time `gorm:"type:timestamptz" json:"-"`
+}
+
+// MFAChallenge a login waiting for its second factor. The device stays pending until the
+// challenge is completed, then either gets its tokens or returns to ResumeStatus.
+type MFAChallenge struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt    time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UserID       uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	DeviceID     uuid.UUID `gorm:"type:uuid" json:"device_id"`
+	IssueTokens  bool      `json:"issue_tokens"`                 // issue the device's tokens on completion
+	ResumeStatus string    `gorm:"size:20" json:"resume_status"` // device status on completion when tokens exist already
+	RedirectURL  string    `gorm:"type:text" json:"redirect_url"`
+	// StateFromToken appends the access token hash as state to the redirect, for the web bind page
+	StateFromToken bool      `json:"state_from_token"`
+	Attempts       int       `gorm:"default:0" json:"attempts"`
+	ExpiresAt      time.Time `gorm:"type:timestamptz" json:"expires_at"`
+	IsUsed         bool      `gorm:"default:false" json:"is_used"`
+}
+
+// WebAuthnCredential a passkey or security key registered by a user
+type WebAuthnCredential struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt    time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"type:timestamptz" json:"updated_at"`
+	UserID       uuid.UUID `gorm:"type:uuid;index" json:"-"`
+	CredentialID string    `gorm:"size:1400" json:"credential_id"` // base64url, as sent by browsers
+	// CredentialHash the sha256 of CredentialID, indexed since IDs can be longer than index keys
+	CredentialHash string     `gorm:"size:64;uniqueIndex" json:"-"`
+	PublicKey      []byte     `json:"-"` // COSE_Key
+	Algorithm      int64      `json:"algorithm"`
+	SignCount      uint32     `gorm:"default:0" json:"-"`
+	AAGUID         string     `gorm:"size:36" json:"aaguid"`
+	Transports     []string   `gorm:"type:jsonb;serializer:json" json:"transports"`
+	Name           string     `gorm:"size:100" json:"name"`
+	BackupEligible bool       `json:"backup_eligible"` // a synced passkey rather than a device-bound key
+	LastUsedAt     *time.Time `gorm:"type:timestamptz" json:"last_used_at"`
+}
+
+// WebAuthnSession the challenge of a WebAuthn ceremony between its begin and finish requests
+type WebAuthnSession struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt time.Time  `gorm:"type:timestamptz" json:"created_at"`
+	Purpose   string     `gorm:"size:20" json:"purpose"` // register, login or mfa
+	UserID    *uuid.UUID `gorm:"type:uuid" json:"user_id"`
+	// MFAChallengeID the login challenge an mfa ceremony completes
+	MFAChallengeID *uuid.UUID `gorm:"type:uuid" json:"mfa_challenge_id"`
+	Challenge      string     `gorm:"size:64" json:"-"`
+	ExpiresAt      time.Time  `gorm:"type:timestamptz" json:"expires_at"`
+	IsUsed         bool       `gorm:"default:false" json:"is_used"`
+}
+
+// UserIdentity a login identity linked to a user: a GitHub account, phone number or email address.
+// An identity belongs to one user at most, so a login with any of them finds the same account.
+type UserIdentity struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt time.Time `gorm:"type:timestamptz" json:"updated_at"`
+	UserID    uuid.UUID `gorm:"type:uuid;index" json:"-"`
+	Provider  string    `gorm:"size:20;uniqueIndex:idx_user_identity_subject" json:"provider"` // github, phone or email
+	Subject   string    `gorm:"size:191;uniqueIndex:idx_user_identity_subject" json:"subject"`
+	Verified  bool      `gorm:"default:false" json:"verified"`
+	LinkedAt  time.Time `gorm:"type:timestamptz" json:"linked_at"`
+}
+
+// PhoneConflict a user whose phone number is, once normalized, the number of another user.
+// Both numbers are left as they are; the accounts are merged or one number is changed by hand.
+type PhoneConflict struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt     time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UserID        uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_phone_conflict_user" json:"user_id"`
+	OwnerID       uuid.UUID `gorm:"type:uuid" json:"owner_id"`                                // the user the number identifies
+	Phone         string    `gorm:"size:20;uniqueIndex:idx_phone_conflict_user" json:"phone"` // E.164
+	OriginalPhone string    `gorm:"size:20" json:"original_phone"`                            // as stored for the user
+}
+
+// IdentityUnbind an unbind of an identity, run as a saga like an account merge: the identity is
+// removed from the upstream account first, outside any lock, and then locally, which deletes the
+// unbind. An unbind that stopped is resumed by unbinding the identity again.
+type IdentityUnbind struct {
+	ID          uuid.UUID   `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt   time.Time   `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt   time.Time   `gorm:"type:timestamptz" json:"updated_at"`
+	IdentityID  uuid.UUID   `gorm:"type:uuid;uniqueIndex:idx_identity_unbind" json:"identity_id"`
+	UserID      uuid.UUID   `gorm:"type:uuid;uniqueIndex:idx_identity_unbind" json:"user_id"`
+	Split       bool        `json:"split"`                                        // move the identity to a new account
+	SplitUserID uuid.UUID   `gorm:"type:uuid" json:"split_user_id"`               // the new account
+	DeviceIDs   []uuid.UUID `gorm:"type:jsonb;serializer:json" json:"device_ids"` // devices moving to the new account
+	InviteeIDs  []uuid.UUID `gorm:"type:jsonb;serializer:json" json:"invitee_ids"`
+	Step        string      `gorm:"size:30" json:"step"`
+	Status      string      `gorm:"size:20" json:"status"`
+	Attempts    int         `gorm:"default:0" json:"attempts"` // failed attempts of the current step
+	LastError   string      `gorm:"type:text" json:"last_error"`
+}
+
+// AccountMerge a merge of one account into another, run as a saga: Step is the next step to run
+// and each step is retried until it succeeds, so a merge that stopped halfway can be resumed
+type AccountMerge struct {
+	ID             uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CreatedAt      time.Time `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt      time.Time `gorm:"type:timestamptz" json:"updated_at"`
+	IdempotencyKey string    `gorm:"size:64;uniqueIndex" json:"idempotency_key"`
+	MainUserID     uuid.UUID `gorm:"type:uuid;index" json:"main_user_id"`
+	OtherUserID    uuid.UUID `gorm:"type:uuid" json:"other_user_id"`
+	OtherSaved     bool      `json:"other_saved"` // the other account is a saved user, folded in and deleted
+	// upstream tokens of both accounts for the upstream step, encrypted; cleared once that step is
+	// passed, the merge fails or it is cancelled
+	MainToken   string       `gorm:"type:text" json:"-"`
+	OtherToken  string       `gorm:"type:text" json:"-"`
+	Profile     MergeProfile `gorm:"type:jsonb;serializer:json" json:"profile"`
+	Step        string       `gorm:"size:30" json:"step"`
+	Status      string       `gorm:"size:20;index" json:"status"`
+	Attempts    int          `gorm:"default:0" json:"attempts"` // failed attempts of the current step
+	LastError   string       `gorm:"type:text" json:"last_error"`
+	CompletedAt *time.Time   `gorm:"type:timestamptz" json:"completed_at"`
+}
+
+// MergeProfile the profile of the merged account
+type MergeProfile struct {
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	EmailVerified  bool       `json:"email_verified"`
+	Phone          string     `json:"phone"`
+	PhoneVerified  bool       `json:"phone_verified"`
+	GithubID       string     `json:"github_id"`
+	GithubName     string     `json:"github_name"`
+	GithubStar     string     `json:"github_star"`
+	Company        string     `json:"company"`
+	Location       string     `json:"location"`
+	EmployeeNumber string     `json:"employee_number"`
+	Vip            int        `json:"vip"`
+	InviteCode     string     `json:"invite_code"`
+	InviterID      *uuid.UUID `json:"inviter_id"`
+}
+
+// WebhookDelivery An event queued for, or delivered to, one webhook endpoint. The payload is kept
+// as sent so a replay delivers the same event.
+type WebhookDelivery struct {
+	ID            uuid.UUID  `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt     time.Time  `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"type:timestamptz" json:"updated_at"`
+	EventID       uuid.UUID  `gorm:"type:uuid;index" json:"event_id"`
+	EventType     string     `gorm:"size:50;index" json:"event_type"`
+	Endpoint      string     `gorm:"size:100;index" json:"endpoint"` // name of the endpoint in the config
+	Payload       string     `gorm:"type:text" json:"payload"`
+	Status        string     `gorm:"size:20;index:idx_webhook_delivery_due" json:"status"`
+	NextAttemptAt time.Time  `gorm:"type:timestamptz;index:idx_webhook_delivery_due" json:"next_attempt_at"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	ResponseCode  int        `json:"response_code"` // of the last attempt, 0 when no response came
+	LastError     string     `gorm:"type:text" json:"last_error"`
+	DeliveredAt   *time.Time `gorm:"type:timestamptz" json:"delivered_at"`
+}
+
+// OutboxEvent An event written in the transaction of the change it announces and published to the
+// sinks by the outbox dispatcher, at least once
+type OutboxEvent struct {
+	ID             uuid.UUID  `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt      time.Time  `gorm:"type:timestamptz" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"type:timestamptz" json:"updated_at"`
+	Topic          string     `gorm:"size:50;index" json:"topic"`
+	AggregateID    uuid.UUID  `gorm:"type:uuid;index" json:"aggregate_id"` // the user the event is about
+	Payload        string     `gorm:"type:text" json:"payload"`
+	PublishedSinks []string   `gorm:"type:jsonb;serializer:json" json:"published_sinks"` // not published to again on retries
+	Status         string     `gorm:"size:20;index:idx_outbox_event_due" json:"status"`
+	NextAttemptAt  time.Time  `gorm:"type:timestamptz;index:idx_outbox_event_due" json:"next_attempt_at"`
+	Attempts       int        `gorm:"default:0" json:"attempts"`
+	LastError      string     `gorm:"type:text" json:"last_error"`
+	PublishedAt    *time.Time `gorm:"type:timestamptz" json:"published_at"`
+}
+
+// AuditLog An append-only record of an authentication or account event. Entries are only
+// deleted once they are older than the configured retention.
+type AuditLog struct {
+	ID        uuid.UUID  `gorm:"type:uuid; primaryKey" json:"id"`
+	CreatedAt time.Time  `gorm:"type:timestamptz;index" json:"created_at"`
+	Action    string     `gorm:"size:50;index" json:"action"`
+	Outcome   string     `gorm:"size:20;index" json:"outcome"`
+	ActorID   *uuid.UUID `gorm:"type:uuid;index" json:"actor_id"`   // who acted, empty when unknown
+	SubjectID *uuid.UUID `gorm:"type:uuid;index" json:"subject_id"` // the user acted upon
+	DeviceID  *uuid.UUID `gorm:"type:uuid" json:"device_id"`
+	IP        string     `gorm:"size:64;index" json:"ip"`
+	UserAgent string     `gorm:"size:512" json:"user_agent"`
+	Reason    string     `gorm:"type:text" json:"reason"` // why the action failed or happened
+	// Details are action specific, like the provider of a login or the merged account
+	Details map[string]string `gorm:"type:jsonb;serializer:json" json:"details"`
 }
@@ -11,7 +11,9 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
 )
 
 var allowedFields = map[string]map[string]bool{
@@ -36,6 +38,10 @@ var allowedFields = map[string]map[string]bool{
 	"SyncLock": {
 		"name": true,
 	},
+	"OAuthClient": {
+		"id":        true,
+		"client_id": true,
+	},
 	"SmsVerificationCode": {
 		"id":      true,
 		"phone":   true,
@@ -132,6 +138,15 @@ func (d *Database) GetUserByField(ctx context.Context, uniqueField string, value
 	return &user, nil
 }
 
+// GetUserByPhone gets the user a phone number is linked to, written in any format the phone package accepts
+func (d *Database) GetUserByPhone(ctx context.Context, phoneNumber string) (*AuthUser, error) {
+	normalized, err := phone.Normalize(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetUserByIdentity(ctx, constants.IdentityPhone, normalized)
+}
+
 func (d *Database) DeleteUserByField(ctx context.Context, field string, value any) (int64, error) {
 	if err := ValidateFieldName("AuthUser", field); err != nil {
 		return 0, fmt.Errorf("field validation failed: %w", err)
@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// addOutboxEvent writes an event in the transaction of the change it announces. Writing an event
+// with the ID of a stored one does nothing, so a repeated change does not announce itself twice.
+func addOutboxEvent(tx *gorm.DB, id uuid.UUID, topic string, aggregateID uuid.UUID, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", topic, err)
+	}
+	now := time.Now()
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&OutboxEvent{
+		ID:             id,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Topic:          topic,
+		AggregateID:    aggregateID,
+		Payload:        string(payload),
+		PublishedSinks: []string{},
+		Status:         constants.OutboxStatusPending,
+		NextAttemptAt:  now,
+	}).Error
+}
+
+// ListDueOutboxEvents returns up to limit pending events due by now, oldest first, without
+// claiming them; ClaimOutboxEvent claims each one before it is published
+func (d *Database) ListDueOutboxEvents(ctx context.Context, now time.Time, limit int) ([]OutboxEvent, error) {
+	var due []OutboxEvent
+	if err := d.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", constants.OutboxStatusPending, now).
+		Order("created_at").Limit(limit).Find(&due).Error; err != nil {
+		return nil, fmt.Errorf("failed to query due outbox events: %w", err)
+	}
+	return due, nil
+}
+
+// ClaimOutboxEvent postpones a listed event to until, so no other replica publishes it meanwhile.
+// It reports false when the event changed since it was listed, i.e. another replica claimed it.
+func (d *Database) ClaimOutboxEvent(ctx context.Context, event *OutboxEvent, until time.Time) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&OutboxEvent{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", event.ID, constants.OutboxStatusPending,
+			event.NextAttemptAt).
+		Update("next_attempt_at", until)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim outbox event: %w", result.Error)
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	event.NextAttemptAt = until
+	return true, nil
+}
+
+// SaveOutboxEventResult stores the outcome of a publication attempt, zero values included
+func (d *Database) SaveOutboxEventResult(ctx context.Context, event *OutboxEvent) error {
+	event.UpdatedAt = time.Now()
+	if err := d.db.WithContext(ctx).Model(event).
+		Select("updated_at", "status", "next_attempt_at", "attempts", "last_error", "published_at",
+			"published_sinks").
+		Updates(event).Error; err != nil {
+		return fmt.Errorf("failed to save outbox event: %w", err)
+	}
+	return nil
+}
+
+// ListOutboxEvents lists the most recently created events, of one status and topic when not empty
+func (d *Database) ListOutboxEvents(ctx context.Context, status, topic string, limit int) ([]OutboxEvent, error) {
+	query := d.db.WithContext(ctx).Order("created_at DESC").Limit(limit)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if topic != "" {
+		query = query.Where("topic = ?", topic)
+	}
+	var events []OutboxEvent
+	if err := query.Find(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to list outbox events: %w", err)
+	}
+	return events, nil
+}
+
+// RetryOutboxEvent queues a failed event again with fresh attempts; sinks it reached are skipped.
+// It reports false when there is no such failed event.
+func (d *Database) RetryOutboxEvent(ctx context.Context, id uuid.UUID) (bool, error) {
+	now := time.Now()
+	result := d.db.WithContext(ctx).Model(&OutboxEvent{}).
+		Where("id = ? AND status = ?", id, constants.OutboxStatusFailed).
+		Updates(map[string]any{
+			"status":          constants.OutboxStatusPending,
+			"next_attempt_at": now,
+			"attempts":        0,
+			"last_error":      "",
+			"updated_at":      now,
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to retry outbox event: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// GetOutboxEvent gets an event by ID
+func (d *Database) GetOutboxEvent(ctx context.Context, id uuid.UUID) (*OutboxEvent, error) {
+	var event OutboxEvent
+	if err := d.db.WithContext(ctx).Where("id = ?", id).First(&event).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query outbox event: %w", err)
+	}
+	return &event, nil
+}
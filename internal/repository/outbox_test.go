@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimOutboxEvent(t *testing.T) {
+	db := newTestDatabase(t, &OutboxEvent{})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := addOutboxEvent(db.db, uuid.New(), "test", uuid.New(), map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Add(time.Second)
+	due, err := db.ListDueOutboxEvents(ctx, now, 10)
+	if err != nil || len(due) != 2 {
+		t.Fatalf("ListDueOutboxEvents = %d events, %v; want 2", len(due), err)
+	}
+	// another replica listed the same events
+	stale := due[0]
+
+	until := now.Add(time.Minute)
+	if claimed, err := db.ClaimOutboxEvent(ctx, &due[0], until); err != nil || !claimed {
+		t.Fatalf("ClaimOutboxEvent = %v, %v; want the event claimed", claimed, err)
+	}
+	if !due[0].NextAttemptAt.Equal(until) {
+		t.Errorf("NextAttemptAt = %s, want the lease end %s", due[0].NextAttemptAt, until)
+	}
+	if claimed, err := db.ClaimOutboxEvent(ctx, &stale, until); err != nil || claimed {
+		t.Errorf("claim of a claimed event = %v, %v; want it refused", claimed, err)
+	}
+
+	// the claimed event is not due until its lease ends, the other one still is
+	if due, err := db.ListDueOutboxEvents(ctx, now, 10); err != nil || len(due) != 1 || due[0].ID == stale.ID {
+		t.Errorf("due during the lease = %v, %v; want only the unclaimed event", due, err)
+	}
+	if due, err := db.ListDueOutboxEvents(ctx, until, 10); err != nil || len(due) != 2 {
+		t.Errorf("due after the lease = %d events, %v; want 2", len(due), err)
+	}
+}
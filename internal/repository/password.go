@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetUserByUsername gets the user with a login name; usernames are stored lower-cased
+func (d *Database) GetUserByUsername(ctx context.Context, username string) (*AuthUser, error) {
+	var user AuthUser
+	if err := d.db.WithContext(ctx).Where("username = ?", username).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	return &user, nil
+}
+
+// SetUserPassword stores a new password hash and clears the failed login count and lockout
+func (d *Database) SetUserPassword(ctx context.Context, userID uuid.UUID, hash string) error {
+	now := time.Now()
+	if err := d.db.WithContext(ctx).Model(&AuthUser{}).Where("id = ?", userID).
+		Updates(map[string]any{
+			"password":            hash,
+			"password_changed_at": now,
+			"failed_logins":       0,
+			"locked_until":        nil,
+			"updated_at":          now,
+		}).Error; err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// UpgradePasswordHash replaces a hash of the same password, e.g. after raising the hashing cost
+func (d *Database) UpgradePasswordHash(ctx context.Context, userID uuid.UUID, hash string) error {
+	if err := d.db.WithContext(ctx).Model(&AuthUser{}).Where("id = ?", userID).
+		UpdateColumn("password", hash).Error; err != nil {
+		return fmt.Errorf("failed to upgrade password hash: %w", err)
+	}
+	return nil
+}
+
+// RecordPasswordFailure counts a wrong password. When the count reaches maxAttempts the
+// account is locked for lockout and the count starts over; the lock end is returned then.
+func (d *Database) RecordPasswordFailure(ctx context.Context, userID uuid.UUID, maxAttempts int, lockout time.Duration) (*time.Time, error) {
+	var lockedUntil *time.Time
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var user AuthUser
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "failed_logins").Where("id = ?", userID).First(&user).Error; err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+		updates := map[string]any{"failed_logins": user.FailedLogins + 1}
+		if maxAttempts > 0 && user.FailedLogins+1 >= maxAttempts {
+			until := time.Now().Add(lockout)
+			lockedUntil = &until
+			updates["failed_logins"] = 0
+			updates["locked_until"] = until
+		}
+		return tx.Model(&AuthUser{}).Where("id = ?", userID).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record password failure: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+// ResetPasswordFailures clears the failed login count after a successful login
+func (d *Database) ResetPasswordFailures(ctx context.Context, userID uuid.UUID) error {
+	if err := d.db.WithContext(ctx).Model(&AuthUser{}).Where("id = ?", userID).
+		Updates(map[string]any{"failed_logins": 0, "locked_until": nil}).Error; err != nil {
+		return fmt.Errorf("failed to reset password failures: %w", err)
+	}
+	return nil
+}
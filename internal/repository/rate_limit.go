@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/ratelimit"
+)
+
+// TakeRateLimitToken takes a token from a shared bucket; the row is locked so replicas never
+// take the same token twice
+func (d *Database) TakeRateLimitToken(ctx context.Context, key string, p ratelimit.Policy) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RateLimitBucket{BucketKey: key, Tokens: float64(p.Burst)}).Error; err != nil {
+			return fmt.Errorf("failed to create rate limit bucket: %w", err)
+		}
+		var row RateLimitBucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("bucket_key = ?", key).First(&row).Error; err != nil {
+			return fmt.Errorf("failed to lock rate limit bucket: %w", err)
+		}
+
+		bucket := ratelimit.Bucket{Tokens: row.Tokens, UpdatedAt: row.UpdatedAt}
+		allowed, retryAfter = bucket.Take(time.Now(), p)
+		return tx.Model(&RateLimitBucket{}).Where("bucket_key = ?", key).
+			Updates(map[string]any{"tokens": bucket.Tokens, "updated_at": bucket.UpdatedAt}).Error
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+// DeleteStaleRateLimitBuckets removes buckets untouched since before, which have refilled by then
+func (d *Database) DeleteStaleRateLimitBuckets(ctx context.Context, before time.Time) (int64, error) {
+	result := d.db.WithContext(ctx).Where("updated_at < ?", before).Delete(&RateLimitBucket{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete stale rate limit buckets: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// CountRateLimitWindow counts an event in a shared fixed window of the given length and reports
+// whether it is within limit; the row is locked so replicas never both take the last event
+func (d *Database) CountRateLimitWindow(ctx context.Context, key string, limit int, length time.Duration) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RateLimitWindow{WindowKey: key, Start: now.Truncate(length), UpdatedAt: now}).Error; err != nil {
+			return fmt.Errorf("failed to create rate limit window: %w", err)
+		}
+		var row RateLimitWindow
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("window_key = ?", key).First(&row).Error; err != nil {
+			return fmt.Errorf("failed to lock rate limit window: %w", err)
+		}
+
+		window := ratelimit.Window{Start: row.Start, Count: row.Count}
+		allowed, retryAfter = window.Add(now, limit, length)
+		return tx.Model(&RateLimitWindow{}).Where("window_key = ?", key).
+			Updates(map[string]any{"start": window.Start, "count": window.Count, "updated_at": now}).Error
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+// DeleteStaleRateLimitWindows removes windows untouched since before, which are over by then
+func (d *Database) DeleteStaleRateLimitWindows(ctx context.Context, before time.Time) (int64, error) {
+	result := d.db.WithContext(ctx).Where("updated_at < ?", before).Delete(&RateLimitWindow{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete stale rate limit windows: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,56 @@
+// Package repositorytest opens throwaway databases for tests of the repository and its callers.
+package repositorytest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+)
+
+// dialector creates timestamptz columns as timestamp, the type the sqlite driver reads times from
+type dialector struct {
+	sqlite.Dialector
+}
+
+func (d dialector) DataTypeOf(field *schema.Field) string {
+	if field.DataType == "timestamptz" {
+		return "timestamp"
+	}
+	return d.Dialector.DataTypeOf(field)
+}
+
+func (d dialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return sqlite.Migrator{Migrator: migrator.Migrator{Config: migrator.Config{
+		DB:                          db,
+		Dialector:                   d,
+		CreateIndexAfterCreateTable: true,
+	}}}
+}
+
+// Open opens an empty in-memory database with the given models migrated, closed when the test ends.
+// Statements run on one connection, one at a time, like rows locked by concurrent replicas would.
+func Open(t testing.TB, models ...any) *gorm.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(dialector{sqlite.Dialector{DSN: "file:" + name + "?mode=memory&cache=shared"}}, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+	return db
+}
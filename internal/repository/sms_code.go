@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// CreateSmsCode stores a new code and invalidates the unused codes of the same phone and purpose
+func (d *Database) CreateSmsCode(ctx context.Context, code *SmsVerificationCode) error {
+	return d.withTransaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(&SmsVerificationCode{}).
+			Where("phone = ? AND purpose = ? AND is_used = ?", code.Phone, code.Purpose, false).
+			Update("is_used", true).Error; err != nil {
+			return fmt.Errorf("failed to invalidate previous codes: %w", err)
+		}
+		if err := tx.Create(code).Error; err != nil {
+			return fmt.Errorf("failed to create sms code: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetLatestSmsCode gets the most recent code of a phone and purpose, used or not
+func (d *Database) GetLatestSmsCode(ctx context.Context, phone, purpose string) (*SmsVerificationCode, error) {
+	var code SmsVerificationCode
+	if err := d.db.WithContext(ctx).
+		Where("phone = ? AND purpose = ?", phone, purpose).
+		Order("created_at DESC").
+		First(&code).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query sms code: %w", err)
+	}
+	return &code, nil
+}
+
+// ClaimSmsCodeAttempt counts a verification attempt against an unused code in a single conditional
+// update, so concurrent guesses cannot all pass the limit. It reports false when the code has
+// already been tried maxAttempts times or was consumed.
+func (d *Database) ClaimSmsCodeAttempt(ctx context.Context, code *SmsVerificationCode, maxAttempts int) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&SmsVerificationCode{}).
+		Where("id = ? AND is_used = ? AND attempts < ?", code.ID, false, maxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update sms code attempts: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ConsumeSmsCode marks a code used; it reports false if the code was consumed concurrently
+func (d *Database) ConsumeSmsCode(ctx context.Context, code *SmsVerificationCode) (bool, error) {
+	result := d.db.WithContext(ctx).Model(&SmsVerificationCode{}).
+		Where("id = ? AND is_used = ?", code.ID, false).
+		UpdateColumn("is_used", true)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to consume sms code: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimSmsCodeAttempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		used     bool
+		want     bool
+	}{
+		{"first attempt", 0, false, true},
+		{"last attempt", 4, false, true},
+		{"attempts used up", 5, false, false},
+		{"consumed code", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t, &SmsVerificationCode{})
+			ctx := context.Background()
+			code := &SmsVerificationCode{ID: uuid.New(), Phone: "+8613800000000", Purpose: "login",
+				Attempts: tt.attempts, IsUsed: tt.used, ExpiresAt: time.Now().Add(time.Minute)}
+			if err := db.db.Create(code).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.ClaimSmsCodeAttempt(ctx, code, 5)
+			if err != nil {
+				t.Fatalf("ClaimSmsCodeAttempt: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ClaimSmsCodeAttempt = %v, want %v", got, tt.want)
+			}
+			var attempts []int
+			if err := db.db.Model(&SmsVerificationCode{}).Where("id = ?", code.ID).Pluck("attempts", &attempts).Error; err != nil {
+				t.Fatal(err)
+			}
+			wantAttempts := tt.attempts
+			if tt.want {
+				wantAttempts++
+			}
+			if len(attempts) != 1 || attempts[0] != wantAttempts {
+				t.Errorf("attempts = %v, want %d", attempts, wantAttempts)
+			}
+		})
+	}
+}
+
+func TestClaimSmsCodeAttemptConcurrent(t *testing.T) {
+	db := newTestDatabase(t, &SmsVerificationCode{})
+	ctx := context.Background()
+	code := &SmsVerificationCode{ID: uuid.New(), Phone: "+8613800000000", Purpose: "login",
+		ExpiresAt: time.Now().Add(time.Minute)}
+	if err := db.db.Create(code).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const maxAttempts = 5
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.ClaimSmsCodeAttempt(ctx, code, maxAttempts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed.Load() != maxAttempts {
+		t.Errorf("%d concurrent attempts were claimed, want %d", claimed.Load(), maxAttempts)
+	}
+}
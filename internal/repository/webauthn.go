@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateWebAuthnCredential stores a newly registered credential
+func (d *Database) CreateWebAuthnCredential(ctx context.Context, cred *WebAuthnCredential) error {
+	if err := d.db.WithContext(ctx).Create(cred).Error; err != nil {
+		return fmt.Errorf("failed to create webauthn credential: %w", err)
+	}
+	return nil
+}
+
+// GetWebAuthnCredential gets a credential by the hash of its credential ID
+func (d *Database) GetWebAuthnCredential(ctx context.Context, credentialHash string) (*WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	if err := d.db.WithContext(ctx).Where("credential_hash = ?", credentialHash).First(&cred).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query webauthn credential: %w", err)
+	}
+	return &cred, nil
+}
+
+// ListWebAuthnCredentials lists the credentials of a user, oldest first
+func (d *Database) ListWebAuthnCredentials(ctx context.Context, userID uuid.UUID) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	if err := d.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&creds).Error; err != nil {
+		return nil, fmt.Errorf("failed to list webauthn credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// CountWebAuthnCredentials counts the credentials of a user
+func (d *Database) CountWebAuthnCredentials(ctx context.Context, userID uuid.UUID) (int64, error) {
+	var count int64
+	if err := d.db.WithContext(ctx).Model(&WebAuthnCredential{}).Where("user_id = ?", userID).
+		Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count webauthn credentials: %w", err)
+	}
+	return count, nil
+}
+
+// UseWebAuthnCredential records an assertion of a credential. It reports false when the signature
+// counter changed concurrently, which means the same assertion was used twice.
+func (d *Database) UseWebAuthnCredential(ctx context.Context, id uuid.UUID, oldCount, newCount uint32) (bool, error) {
+	now := time.Now()
+	result := d.db.WithContext(ctx).Model(&WebAuthnCredential{}).
+		Where("id = ? AND sign_count = ?", id, oldCount).
+		Updates(map[string]any{"sign_count": newCount, "last_used_at": now, "updated_at": now})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update webauthn credential: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// DeleteWebAuthnCredential removes a credential of a user; it reports false when the user has no such credential
+func (d *Database) DeleteWebAuthnCredential(ctx context.Context, userID, id uuid.UUID) (bool, error) {
+	result := d.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Delete(&WebAuthnCredential{})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to delete webauthn credential: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// CreateWebAuthnSession stores the challenge of a ceremony
+func (d *Database) CreateWebAuthnSession(ctx context.Context, session *WebAuthnSession) error {
+	if err := d.db.WithContext(ctx).Create(session).Error; err != nil {
+		return fmt.Errorf("failed to create webauthn session: %w", err)
+	}
+	return nil
+}
+
+// ConsumeWebAuthnSession marks an open session of the purpose used and returns it, or nil when
+// there is no such session or it expired. A challenge is only ever checked once.
+func (d *Database) ConsumeWebAuthnSession(ctx context.Context, id uuid.UUID, purpose string) (*WebAuthnSession, error) {
+	var found *WebAuthnSession
+	err := d.withTransaction(ctx, func(tx *gorm.DB) error {
+		var session WebAuthnSession
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND purpose = ? AND is_used = ?", id, purpose, false).First(&session).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		if err := tx.Model(&session).UpdateColumn("is_used", true).Error; err != nil {
+			return err
+		}
+		if time.Now().Before(session.ExpiresAt) {
+			found = &session
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume webauthn session: %w", err)
+	}
+	return found, nil
+}
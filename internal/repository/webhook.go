@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+)
+
+// WebhookDeliveryFilter narrows a list of deliveries; empty fields match every delivery
+type WebhookDeliveryFilter struct {
+	Status    string
+	EventType string
+	Endpoint  string
+}
+
+// CreateWebhookDeliveries queues deliveries of an event
+func (d *Database) CreateWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := d.db.WithContext(ctx).Create(&deliveries).Error; err != nil {
+		return fmt.Errorf("failed to create webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// WebhookDeliveryEndpoints lists the endpoints an event has been queued for
+func (d *Database) WebhookDeliveryEndpoints(ctx context.Context, eventID uuid.UUID) ([]string, error) {
+	var endpoints []string
+	if err := d.db.WithContext(ctx).Model(&WebhookDelivery{}).Where("event_id = ?", eventID).
+		Pluck("endpoint", &endpoints).Error; err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries of event: %w", err)
+	}
+	return endpoints, nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries due by now, postponing each by
+// lease so no other replica sends it meanwhile. A claim the sender never settles runs again after it.
+func (d *Database) ClaimDueWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration,
+	limit int) ([]WebhookDelivery, error) {
+	var due []WebhookDelivery
+	if err := d.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", constants.WebhookStatusPending, now).
+		Order("next_attempt_at").Limit(limit).Find(&due).Error; err != nil {
+		return nil, fmt.Errorf("failed to query due webhook deliveries: %w", err)
+	}
+	claimed := due[:0]
+	for _, delivery := range due {
+		result := d.db.WithContext(ctx).Model(&WebhookDelivery{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, constants.WebhookStatusPending,
+				delivery.NextAttemptAt).
+			Update("next_attempt_at", now.Add(lease))
+		if result.Error != nil {
+			return nil, fmt.Errorf("failed to claim webhook delivery: %w", result.Error)
+		}
+		if result.RowsAffected == 1 {
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed, nil
+}
+
+// SaveWebhookDeliveryResult stores the outcome of an attempt, zero values included
+func (d *Database) SaveWebhookDeliveryResult(ctx context.Context, delivery *WebhookDelivery) error {
+	delivery.UpdatedAt = time.Now()
+	if err := d.db.WithContext(ctx).Model(delivery).
+		Select("updated_at", "status", "next_attempt_at", "attempts", "response_code", "last_error", "delivered_at").
+		Updates(delivery).Error; err != nil {
+		return fmt.Errorf("failed to save webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDelivery gets a delivery by ID
+func (d *Database) GetWebhookDelivery(ctx context.Context, id uuid.UUID) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := d.db.WithContext(ctx).Where("id = ?", id).First(&delivery).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query webhook delivery: %w", err)
+	}
+	return &delivery, nil
+}
+
+// ListWebhookDeliveries lists the most recently created deliveries matching the filter
+func (d *Database) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit int) ([]WebhookDelivery, error) {
+	query := d.db.WithContext(ctx).Order("created_at DESC").Limit(limit)
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.EventType != "" {
+		query = query.Where("event_type = ?", filter.EventType)
+	}
+	if filter.Endpoint != "" {
+		query = query.Where("endpoint = ?", filter.Endpoint)
+	}
+	var deliveries []WebhookDelivery
+	if err := query.Find(&deliveries).Error; err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// ReplayWebhookDelivery queues a delivery again with fresh attempts, whatever its status.
+// It reports false when there is no such delivery.
+func (d *Database) ReplayWebhookDelivery(ctx context.Context, id uuid.UUID) (bool, error) {
+	now := time.Now()
+	result := d.db.WithContext(ctx).Model(&WebhookDelivery{}).Where("id = ?", id).Updates(map[string]any{
+		"status":          constants.WebhookStatusPending,
+		"next_attempt_at": now,
+		"attempts":        0,
+		"response_code":   0,
+		"last_error":      "",
+		"delivered_at":    nil,
+		"updated_at":      now,
+	})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to replay webhook delivery: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/outbox"
+	"github.com/zgsm-ai/oidc-auth/internal/providers"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+const (
+	mergeStepAttempts = 2               // attempts of a step within one run, later runs retry again
+	mergeRetryDelay   = time.Second     // grows with each attempt
+	mergeLease        = 2 * time.Minute // a running merge not saved for this long is resumed by the next caller
+	mergeSaveTimeout  = 5 * time.Second
+)
+
+var (
+	ErrMergeNotFound         = errors.New("account merge not found")
+	ErrMergeBusy             = errors.New("account merge is running or already finished")
+	ErrMergeNotCancellable   = errors.New("account merge cannot be cancelled once the upstream accounts are merged")
+	ErrMergeStepNotSkippable = errors.New("only a failed upstream step can be skipped")
+	ErrMergeTokensCleared    = errors.New("the upstream tokens of the merge were dropped, bind the accounts again")
+)
+
+// mergeSteps the steps of a merge in the order they run. The quota is merged from the outbox event
+// the accounts step writes.
+var mergeSteps = []string{
+	constants.MergeStepCasdoor,
+	constants.MergeStepAccounts,
+	constants.MergeStepIdentities,
+	constants.MergeStepDone,
+}
+
+// AccountMergeRequest the accounts a bind merges and the profile of the merged account
+type AccountMergeRequest struct {
+	MainUserID  uuid.UUID
+	OtherUserID uuid.UUID
+	OtherSaved  bool // the other account is a saved user rather than a new upstream login
+	MainToken   string
+	OtherToken  string
+	Profile     repository.MergeProfile
+}
+
+// mergeIdempotencyKey identifies the merge of two accounts, so binding them again resumes it
+func mergeIdempotencyKey(mainUserID, otherUserID uuid.UUID) string {
+	sum := sha256.Sum256([]byte("merge:" + mainUserID.String() + ":" + otherUserID.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartAccountMerge stores the merge of two accounts, or returns the stored merge of the same
+// accounts. A stored merge that has not reached the upstream accounts yet takes the new tokens
+// and profile, and starts over when it was cancelled.
+func StartAccountMerge(ctx context.Context, req AccountMergeRequest) (*repository.AccountMerge, error) {
+	mainToken, err := encryptMergeToken(req.MainToken)
+	if err != nil {
+		return nil, err
+	}
+	otherToken, err := encryptMergeToken(req.OtherToken)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	db := repository.GetDB()
+	merge, err := db.CreateAccountMerge(ctx, &repository.AccountMerge{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		IdempotencyKey: mergeIdempotencyKey(req.MainUserID, req.OtherUserID),
+		MainUserID:     req.MainUserID,
+		OtherUserID:    req.OtherUserID,
+		OtherSaved:     req.OtherSaved,
+		MainToken:      mainToken,
+		OtherToken:     otherToken,
+		Profile:        req.Profile,
+		Step:           constants.MergeStepCasdoor,
+		Status:         constants.MergeStatusPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if merge.Step == constants.MergeStepCasdoor && merge.Status != constants.MergeStatusRunning {
+		merge.MainToken, merge.OtherToken, merge.Profile = mainToken, otherToken, req.Profile
+		if merge.Status == constants.MergeStatusCancelled {
+			merge.Status = constants.MergeStatusPending
+			merge.Attempts, merge.LastError = 0, ""
+		}
+		if err := db.SaveAccountMergeProgress(ctx, merge); err != nil {
+			return nil, err
+		}
+	}
+	return merge, nil
+}
+
+// RunAccountMerge runs the remaining steps of a merge. A step that keeps failing leaves the merge
+// failed at that step, to be resumed later; the steps before it are not run again.
+func RunAccountMerge(ctx context.Context, id uuid.UUID, httpClient *http.Client) (*repository.AccountMerge, error) {
+	db := repository.GetDB()
+	claimed, err := db.ClaimAccountMerge(ctx, id, time.Now().Add(-mergeLease))
+	if err != nil {
+		return nil, err
+	}
+	merge, err := db.GetAccountMerge(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if merge == nil {
+		return nil, ErrMergeNotFound
+	}
+	if !claimed {
+		if merge.Status == constants.MergeStatusCompleted {
+			return merge, nil
+		}
+		return merge, ErrMergeBusy
+	}
+
+	for merge.Step != constants.MergeStepDone {
+		if err := runMergeStepWithRetries(ctx, merge, httpClient); err != nil {
+			merge.Status = constants.MergeStatusFailed
+			merge.LastError = err.Error()
+			// binding the accounts again starts a failed merge over with fresh tokens
+			merge.MainToken, merge.OtherToken = "", ""
+			if saveErr := saveMergeProgress(ctx, merge); saveErr != nil {
+				log.Error(nil, "account merge %s: %v", merge.ID, saveErr)
+			}
+			log.Warn(nil, "account merge %s stopped at %s after %d attempts: %v", merge.ID, merge.Step, merge.Attempts, err)
+			audit.AccountMerge(ctx, merge, err)
+			return merge, fmt.Errorf("account merge %s stopped at %s: %w", merge.ID, merge.Step, err)
+		}
+		merge.Step = nextMergeStep(merge)
+		merge.Attempts, merge.LastError = 0, ""
+		// only the upstream step calls with the tokens of the users
+		merge.MainToken, merge.OtherToken = "", ""
+		if merge.Step == constants.MergeStepDone {
+			now := time.Now()
+			merge.Status = constants.MergeStatusCompleted
+			merge.CompletedAt = &now
+		}
+		if err := saveMergeProgress(ctx, merge); err != nil {
+			return merge, err
+		}
+	}
+	log.Info(nil, "account merge %s completed: user %s merged into %s", merge.ID, merge.OtherUserID, merge.MainUserID)
+	audit.AccountMerge(ctx, merge, nil)
+	return merge, nil
+}
+
+// ResumeAccountMerge runs a stopped merge again. Skipping its step is for an operator who checked
+// that a failed upstream merge did go through, so retrying it can only fail. A merge that
+// failed at the upstream step has dropped the tokens of the users; binding the accounts again
+// starts it over.
+func ResumeAccountMerge(ctx context.Context, id string, skipStep bool, httpClient *http.Client) (*repository.AccountMerge, error) {
+	mergeID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrMergeNotFound
+	}
+	if skipStep {
+		db := repository.GetDB()
+		merge, err := db.GetAccountMerge(ctx, mergeID)
+		if err != nil {
+			return nil, err
+		}
+		if merge == nil {
+			return nil, ErrMergeNotFound
+		}
+		if merge.Status != constants.MergeStatusFailed || merge.Step != constants.MergeStepCasdoor {
+			return merge, ErrMergeStepNotSkippable
+		}
+		log.Warn(nil, "account merge %s: step %s skipped by an operator", merge.ID, merge.Step)
+		merge.Step = nextMergeStep(merge)
+		merge.Attempts, merge.LastError = 0, ""
+		merge.MainToken, merge.OtherToken = "", ""
+		if err := db.SaveAccountMergeProgress(ctx, merge); err != nil {
+			return nil, err
+		}
+	}
+	return RunAccountMerge(ctx, mergeID, httpClient)
+}
+
+// CancelAccountMerge cancels a merge that stopped before merging the upstream accounts, when
+// nothing has been changed yet
+func CancelAccountMerge(ctx context.Context, id string) (*repository.AccountMerge, error) {
+	mergeID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrMergeNotFound
+	}
+	db := repository.GetDB()
+	cancelled, err := db.CancelAccountMerge(ctx, mergeID)
+	if err != nil {
+		return nil, err
+	}
+	merge, err := db.GetAccountMerge(ctx, mergeID)
+	if err != nil {
+		return nil, err
+	}
+	if merge == nil {
+		return nil, ErrMergeNotFound
+	}
+	if !cancelled {
+		return merge, ErrMergeNotCancellable
+	}
+	return merge, nil
+}
+
+// GetAccountMerge gets a merge by ID
+func GetAccountMerge(ctx context.Context, id string) (*repository.AccountMerge, error) {
+	mergeID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrMergeNotFound
+	}
+	merge, err := repository.GetDB().GetAccountMerge(ctx, mergeID)
+	if err != nil {
+		return nil, err
+	}
+	if merge == nil {
+		return nil, ErrMergeNotFound
+	}
+	return merge, nil
+}
+
+// ListAccountMerges lists the most recently updated merges, of one status when it is not empty
+func ListAccountMerges(ctx context.Context, status string, limit int) ([]repository.AccountMerge, error) {
+	return repository.GetDB().ListAccountMerges(ctx, status, limit)
+}
+
+// runMergeStepWithRetries runs the current step of a merge, retrying it after a growing delay
+func runMergeStepWithRetries(ctx context.Context, merge *repository.AccountMerge, httpClient *http.Client) error {
+	for attempt := 1; ; attempt++ {
+		err := runMergeStep(ctx, merge, httpClient)
+		if err == nil {
+			return nil
+		}
+		merge.Attempts++
+		if attempt == mergeStepAttempts {
+			return err
+		}
+		merge.LastError = err.Error()
+		// also keeps the lease of the running merge
+		if saveErr := saveMergeProgress(ctx, merge); saveErr != nil {
+			return saveErr
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * mergeRetryDelay):
+		}
+	}
+}
+
+// runMergeStep runs the current step of a merge. Remote steps send an idempotency key of the merge
+// and step, so a retry of a call that went through is recognized.
+func runMergeStep(ctx context.Context, merge *repository.AccountMerge, httpClient *http.Client) error {
+	idempotencyKey := merge.ID.String() + ":" + merge.Step
+	switch merge.Step {
+	case constants.MergeStepCasdoor:
+		provider, err := providers.GetManager().GetProvider("casdoor")
+		if err != nil {
+			return err
+		}
+		if merge.MainToken == "" || merge.OtherToken == "" {
+			return ErrMergeTokensCleared
+		}
+		mainToken, err := decryptMergeToken(merge.MainToken)
+		if err != nil {
+			return err
+		}
+		otherToken, err := decryptMergeToken(merge.OtherToken)
+		if err != nil {
+			return err
+		}
+		resp, err := MergeByCasdoor(provider, mainToken, otherToken, idempotencyKey, httpClient)
+		if err != nil {
+			return err
+		}
+		if resp.Status != "ok" {
+			return fmt.Errorf("upstream merge returned status %q", resp.Status)
+		}
+		return nil
+	case constants.MergeStepAccounts:
+		if err := repository.GetDB().MergeAccounts(ctx, merge); err != nil {
+			return err
+		}
+		outbox.Notify()
+		return nil
+	case constants.MergeStepIdentities:
+		db := repository.GetDB()
+		user, err := db.GetUserByField(ctx, constants.DBIndexField, merge.MainUserID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("main user %s no longer exists", merge.MainUserID)
+		}
+		return db.SyncUserIdentities(ctx, user)
+	default:
+		return fmt.Errorf("unknown merge step %q", merge.Step)
+	}
+}
+
+// nextMergeStep returns the step after the current one
+func nextMergeStep(merge *repository.AccountMerge) string {
+	for i, step := range mergeSteps[:len(mergeSteps)-1] {
+		if step == merge.Step {
+			return mergeSteps[i+1]
+		}
+	}
+	return constants.MergeStepDone
+}
+
+// saveMergeProgress saves a merge even when the request that ran it timed out, so it can be resumed
+func saveMergeProgress(ctx context.Context, merge *repository.AccountMerge) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mergeSaveTimeout)
+	defer cancel()
+	return repository.GetDB().SaveAccountMergeProgress(ctx, merge)
+}
+
+// encryptMergeToken encrypts an upstream token for storage with a merge; an empty token stays empty
+func encryptMergeToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	keys, err := utils.GetEncryptKeyManager()
+	if err != nil {
+		return "", err
+	}
+	return keys.AESEncrypt([]byte(token))
+}
+
+func decryptMergeToken(encrypted string) (string, error) {
+	keys, err := utils.GetEncryptKeyManager()
+	if err != nil {
+		return "", err
+	}
+	token, err := keys.AESDecrypt(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt merge token: %w", err)
+	}
+	return string(token), nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+var (
+	ErrClientNotFound     = errors.New("client not found")
+	ErrClientDisabled     = errors.New("client is disabled")
+	ErrClientUnauthorized = errors.New("client authentication failed")
+)
+
+// clientCacheTTL how long a cached client is used before it is read again, so a client changed
+// in the database takes effect on every replica without a restart
+const clientCacheTTL = time.Minute
+
+// cachedClient a client of the registry and when it was read from the database
+type cachedClient struct {
+	client   *repository.OAuthClient
+	loadedAt time.Time
+}
+
+// clientRegistry caches registered OAuth clients; the database is the source of truth
+var clientRegistry = struct {
+	mu      sync.RWMutex
+	clients map[string]cachedClient
+}{clients: make(map[string]cachedClient)}
+
+// defaultClients keep the plugin and web route groups working without any client configuration
+func defaultClients() map[string]config.ClientConfig {
+	grants := []string{constants.GrantAuthorizationCode, constants.GrantRefreshToken, constants.GrantSMSCode,
+		constants.GrantEmail, constants.GrantPassword, constants.GrantWebAuthn}
+	return map[string]config.ClientConfig{
+		constants.DefaultPluginClientID: {
+			Name:          "IDE plugin",
+			Platform:      "plugin",
+			AllowedGrants: grants,
+			URISchemes:    constants.DefaultPluginURISchemes,
+			RedirectURIs:  constants.DefaultPluginRedirectURIs(),
+		},
+		constants.DefaultWebClientID: {
+			Name:          "Web manager",
+			Platform:      "web",
+			AllowedGrants: grants,
+		},
+	}
+}
+
+// InitClientRegistry saves the configured and built-in clients to the database and loads the registry.
+// The config is the source of truth for the clients it declares: a registered one is updated to it,
+// keeping its ID. Clients registered only in the database are left as they are.
+func InitClientRegistry(ctx context.Context, cfgs map[string]config.ClientConfig) error {
+	seeds := defaultClients()
+	for clientID, cfg := range cfgs {
+		seeds[clientID] = cfg
+	}
+
+	db := repository.GetDB()
+	for clientID, cfg := range seeds {
+		existing, err := db.GetClientByID(ctx, clientID)
+		if err != nil {
+			return err
+		}
+		client, err := clientFromConfig(clientID, cfg)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			client.ID = existing.ID
+			client.CreatedAt = existing.CreatedAt
+		}
+		if err := db.SaveClient(ctx, client); err != nil {
+			return fmt.Errorf("failed to save client %s: %w", clientID, err)
+		}
+	}
+
+	clients, err := db.ListClients(ctx)
+	if err != nil {
+		return err
+	}
+	clientRegistry.mu.Lock()
+	defer clientRegistry.mu.Unlock()
+	now := time.Now()
+	clientRegistry.clients = make(map[string]cachedClient, len(clients))
+	for i := range clients {
+		clientRegistry.clients[clients[i].ClientID] = cachedClient{client: &clients[i], loadedAt: now}
+	}
+	log.Info(nil, "Client registry initialized with %d clients", len(clients))
+	return nil
+}
+
+func clientFromConfig(clientID string, cfg config.ClientConfig) (*repository.OAuthClient, error) {
+	if cfg.Platform == "" {
+		return nil, fmt.Errorf("client %s: platform must be plugin or web", clientID)
+	}
+	for _, uri := range cfg.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, fmt.Errorf("client %s: %w", clientID, err)
+		}
+	}
+	if len(cfg.AllowedGrants) == 0 {
+		cfg.AllowedGrants = []string{constants.GrantAuthorizationCode, constants.GrantRefreshToken}
+	}
+
+	client := &repository.OAuthClient{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+	}
+	client.UpdatedAt = time.Now()
+	client.ClientID = clientID
+	client.Name = cfg.Name
+	client.Platform = cfg.Platform
+	client.RedirectURIs = cfg.RedirectURIs
+	client.URISchemes = make([]string, 0, len(cfg.URISchemes))
+	for _, scheme := range cfg.URISchemes {
+		client.URISchemes = append(client.URISchemes, strings.ToLower(scheme))
+	}
+	client.AllowedGrants = cfg.AllowedGrants
+	client.Audience = cfg.Audience
+	client.AccessTokenTTL = int64(cfg.AccessTokenTTL.Seconds())
+	client.RefreshTokenTTL = int64(cfg.RefreshTokenTTL.Seconds())
+	client.DisplayName = cfg.Branding.DisplayName
+	client.LogoURL = cfg.Branding.LogoURL
+	client.HomepageURL = cfg.Branding.HomepageURL
+	client.PrimaryColor = cfg.Branding.PrimaryColor
+	client.Disabled = cfg.Disabled
+	if cfg.ClientSecret != "" {
+		client.ClientSecretHash = utils.HashToken(cfg.ClientSecret)
+	}
+	return client, nil
+}
+
+// validateRedirectURI rejects redirect URIs that cannot be matched exactly
+func validateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid redirect URI %q: %w", uri, err)
+	}
+	if parsed.Scheme == "" {
+		return fmt.Errorf("redirect URI %q must be absolute", uri)
+	}
+	if parsed.Fragment != "" {
+		return fmt.Errorf("redirect URI %q must not contain a fragment", uri)
+	}
+	if parsed.Scheme == "http" && parsed.Hostname() != "localhost" && parsed.Hostname() != "127.0.0.1" {
+		return fmt.Errorf("redirect URI %q must use https", uri)
+	}
+	return nil
+}
+
+// GetClient returns an enabled client from the registry, reading it from the database when it is
+// not cached or was cached longer than clientCacheTTL ago
+func GetClient(ctx context.Context, clientID string) (*repository.OAuthClient, error) {
+	clientRegistry.mu.RLock()
+	cached, ok := clientRegistry.clients[clientID]
+	clientRegistry.mu.RUnlock()
+
+	client := cached.client
+	if !ok || time.Since(cached.loadedAt) >= clientCacheTTL {
+		var err error
+		client, err = repository.GetDB().GetClientByID(ctx, clientID)
+		if err != nil {
+			return nil, err
+		}
+		clientRegistry.mu.Lock()
+		if client == nil {
+			delete(clientRegistry.clients, clientID)
+		} else {
+			clientRegistry.clients[clientID] = cachedClient{client: client, loadedAt: time.Now()}
+		}
+		clientRegistry.mu.Unlock()
+		if client == nil {
+			return nil, ErrClientNotFound
+		}
+	}
+	if client.Disabled {
+		return nil, ErrClientDisabled
+	}
+	return client, nil
+}
+
+// AuthenticateClient checks the secret of a confidential client; public clients always pass
+func AuthenticateClient(client *repository.OAuthClient, clientSecret string) error {
+	if !client.IsConfidential() {
+		return nil
+	}
+	if clientSecret == "" {
+		return ErrClientUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(clientSecret)), []byte(client.ClientSecretHash)) != 1 {
+		return ErrClientUnauthorized
+	}
+	return nil
+}
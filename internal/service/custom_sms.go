@@ -2,9 +2,11 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -92,35 +94,51 @@ func getMD5(params map[string]interface{}, appKey string) string {
 	return strings.ToUpper(digest)
 }
 
-func SendSMS(phoneNum, code string) error {
-	smsCfg := GetSMSCfg(nil)
+// customSMSSender sends codes through the original MD5-signed vendor API
+type customSMSSender struct {
+	cfg *config.SMSConfig
+}
+
+func newCustomSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	// the custom vendor is the implicit default, so a missing config only fails when sending
+	if cfg.SendURL == "" {
+		log.Warn(nil, "custom sms sender has no sendURL, SMS cannot be sent")
+	}
+	return &customSMSSender{cfg: cfg}, nil
+}
+
+func (s *customSMSSender) Name() string {
+	return "custom"
+}
+
+func (s *customSMSSender) Send(ctx context.Context, msg SMSMessage) error {
+	if s.cfg.SendURL == "" {
+		return errors.New("custom sms sender is not configured")
+	}
 	requestParams := map[string]interface{}{
-		"AppId":            smsCfg.AppID,
-		"MchId":            smsCfg.MchID,
+		"AppId":            s.cfg.AppID,
+		"MchId":            s.cfg.MchID,
 		"SignType":         "MD5",
-		"TemplateId":       smsCfg.TemplateID,
+		"TemplateId":       s.cfg.TemplateID,
 		"TimeStamp":        strconv.FormatInt(time.Now().Unix(), 10),
 		"Type":             "3",
 		"Version":          "1.1.0",
-		"TemplateParamSet": []string{code},
-		"PhoneNumberSet":   []string{strings.TrimPrefix(phoneNum, "+86")},
+		"TemplateParamSet": []string{msg.Code},
+		"PhoneNumberSet":   []string{nationalOrE164(msg.Phone)},
 	}
-	fmt.Println(requestParams)
-	calculatedSignature := getMD5(requestParams, smsCfg.ApiKey)
-	requestParams["Signature"] = calculatedSignature
+	requestParams["Signature"] = getMD5(requestParams, s.cfg.ApiKey)
 
 	jsonPayload, err := json.Marshal(requestParams)
 	if err != nil {
-		return fmt.Errorf("")
+		return fmt.Errorf("failed to marshal sms request: %w", err)
 	}
-	client := smsCfg.HTTPClient
-	req, err := http.NewRequest("POST", smsCfg.SendURL, bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.SendURL, bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		return fmt.Errorf("")
+		return fmt.Errorf("failed to create sms request: %w", err)
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json;charset=utf-8")
-	resp, err := client.Do(req)
+	resp, err := smsHTTPClient(s.cfg).Do(req)
 	if err != nil {
 		return err
 	}
@@ -138,7 +156,7 @@ func SendSMS(phoneNum, code string) error {
 		return err
 	}
 	if smsRes.Status != "00" {
-		return fmt.Errorf(smsRes.Message)
+		return errors.New(smsRes.Message)
 	}
 	return nil
 }
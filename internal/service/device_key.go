@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+const (
+	// proofClockSkew how far in the future a proof may be issued by a device with a fast clock
+	proofClockSkew = time.Minute
+	// proofSweepInterval how often the used proofs too old to be accepted anyway are deleted
+	proofSweepInterval = time.Hour
+)
+
+var (
+	ErrDeviceProofInvalid = errors.New("invalid device key proof")
+	ErrDeviceKeyRequired  = errors.New("a proof of the device key is required")
+	ErrDeviceKeyMismatch  = errors.New("the proof is not made with the key of this device")
+	// ErrDeviceKeyLogin a refresh of a device without a key where keys are required; keys are only
+	// registered at login, so the device logs in again
+	ErrDeviceKeyLogin = errors.New("the device has no key, log in again to register one")
+)
+
+var (
+	deviceCfg     *config.DeviceConfig
+	deviceBaseURL string
+	geoClient     *http.Client
+	deviceOnce    sync.Once
+	usedProofs    proofStore = &dbProofStore{}
+)
+
+// InitDeviceAttestation sets how devices prove their keys, where client IPs are located and how
+// refreshes are scored. Proofs are made for URLs under the base URL.
+func InitDeviceAttestation(cfg *config.DeviceConfig, baseURL string, client *http.Client) {
+	deviceOnce.Do(func() {
+		deviceCfg = cfg
+		deviceBaseURL = strings.TrimRight(baseURL, "/")
+		geoClient = client
+		if cfg.RequireKey {
+			log.Info(nil, "plugin logins must register a device key")
+		}
+		if cfg.Geo.Source != "" {
+			log.Info(nil, "client IPs are located from %s", cfg.Geo.Source)
+		}
+	})
+}
+
+// DeviceKeyRequired reports whether plugin devices must be bound to a key
+func DeviceKeyRequired() bool {
+	return deviceCfg != nil && deviceCfg.RequireKey
+}
+
+// proofStore remembers the proofs accepted until they are too old to be accepted anyway
+type proofStore interface {
+	// use records a proof, reporting false when it was used before
+	use(ctx context.Context, id string, expires time.Time) (bool, error)
+}
+
+// dbProofStore remembers the proofs in the database, so a proof replayed to another replica fails too
+type dbProofStore struct {
+	lastSweep atomic.Int64
+}
+
+func (s *dbProofStore) use(ctx context.Context, id string, expires time.Time) (bool, error) {
+	db := repository.GetDB()
+	now := time.Now()
+	if last := s.lastSweep.Load(); now.Unix()-last >= int64(proofSweepInterval.Seconds()) &&
+		s.lastSweep.CompareAndSwap(last, now.Unix()) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if _, err := db.DeleteExpiredDeviceProofs(ctx, now); err != nil {
+				log.Warn(nil, "failed to sweep used device proofs: %v", err)
+			}
+		}()
+	}
+	return db.UseDeviceProof(ctx, utils.HashToken(id), expires)
+}
+
+// VerifyDeviceProof checks a key proof was made recently, and only once, for a request with the
+// method to the path on this server. It returns the thumbprint of the proven key.
+func VerifyDeviceProof(ctx context.Context, proof, method, path string) (string, error) {
+	parsed, err := verifyProof(ctx, proof, method, ProofURL(path))
+	if err != nil {
+		return "", err
+	}
+	return parsed.Thumbprint, nil
+}
+
+// VerifyTokenProof checks the proof presented with an access token bound to the key of the
+// thumbprint: made by that key, for the request with the method to the URL, and for that token
+func VerifyTokenProof(ctx context.Context, proof, method, target, accessToken, thumbprint string) error {
+	parsed, err := verifyProof(ctx, proof, method, target)
+	if err != nil {
+		return err
+	}
+	return matchTokenProof(parsed, accessToken, thumbprint)
+}
+
+// CheckTokenProof is VerifyTokenProof for a proof presented to another server, which forwarded it
+// to introspect the token: the proof is not used up here, that server decides whether it saw it before
+func CheckTokenProof(proof, method, target, accessToken, thumbprint string) error {
+	parsed, err := checkProof(proof, method, target)
+	if err != nil {
+		return err
+	}
+	return matchTokenProof(parsed, accessToken, thumbprint)
+}
+
+// matchTokenProof checks a proof was made by the key of the thumbprint for the access token
+func matchTokenProof(parsed *utils.KeyProof, accessToken, thumbprint string) error {
+	if subtle.ConstantTimeCompare([]byte(parsed.Thumbprint), []byte(thumbprint)) != 1 {
+		return ErrDeviceKeyMismatch
+	}
+	if subtle.ConstantTimeCompare([]byte(parsed.AccessTokenHash), []byte(utils.AccessTokenHash(accessToken))) != 1 {
+		return fmt.Errorf("%w: not made for this access token", ErrDeviceProofInvalid)
+	}
+	return nil
+}
+
+// ProofURL the URL proofs are made for to reach the path on this server
+func ProofURL(path string) string {
+	return deviceBaseURL + path
+}
+
+// verifyProof checks a key proof was made recently, and only once, for a request with the method to the URL
+func verifyProof(ctx context.Context, proof, method, target string) (*utils.KeyProof, error) {
+	parsed, err := checkProof(proof, method, target)
+	if err != nil {
+		return nil, err
+	}
+	unused, err := usedProofs.use(ctx, parsed.Thumbprint+"."+parsed.ID, parsed.IssuedAt.Add(proofMaxAge()+proofClockSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, fmt.Errorf("%w: already used", ErrDeviceProofInvalid)
+	}
+	return parsed, nil
+}
+
+// proofMaxAge how old a proof may be
+func proofMaxAge() time.Duration {
+	if deviceCfg != nil {
+		return deviceCfg.ProofMaxAge
+	}
+	return 5 * time.Minute
+}
+
+// checkProof checks a key proof was made recently for a request with the method to the URL
+func checkProof(proof, method, target string) (*utils.KeyProof, error) {
+	parsed, err := utils.ParseKeyProof(proof)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeviceProofInvalid, err)
+	}
+	made, _, _ := strings.Cut(parsed.URL, "?")
+	made, _, _ = strings.Cut(made, "#")
+	if !strings.EqualFold(parsed.Method, method) || made != target {
+		return nil, fmt.Errorf("%w: made for %s %s", ErrDeviceProofInvalid, parsed.Method, made)
+	}
+	now := time.Now()
+	maxAge := proofMaxAge()
+	if parsed.IssuedAt.Before(now.Add(-maxAge)) || parsed.IssuedAt.After(now.Add(proofClockSkew)) {
+		return nil, fmt.Errorf("%w: issued at %s", ErrDeviceProofInvalid, parsed.IssuedAt.Format(time.RFC3339))
+	}
+	return parsed, nil
+}
+
+// BindDeviceKey checks the key proven on the request for the first tokens of a device: a device
+// bound to a key needs a proof of that key, a device without one registers the proven key. An
+// empty thumbprint means the request carried no proof.
+func BindDeviceKey(device *repository.Device, thumbprint string) error {
+	if device.Attestation.KeyThumbprint != "" {
+		return CheckDeviceKey(device, thumbprint)
+	}
+	if thumbprint != "" {
+		device.Attestation.RegisterKey(thumbprint, time.Now())
+		return nil
+	}
+	if DeviceKeyRequired() && device.Platform == "plugin" {
+		return ErrDeviceKeyRequired
+	}
+	return nil
+}
+
+// CheckDeviceKey checks the key proven on a refresh against the device. A refresh never registers
+// a key: a device without one stays without, or logs in again when keys are required.
+func CheckDeviceKey(device *repository.Device, thumbprint string) error {
+	registered := device.Attestation.KeyThumbprint
+	switch {
+	case registered == "":
+		if DeviceKeyRequired() && device.Platform == "plugin" {
+			return ErrDeviceKeyLogin
+		}
+	case thumbprint == "":
+		return ErrDeviceKeyRequired
+	case subtle.ConstantTimeCompare([]byte(registered), []byte(thumbprint)) != 1:
+		return ErrDeviceKeyMismatch
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+const proofTarget = "https://auth.example.com/oidc-auth/api/v1/plugin/login/token"
+
+// memoryProofStore remembers used proofs for the tests, which have no database
+type memoryProofStore struct {
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+func (s *memoryProofStore) use(_ context.Context, id string, _ time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used[id] {
+		return false, nil
+	}
+	s.used[id] = true
+	return true, nil
+}
+
+func useMemoryProofs(t *testing.T) {
+	previous := usedProofs
+	usedProofs = &memoryProofStore{used: map[string]bool{}}
+	t.Cleanup(func() { usedProofs = previous })
+}
+
+func newProofKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// makeProof a proof by the key for the request, issued at the time, for the access token unless it is empty
+func makeProof(t *testing.T, key *ecdsa.PrivateKey, jti, method, target string, issuedAt time.Time, accessToken string) string {
+	t.Helper()
+	claims := jwt.MapClaims{"jti": jti, "htm": method, "htu": target, "iat": issuedAt.Unix()}
+	if accessToken != "" {
+		claims["ath"] = utils.AccessTokenHash(accessToken)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = utils.KeyProofType
+	token.Header["jwk"] = map[string]any{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerifyProof(t *testing.T) {
+	key := newProofKey(t)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		proof  string
+		method string
+		target string
+		valid  bool
+	}{
+		{"valid", makeProof(t, key, "a", "POST", proofTarget, now, ""), "POST", proofTarget, true},
+		{"method in another case", makeProof(t, key, "b", "post", proofTarget, now, ""), "POST", proofTarget, true},
+		{"query and fragment ignored", makeProof(t, key, "c", "POST", proofTarget+"?x=1#y", now, ""), "POST", proofTarget, true},
+		{"slightly fast clock", makeProof(t, key, "d", "POST", proofTarget, now.Add(30*time.Second), ""), "POST", proofTarget, true},
+		{"another method", makeProof(t, key, "e", "GET", proofTarget, now, ""), "POST", proofTarget, false},
+		{"another url", makeProof(t, key, "f", "POST", proofTarget+"/other", now, ""), "POST", proofTarget, false},
+		{"too old", makeProof(t, key, "g", "POST", proofTarget, now.Add(-6*time.Minute), ""), "POST", proofTarget, false},
+		{"from the future", makeProof(t, key, "h", "POST", proofTarget, now.Add(2*time.Minute), ""), "POST", proofTarget, false},
+		{"not a proof", "not.a.proof", "POST", proofTarget, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryProofs(t)
+			_, err := verifyProof(context.Background(), tt.proof, tt.method, tt.target)
+			if tt.valid && err != nil {
+				t.Errorf("verifyProof: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrDeviceProofInvalid) {
+				t.Errorf("verifyProof error = %v, want %v", err, ErrDeviceProofInvalid)
+			}
+		})
+	}
+}
+
+func TestVerifyProofReplay(t *testing.T) {
+	useMemoryProofs(t)
+	ctx := context.Background()
+	key := newProofKey(t)
+	proof := makeProof(t, key, "once", "POST", proofTarget, time.Now(), "")
+	if _, err := verifyProof(ctx, proof, "POST", proofTarget); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := verifyProof(ctx, proof, "POST", proofTarget); !errors.Is(err, ErrDeviceProofInvalid) {
+		t.Errorf("replay error = %v, want %v", err, ErrDeviceProofInvalid)
+	}
+	// the jti is only unique per key
+	other := makeProof(t, newProofKey(t), "once", "POST", proofTarget, time.Now(), "")
+	if _, err := verifyProof(ctx, other, "POST", proofTarget); err != nil {
+		t.Errorf("same jti by another key: %v", err)
+	}
+}
+
+func TestVerifyTokenProof(t *testing.T) {
+	key := newProofKey(t)
+	proof := makeProof(t, key, "a", "GET", proofTarget, time.Now(), "access-token")
+	parsed, err := utils.ParseKeyProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		token      string
+		thumbprint string
+		wantErr    error
+	}{
+		{"bound key and token", "access-token", parsed.Thumbprint, nil},
+		{"another token", "other-token", parsed.Thumbprint, ErrDeviceProofInvalid},
+		{"another key", "access-token", "another-thumbprint", ErrDeviceKeyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryProofs(t)
+			err := VerifyTokenProof(context.Background(), proof, "GET", proofTarget, tt.token, tt.thumbprint)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("VerifyTokenProof error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTokenProofDoesNotUseProof(t *testing.T) {
+	useMemoryProofs(t)
+	key := newProofKey(t)
+	proof := makeProof(t, key, "forwarded", "GET", proofTarget, time.Now(), "access-token")
+	parsed, err := utils.ParseKeyProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := CheckTokenProof(proof, "GET", proofTarget, "access-token", parsed.Thumbprint); err != nil {
+			t.Fatalf("CheckTokenProof: %v", err)
+		}
+	}
+	if err := CheckTokenProof(proof, "GET", proofTarget, "other-token", parsed.Thumbprint); !errors.Is(err, ErrDeviceProofInvalid) {
+		t.Errorf("CheckTokenProof for another token error = %v, want %v", err, ErrDeviceProofInvalid)
+	}
+	// the device presenting it to this server still uses it once
+	ctx := context.Background()
+	if err := VerifyTokenProof(ctx, proof, "GET", proofTarget, "access-token", parsed.Thumbprint); err != nil {
+		t.Errorf("VerifyTokenProof after introspection: %v", err)
+	}
+}
+
+func TestDeviceKeyRegisteredOnlyAtLogin(t *testing.T) {
+	previous := deviceCfg
+	t.Cleanup(func() { deviceCfg = previous })
+	keyed := func() *repository.Device {
+		device := &repository.Device{Platform: "plugin"}
+		device.Attestation.RegisterKey("key-a", time.Now())
+		return device
+	}
+	keyless := func() *repository.Device { return &repository.Device{Platform: "plugin"} }
+	tests := []struct {
+		name        string
+		requireKey  bool
+		device      *repository.Device
+		thumbprint  string
+		wantBindErr error
+		wantBound   string // key of the device after a login
+		wantErr     error  // of a refresh, which never changes the key
+	}{
+		{"keyless without proof", false, keyless(), "", nil, "", nil},
+		{"keyless with proof", false, keyless(), "key-b", nil, "key-b", nil},
+		{"keyless where keys are required", true, keyless(), "", ErrDeviceKeyRequired, "", ErrDeviceKeyLogin},
+		{"keyless with proof where keys are required", true, keyless(), "key-b", nil, "key-b", ErrDeviceKeyLogin},
+		{"keyed with its key", false, keyed(), "key-a", nil, "key-a", nil},
+		{"keyed without proof", false, keyed(), "", ErrDeviceKeyRequired, "key-a", ErrDeviceKeyRequired},
+		{"keyed with another key", false, keyed(), "key-b", ErrDeviceKeyMismatch, "key-a", ErrDeviceKeyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceCfg = &config.DeviceConfig{RequireKey: tt.requireKey}
+			refreshed := *tt.device
+			if err := CheckDeviceKey(&refreshed, tt.thumbprint); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckDeviceKey = %v, want %v", err, tt.wantErr)
+			}
+			if refreshed.Attestation.KeyThumbprint != tt.device.Attestation.KeyThumbprint {
+				t.Errorf("refresh changed the key to %q", refreshed.Attestation.KeyThumbprint)
+			}
+			if err := BindDeviceKey(tt.device, tt.thumbprint); !errors.Is(err, tt.wantBindErr) {
+				t.Errorf("BindDeviceKey = %v, want %v", err, tt.wantBindErr)
+			}
+			if got := tt.device.Attestation.KeyThumbprint; got != tt.wantBound {
+				t.Errorf("key after login = %q, want %q", got, tt.wantBound)
+			}
+		})
+	}
+}
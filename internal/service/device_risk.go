@@ -0,0 +1,116 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+const (
+	earthRadiusKm = 6371.0
+	// travelNoiseKm distances below it are geolocation noise rather than travel
+	travelNoiseKm = 100.0
+)
+
+var (
+	ErrStepUpRequired = errors.New("the refresh looks unusual, pass the second factor challenge to continue")
+	ErrDeviceRevoked  = errors.New("the refresh looks unusual and the device was signed out, log in again")
+	// ErrStepUpLogin a refresh that has to step up for a user without a second factor, who proves
+	// it is them by logging in again
+	ErrStepUpLogin = errors.New("the refresh looks unusual and the account has no second factor, log in again to continue")
+)
+
+// Observation a request of a device: where it came from and with what
+type Observation struct {
+	IP        string
+	UserAgent string
+	Location  *GeoLocation // nil when unknown
+	At        time.Time
+}
+
+// RiskAssessment the score of a refresh, why it got it and what to do about it
+type RiskAssessment struct {
+	Score   int
+	Reasons []string
+	Action  string
+}
+
+// AssessDeviceRisk scores a refresh by what changed since the device was last seen and records
+// the score on the device. A device never seen before scores 0, the refresh is its baseline.
+func AssessDeviceRisk(device *repository.Device, seen Observation) RiskAssessment {
+	var assessment RiskAssessment
+	attestation := &device.Attestation
+	if deviceCfg == nil || attestation.SeenAt == nil {
+		return assessment
+	}
+	risk := deviceCfg.Risk
+	add := func(weight int, reason string, args ...any) {
+		if weight > 0 {
+			assessment.Score += weight
+			assessment.Reasons = append(assessment.Reasons, fmt.Sprintf(reason, args...))
+		}
+	}
+	if location := seen.Location; location != nil {
+		if location.Country != "" && len(attestation.Countries) > 0 && !slices.Contains(attestation.Countries, location.Country) {
+			add(risk.NewCountry, "new country %s", location.Country)
+		}
+		if location.ASN != "" && len(attestation.ASNs) > 0 && !slices.Contains(attestation.ASNs, location.ASN) {
+			add(risk.NewASN, "new network %s", location.ASN)
+		}
+		if location.Latitude != nil && location.Longitude != nil &&
+			attestation.Latitude != nil && attestation.Longitude != nil {
+			distance := distanceKm(*attestation.Latitude, *attestation.Longitude, *location.Latitude, *location.Longitude)
+			elapsed := seen.At.Sub(*attestation.SeenAt)
+			if distance > travelNoiseKm && (elapsed <= 0 || distance/elapsed.Hours() > risk.MaxTravelSpeed) {
+				add(risk.ImpossibleTravel, "impossible travel of %.0f km in %s", distance, elapsed.Round(time.Second))
+			}
+		}
+	}
+	if seen.UserAgent != "" && attestation.UserAgent != "" && seen.UserAgent != attestation.UserAgent {
+		add(risk.NewUserAgent, "new user agent")
+	}
+
+	switch {
+	case risk.RevokeScore > 0 && assessment.Score >= risk.RevokeScore:
+		assessment.Action = constants.RiskActionRevoke
+	case risk.StepUpScore > 0 && assessment.Score >= risk.StepUpScore:
+		assessment.Action = constants.RiskActionStepUp
+	case risk.LogScore > 0 && assessment.Score >= risk.LogScore:
+		assessment.Action = constants.RiskActionLog
+	}
+	attestation.RiskScore = assessment.Score
+	attestation.RiskReasons = assessment.Reasons
+	return assessment
+}
+
+// ObserveDevice records where a device was seen from and the plugin version it runs
+func ObserveDevice(device *repository.Device, seen Observation) {
+	attestation := &device.Attestation
+	attestation.IP = seen.IP
+	attestation.UserAgent = seen.UserAgent
+	attestation.SeenAt = &seen.At
+	if location := seen.Location; location != nil {
+		attestation.Country = location.Country
+		attestation.ASN = location.ASN
+		if location.Latitude != nil && location.Longitude != nil {
+			attestation.Latitude, attestation.Longitude = location.Latitude, location.Longitude
+		}
+		attestation.RememberOrigin(location.Country, location.ASN)
+	}
+	attestation.RememberPluginVersion(device.PluginVersion, seen.At)
+}
+
+// distanceKm the great-circle distance between two coordinates
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
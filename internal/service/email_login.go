@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// emailCodeLength the number of digits of email login codes
+const emailCodeLength = 6
+
+var (
+	ErrEmailLoginDisabled    = errors.New("email login is not enabled")
+	ErrInvalidEmail          = errors.New("invalid email address")
+	ErrEmailResendTooSoon    = errors.New("an email was sent recently, please wait before requesting another")
+	ErrEmailCodeInvalid      = errors.New("invalid or expired verification code")
+	ErrEmailCodeTooManyTries = errors.New("too many failed attempts, please request a new email")
+	ErrEmailLinkInvalid      = errors.New("invalid or expired sign-in link")
+)
+
+// NormalizeEmail validates an address and returns it lower-cased without a display name
+func NormalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// EmailVerificationIssue describes a verification email that was sent
+type EmailVerificationIssue struct {
+	Email     string
+	ExpiresAt time.Time
+}
+
+// IssueEmailVerification sends an email with a one-time code rendered from the templates of the purpose.
+// With a linkURL the email also holds a magic link, and the login context is stored so the link can
+// complete the login in any browser.
+func IssueEmailVerification(ctx context.Context, email, purpose, linkURL string, login repository.EmailLoginContext) (*EmailVerificationIssue, error) {
+	mailMu.RLock()
+	sender, cfg, templates := mailSender, mailCfg, mailTmpl[purpose]
+	mailMu.RUnlock()
+	if sender == nil {
+		return nil, ErrEmailLoginDisabled
+	}
+	if templates == nil {
+		return nil, fmt.Errorf("no mail templates for %s", purpose)
+	}
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	db := repository.GetDB()
+	latest, err := db.GetLatestEmailVerification(ctx, normalized, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && time.Since(latest.CreatedAt) < cfg.ResendInterval {
+		return nil, ErrEmailResendTooSoon
+	}
+
+	code, err := utils.GenerateNumericCode(emailCodeLength)
+	if err != nil {
+		return nil, err
+	}
+	// a token is stored even without a link, the column is unique
+	token, err := utils.GenerateRandomString(43)
+	if err != nil {
+		return nil, err
+	}
+	var link string
+	if linkURL != "" {
+		parsed, err := url.Parse(linkURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid login link: %w", err)
+		}
+		query := parsed.Query()
+		query.Set("token", token)
+		parsed.RawQuery = query.Encode()
+		link = parsed.String()
+	}
+
+	now := time.Now()
+	record := &repository.EmailVerification{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		Email:     normalized,
+		Purpose:   purpose,
+		CodeHash:  utils.HashSecret(code),
+		TokenHash: utils.HashSecret(token),
+		ExpiresAt: now.Add(cfg.CodeTTL),
+		Login:     login,
+	}
+	if err := db.CreateEmailVerification(ctx, record); err != nil {
+		return nil, err
+	}
+
+	msg, err := templates.render(normalized, map[string]any{
+		"Email":            normalized,
+		"Code":             code,
+		"Link":             link,
+		"ExpiresInMinutes": int(cfg.CodeTTL.Minutes()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render %s email: %w", purpose, err)
+	}
+	if err := sender.Send(ctx, msg); err != nil {
+		return nil, fmt.Errorf("failed to send %s email: %w", purpose, err)
+	}
+	return &EmailVerificationIssue{Email: normalized, ExpiresAt: record.ExpiresAt}, nil
+}
+
+// VerifyEmailCode checks a code against the latest email of the address and purpose and consumes it
+func VerifyEmailCode(ctx context.Context, email, purpose, code string) (*repository.EmailVerification, error) {
+	mailMu.RLock()
+	cfg := mailCfg
+	mailMu.RUnlock()
+	if cfg == nil {
+		return nil, ErrEmailLoginDisabled
+	}
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	db := repository.GetDB()
+	record, err := db.GetLatestEmailVerification(ctx, normalized, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.IsUsed || time.Now().After(record.ExpiresAt) {
+		return nil, ErrEmailCodeInvalid
+	}
+	// the attempt is counted before the code is compared, so only maxAttempts guesses are ever compared
+	claimed, err := db.ClaimEmailVerificationAttempt(ctx, record, cfg.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		// used up by concurrent attempts, or consumed by one of them
+		if record.Attempts+1 >= cfg.MaxAttempts {
+			return nil, ErrEmailCodeTooManyTries
+		}
+		return nil, ErrEmailCodeInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashSecret(code)), []byte(record.CodeHash)) != 1 {
+		return nil, ErrEmailCodeInvalid
+	}
+	return consumeEmailVerification(ctx, record, ErrEmailCodeInvalid)
+}
+
+// VerifyEmailLink checks a magic link token of the purpose and consumes its email
+func VerifyEmailLink(ctx context.Context, purpose, token string) (*repository.EmailVerification, error) {
+	if token == "" {
+		return nil, ErrEmailLinkInvalid
+	}
+	record, err := repository.GetDB().GetEmailVerificationByToken(ctx, utils.HashSecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.Purpose != purpose || record.IsUsed || time.Now().After(record.ExpiresAt) {
+		return nil, ErrEmailLinkInvalid
+	}
+	return consumeEmailVerification(ctx, record, ErrEmailLinkInvalid)
+}
+
+func consumeEmailVerification(ctx context.Context, record *repository.EmailVerification, invalid error) (*repository.EmailVerification, error) {
+	consumed, err := repository.GetDB().ConsumeEmailVerification(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		return nil, invalid
+	}
+	return record, nil
+}
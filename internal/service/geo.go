@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+const (
+	geoLookupTimeout = 3 * time.Second
+	maxGeoCacheSize  = 10000
+)
+
+// GeoLocation where a client IP is, as far as it is known
+type GeoLocation struct {
+	Country   string   `json:"country,omitempty"` // ISO 3166 code
+	ASN       string   `json:"asn,omitempty"`     // like AS13335
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+type geoCacheEntry struct {
+	location *GeoLocation
+	expires  time.Time
+}
+
+var (
+	geoCacheMu sync.Mutex
+	geoCache   = map[string]geoCacheEntry{}
+)
+
+// LocateIP locates a client IP from the headers of its request or the lookup service, as
+// configured. It returns nil when the location is unknown; lookup failures are only logged since
+// a refresh does not fail for them.
+func LocateIP(ctx context.Context, ip string, header http.Header) *GeoLocation {
+	if deviceCfg == nil {
+		return nil
+	}
+	cfg := deviceCfg.Geo
+	switch cfg.Source {
+	case "headers":
+		location := &GeoLocation{
+			Country:   strings.ToUpper(strings.TrimSpace(header.Get(cfg.CountryHeader))),
+			ASN:       normalizeASN(header.Get(cfg.ASNHeader)),
+			Latitude:  parseCoordinate(header.Get(cfg.LatitudeHeader)),
+			Longitude: parseCoordinate(header.Get(cfg.LongitudeHeader)),
+		}
+		// Cloudflare reports XX when it does not know the country
+		if location.Country == "XX" {
+			location.Country = ""
+		}
+		if location.Country == "" && location.ASN == "" && location.Latitude == nil {
+			return nil
+		}
+		return location
+	case "http":
+		return lookupIP(ctx, ip)
+	default:
+		return nil
+	}
+}
+
+// lookupIP asks the lookup service for the location of a public IP, caching the answer
+func lookupIP(ctx context.Context, ip string) *GeoLocation {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return nil
+	}
+	now := time.Now()
+	geoCacheMu.Lock()
+	entry, ok := geoCache[ip]
+	geoCacheMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.location
+	}
+
+	location, err := fetchLocation(ctx, ip)
+	if err != nil {
+		log.Warn(nil, "failed to locate %s: %v", ip, err)
+		return nil
+	}
+	geoCacheMu.Lock()
+	if len(geoCache) >= maxGeoCacheSize {
+		clear(geoCache)
+	}
+	geoCache[ip] = geoCacheEntry{location: location, expires: now.Add(deviceCfg.Geo.CacheTTL)}
+	geoCacheMu.Unlock()
+	return location
+}
+
+func fetchLocation(ctx context.Context, ip string) (*GeoLocation, error) {
+	cfg := deviceCfg.Geo
+	ctx, cancel := context.WithTimeout(ctx, geoLookupTimeout)
+	defer cancel()
+	endpoint := strings.ReplaceAll(cfg.URL, "{ip}", url.PathEscape(ip))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create geo lookup request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	client := geoClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("geo lookup failed with status %s: %s", resp.Status, body)
+	}
+	var fields map[string]any
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("failed to decode geo lookup response: %w", err)
+	}
+	return &GeoLocation{
+		Country:   strings.ToUpper(fieldString(fields[cfg.CountryField])),
+		ASN:       normalizeASN(fieldString(fields[cfg.ASNField])),
+		Latitude:  parseCoordinate(fieldString(fields[cfg.LatitudeField])),
+		Longitude: parseCoordinate(fieldString(fields[cfg.LongitudeField])),
+	}, nil
+}
+
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// normalizeASN keeps the number of an ASN given as "AS13335 Cloudflare, Inc." or "13335"
+func normalizeASN(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	asn := strings.ToUpper(fields[0])
+	if !strings.HasPrefix(asn, "AS") {
+		asn = "AS" + asn
+	}
+	if _, err := strconv.ParseUint(asn[2:], 10, 32); err != nil {
+		return ""
+	}
+	return asn
+}
+
+func parseCoordinate(value string) *float64 {
+	coordinate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil
+	}
+	return &coordinate
+}
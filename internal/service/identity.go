@@ -0,0 +1,378 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/providers"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrLastLoginMethod  = errors.New("the last way to sign in to the account cannot be removed")
+	ErrInvalidSplit     = errors.New("the devices and invitees to split off need to belong to the account, except the signed in device")
+	ErrUpstreamSession  = errors.New("sign in through the upstream provider again to unbind this identity")
+	ErrUpstreamUnbind   = errors.New("failed to unbind the identity upstream")
+	ErrUnbindBusy       = errors.New("the identity is being unbound already")
+)
+
+// ListIdentities lists the identities linked to a user
+func ListIdentities(ctx context.Context, userID uuid.UUID) ([]repository.UserIdentity, error) {
+	return repository.GetDB().ListUserIdentities(ctx, userID)
+}
+
+// LinkPhoneIdentity links a phone number to a user with the link code sent to it
+func LinkPhoneIdentity(ctx context.Context, userID uuid.UUID, phoneNumber, code string) (*repository.UserIdentity, error) {
+	normalized, err := VerifySMSCode(ctx, phoneNumber, constants.IdentityPurposeLink, code)
+	if err != nil {
+		return nil, err
+	}
+	return repository.GetDB().LinkUserIdentity(ctx, userID, repository.UserIdentity{
+		Provider: constants.IdentityPhone,
+		Subject:  normalized,
+		Verified: true,
+	})
+}
+
+// LinkEmailIdentity links an email to a user with the code of the link email sent to it
+func LinkEmailIdentity(ctx context.Context, userID uuid.UUID, email, code string) (*repository.UserIdentity, error) {
+	verification, err := VerifyEmailCode(ctx, email, constants.IdentityPurposeLink, code)
+	if err != nil {
+		return nil, err
+	}
+	return repository.GetDB().LinkUserIdentity(ctx, userID, repository.UserIdentity{
+		Provider: constants.IdentityEmail,
+		Subject:  verification.Email,
+		Verified: true,
+	})
+}
+
+// UnbindOptions what an unbind takes along when it splits the identity off into a new account
+type UnbindOptions struct {
+	Split      bool     // move the identity to a new account rather than removing it
+	DeviceIDs  []string // devices of the account that move to the new account
+	InviteeIDs []string // invited users whose inviter becomes the new account
+}
+
+// UnbindIdentity removes an identity of a user, unless the user could not sign in without it, and
+// from the upstream account of the user. With Split the identity moves to a new account, which is
+// returned, along with the devices and invitees listed. The device signed in at currentDevice stays.
+// The unbind runs as a saga: the upstream account is changed first, outside any lock, and then the
+// identity locally. A failed upstream call leaves the identity linked; an unbind that failed locally
+// is resumed by unbinding the identity again, without calling upstream again.
+func UnbindIdentity(ctx context.Context, user *repository.AuthUser, currentDevice int, id string,
+	opts UnbindOptions, httpClient *http.Client) (*repository.AuthUser, error) {
+	identityID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrIdentityNotFound
+	}
+	identity, err := unbindableIdentity(ctx, user, identityID)
+	if err != nil {
+		return nil, err
+	}
+	var deviceIDs, inviteeIDs []uuid.UUID
+	if opts.Split {
+		if deviceIDs, err = splitDeviceIDs(user, currentDevice, opts.DeviceIDs); err != nil {
+			return nil, err
+		}
+		if inviteeIDs, err = parseUUIDs(opts.InviteeIDs); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	unbind, err := startIdentityUnbind(ctx, &repository.IdentityUnbind{
+		ID:          uuid.New(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		IdentityID:  identity.ID,
+		UserID:      user.ID,
+		Split:       opts.Split,
+		SplitUserID: uuid.New(),
+		DeviceIDs:   deviceIDs,
+		InviteeIDs:  inviteeIDs,
+		Step:        constants.UnbindStepUpstream,
+		Status:      constants.MergeStatusPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if unbind.Step == constants.UnbindStepUpstream {
+		idempotencyKey := unbind.ID.String() + ":" + unbind.Step
+		if err := runUnbindStepWithRetries(ctx, unbind, func() error {
+			return unbindUpstream(user, currentDevice, identity, idempotencyKey, httpClient)
+		}); err != nil {
+			return nil, failIdentityUnbind(ctx, unbind, err)
+		}
+		unbind.Step = constants.UnbindStepLocal
+		unbind.Attempts, unbind.LastError = 0, ""
+		if err := saveUnbindProgress(ctx, unbind); err != nil {
+			return nil, err
+		}
+	}
+
+	// the local step deletes the unbind along with the identity
+	db := repository.GetDB()
+	var unbound *repository.UserIdentity
+	var splitUser *repository.AuthUser
+	if err := runUnbindStepWithRetries(ctx, unbind, func() (err error) {
+		if !unbind.Split {
+			unbound, err = db.UnlinkUserIdentity(ctx, unbind)
+			return err
+		}
+		if splitUser, err = newSplitUser(user, identity, unbind.SplitUserID); err != nil {
+			return err
+		}
+		unbound, err = db.SplitUserIdentity(ctx, unbind, splitUser)
+		return err
+	}); err != nil {
+		return nil, failIdentityUnbind(ctx, unbind, err)
+	}
+	if unbound == nil {
+		return nil, ErrIdentityNotFound
+	}
+	if !unbind.Split {
+		return nil, nil
+	}
+	log.Info(nil, "%s identity of user %s split off into user %s with %d devices",
+		identity.Provider, user.ID, splitUser.ID, len(splitUser.Devices))
+	webhook.UserCreated(ctx, splitUser)
+	return splitUser, nil
+}
+
+// startIdentityUnbind stores an unbind, or takes up the stored unbind of the same identity with the
+// split options of the new one, and claims it
+func startIdentityUnbind(ctx context.Context, unbind *repository.IdentityUnbind) (*repository.IdentityUnbind, error) {
+	db := repository.GetDB()
+	stored, err := db.CreateIdentityUnbind(ctx, unbind)
+	if err != nil {
+		return nil, err
+	}
+	stored.Split, stored.DeviceIDs, stored.InviteeIDs = unbind.Split, unbind.DeviceIDs, unbind.InviteeIDs
+	claimed, err := db.ClaimIdentityUnbind(ctx, stored, time.Now().Add(-mergeLease))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrUnbindBusy
+	}
+	stored, err = db.GetIdentityUnbind(ctx, stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		// finished by another request in the meantime
+		return nil, ErrIdentityNotFound
+	}
+	return stored, nil
+}
+
+// runUnbindStepWithRetries runs the current step of an unbind, retrying it after a growing delay
+// like a merge step. A missing upstream session is not retried, the user needs to sign in again.
+func runUnbindStepWithRetries(ctx context.Context, unbind *repository.IdentityUnbind, step func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil {
+			return nil
+		}
+		unbind.Attempts++
+		if attempt == mergeStepAttempts || errors.Is(err, ErrUpstreamSession) {
+			return err
+		}
+		unbind.LastError = err.Error()
+		// also keeps the lease of the running unbind
+		if saveErr := saveUnbindProgress(ctx, unbind); saveErr != nil {
+			return saveErr
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * mergeRetryDelay):
+		}
+	}
+}
+
+// failIdentityUnbind leaves an unbind failed at its step, to be resumed by unbinding the identity again
+func failIdentityUnbind(ctx context.Context, unbind *repository.IdentityUnbind, err error) error {
+	unbind.Status = constants.MergeStatusFailed
+	unbind.LastError = err.Error()
+	if saveErr := saveUnbindProgress(ctx, unbind); saveErr != nil {
+		log.Error(nil, "identity unbind %s: %v", unbind.ID, saveErr)
+	}
+	log.Warn(nil, "identity unbind %s stopped at %s after %d attempts: %v", unbind.ID, unbind.Step, unbind.Attempts, err)
+	return err
+}
+
+// saveUnbindProgress saves an unbind even when the request that ran it timed out, so it can be resumed
+func saveUnbindProgress(ctx context.Context, unbind *repository.IdentityUnbind) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mergeSaveTimeout)
+	defer cancel()
+	return repository.GetDB().SaveIdentityUnbindProgress(ctx, unbind)
+}
+
+// unbindableIdentity gets an identity of a user, refusing the last one when the user has no
+// other way to sign in
+func unbindableIdentity(ctx context.Context, user *repository.AuthUser, identityID uuid.UUID) (*repository.UserIdentity, error) {
+	identities, err := repository.GetDB().ListUserIdentities(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	var found *repository.UserIdentity
+	others := 0
+	for i := range identities {
+		if identities[i].ID == identityID {
+			found = &identities[i]
+		} else {
+			others++
+		}
+	}
+	if found == nil {
+		return nil, ErrIdentityNotFound
+	}
+	if others == 0 {
+		canSignIn, err := hasCredentialLogin(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		if !canSignIn {
+			return nil, ErrLastLoginMethod
+		}
+	}
+	return found, nil
+}
+
+// splitDeviceIDs checks the devices to split off belong to the user and are not the signed in one
+func splitDeviceIDs(user *repository.AuthUser, currentDevice int, ids []string) ([]uuid.UUID, error) {
+	deviceIDs, err := parseUUIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range deviceIDs {
+		index := slices.IndexFunc(user.Devices, func(device repository.Device) bool { return device.ID == id })
+		if index == -1 || index == currentDevice {
+			return nil, ErrInvalidSplit
+		}
+	}
+	return deviceIDs, nil
+}
+
+func parseUUIDs(ids []string) ([]uuid.UUID, error) {
+	parsed := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		value, err := uuid.Parse(id)
+		if err != nil {
+			return nil, ErrInvalidSplit
+		}
+		parsed = append(parsed, value)
+	}
+	return parsed, nil
+}
+
+// UpstreamToken returns an upstream access token of the user: the one of the signed in device when
+// it was issued upstream, or else the most recently used one. It is empty when the user has none.
+func UpstreamToken(user *repository.AuthUser, currentDevice int) string {
+	if currentDevice >= 0 && currentDevice < len(user.Devices) {
+		if device := user.Devices[currentDevice]; device.TokenProvider == "custom" && device.AccessToken != "" {
+			return device.AccessToken
+		}
+	}
+	var token string
+	var updatedAt time.Time
+	for _, device := range user.Devices {
+		if device.TokenProvider == "custom" && device.AccessToken != "" && device.UpdatedAt.After(updatedAt) {
+			token, updatedAt = device.AccessToken, device.UpdatedAt
+		}
+	}
+	return token
+}
+
+// unbindUpstream removes a GitHub or phone identity from the upstream account, so the next upstream
+// login does not link it again. Emails are only linked here. A phone number of a user without an
+// upstream session was linked here as well; a GitHub account always comes from upstream.
+func unbindUpstream(user *repository.AuthUser, currentDevice int, identity *repository.UserIdentity,
+	idempotencyKey string, httpClient *http.Client) error {
+	if identity.Provider == constants.IdentityEmail {
+		return nil
+	}
+	token := UpstreamToken(user, currentDevice)
+	if token == "" {
+		if identity.Provider == constants.IdentityGitHub {
+			return ErrUpstreamSession
+		}
+		return nil
+	}
+	provider, err := providers.GetManager().GetProvider("casdoor")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstreamUnbind, err)
+	}
+	resp, err := UnbindByCasdoor(provider, token, AuthMethod{AuthType: identity.Provider, AuthValue: identity.Subject},
+		idempotencyKey, httpClient)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstreamUnbind, err)
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("%w: upstream unbind returned status %q", ErrUpstreamUnbind, resp.Status)
+	}
+	return nil
+}
+
+// newSplitUser returns the new account with the given ID an identity splits off into, named after
+// the identity and invited by the inviter of the user
+func newSplitUser(user *repository.AuthUser, identity *repository.UserIdentity, id uuid.UUID) (*repository.AuthUser, error) {
+	userCode, err := utils.GenerateRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	splitUser := &repository.AuthUser{
+		ID:         id,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		AccessTime: now,
+		Name:       identity.Subject,
+		UserCode:   userCode,
+		InviterID:  user.InviterID,
+	}
+	switch identity.Provider {
+	case constants.IdentityGitHub:
+		splitUser.GithubID = identity.Subject
+		if user.GithubID == identity.Subject && user.GithubName != "" {
+			splitUser.GithubName = user.GithubName
+			splitUser.Name = user.GithubName
+		}
+	case constants.IdentityPhone:
+		splitUser.Phone = identity.Subject
+		splitUser.PhoneVerified = identity.Verified
+	case constants.IdentityEmail:
+		splitUser.Email = identity.Subject
+		splitUser.EmailVerified = identity.Verified
+	}
+	return splitUser, nil
+}
+
+// hasCredentialLogin reports whether the user can sign in without any identity: with a username
+// and password, or with a passkey
+func hasCredentialLogin(ctx context.Context, user *repository.AuthUser) (bool, error) {
+	if passwordEnabled() && user.Username != nil && user.Password != "" {
+		return true, nil
+	}
+	if !webauthnEnabled() {
+		return false, nil
+	}
+	passkeys, err := repository.GetDB().CountWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+	return passkeys > 0, nil
+}
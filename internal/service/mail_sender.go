@@ -0,0 +1,371 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+// MailMessage an email with a plain text and an HTML body
+type MailMessage struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// MailSender delivers emails
+type MailSender interface {
+	Name() string
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+var mailSenderFactories = map[string]func(cfg *config.EmailConfig) (MailSender, error){
+	"smtp": newSMTPMailSender,
+	"file": newFileMailSender,
+	"mock": func(*config.EmailConfig) (MailSender, error) { return NewMockMailSender(), nil },
+}
+
+var (
+	mailMu     sync.RWMutex
+	mailSender MailSender
+	mailCfg    *config.EmailConfig
+	mailTmpl   map[string]*mailTemplates
+)
+
+// InitMailSender creates the configured mail sender and loads the templates.
+// Without a provider email login stays disabled.
+func InitMailSender(cfg *config.EmailConfig) error {
+	if cfg.Provider == "" {
+		log.Info(nil, "email login disabled: no mail provider configured")
+		return nil
+	}
+	factory, ok := mailSenderFactories[cfg.Provider]
+	if !ok {
+		return fmt.Errorf("unsupported mail provider: %s", cfg.Provider)
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return fmt.Errorf("invalid email sender address %q: %w", cfg.From, err)
+	}
+	sender, err := factory(cfg)
+	if err != nil {
+		return err
+	}
+	templates, err := loadMailTemplates(cfg.TemplateDir)
+	if err != nil {
+		return err
+	}
+
+	mailMu.Lock()
+	defer mailMu.Unlock()
+	mailSender, mailCfg, mailTmpl = sender, cfg, templates
+	log.Info(nil, "Mail sender initialized: %s", sender.Name())
+	return nil
+}
+
+// GetMailSender returns the configured mail sender, nil when email login is disabled
+func GetMailSender() MailSender {
+	mailMu.RLock()
+	defer mailMu.RUnlock()
+	return mailSender
+}
+
+//go:embed templates/email
+var builtinMailTemplates embed.FS
+
+// mailTemplateNames the purposes with built-in templates: <name>_subject.txt, <name>.txt and <name>.html
+var mailTemplateNames = []string{"login", "password_reset", "identity_link"}
+
+type mailTemplates struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// loadMailTemplates parses the templates of every purpose from dir, falling back to the built-in ones per file
+func loadMailTemplates(dir string) (map[string]*mailTemplates, error) {
+	read := func(name string) (string, error) {
+		if dir != "" {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				return string(data), nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("failed to read mail template %s: %w", name, err)
+			}
+		}
+		data, err := builtinMailTemplates.ReadFile("templates/email/" + name)
+		return string(data), err
+	}
+
+	all := make(map[string]*mailTemplates, len(mailTemplateNames))
+	for _, name := range mailTemplateNames {
+		var t mailTemplates
+		src, err := read(name + "_subject.txt")
+		if err != nil {
+			return nil, err
+		}
+		if t.subject, err = texttemplate.New("subject").Parse(strings.TrimSpace(src)); err != nil {
+			return nil, fmt.Errorf("invalid mail subject template of %s: %w", name, err)
+		}
+		if src, err = read(name + ".txt"); err != nil {
+			return nil, err
+		}
+		if t.text, err = texttemplate.New("text").Parse(src); err != nil {
+			return nil, fmt.Errorf("invalid mail text template of %s: %w", name, err)
+		}
+		if src, err = read(name + ".html"); err != nil {
+			return nil, err
+		}
+		if t.html, err = htmltemplate.New("html").Parse(src); err != nil {
+			return nil, fmt.Errorf("invalid mail html template of %s: %w", name, err)
+		}
+		all[name] = &t
+	}
+	return all, nil
+}
+
+// render fills the templates into a message to the address
+func (t *mailTemplates) render(to string, data any) (MailMessage, error) {
+	msg := MailMessage{To: to}
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Subject = buf.String()
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Text = buf.String()
+	buf.Reset()
+	if err := t.html.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.HTML = buf.String()
+	return msg, nil
+}
+
+// buildMIMEMessage encodes a message as multipart/alternative MIME
+func buildMIMEMessage(cfg *config.EmailConfig, msg MailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	from := mail.Address{Name: cfg.FromName, Address: cfg.From}
+
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + randomHex(16) + "@" + domainOf(cfg.From) + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + writer.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// smtpMailSender sends emails through an SMTP server
+type smtpMailSender struct {
+	cfg *config.EmailConfig
+}
+
+func newSMTPMailSender(cfg *config.EmailConfig) (MailSender, error) {
+	if cfg.SMTP.Host == "" || cfg.SMTP.Port == 0 {
+		return nil, fmt.Errorf("smtp mail sender requires host and port")
+	}
+	return &smtpMailSender{cfg: cfg}, nil
+}
+
+func (s *smtpMailSender) Name() string {
+	return "smtp"
+}
+
+func (s *smtpMailSender) Send(ctx context.Context, msg MailMessage) error {
+	data, err := buildMIMEMessage(s.cfg, msg)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+	c := s.cfg.SMTP
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	tlsConfig := &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+	var conn net.Conn
+	if c.Security == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to smtp server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start smtp session: %w", err)
+	}
+	defer client.Close()
+
+	if c.Security == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smtp starttls failed: %w", err)
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return fmt.Errorf("smtp authentication failed: %w", err)
+		}
+	}
+	if err := client.Mail(s.cfg.From); err != nil {
+		return fmt.Errorf("smtp MAIL FROM failed: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("smtp RCPT TO failed: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA failed: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp server rejected the email: %w", err)
+	}
+	return client.Quit()
+}
+
+// fileMailSender writes emails as .eml files, for development
+type fileMailSender struct {
+	cfg *config.EmailConfig
+}
+
+func newFileMailSender(cfg *config.EmailConfig) (MailSender, error) {
+	if err := os.MkdirAll(cfg.FileDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &fileMailSender{cfg: cfg}, nil
+}
+
+func (s *fileMailSender) Name() string {
+	return "file"
+}
+
+func (s *fileMailSender) Send(_ context.Context, msg MailMessage) error {
+	data, err := buildMIMEMessage(s.cfg, msg)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), randomHex(4))
+	return os.WriteFile(filepath.Join(s.cfg.FileDir, name), data, 0o640)
+}
+
+// MockMailSender records emails instead of sending them, so tests can read codes and links
+type MockMailSender struct {
+	mu       sync.Mutex
+	messages []MailMessage
+}
+
+func NewMockMailSender() *MockMailSender {
+	return &MockMailSender{}
+}
+
+func (s *MockMailSender) Name() string {
+	return "mock"
+}
+
+func (s *MockMailSender) Send(_ context.Context, msg MailMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) >= maxMockSMSMessages {
+		s.messages = s.messages[1:]
+	}
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages returns the recorded emails, oldest first; an empty address returns all of them
+func (s *MockMailSender) Messages(to string) []MailMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]MailMessage, 0, len(s.messages))
+	for _, msg := range s.messages {
+		if to == "" || strings.EqualFold(msg.To, to) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// Reset forgets the recorded emails
+func (s *MockMailSender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
@@ -30,7 +30,10 @@ type MergeResponse struct {
 	MergedAuthMethods []AuthMethod `json:"merged_auth_methods"`
 }
 
-func MergeByCasdoor(provider providers.OAuthProvider, reservedUserToken, deletedUserToken string, httpClient *http.Client) (*MergeResponse, error) {
+// MergeByCasdoor merges the upstream user of deletedUserToken into the one of reservedUserToken.
+// The idempotency key, when not empty, lets the upstream recognize a retried merge.
+func MergeByCasdoor(provider providers.OAuthProvider, reservedUserToken, deletedUserToken, idempotencyKey string,
+	httpClient *http.Client) (*MergeResponse, error) {
 	url := provider.GetEndpoint(true) + constants.CasdoorMergeURI
 	payload := MergeRequestPayload{
 		ReservedUserToken: reservedUserToken,
@@ -51,6 +54,9 @@ func MergeByCasdoor(provider providers.OAuthProvider, reservedUserToken, deleted
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+reservedUserToken)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -70,3 +76,51 @@ func MergeByCasdoor(provider providers.OAuthProvider, reservedUserToken, deleted
 
 	return &mergeResponse, nil
 }
+
+type UnbindResponse struct {
+	Status      string `json:"status"`
+	UniversalID string `json:"universal_id"`
+}
+
+// UnbindByCasdoor removes an auth method from the upstream user of userToken. The idempotency key,
+// when not empty, lets the upstream recognize a retried unbind.
+func UnbindByCasdoor(provider providers.OAuthProvider, userToken string, method AuthMethod, idempotencyKey string,
+	httpClient *http.Client) (*UnbindResponse, error) {
+	url := provider.GetEndpoint(true) + constants.CasdoorUnbindURI
+	jsonPayload, err := json.Marshal(method)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API call failed with status %s: %s", resp.Status, string(bodyBytes))
+	}
+
+	var unbindResponse UnbindResponse
+	if err := json.NewDecoder(resp.Body).Decode(&unbindResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	return &unbindResponse, nil
+}
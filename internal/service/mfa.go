@@ -0,0 +1,455 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/totp"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+// totpSkew accepts the codes of one step before and after the current one for clock drift
+const totpSkew = 1
+
+var (
+	ErrTOTPNotEnabled           = errors.New("two-factor authentication is not enabled")
+	ErrTOTPAlreadyEnabled       = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolling         = errors.New("no two-factor enrollment in progress")
+	ErrMFACodeInvalid           = errors.New("invalid two-factor code")
+	ErrMFARequired              = errors.New("two-factor authentication is required by the organization")
+	ErrMFAChallengeInvalid      = errors.New("invalid or expired two-factor challenge")
+	ErrMFAChallengeTooManyTries = errors.New("too many failed attempts, please log in again")
+	ErrMFAUseExistingFactor     = errors.New("use your existing second factor to complete the login")
+)
+
+// MFALockedError is returned while the factor of a user is locked after too many wrong codes
+type MFALockedError struct {
+	Until time.Time
+}
+
+func (e *MFALockedError) Error() string {
+	return fmt.Sprintf("too many wrong two-factor codes, retry after %s", e.Until.Format(time.RFC3339))
+}
+
+var (
+	mfaCfg  *config.MFAConfig
+	mfaOnce sync.Once
+)
+
+// InitMFAService sets the two-factor authentication config
+func InitMFAService(cfg *config.MFAConfig) {
+	mfaOnce.Do(func() {
+		mfaCfg = cfg
+		if cfg.Required {
+			log.Info(nil, "two-factor authentication is required for every account")
+		}
+	})
+}
+
+func getMFACfg() *config.MFAConfig {
+	if mfaCfg == nil {
+		return &config.MFAConfig{}
+	}
+	return mfaCfg
+}
+
+// MFAStatus the second factor state of a user
+type MFAStatus struct {
+	Enabled           bool  `json:"enabled"`  // TOTP
+	Required          bool  `json:"required"` // by the organization
+	RecoveryCodesLeft int   `json:"recovery_codes_left"`
+	Passkeys          int64 `json:"passkeys"`
+}
+
+// GetMFAStatus returns the second factor state of a user
+func GetMFAStatus(ctx context.Context, userID uuid.UUID) (*MFAStatus, error) {
+	db := repository.GetDB()
+	t, err := db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	status := &MFAStatus{Required: getMFACfg().Required}
+	if t != nil && t.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesLeft = len(t.RecoveryCodes)
+	}
+	if status.Passkeys, err = db.CountWebAuthnCredentials(ctx, userID); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MFANeeded reports whether a login of the user has to pass a second factor: the organization
+// requires it, or the user enabled TOTP or registered a passkey
+func MFANeeded(ctx context.Context, userID uuid.UUID) (bool, error) {
+	if getMFACfg().Required {
+		return true, nil
+	}
+	status, err := GetMFAStatus(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled || status.Passkeys > 0, nil
+}
+
+// TOTPEnrollment the secret of a new TOTP factor, to be added to an authenticator app
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"` // otpauth:// URI, usually shown as a QR code
+}
+
+// StartTOTPEnrollment creates a new secret for the user; it replaces an enrollment in progress
+// but never an enabled factor
+func StartTOTPEnrollment(ctx context.Context, userID uuid.UUID, account string) (*TOTPEnrollment, error) {
+	db := repository.GetDB()
+	existing, err := db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SaveUserTOTP(ctx, &repository.UserTOTP{UserID: userID, Secret: encrypted}); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(getMFACfg().Issuer, account, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables the factor being enrolled with its first code and returns
+// the recovery codes, which are shown only this once
+func ConfirmTOTPEnrollment(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	db := repository.GetDB()
+	t, err := db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || t.Enabled {
+		return nil, ErrTOTPNotEnrolling
+	}
+	step, err := matchTOTP(t, code)
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	t.Enabled = true
+	t.ConfirmedAt = &now
+	t.LastUsedStep = step
+	t.RecoveryCodes = hashes
+	if err := db.SaveUserTOTP(ctx, t); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyMFA checks a TOTP code or, if code is empty, a recovery code of a user with an enabled factor
+func VerifyMFA(ctx context.Context, userID uuid.UUID, code, recoveryCode string) error {
+	db := repository.GetDB()
+	t, err := db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if t == nil || !t.Enabled {
+		return ErrTOTPNotEnabled
+	}
+	if t.LockedUntil != nil && time.Now().Before(*t.LockedUntil) {
+		return &MFALockedError{Until: *t.LockedUntil}
+	}
+	if err := verifyTOTPOrRecoveryCode(ctx, t, code, recoveryCode); err != nil {
+		if !errors.Is(err, ErrMFACodeInvalid) {
+			return err
+		}
+		cfg := getMFACfg()
+		lockedUntil, recordErr := db.RecordTOTPFailure(ctx, userID, cfg.MaxFailedCodes, cfg.LockoutDuration, cfg.MaxLockoutDuration)
+		if recordErr != nil {
+			return recordErr
+		}
+		if lockedUntil != nil {
+			log.Warn(nil, "two-factor of user %s locked until %s after too many wrong codes", userID, lockedUntil.Format(time.RFC3339))
+			return &MFALockedError{Until: *lockedUntil}
+		}
+		return err
+	}
+	if t.FailedCodes > 0 || t.LockedUntil != nil {
+		return db.ResetTOTPFailures(ctx, userID)
+	}
+	return nil
+}
+
+// verifyTOTPOrRecoveryCode checks a TOTP code, or a recovery code if code is empty, against an
+// enabled factor and uses it up
+func verifyTOTPOrRecoveryCode(ctx context.Context, t *repository.UserTOTP, code, recoveryCode string) error {
+	db := repository.GetDB()
+	if code == "" {
+		consumed, err := db.ConsumeRecoveryCode(ctx, t.UserID, utils.HashSecret(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return ErrMFACodeInvalid
+		}
+		log.Info(nil, "user %s used a recovery code", t.UserID)
+		return nil
+	}
+	step, err := matchTOTP(t, code)
+	if err != nil {
+		return err
+	}
+	fresh, err := db.UseTOTPStep(ctx, t.UserID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrMFACodeInvalid
+	}
+	return nil
+}
+
+// DisableTOTP removes the factor of a user after checking a code; not allowed when the organization requires 2FA
+func DisableTOTP(ctx context.Context, userID uuid.UUID, code, recoveryCode string) error {
+	if getMFACfg().Required {
+		return ErrMFARequired
+	}
+	if err := VerifyMFA(ctx, userID, code, recoveryCode); err != nil {
+		return err
+	}
+	return repository.GetDB().DeleteUserTOTP(ctx, userID)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user after checking a TOTP code
+func RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	if err := VerifyMFA(ctx, userID, code, ""); err != nil {
+		return nil, err
+	}
+	db := repository.GetDB()
+	t, err := db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrTOTPNotEnabled
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	t.RecoveryCodes = hashes
+	if err := db.SaveUserTOTP(ctx, t); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// NewMFAChallenge starts the second factor step of a login whose device is pending
+func NewMFAChallenge(ctx context.Context, challenge *repository.MFAChallenge) error {
+	cfg := getMFACfg()
+	challenge.ID = uuid.New()
+	challenge.CreatedAt = time.Now()
+	challenge.ExpiresAt = challenge.CreatedAt.Add(cfg.ChallengeTTL)
+	return repository.GetDB().CreateMFAChallenge(ctx, challenge)
+}
+
+// GetOpenMFAChallenge returns a challenge that can still be completed
+func GetOpenMFAChallenge(ctx context.Context, id string) (*repository.MFAChallenge, error) {
+	challengeID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrMFAChallengeInvalid
+	}
+	challenge, err := repository.GetDB().GetMFAChallenge(ctx, challengeID)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || challenge.IsUsed || time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrMFAChallengeInvalid
+	}
+	if challenge.Attempts >= getMFACfg().MaxAttempts {
+		return nil, ErrMFAChallengeTooManyTries
+	}
+	return challenge, nil
+}
+
+// StartChallengeEnrollment starts a TOTP enrollment during the login of a challenge. Only a user
+// the organization requires a second factor of and who has none yet may enroll one this way;
+// anyone else has to pass the factor they already have.
+func StartChallengeEnrollment(ctx context.Context, challenge *repository.MFAChallenge, account string) (*TOTPEnrollment, error) {
+	if err := checkChallengeEnrollment(ctx, challenge.UserID); err != nil {
+		return nil, err
+	}
+	return StartTOTPEnrollment(ctx, challenge.UserID, account)
+}
+
+// checkChallengeEnrollment returns ErrMFAUseExistingFactor unless the user may enroll during a login
+func checkChallengeEnrollment(ctx context.Context, userID uuid.UUID) error {
+	if !getMFACfg().Required {
+		return ErrMFAUseExistingFactor
+	}
+	status, err := GetMFAStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if status.Enabled || status.Passkeys > 0 {
+		return ErrMFAUseExistingFactor
+	}
+	return nil
+}
+
+// CompleteMFAChallenge passes a challenge with a TOTP or recovery code. A user who had to enroll
+// during the login confirms the enrollment with the code and gets the recovery codes back.
+func CompleteMFAChallenge(ctx context.Context, id, code, recoveryCode string) (*repository.MFAChallenge, []string, error) {
+	challenge, err := GetOpenMFAChallenge(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := repository.GetDB().GetUserTOTP(ctx, challenge.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	enrolling := t != nil && !t.Enabled && code != ""
+	if enrolling {
+		if err := checkChallengeEnrollment(ctx, challenge.UserID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var recoveryCodes []string
+	err = passMFAChallenge(ctx, challenge, func() error {
+		if enrolling {
+			recoveryCodes, err = ConfirmTOTPEnrollment(ctx, challenge.UserID, code)
+			return err
+		}
+		return VerifyMFA(ctx, challenge.UserID, code, recoveryCode)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return challenge, recoveryCodes, nil
+}
+
+// passMFAChallenge completes an open challenge when verify accepts the second factor.
+// Every attempt is counted before verify runs, so concurrent attempts cannot exceed the limit.
+func passMFAChallenge(ctx context.Context, challenge *repository.MFAChallenge, verify func() error) error {
+	db := repository.GetDB()
+	maxAttempts := getMFACfg().MaxAttempts
+	claimed, err := db.ClaimMFAChallengeAttempt(ctx, challenge.ID, maxAttempts)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// used up by concurrent attempts, or completed by one of them
+		if challenge.Attempts+1 >= maxAttempts {
+			return ErrMFAChallengeTooManyTries
+		}
+		return ErrMFAChallengeInvalid
+	}
+	if err := verify(); err != nil {
+		return err
+	}
+	consumed, err := db.ConsumeMFAChallenge(ctx, challenge.ID)
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return ErrMFAChallengeInvalid
+	}
+	return nil
+}
+
+// MFAChallengeURL returns the page asking for the code of a challenge
+func MFAChallengeURL(frontend, challengeID, platform string) string {
+	base := getMFACfg().ChallengeURL
+	if base == "" {
+		base = frontend
+	}
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "challenge=" + challengeID + "&platform=" + platform
+}
+
+// matchTOTP checks a code against the secret of a factor and returns its time step
+func matchTOTP(t *repository.UserTOTP, code string) (int64, error) {
+	secret, err := decryptTOTPSecret(t.Secret)
+	if err != nil {
+		return 0, err
+	}
+	ok, step, err := totp.Validate(secret, code, time.Now(), totpSkew)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || step <= t.LastUsedStep {
+		return 0, ErrMFACodeInvalid
+	}
+	return step, nil
+}
+
+func encryptTOTPSecret(secret string) (string, error) {
+	keys, err := utils.GetEncryptKeyManager()
+	if err != nil {
+		return "", err
+	}
+	return keys.AESEncrypt([]byte(secret))
+}
+
+func decryptTOTPSecret(encrypted string) (string, error) {
+	keys, err := utils.GetEncryptKeyManager()
+	if err != nil {
+		return "", err
+	}
+	secret, err := keys.AESDecrypt(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt totp secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns fresh recovery codes like "abcde-fghij" and their keyed hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	count := getMFACfg().RecoveryCodeCount
+	if count <= 0 {
+		count = 10
+	}
+	codes := make([]string, count)
+	hashes := make([]string, count)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = utils.HashSecret(raw)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
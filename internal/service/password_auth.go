@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/password"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+var (
+	ErrPasswordLoginDisabled = errors.New("password login is not enabled")
+	ErrRegistrationDisabled  = errors.New("registration is not enabled")
+	ErrInvalidCredentials    = errors.New("invalid username or password")
+	ErrInvalidUsername       = errors.New("username must be 3-32 characters of letters, digits, '.', '_' or '-' and start with a letter")
+	ErrUsernameTaken         = errors.New("username is already taken")
+)
+
+// AccountLockedError is returned while an account is locked after too many wrong passwords
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("account is locked after too many failed logins, retry after %s", e.Until.Format(time.RFC3339))
+}
+
+// usernamePattern starts with a letter so usernames never look like a phone number or an email
+var usernamePattern = regexp.MustCompile(`^[a-z][a-z0-9._-]{2,31}$`)
+
+var (
+	passwordCfg  *config.PasswordConfig
+	passwordOnce sync.Once
+	// dummyPasswordHash is verified for unknown accounts so they take as long as known ones
+	dummyPasswordHash string
+)
+
+// InitPasswordService sets the password account config
+func InitPasswordService(cfg *config.PasswordConfig) {
+	passwordOnce.Do(func() {
+		passwordCfg = cfg
+		if !cfg.Enabled {
+			log.Info(nil, "password login disabled")
+			return
+		}
+		hash, err := password.Hash("", argon2Params(cfg))
+		if err != nil {
+			log.Error(nil, "failed to prepare password hashing: %v", err)
+		}
+		dummyPasswordHash = hash
+		log.Info(nil, "Password service initialized successfully")
+	})
+}
+
+func passwordEnabled() bool {
+	return passwordCfg != nil && passwordCfg.Enabled
+}
+
+func argon2Params(cfg *config.PasswordConfig) password.Params {
+	return password.Params{
+		Memory:      cfg.Argon2.Memory,
+		Iterations:  cfg.Argon2.Iterations,
+		Parallelism: cfg.Argon2.Parallelism,
+	}
+}
+
+// PasswordPolicy returns the configured policy for new passwords
+func PasswordPolicy() password.Policy {
+	if passwordCfg == nil {
+		return password.Policy{}
+	}
+	return password.Policy{
+		MinLength:     passwordCfg.MinLength,
+		MaxLength:     passwordCfg.MaxLength,
+		RequireUpper:  passwordCfg.RequireUpper,
+		RequireLower:  passwordCfg.RequireLower,
+		RequireDigit:  passwordCfg.RequireDigit,
+		RequireSymbol: passwordCfg.RequireSymbol,
+	}
+}
+
+// NormalizeUsername validates a username and returns it lower-cased
+func NormalizeUsername(username string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(username))
+	if !usernamePattern.MatchString(normalized) {
+		return "", ErrInvalidUsername
+	}
+	return normalized, nil
+}
+
+// CheckRegistration checks that a username is free for a new password account
+func CheckRegistration(ctx context.Context, username string) (string, error) {
+	if !passwordEnabled() {
+		return "", ErrPasswordLoginDisabled
+	}
+	if !passwordCfg.AllowRegistration {
+		return "", ErrRegistrationDisabled
+	}
+	normalized, err := NormalizeUsername(username)
+	if err != nil {
+		return "", err
+	}
+	existing, err := repository.GetDB().GetUserByUsername(ctx, normalized)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", ErrUsernameTaken
+	}
+	return normalized, nil
+}
+
+// NewPasswordHash checks a new password of the user against the policy and hashes it
+func NewPasswordHash(user *repository.AuthUser, newPassword string) (string, error) {
+	if !passwordEnabled() {
+		return "", ErrPasswordLoginDisabled
+	}
+	identifiers := []string{user.Name, user.Email, user.Phone}
+	if user.Username != nil {
+		identifiers = append(identifiers, *user.Username)
+	}
+	if err := PasswordPolicy().Validate(newPassword, identifiers...); err != nil {
+		return "", err
+	}
+	return password.Hash(newPassword, argon2Params(passwordCfg))
+}
+
+// SetUserPassword replaces the password of a saved user and lifts any lockout
+func SetUserPassword(ctx context.Context, user *repository.AuthUser, newPassword string) error {
+	hash, err := NewPasswordHash(user, newPassword)
+	if err != nil {
+		return err
+	}
+	if err := repository.GetDB().SetUserPassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	now := time.Now()
+	user.Password = hash
+	user.PasswordChangedAt = &now
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return nil
+}
+
+// AuthenticatePassword logs in with a username, verified email or phone number and a password
+func AuthenticatePassword(ctx context.Context, identifier, plain string) (*repository.AuthUser, error) {
+	if !passwordEnabled() {
+		return nil, ErrPasswordLoginDisabled
+	}
+	user, err := findPasswordUser(ctx, identifier)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Password == "" {
+		// spend the same time as a real check so unknown accounts cannot be told apart
+		_, _, _ = password.Verify(plain, dummyPasswordHash, argon2Params(passwordCfg))
+		return nil, ErrInvalidCredentials
+	}
+	if err := CheckUserPassword(ctx, user, plain); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CheckUserPassword verifies the password of a user, counting failures towards the lockout.
+// Hashes with outdated parameters are upgraded on success.
+func CheckUserPassword(ctx context.Context, user *repository.AuthUser, plain string) error {
+	if !passwordEnabled() {
+		return ErrPasswordLoginDisabled
+	}
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return &AccountLockedError{Until: *user.LockedUntil}
+	}
+	if user.Password == "" {
+		return ErrInvalidCredentials
+	}
+
+	db := repository.GetDB()
+	params := argon2Params(passwordCfg)
+	ok, needsRehash, err := password.Verify(plain, user.Password, params)
+	if err != nil {
+		log.Warn(nil, "user %s has an unreadable password hash: %v", user.ID, err)
+		return ErrInvalidCredentials
+	}
+	if !ok {
+		lockedUntil, err := db.RecordPasswordFailure(ctx, user.ID, passwordCfg.MaxFailedAttempts, passwordCfg.LockoutDuration)
+		if err != nil {
+			return err
+		}
+		if lockedUntil != nil {
+			log.Warn(nil, "user %s locked until %s after too many failed logins", user.ID, lockedUntil.Format(time.RFC3339))
+			return &AccountLockedError{Until: *lockedUntil}
+		}
+		return ErrInvalidCredentials
+	}
+
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		if err := db.ResetPasswordFailures(ctx, user.ID); err != nil {
+			return err
+		}
+		user.FailedLogins = 0
+		user.LockedUntil = nil
+	}
+	if needsRehash {
+		if hash, err := password.Hash(plain, params); err == nil {
+			if err := db.UpgradePasswordHash(ctx, user.ID, hash); err != nil {
+				log.Warn(nil, "failed to upgrade password hash of user %s: %v", user.ID, err)
+			} else {
+				user.Password = hash
+			}
+		}
+	}
+	return nil
+}
+
+// findPasswordUser looks an account up by username, verified email or phone number
+func findPasswordUser(ctx context.Context, identifier string) (*repository.AuthUser, error) {
+	db := repository.GetDB()
+	identifier = strings.TrimSpace(identifier)
+	if strings.Contains(identifier, "@") {
+		email, err := NormalizeEmail(identifier)
+		if err != nil {
+			return nil, nil
+		}
+		return db.GetUserByVerifiedEmail(ctx, email)
+	}
+	if username, err := NormalizeUsername(identifier); err == nil {
+		return db.GetUserByUsername(ctx, username)
+	}
+	if phoneNumber, err := phone.Normalize(identifier); err == nil {
+		return db.GetUserByPhone(ctx, phoneNumber)
+	}
+	return nil, nil
+}
@@ -12,6 +12,8 @@ import (
 
 	"github.com/zgsm-ai/oidc-auth/internal/config"
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/outbox"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
 )
 
@@ -54,7 +56,9 @@ func InitQuotaService(cfg *config.QuotaConfig) {
 	})
 }
 
-func MergeUserQuota(MainUserID, OtherUserID, userToken string) error {
+// MergeUserQuota moves the quota of the other user to the main user, calling the quota manager with
+// its service token. The idempotency key, when not empty, lets the quota manager recognize a retried merge.
+func MergeUserQuota(ctx context.Context, MainUserID, OtherUserID, idempotencyKey string) error {
 	if quotaConfig == nil {
 		log.Info(nil, "Quota service is not configured, skipping quota merge")
 		return nil
@@ -78,7 +82,7 @@ func MergeUserQuota(MainUserID, OtherUserID, userToken string) error {
 		return fmt.Errorf("failed to marshal quota merge request: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
@@ -87,8 +91,11 @@ func MergeUserQuota(MainUserID, OtherUserID, userToken string) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	if userToken != "" {
-		req.Header.Set("Authorization", "Bearer "+userToken)
+	if quotaConfig.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+quotaConfig.Token)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
 	}
 
 	resp, err := quotaConfig.HTTPClient.Do(req)
@@ -115,3 +122,19 @@ func MergeUserQuota(MainUserID, OtherUserID, userToken string) error {
 	log.Info(nil, "Successfully merged quota from other user %s to main user %s", OtherUserID, MainUserID)
 	return nil
 }
+
+// QuotaMergeSink merges the quota of merged accounts as the outbox publishes their
+// quota.merge_requested events
+type QuotaMergeSink struct{}
+
+func (QuotaMergeSink) Name() string {
+	return "quota"
+}
+
+func (QuotaMergeSink) Publish(ctx context.Context, event outbox.Event) error {
+	var data repository.QuotaMergeEvent
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		return fmt.Errorf("invalid quota merge event: %w", err)
+	}
+	return MergeUserQuota(ctx, data.MainUserID.String(), data.OtherUserID.String(), data.IdempotencyKey)
+}
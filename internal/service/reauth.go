@@ -0,0 +1,20 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+// ReauthWindow how long after a login a device may change the credentials of its user without
+// proving one again
+const ReauthWindow = 10 * time.Minute
+
+var ErrReauthRequired = errors.New("sign in again or prove a credential of the account to do this")
+
+// RecentlyAuthenticated reports whether the user logged in on the device within ReauthWindow;
+// refreshing its tokens does not count as a login
+func RecentlyAuthenticated(device *repository.Device) bool {
+	return device.AuthenticatedAt != nil && time.Since(*device.AuthenticatedAt) < ReauthWindow
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+// ErrSessionLimit the user is logged in on as many devices as allowed and new logins are refused
+var ErrSessionLimit = errors.New("logged in on too many devices, sign out of one first")
+
+var (
+	sessionCfg  *config.SessionConfig
+	sessionOnce sync.Once
+)
+
+// InitSessionLimits sets how many devices users may be logged in on at once
+func InitSessionLimits(cfg *config.SessionConfig) {
+	sessionOnce.Do(func() {
+		sessionCfg = cfg
+		if cfg.MaxDevices > 0 || len(cfg.VipMaxDevices) > 0 {
+			log.Info(nil, "session limit: %d devices, by vip level %v, policy %s",
+				cfg.MaxDevices, cfg.VipMaxDevices, cfg.Policy)
+		}
+	})
+}
+
+// SessionLimit the most devices a user of the Vip level may be logged in on, 0 for no limit
+func SessionLimit(vip int) int {
+	if sessionCfg == nil {
+		return 0
+	}
+	if limit, ok := sessionCfg.VipMaxDevices[vip]; ok {
+		return limit
+	}
+	return sessionCfg.MaxDevices
+}
+
+func lastAccess(device *repository.Device) time.Time {
+	if device.LastAccessAt != nil {
+		return *device.LastAccessAt
+	}
+	return device.UpdatedAt
+}
+
+// EnforceSessionLimit makes room for the device at index to log in within the session limit of
+// the user. Under the evict_lru policy the least recently used devices are evicted: their tokens
+// are revoked and their status tells them why. Their indexes are returned so the caller announces
+// them once the user is saved. Under the reject policy the login fails with ErrSessionLimit.
+func EnforceSessionLimit(user *repository.AuthUser, index int) ([]int, error) {
+	limit := SessionLimit(user.Vip)
+	if limit <= 0 {
+		return nil, nil
+	}
+	var signedIn []int
+	for i := range user.Devices {
+		if i != index && user.Devices[i].Status == constants.LoginStatusLoggedIn {
+			signedIn = append(signedIn, i)
+		}
+	}
+	excess := len(signedIn) - limit + 1
+	if excess <= 0 {
+		return nil, nil
+	}
+	if sessionCfg.Policy == constants.SessionPolicyReject {
+		return nil, ErrSessionLimit
+	}
+
+	slices.SortFunc(signedIn, func(a, b int) int {
+		return lastAccess(&user.Devices[a]).Compare(lastAccess(&user.Devices[b]))
+	})
+	evicted := signedIn[:excess]
+	now := time.Now()
+	for _, i := range evicted {
+		device := &user.Devices[i]
+		device.Status = constants.LoginStatusEvicted
+		// the access token hash stays so the device can still ask the status endpoint what happened
+		device.AccessToken = ""
+		device.RefreshToken = ""
+		device.RefreshTokenHash = ""
+		device.State = ""
+		device.UpdatedAt = now
+	}
+	return evicted, nil
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+// sessionUser a user whose devices have the statuses, each used a minute after the previous one
+func sessionUser(vip int, statuses ...string) *repository.AuthUser {
+	start := time.Now().Add(-time.Hour)
+	user := &repository.AuthUser{Vip: vip}
+	for i, status := range statuses {
+		lastAccess := start.Add(time.Duration(i) * time.Minute)
+		user.Devices = append(user.Devices, repository.Device{
+			Status:       status,
+			RefreshToken: "refresh",
+			LastAccessAt: &lastAccess,
+		})
+	}
+	return user
+}
+
+func TestEnforceSessionLimit(t *testing.T) {
+	in, out := constants.LoginStatusLoggedIn, constants.LoginStatusLoggedOut
+	tests := []struct {
+		name        string
+		cfg         config.SessionConfig
+		user        *repository.AuthUser
+		index       int
+		wantEvicted []int
+		wantErr     error
+	}{
+		{"no limit", config.SessionConfig{Policy: constants.SessionPolicyEvictLRU},
+			sessionUser(0, in, in, in, out), 3, nil, nil},
+		{"room left", config.SessionConfig{MaxDevices: 3, Policy: constants.SessionPolicyEvictLRU},
+			sessionUser(0, in, in, out, out), 3, nil, nil},
+		{"the device itself does not count", config.SessionConfig{MaxDevices: 2, Policy: constants.SessionPolicyEvictLRU},
+			sessionUser(0, in, in), 1, nil, nil},
+		{"least recently used evicted", config.SessionConfig{MaxDevices: 2, Policy: constants.SessionPolicyEvictLRU},
+			sessionUser(0, out, in, in, out), 3, []int{1}, nil},
+		{"several evicted over a lowered limit", config.SessionConfig{MaxDevices: 1, Policy: constants.SessionPolicyEvictLRU},
+			sessionUser(0, in, in, in, out), 3, []int{0, 1, 2}, nil},
+		{"rejected", config.SessionConfig{MaxDevices: 2, Policy: constants.SessionPolicyReject},
+			sessionUser(0, in, in, out), 2, nil, ErrSessionLimit},
+		{"vip level overrides", config.SessionConfig{MaxDevices: 1, VipMaxDevices: map[int]int{2: 3},
+			Policy: constants.SessionPolicyReject}, sessionUser(2, in, in, out), 2, nil, nil},
+		{"vip level without limit", config.SessionConfig{MaxDevices: 1, VipMaxDevices: map[int]int{2: 0},
+			Policy: constants.SessionPolicyReject}, sessionUser(2, in, in, out), 2, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := sessionCfg
+			sessionCfg = &tt.cfg
+			t.Cleanup(func() { sessionCfg = previous })
+
+			evicted, err := EnforceSessionLimit(tt.user, tt.index)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EnforceSessionLimit error = %v, want %v", err, tt.wantErr)
+			}
+			slices.Sort(evicted)
+			if !slices.Equal(evicted, tt.wantEvicted) {
+				t.Errorf("evicted = %v, want %v", evicted, tt.wantEvicted)
+			}
+			for i, device := range tt.user.Devices {
+				wasEvicted := slices.Contains(tt.wantEvicted, i)
+				if got := device.Status == constants.LoginStatusEvicted; got != wasEvicted {
+					t.Errorf("device %d status = %s, evicted want %v", i, device.Status, wasEvicted)
+				}
+				if wasEvicted && device.RefreshToken != "" {
+					t.Errorf("device %d kept its refresh token after the eviction", i)
+				}
+			}
+		})
+	}
+}
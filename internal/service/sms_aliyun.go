@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+)
+
+const aliyunSMSEndpoint = "https://dysmsapi.aliyuncs.com"
+
+// aliyunSMSSender sends codes through Aliyun SMS (dysmsapi, RPC API signature version 1.0)
+type aliyunSMSSender struct {
+	cfg      *config.SMSConfig
+	endpoint string
+}
+
+type aliyunSMSResponse struct {
+	Code      string `json:"Code"`
+	Message   string `json:"Message"`
+	RequestID string `json:"RequestId"`
+}
+
+func newAliyunSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	c := cfg.Aliyun
+	if c.AccessKeyID == "" || c.AccessKeySecret == "" || c.SignName == "" || c.TemplateCode == "" {
+		return nil, fmt.Errorf("aliyun sms sender requires accessKeyID, accessKeySecret, signName and templateCode")
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = aliyunSMSEndpoint
+	}
+	return &aliyunSMSSender{cfg: cfg, endpoint: strings.TrimSuffix(endpoint, "/") + "/"}, nil
+}
+
+func (s *aliyunSMSSender) Name() string {
+	return "aliyun"
+}
+
+func (s *aliyunSMSSender) Send(ctx context.Context, msg SMSMessage) error {
+	c := s.cfg.Aliyun
+	templateParam, err := json.Marshal(map[string]string{"code": msg.Code})
+	if err != nil {
+		return err
+	}
+	regionID := c.RegionID
+	if regionID == "" {
+		regionID = "cn-hangzhou"
+	}
+	params := map[string]string{
+		"AccessKeyId":      c.AccessKeyID,
+		"Action":           "SendSms",
+		"Format":           "JSON",
+		"PhoneNumbers":     strings.TrimPrefix(nationalOrE164(msg.Phone), "+"),
+		"RegionId":         regionID,
+		"SignName":         c.SignName,
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureNonce":   uuid.NewString(),
+		"SignatureVersion": "1.0",
+		"TemplateCode":     c.TemplateCode,
+		"TemplateParam":    string(templateParam),
+		"Timestamp":        time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		"Version":          "2017-05-25",
+	}
+	query := aliyunCanonicalQuery(params)
+	stringToSign := http.MethodGet + "&" + aliyunPercentEncode("/") + "&" + aliyunPercentEncode(query)
+	mac := hmac.New(sha1.New, []byte(c.AccessKeySecret+"&"))
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.endpoint+"?Signature="+aliyunPercentEncode(signature)+"&"+query, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create aliyun sms request: %w", err)
+	}
+	resp, err := smsHTTPClient(s.cfg).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result aliyunSMSResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode aliyun sms response, status %s: %w", resp.Status, err)
+	}
+	if result.Code != "OK" {
+		return fmt.Errorf("aliyun sms failed: %s %s (request %s)", result.Code, result.Message, result.RequestID)
+	}
+	return nil
+}
+
+func aliyunCanonicalQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, aliyunPercentEncode(k)+"="+aliyunPercentEncode(params[k]))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// aliyunPercentEncode is RFC 3986 encoding as required by the signature
+func aliyunPercentEncode(value string) string {
+	encoded := url.QueryEscape(value)
+	encoded = strings.ReplaceAll(encoded, "+", "%20")
+	encoded = strings.ReplaceAll(encoded, "*", "%2A")
+	return strings.ReplaceAll(encoded, "%7E", "~")
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+)
+
+var (
+	ErrSMSCodeResendTooSoon = errors.New("a code was sent recently, please wait before requesting another")
+	ErrSMSCodeInvalid       = errors.New("invalid verification code")
+	ErrSMSCodeExpired       = errors.New("verification code has expired")
+	ErrSMSCodeTooManyTries  = errors.New("too many failed attempts, please request a new code")
+)
+
+// SMSCodeIssue describes a code that was sent
+type SMSCodeIssue struct {
+	Phone     string
+	ExpiresAt time.Time
+}
+
+// IssueSMSCode generates a one-time code for the phone and purpose and sends it by SMS.
+// Any earlier unused code of the same phone and purpose stops being valid.
+func IssueSMSCode(ctx context.Context, phoneNumber, purpose string) (*SMSCodeIssue, error) {
+	cfg := GetSMSCfg(nil)
+	normalized, err := phone.Normalize(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	db := repository.GetDB()
+	latest, err := db.GetLatestSmsCode(ctx, normalized, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && time.Since(latest.CreatedAt) < cfg.ResendInterval {
+		return nil, ErrSMSCodeResendTooSoon
+	}
+
+	code, err := utils.GenerateNumericCode(cfg.CodeLength)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	record := &repository.SmsVerificationCode{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		Phone:     normalized,
+		Purpose:   purpose,
+		Code:      utils.HashSecret(code),
+		ExpiresAt: now.Add(cfg.CodeTTL),
+	}
+	if err := db.CreateSmsCode(ctx, record); err != nil {
+		return nil, err
+	}
+
+	if err := SendSMS(ctx, normalized, code); err != nil {
+		return nil, fmt.Errorf("failed to send sms: %w", err)
+	}
+	return &SMSCodeIssue{Phone: normalized, ExpiresAt: record.ExpiresAt}, nil
+}
+
+// VerifySMSCode checks a code against the latest code sent for the phone and purpose and consumes it.
+// It returns the normalized phone number the code was sent to.
+func VerifySMSCode(ctx context.Context, phoneNumber, purpose, code string) (string, error) {
+	cfg := GetSMSCfg(nil)
+	normalized, err := phone.Normalize(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+
+	db := repository.GetDB()
+	record, err := db.GetLatestSmsCode(ctx, normalized, purpose)
+	if err != nil {
+		return "", err
+	}
+	if record == nil || record.IsUsed {
+		return "", ErrSMSCodeInvalid
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return "", ErrSMSCodeExpired
+	}
+	// the attempt is counted before the code is compared, so only maxAttempts guesses are ever compared
+	claimed, err := db.ClaimSmsCodeAttempt(ctx, record, cfg.MaxAttempts)
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		// used up by concurrent attempts, or consumed by one of them
+		if record.Attempts+1 >= cfg.MaxAttempts {
+			return "", ErrSMSCodeTooManyTries
+		}
+		return "", ErrSMSCodeInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashSecret(code)), []byte(record.Code)) != 1 {
+		return "", ErrSMSCodeInvalid
+	}
+
+	consumed, err := db.ConsumeSmsCode(ctx, record)
+	if err != nil {
+		return "", err
+	}
+	if !consumed {
+		return "", ErrSMSCodeInvalid
+	}
+	return normalized, nil
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/metrics"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+var ErrSMSRegionNotAllowed = errors.New("sms to this region is not allowed")
+
+// SMSRateLimitError is returned when a send exceeds one of the SMS limits
+type SMSRateLimitError struct {
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *SMSRateLimitError) Error() string {
+	return fmt.Sprintf("too many sms requests (%s limit), retry after %s", e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+var (
+	smsSent     = metrics.NewCounterVec("oidc_auth_sms_sent_total", "SMS messages handed to the gateway.", "provider")
+	smsRejected = metrics.NewCounterVec("oidc_auth_sms_rejected_total", "SMS sends rejected before reaching the gateway.", "reason")
+)
+
+// smsLimit allows at most limit sends per key in each window; a limit or window of 0 allows all
+type smsLimit struct {
+	scope  string
+	limit  int
+	window time.Duration
+}
+
+type smsLimiterSet struct {
+	// keeps the counters, shared by every replica
+	db *repository.Database
+	// narrowest first, so a send rejected for one phone or IP never spends the global budget
+	limits []smsLimit
+	// calling code -> allowed; nil allows all
+	callingCodes map[string]bool
+	// counters untouched for this long are over and swept
+	retention time.Duration
+	lastSweep atomic.Int64
+}
+
+// smsSweepInterval how often counters of past windows are deleted
+const smsSweepInterval = time.Hour
+
+var (
+	smsLimitersOnce sync.Once
+	smsLimiters     *smsLimiterSet
+)
+
+func getSMSLimiters() *smsLimiterSet {
+	smsLimitersOnce.Do(func() {
+		cfg := GetSMSCfg(nil)
+		rl := cfg.RateLimit
+		day := 24 * time.Hour
+		smsLimiters = &smsLimiterSet{
+			db: repository.GetDB(),
+			limits: []smsLimit{
+				{"ip", rl.PerIP, rl.PerIPWindow},
+				{"phone", rl.PerPhone, rl.PerPhoneWindow},
+				{"phone_daily", rl.PhoneDailyCap, day},
+				{"global", rl.Global, rl.GlobalWindow},
+				{"global_daily", rl.GlobalDailyCap, day},
+			},
+			retention: day,
+		}
+		for _, l := range smsLimiters.limits {
+			smsLimiters.retention = max(smsLimiters.retention, l.window)
+		}
+		smsLimiters.lastSweep.Store(time.Now().Unix())
+		if len(cfg.AllowedRegions) > 0 {
+			smsLimiters.callingCodes = make(map[string]bool, len(cfg.AllowedRegions))
+			for _, region := range cfg.AllowedRegions {
+				code, ok := phone.RegionCallingCode(region)
+				if !ok {
+					log.Warn(nil, "ignoring unknown sms allowed region %q", region)
+					continue
+				}
+				smsLimiters.callingCodes[code] = true
+			}
+		}
+	})
+	return smsLimiters
+}
+
+// GuardSMS checks a send to an E.164 number requested from clientIP against the region
+// allowlist and the rate limits, and counts rejections. The counters are kept in the database
+// so every replica enforces the same limits; the per IP and per phone limits are checked before
+// the global ones, so rejected sends do not use up the budget of everybody else.
+func GuardSMS(ctx context.Context, phoneE164, clientIP string) error {
+	l := getSMSLimiters()
+	if l.callingCodes != nil && !l.callingCodes[phone.CallingCode(phoneE164)] {
+		smsRejected.Inc("region")
+		return ErrSMSRegionNotAllowed
+	}
+
+	l.sweep()
+	keys := map[string]string{
+		"ip":          clientIP,
+		"phone":       phoneE164,
+		"phone_daily": phoneE164,
+	}
+	for _, limit := range l.limits {
+		if limit.limit <= 0 || limit.window <= 0 {
+			continue
+		}
+		ok, retryAfter, err := l.db.CountRateLimitWindow(ctx, "sms:"+limit.scope+":"+keys[limit.scope],
+			limit.limit, limit.window)
+		if err != nil {
+			return fmt.Errorf("failed to check the sms %s limit: %w", limit.scope, err)
+		}
+		if !ok {
+			smsRejected.Inc(limit.scope)
+			log.Warn(nil, "sms to %s from %s rejected by the %s limit", maskPhone(phoneE164), clientIP, limit.scope)
+			return &SMSRateLimitError{Scope: limit.scope, RetryAfter: retryAfter}
+		}
+	}
+	return nil
+}
+
+// sweep deletes the counters of windows that are over, at most once per interval
+func (l *smsLimiterSet) sweep() {
+	now := time.Now()
+	last := l.lastSweep.Load()
+	if now.Unix()-last < int64(smsSweepInterval.Seconds()) || !l.lastSweep.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := l.db.DeleteStaleRateLimitWindows(ctx, now.Add(-l.retention)); err != nil {
+			log.Warn(nil, "failed to sweep sms rate limit counters: %v", err)
+		}
+	}()
+}
+
+// RecordSMSRejected counts a send rejected by the caller, e.g. for failed authentication
+func RecordSMSRejected(reason string) {
+	smsRejected.Inc(reason)
+}
+
+// maskPhone keeps the country code and last digits of a number for logs
+func maskPhone(e164 string) string {
+	if len(e164) <= 7 {
+		return e164
+	}
+	return e164[:3] + strings.Repeat("*", len(e164)-7) + e164[len(e164)-4:]
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/repository/repositorytest"
+)
+
+// useSMSLimiters makes GuardSMS check the limits against a fresh test database
+func useSMSLimiters(t *testing.T, limits []smsLimit, callingCodes map[string]bool) {
+	t.Helper()
+	smsLimitersOnce.Do(func() {}) // keep the configured limits from replacing these
+	previous := smsLimiters
+	t.Cleanup(func() { smsLimiters = previous })
+	smsLimiters = &smsLimiterSet{
+		db:           repository.NewDatabase(repositorytest.Open(t, &repository.RateLimitWindow{})),
+		limits:       limits,
+		callingCodes: callingCodes,
+		retention:    24 * time.Hour,
+	}
+	smsLimiters.lastSweep.Store(time.Now().Unix())
+}
+
+func TestGuardSMSLimitOrder(t *testing.T) {
+	useSMSLimiters(t, []smsLimit{
+		{"ip", 2, time.Hour},
+		{"phone", 2, time.Hour},
+		{"phone_daily", 0, 24 * time.Hour}, // disabled
+		{"global", 4, time.Hour},
+		{"global_daily", 4, 0}, // disabled
+	}, nil)
+	steps := []struct {
+		name      string
+		ip        string
+		phone     string
+		wantScope string
+	}{
+		{"first send", "10.0.0.1", "+8613800000001", ""},
+		{"second send", "10.0.0.1", "+8613800000001", ""},
+		{"ip over its limit", "10.0.0.1", "+8613800000001", "ip"},
+		{"phone over its limit", "10.0.0.2", "+8613800000001", "phone"},
+		// the two rejected sends did not count against the global limit
+		{"third global send", "10.0.0.3", "+8613800000002", ""},
+		{"fourth global send", "10.0.0.4", "+8613800000003", ""},
+		{"global over its limit", "10.0.0.5", "+8613800000004", "global"},
+	}
+	for _, step := range steps {
+		err := GuardSMS(context.Background(), step.phone, step.ip)
+		if step.wantScope == "" {
+			if err != nil {
+				t.Fatalf("%s: GuardSMS = %v, want it allowed", step.name, err)
+			}
+			continue
+		}
+		var limitErr *SMSRateLimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("%s: GuardSMS = %v, want a rate limit error", step.name, err)
+		}
+		if limitErr.Scope != step.wantScope {
+			t.Errorf("%s: rejected by the %s limit, want %s", step.name, limitErr.Scope, step.wantScope)
+		}
+		if limitErr.RetryAfter <= 0 || limitErr.RetryAfter > time.Hour {
+			t.Errorf("%s: RetryAfter = %s, want within the window", step.name, limitErr.RetryAfter)
+		}
+	}
+}
+
+func TestGuardSMSRegionAllowlist(t *testing.T) {
+	tests := []struct {
+		name         string
+		callingCodes map[string]bool
+		phone        string
+		wantErr      error
+	}{
+		{"allowed region", map[string]bool{"86": true, "852": true}, "+8613800000001", nil},
+		{"three digit calling code", map[string]bool{"86": true, "852": true}, "+85291234567", nil},
+		{"other region", map[string]bool{"86": true}, "+12025550143", ErrSMSRegionNotAllowed},
+		{"unknown calling code", map[string]bool{"86": true}, "+99912345678", ErrSMSRegionNotAllowed},
+		{"no allowlist", nil, "+12025550143", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a send outside the allowlist is rejected before it counts against any limit
+			useSMSLimiters(t, []smsLimit{{"global", 1, time.Hour}}, tt.callingCodes)
+			if err := GuardSMS(context.Background(), tt.phone, "10.0.0.1"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GuardSMS = %v, want %v", err, tt.wantErr)
+			}
+			if err := GuardSMS(context.Background(), "+8613800000009", "10.0.0.1"); (err == nil) != (tt.wantErr != nil) {
+				t.Errorf("a later send = %v, want it allowed only when the first was rejected", err)
+			}
+		})
+	}
+}
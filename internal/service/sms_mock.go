@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+// maxMockSMSMessages bounds the memory a long running test instance uses
+const maxMockSMSMessages = 1000
+
+// MockSMSMessage a message recorded by the mock sender
+type MockSMSMessage struct {
+	SMSMessage
+	SentAt time.Time `json:"sent_at"`
+}
+
+// MockSMSSender records messages instead of sending them, so tests can read the delivered codes
+type MockSMSSender struct {
+	mu       sync.Mutex
+	messages []MockSMSMessage
+}
+
+func NewMockSMSSender() *MockSMSSender {
+	return &MockSMSSender{}
+}
+
+func (s *MockSMSSender) Name() string {
+	return "mock"
+}
+
+func (s *MockSMSSender) Send(_ context.Context, msg SMSMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) >= maxMockSMSMessages {
+		s.messages = s.messages[1:]
+	}
+	s.messages = append(s.messages, MockSMSMessage{SMSMessage: msg, SentAt: time.Now()})
+	log.Info(nil, "mock sms sender recorded a message to %s", msg.Phone)
+	return nil
+}
+
+// Messages returns the recorded messages, oldest first; an empty phone returns all of them
+func (s *MockSMSSender) Messages(phoneNumber string) []MockSMSMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]MockSMSMessage, 0, len(s.messages))
+	for _, msg := range s.messages {
+		if phoneNumber == "" || msg.Phone == phoneNumber {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// LastCode returns the code most recently sent to a phone number
+func (s *MockSMSSender) LastCode(phoneNumber string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].Phone == phoneNumber {
+			return s.messages[i].Code, true
+		}
+	}
+	return "", false
+}
+
+// Reset forgets the recorded messages
+func (s *MockSMSSender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
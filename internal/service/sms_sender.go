@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zgsm-ai/oidc-auth/internal/audit"
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/phone"
+)
+
+// SMSMessage a verification code to deliver
+type SMSMessage struct {
+	Phone string `json:"phone"` // E.164
+	Code  string `json:"code"`
+	Body  string `json:"message"` // the configured template with the code filled in
+}
+
+// SMSSender delivers verification codes through an SMS gateway
+type SMSSender interface {
+	Name() string
+	Send(ctx context.Context, msg SMSMessage) error
+}
+
+var smsSenderFactories = map[string]func(cfg *config.SMSConfig) (SMSSender, error){
+	"custom":  newCustomSMSSender,
+	"aliyun":  newAliyunSMSSender,
+	"tencent": newTencentSMSSender,
+	"twilio":  newTwilioSMSSender,
+	"webhook": newWebhookSMSSender,
+	"mock":    func(*config.SMSConfig) (SMSSender, error) { return NewMockSMSSender(), nil },
+}
+
+var (
+	smsSenderMu sync.RWMutex
+	smsSender   SMSSender
+)
+
+// NewSMSSender creates the sender selected by the SMS config
+func NewSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	provider := cfg.Provider
+	if provider == "" {
+		provider = "custom"
+		if cfg.EnabledTest {
+			provider = "mock"
+		}
+	}
+	factory, ok := smsSenderFactories[provider]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sms provider: %s", provider)
+	}
+	return factory(cfg)
+}
+
+// InitSMSSender creates the configured sender and makes it the one SendSMS uses
+func InitSMSSender(cfg *config.SMSConfig) error {
+	sender, err := NewSMSSender(cfg)
+	if err != nil {
+		return err
+	}
+	SetSMSSender(sender)
+	log.Info(nil, "SMS sender initialized: %s", sender.Name())
+	return nil
+}
+
+// SetSMSSender replaces the sender SendSMS uses
+func SetSMSSender(sender SMSSender) {
+	smsSenderMu.Lock()
+	defer smsSenderMu.Unlock()
+	smsSender = sender
+}
+
+// GetSMSSender returns the sender SendSMS uses
+func GetSMSSender() SMSSender {
+	smsSenderMu.RLock()
+	defer smsSenderMu.RUnlock()
+	return smsSender
+}
+
+// SendSMS sends a verification code to a phone number through the configured sender
+func SendSMS(ctx context.Context, phoneNum, code string) error {
+	sender := GetSMSSender()
+	if sender == nil {
+		return errors.New("sms sender is not initialized")
+	}
+	normalized, err := phone.Normalize(phoneNum)
+	if err != nil {
+		return err
+	}
+	body := "{code}"
+	if cfg := GetSMSCfg(nil); cfg != nil && cfg.Template != "" {
+		body = cfg.Template
+	}
+	err = sender.Send(ctx, SMSMessage{
+		Phone: normalized,
+		Code:  code,
+		Body:  strings.ReplaceAll(body, "{code}", code),
+	})
+	audit.SMSSend(ctx, maskPhone(normalized), sender.Name(), err)
+	if err != nil {
+		return err
+	}
+	smsSent.Inc(sender.Name())
+	return nil
+}
+
+// nationalOrE164 formats a phone number the way mainland China gateways expect it:
+// domestic numbers without country code, everything else in E.164
+func nationalOrE164(e164 string) string {
+	callingCode, national, err := phone.Split(e164)
+	if err == nil && callingCode == "86" {
+		return national
+	}
+	return e164
+}
+
+func smsHTTPClient(cfg *config.SMSConfig) *http.Client {
+	if cfg.HTTPClient != nil {
+		return cfg.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+)
+
+const tencentSMSEndpoint = "https://sms.tencentcloudapi.com"
+
+// tencentSMSSender sends codes through Tencent Cloud SMS (API 3.0, TC3-HMAC-SHA256 signature)
+type tencentSMSSender struct {
+	cfg      *config.SMSConfig
+	endpoint string
+	host     string
+}
+
+type tencentSMSResponse struct {
+	Response struct {
+		SendStatusSet []struct {
+			PhoneNumber string `json:"PhoneNumber"`
+			Code        string `json:"Code"`
+			Message     string `json:"Message"`
+		} `json:"SendStatusSet"`
+		Error *struct {
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		} `json:"Error"`
+		RequestID string `json:"RequestId"`
+	} `json:"Response"`
+}
+
+func newTencentSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	c := cfg.Tencent
+	if c.SecretID == "" || c.SecretKey == "" || c.SdkAppID == "" || c.TemplateID == "" {
+		return nil, fmt.Errorf("tencent sms sender requires secretID, secretKey, sdkAppID and templateID")
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = tencentSMSEndpoint
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid tencent sms endpoint: %s", endpoint)
+	}
+	return &tencentSMSSender{cfg: cfg, endpoint: endpoint, host: parsed.Host}, nil
+}
+
+func (s *tencentSMSSender) Name() string {
+	return "tencent"
+}
+
+func (s *tencentSMSSender) Send(ctx context.Context, msg SMSMessage) error {
+	c := s.cfg.Tencent
+	payload, err := json.Marshal(map[string]any{
+		"PhoneNumberSet":   []string{msg.Phone},
+		"SmsSdkAppId":      c.SdkAppID,
+		"SignName":         c.SignName,
+		"TemplateId":       c.TemplateID,
+		"TemplateParamSet": []string{msg.Code},
+	})
+	if err != nil {
+		return err
+	}
+	region := c.Region
+	if region == "" {
+		region = "ap-guangzhou"
+	}
+	now := time.Now().UTC()
+	const contentType = "application/json; charset=utf-8"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create tencent sms request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", s.authorization(payload, contentType, now))
+	req.Header.Set("X-TC-Action", "SendSms")
+	req.Header.Set("X-TC-Version", "2021-01-11")
+	req.Header.Set("X-TC-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-TC-Region", region)
+
+	resp, err := smsHTTPClient(s.cfg).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result tencentSMSResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode tencent sms response, status %s: %w", resp.Status, err)
+	}
+	if result.Response.Error != nil {
+		return fmt.Errorf("tencent sms failed: %s %s (request %s)",
+			result.Response.Error.Code, result.Response.Error.Message, result.Response.RequestID)
+	}
+	for _, status := range result.Response.SendStatusSet {
+		if !strings.EqualFold(status.Code, "Ok") {
+			return fmt.Errorf("tencent sms failed: %s %s (request %s)", status.Code, status.Message, result.Response.RequestID)
+		}
+	}
+	return nil
+}
+
+// authorization signs the request with TC3-HMAC-SHA256
+func (s *tencentSMSSender) authorization(payload []byte, contentType string, now time.Time) string {
+	const service = "sms"
+	const signedHeaders = "content-type;host"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		"/",
+		"",
+		"content-type:" + contentType + "\nhost:" + s.host + "\n",
+		signedHeaders,
+		sha256Hex(payload),
+	}, "\n")
+
+	date := now.Format("2006-01-02")
+	credentialScope := date + "/" + service + "/tc3_request"
+	stringToSign := strings.Join([]string{
+		"TC3-HMAC-SHA256",
+		strconv.FormatInt(now.Unix(), 10),
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	secretDate := hmacSHA256([]byte("TC3"+s.cfg.Tencent.SecretKey), date)
+	secretService := hmacSHA256(secretDate, service)
+	secretSigning := hmacSHA256(secretService, "tc3_request")
+	signature := hex.EncodeToString(hmacSHA256(secretSigning, stringToSign))
+
+	return fmt.Sprintf("TC3-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.Tencent.SecretID, credentialScope, signedHeaders, signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
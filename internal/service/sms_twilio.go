@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+)
+
+const twilioBaseURL = "https://api.twilio.com"
+
+// twilioSMSSender sends codes through the Twilio Messages API
+type twilioSMSSender struct {
+	cfg     *config.SMSConfig
+	baseURL string
+}
+
+type twilioErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newTwilioSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	c := cfg.Twilio
+	if c.AccountSID == "" || c.AuthToken == "" {
+		return nil, fmt.Errorf("twilio sms sender requires accountSID and authToken")
+	}
+	if c.From == "" && c.MessagingServiceSID == "" {
+		return nil, fmt.Errorf("twilio sms sender requires from or messagingServiceSID")
+	}
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = twilioBaseURL
+	}
+	return &twilioSMSSender{cfg: cfg, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (s *twilioSMSSender) Name() string {
+	return "twilio"
+}
+
+func (s *twilioSMSSender) Send(ctx context.Context, msg SMSMessage) error {
+	c := s.cfg.Twilio
+	form := url.Values{
+		"To":   {msg.Phone},
+		"Body": {msg.Body},
+	}
+	if c.MessagingServiceSID != "" {
+		form.Set("MessagingServiceSid", c.MessagingServiceSID)
+	} else {
+		form.Set("From", c.From)
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.baseURL, url.PathEscape(c.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create twilio request: %w", err)
+	}
+	req.SetBasicAuth(c.AccountSID, c.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := smsHTTPClient(s.cfg).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var result twilioErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Message == "" {
+		return fmt.Errorf("twilio request failed with status: %s", resp.Status)
+	}
+	return fmt.Errorf("twilio request failed: %d %s", result.Code, result.Message)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+)
+
+// webhookSMSSender posts codes as JSON to an HTTP endpoint that delivers them
+type webhookSMSSender struct {
+	cfg *config.SMSConfig
+}
+
+func newWebhookSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	if cfg.Webhook.URL == "" {
+		return nil, fmt.Errorf("webhook sms sender requires url")
+	}
+	return &webhookSMSSender{cfg: cfg}, nil
+}
+
+func (s *webhookSMSSender) Name() string {
+	return "webhook"
+}
+
+func (s *webhookSMSSender) Send(ctx context.Context, msg SMSMessage) error {
+	c := s.cfg.Webhook
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create sms webhook request: %w", err)
+	}
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Secret != "" {
+		// the timestamp is signed with the body so a captured request cannot be replayed later
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(
+			hmacSHA256([]byte(c.Secret), timestamp+"."+string(payload))))
+	}
+
+	resp, err := smsHTTPClient(s.cfg).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sms webhook failed with status %s: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+	"github.com/zgsm-ai/oidc-auth/pkg/utils"
+	"github.com/zgsm-ai/oidc-auth/pkg/webauthn"
+)
+
+var (
+	ErrWebAuthnDisabled       = errors.New("passkeys are not enabled")
+	ErrWebAuthnSessionInvalid = errors.New("invalid or expired passkey request, please try again")
+	ErrPasskeyInvalid         = errors.New("passkey verification failed")
+	ErrPasskeyExists          = errors.New("this passkey is already registered")
+	ErrPasskeyNotFound        = errors.New("passkey not found")
+)
+
+var (
+	webauthnCfg  *config.WebAuthnConfig
+	relyingParty *webauthn.RelyingParty
+	webauthnOnce sync.Once
+)
+
+// InitWebAuthnService sets up the relying party of passkeys; the RP ID and origins default to baseURL
+func InitWebAuthnService(cfg *config.WebAuthnConfig, baseURL string) error {
+	var err error
+	webauthnOnce.Do(func() {
+		if !cfg.Enabled {
+			log.Info(nil, "passkeys disabled")
+			return
+		}
+		rp := &webauthn.RelyingParty{ID: cfg.RPID, Origins: cfg.Origins}
+		if rp.ID == "" || len(rp.Origins) == 0 {
+			base, parseErr := url.Parse(baseURL)
+			if parseErr != nil || base.Host == "" {
+				err = fmt.Errorf("webauthn.rpID and webauthn.origins are required without a valid server.baseURL")
+				return
+			}
+			if rp.ID == "" {
+				rp.ID = base.Hostname()
+			}
+			if len(rp.Origins) == 0 {
+				rp.Origins = []string{base.Scheme + "://" + base.Host}
+			}
+		}
+		webauthnCfg, relyingParty = cfg, rp
+		log.Info(nil, "Passkeys enabled for %s", rp.ID)
+	})
+	return err
+}
+
+func webauthnEnabled() bool {
+	return relyingParty != nil
+}
+
+// PasskeyCreation the options for navigator.credentials.create, binary values in base64url
+type PasskeyCreation struct {
+	Challenge              string                  `json:"challenge"`
+	RP                     passkeyRP               `json:"rp"`
+	User                   passkeyUser             `json:"user"`
+	PubKeyCredParams       []passkeyParam          `json:"pubKeyCredParams"`
+	Timeout                int64                   `json:"timeout"`
+	ExcludeCredentials     []PasskeyDescriptor     `json:"excludeCredentials"`
+	AuthenticatorSelection passkeyAuthenticatorSel `json:"authenticatorSelection"`
+	Attestation            string                  `json:"attestation"`
+}
+
+// PasskeyRequest the options for navigator.credentials.get, binary values in base64url
+type PasskeyRequest struct {
+	Challenge        string              `json:"challenge"`
+	Timeout          int64               `json:"timeout"`
+	RPID             string              `json:"rpId"`
+	AllowCredentials []PasskeyDescriptor `json:"allowCredentials"`
+	UserVerification string              `json:"userVerification"`
+}
+
+type passkeyRP struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type passkeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type passkeyParam struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type passkeyAuthenticatorSel struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PasskeyDescriptor identifies a credential the browser may use or must not register again
+type PasskeyDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// PasskeyCeremony the options of a ceremony and the session its response is finished with
+type PasskeyCeremony[T any] struct {
+	Session   string `json:"session"`
+	PublicKey T      `json:"publicKey"`
+}
+
+// PasskeyAttestation the response of navigator.credentials.create as serialized by the page
+type PasskeyAttestation struct {
+	ID       string `json:"id" binding:"required"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" binding:"required"`
+		AttestationObject string   `json:"attestationObject" binding:"required"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// PasskeyAssertion the response of navigator.credentials.get as serialized by the page
+type PasskeyAssertion struct {
+	ID       string `json:"id" binding:"required"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+		AuthenticatorData string `json:"authenticatorData" binding:"required"`
+		Signature         string `json:"signature" binding:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// BeginPasskeyRegistration starts registering a passkey for a signed in user
+func BeginPasskeyRegistration(ctx context.Context, userID uuid.UUID, account, displayName string) (*PasskeyCeremony[PasskeyCreation], error) {
+	if !webauthnEnabled() {
+		return nil, ErrWebAuthnDisabled
+	}
+	existing, err := passkeyDescriptors(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	session, challenge, err := newWebAuthnSession(ctx, constants.WebAuthnPurposeRegister, &userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	params := make([]passkeyParam, 0, len(webauthn.SupportedAlgorithms))
+	for _, alg := range webauthn.SupportedAlgorithms {
+		params = append(params, passkeyParam{Type: "public-key", Alg: alg})
+	}
+	return &PasskeyCeremony[PasskeyCreation]{
+		Session: session.ID.String(),
+		PublicKey: PasskeyCreation{
+			Challenge: challenge,
+			RP:        passkeyRP{ID: relyingParty.ID, Name: webauthnCfg.RPName},
+			User: passkeyUser{
+				ID:          webauthn.Encoding.EncodeToString(userID[:]),
+				Name:        account,
+				DisplayName: displayName,
+			},
+			PubKeyCredParams:   params,
+			Timeout:            webauthnCfg.Timeout.Milliseconds(),
+			ExcludeCredentials: existing,
+			AuthenticatorSelection: passkeyAuthenticatorSel{
+				ResidentKey:      "preferred",
+				UserVerification: webauthnCfg.UserVerification,
+			},
+			Attestation: "none",
+		},
+	}, nil
+}
+
+// FinishPasskeyRegistration verifies the new credential and stores it under the given name
+func FinishPasskeyRegistration(ctx context.Context, userID uuid.UUID, sessionID, name string,
+	resp *PasskeyAttestation) (*repository.WebAuthnCredential, error) {
+	if !webauthnEnabled() {
+		return nil, ErrWebAuthnDisabled
+	}
+	session, err := consumeWebAuthnSession(ctx, sessionID, constants.WebAuthnPurposeRegister)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID == nil || *session.UserID != userID {
+		return nil, ErrWebAuthnSessionInvalid
+	}
+	challenge, clientData, attestation, err := decodeWebAuthnValues(session.Challenge,
+		resp.Response.ClientDataJSON, resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := relyingParty.VerifyRegistration(challenge, clientData, attestation,
+		webauthnCfg.UserVerification == "required")
+	if err != nil {
+		log.Info(nil, "passkey registration of user %s rejected: %v", userID, err)
+		return nil, fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)
+	}
+	credentialID := webauthn.Encoding.EncodeToString(credential.ID)
+	if credentialID != resp.ID {
+		return nil, fmt.Errorf("%w: credential id does not match", ErrPasskeyInvalid)
+	}
+
+	db := repository.GetDB()
+	existing, err := db.GetWebAuthnCredential(ctx, utils.HashToken(credentialID))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrPasskeyExists
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	now := time.Now()
+	stored := &repository.WebAuthnCredential{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		UserID:         userID,
+		CredentialID:   credentialID,
+		CredentialHash: utils.HashToken(credentialID),
+		PublicKey:      credential.PublicKey,
+		Algorithm:      credential.Algorithm,
+		SignCount:      credential.SignCount,
+		Transports:     resp.Response.Transports,
+		Name:           name,
+		BackupEligible: credential.BackupEligible,
+	}
+	if aaguid, err := uuid.FromBytes(credential.AAGUID); err == nil {
+		stored.AAGUID = aaguid.String()
+	}
+	if err := db.CreateWebAuthnCredential(ctx, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// ListPasskeys lists the passkeys of a user
+func ListPasskeys(ctx context.Context, userID uuid.UUID) ([]repository.WebAuthnCredential, error) {
+	return repository.GetDB().ListWebAuthnCredentials(ctx, userID)
+}
+
+// DeletePasskey removes a passkey of a user; the last second factor cannot be removed while the
+// organization requires 2FA
+func DeletePasskey(ctx context.Context, userID uuid.UUID, id string) error {
+	credentialID, err := uuid.Parse(id)
+	if err != nil {
+		return ErrPasskeyNotFound
+	}
+	if getMFACfg().Required {
+		status, err := GetMFAStatus(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !status.Enabled && status.Passkeys <= 1 {
+			return ErrMFARequired
+		}
+	}
+	deleted, err := repository.GetDB().DeleteWebAuthnCredential(ctx, userID, credentialID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// BeginPasskeyLogin starts a passwordless login with any passkey the browser discovers for this site
+func BeginPasskeyLogin(ctx context.Context) (*PasskeyCeremony[PasskeyRequest], error) {
+	if !webauthnEnabled() {
+		return nil, ErrWebAuthnDisabled
+	}
+	return beginPasskeyAssertion(ctx, constants.WebAuthnPurposeLogin, nil, nil, nil)
+}
+
+// FinishPasskeyLogin verifies a passkey login and returns the user it belongs to. The login
+// counts as two factors when the authenticator verified the user, e.g. by biometrics or a PIN.
+func FinishPasskeyLogin(ctx context.Context, sessionID string, resp *PasskeyAssertion) (*repository.AuthUser, bool, error) {
+	if !webauthnEnabled() {
+		return nil, false, ErrWebAuthnDisabled
+	}
+	session, err := consumeWebAuthnSession(ctx, sessionID, constants.WebAuthnPurposeLogin)
+	if err != nil {
+		return nil, false, err
+	}
+	credential, userVerified, err := verifyPasskeyAssertion(ctx, session, resp, nil,
+		webauthnCfg.UserVerification != "discouraged")
+	if err != nil {
+		return nil, false, err
+	}
+	user, err := repository.GetDB().GetUserByField(ctx, "id", credential.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	if user == nil {
+		return nil, false, ErrPasskeyInvalid
+	}
+	return user, userVerified, nil
+}
+
+// BeginPasskeyMFA starts using a passkey of the user as the second factor of a login challenge
+func BeginPasskeyMFA(ctx context.Context, challengeID string) (*PasskeyCeremony[PasskeyRequest], error) {
+	if !webauthnEnabled() {
+		return nil, ErrWebAuthnDisabled
+	}
+	challenge, err := GetOpenMFAChallenge(ctx, challengeID)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := passkeyDescriptors(ctx, challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 {
+		return nil, ErrPasskeyNotFound
+	}
+	return beginPasskeyAssertion(ctx, constants.WebAuthnPurposeMFA, &challenge.UserID, &challenge.ID, allowed)
+}
+
+// CompleteMFAChallengeWithPasskey passes a login challenge with a passkey of its user
+func CompleteMFAChallengeWithPasskey(ctx context.Context, challengeID, sessionID string,
+	resp *PasskeyAssertion) (*repository.MFAChallenge, error) {
+	if !webauthnEnabled() {
+		return nil, ErrWebAuthnDisabled
+	}
+	challenge, err := GetOpenMFAChallenge(ctx, challengeID)
+	if err != nil {
+		return nil, err
+	}
+	err = passMFAChallenge(ctx, challenge, func() error {
+		session, err := consumeWebAuthnSession(ctx, sessionID, constants.WebAuthnPurposeMFA)
+		if err != nil {
+			return err
+		}
+		if session.MFAChallengeID == nil || *session.MFAChallengeID != challenge.ID {
+			return ErrWebAuthnSessionInvalid
+		}
+		_, _, err = verifyPasskeyAssertion(ctx, session, resp, &challenge.UserID,
+			webauthnCfg.UserVerification == "required")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func beginPasskeyAssertion(ctx context.Context, purpose string, userID, mfaChallengeID *uuid.UUID,
+	allowed []PasskeyDescriptor) (*PasskeyCeremony[PasskeyRequest], error) {
+	session, challenge, err := newWebAuthnSession(ctx, purpose, userID, mfaChallengeID)
+	if err != nil {
+		return nil, err
+	}
+	if allowed == nil {
+		allowed = []PasskeyDescriptor{}
+	}
+	return &PasskeyCeremony[PasskeyRequest]{
+		Session: session.ID.String(),
+		PublicKey: PasskeyRequest{
+			Challenge:        challenge,
+			Timeout:          webauthnCfg.Timeout.Milliseconds(),
+			RPID:             relyingParty.ID,
+			AllowCredentials: allowed,
+			UserVerification: webauthnCfg.UserVerification,
+		},
+	}, nil
+}
+
+// verifyPasskeyAssertion checks an assertion against its stored credential, optionally of a given
+// user, and records the new signature counter. It reports whether the user was verified.
+func verifyPasskeyAssertion(ctx context.Context, session *repository.WebAuthnSession, resp *PasskeyAssertion,
+	userID *uuid.UUID, requireUserVerification bool) (*repository.WebAuthnCredential, bool, error) {
+	db := repository.GetDB()
+	credential, err := db.GetWebAuthnCredential(ctx, utils.HashToken(resp.ID))
+	if err != nil {
+		return nil, false, err
+	}
+	if credential == nil || (userID != nil && credential.UserID != *userID) {
+		return nil, false, fmt.Errorf("%w: unknown credential", ErrPasskeyInvalid)
+	}
+	if resp.Response.UserHandle != "" {
+		handle, err := webauthn.Encoding.DecodeString(resp.Response.UserHandle)
+		if err != nil || string(handle) != string(credential.UserID[:]) {
+			return nil, false, fmt.Errorf("%w: user handle does not match", ErrPasskeyInvalid)
+		}
+	}
+	challenge, clientData, authData, err := decodeWebAuthnValues(session.Challenge,
+		resp.Response.ClientDataJSON, resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, false, err
+	}
+	signature, err := webauthn.Encoding.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)
+	}
+	ad, err := relyingParty.VerifyAssertion(challenge, clientData, authData, signature,
+		credential.PublicKey, credential.SignCount, requireUserVerification)
+	if err != nil {
+		if errors.Is(err, webauthn.ErrSignCountRollback) {
+			log.Warn(nil, "passkey %s of user %s reported an old signature counter", credential.ID, credential.UserID)
+		}
+		return nil, false, fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)
+	}
+	fresh, err := db.UseWebAuthnCredential(ctx, credential.ID, credential.SignCount, ad.SignCount)
+	if err != nil {
+		return nil, false, err
+	}
+	if !fresh {
+		return nil, false, fmt.Errorf("%w: credential used concurrently", ErrPasskeyInvalid)
+	}
+	return credential, ad.UserVerified(), nil
+}
+
+func passkeyDescriptors(ctx context.Context, userID uuid.UUID) ([]PasskeyDescriptor, error) {
+	credentials, err := repository.GetDB().ListWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	descriptors := make([]PasskeyDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, PasskeyDescriptor{
+			Type:       "public-key",
+			ID:         credential.CredentialID,
+			Transports: credential.Transports,
+		})
+	}
+	return descriptors, nil
+}
+
+// newWebAuthnSession stores a fresh ceremony challenge and returns it base64url encoded
+func newWebAuthnSession(ctx context.Context, purpose string, userID, mfaChallengeID *uuid.UUID) (*repository.WebAuthnSession, string, error) {
+	raw, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, "", err
+	}
+	challenge := webauthn.Encoding.EncodeToString(raw)
+	now := time.Now()
+	session := &repository.WebAuthnSession{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		Purpose:        purpose,
+		UserID:         userID,
+		MFAChallengeID: mfaChallengeID,
+		Challenge:      challenge,
+		ExpiresAt:      now.Add(webauthnCfg.Timeout),
+	}
+	if err := repository.GetDB().CreateWebAuthnSession(ctx, session); err != nil {
+		return nil, "", err
+	}
+	return session, challenge, nil
+}
+
+func consumeWebAuthnSession(ctx context.Context, id, purpose string) (*repository.WebAuthnSession, error) {
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrWebAuthnSessionInvalid
+	}
+	session, err := repository.GetDB().ConsumeWebAuthnSession(ctx, sessionID, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrWebAuthnSessionInvalid
+	}
+	return session, nil
+}
+
+// decodeWebAuthnValues decodes the stored challenge and the base64url values of a browser response
+func decodeWebAuthnValues(challenge string, values ...string) ([]byte, []byte, []byte, error) {
+	decoded := make([][]byte, 0, 3)
+	for _, value := range append([]string{challenge}, values...) {
+		b, err := webauthn.Encoding.DecodeString(value)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrPasskeyInvalid, err)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded[0], decoded[1], decoded[2], nil
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/internal/webhook"
 	"github.com/zgsm-ai/oidc-auth/pkg/log"
 )
 
@@ -176,12 +177,17 @@ func (s *SyncStar) Stargazers() error {
 		processedMap[p.GitHubID] = p
 	}
 
+	repo := fmt.Sprintf("%s.%s", s.Owner, s.Repo)
+	var changed []int
 	for i, u := range users {
+		starred := ""
 		if _, ok := processedMap[u.GithubID]; ok {
-			users[i].GithubStar = fmt.Sprintf("%s.%s", s.Owner, s.Repo)
-		} else {
-			users[i].GithubStar = ""
+			starred = repo
 		}
+		if users[i].GithubStar != starred {
+			changed = append(changed, i)
+		}
+		users[i].GithubStar = starred
 	}
 
 	err = repository.GetDB().BatchUpsert(ctx, users, constants.DBIndexField)
@@ -190,6 +196,9 @@ func (s *SyncStar) Stargazers() error {
 		log.Error(nil, "Failed to batch upsert stargazers: %v", err)
 		return err
 	}
+	for _, i := range changed {
+		webhook.StarChanged(ctx, &users[i], repo, users[i].GithubStar != "")
+	}
 	return nil
 }
 
@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+)
+
+// UserData the user an event is about
+type UserData struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	GithubID   string     `json:"github_id,omitempty"`
+	GithubName string     `json:"github_name,omitempty"`
+	Phone      string     `json:"phone,omitempty"`
+	Email      string     `json:"email,omitempty"`
+	InviterID  *uuid.UUID `json:"inviter_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// DeviceData a device signing in or out
+type DeviceData struct {
+	UserID      uuid.UUID `json:"user_id"`
+	DeviceID    uuid.UUID `json:"device_id"`
+	Provider    string    `json:"provider,omitempty"`
+	Platform    string    `json:"platform,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	MachineCode string    `json:"machine_code,omitempty"`
+}
+
+// StarData the star of a user on the synchronized repository
+type StarData struct {
+	UserID   uuid.UUID `json:"user_id"`
+	GithubID string    `json:"github_id"`
+	Repo     string    `json:"repo"`
+	Starred  bool      `json:"starred"`
+}
+
+// InviteData a new user that signed up with the invite code of another
+type InviteData struct {
+	UserID    uuid.UUID `json:"user_id"`
+	InviterID uuid.UUID `json:"inviter_id"`
+}
+
+func userData(user *repository.AuthUser) UserData {
+	return UserData{
+		UserID:     user.ID,
+		Name:       user.Name,
+		GithubID:   user.GithubID,
+		GithubName: user.GithubName,
+		Phone:      user.Phone,
+		Email:      user.Email,
+		InviterID:  user.InviterID,
+		CreatedAt:  user.CreatedAt,
+	}
+}
+
+func deviceData(user *repository.AuthUser, device *repository.Device) DeviceData {
+	return DeviceData{
+		UserID:      user.ID,
+		DeviceID:    device.ID,
+		Provider:    device.Provider,
+		Platform:    device.Platform,
+		ClientID:    device.ClientID,
+		MachineCode: device.MachineCode,
+	}
+}
+
+// UserCreated emits user.created for a saved new user, and invite.redeemed when it signed up
+// with an invite code
+func UserCreated(ctx context.Context, user *repository.AuthUser) {
+	Emit(ctx, constants.EventUserCreated, userData(user))
+	if user.InviterID != nil && *user.InviterID != uuid.Nil {
+		Emit(ctx, constants.EventInviteRedeemed, InviteData{UserID: user.ID, InviterID: *user.InviterID})
+	}
+}
+
+// UserLogin emits user.login for a device that signed in
+func UserLogin(ctx context.Context, user *repository.AuthUser, device *repository.Device) {
+	Emit(ctx, constants.EventUserLogin, deviceData(user, device))
+}
+
+// DeviceLoggedOut emits device.logged_out for a device that was signed out
+func DeviceLoggedOut(ctx context.Context, user *repository.AuthUser, device *repository.Device) {
+	Emit(ctx, constants.EventDeviceLoggedOut, deviceData(user, device))
+}
+
+// StarChanged emits star.changed for a user who starred or unstarred the repository
+func StarChanged(ctx context.Context, user *repository.AuthUser, repo string, starred bool) {
+	Emit(ctx, constants.EventStarChanged, StarData{
+		UserID:   user.ID,
+		GithubID: user.GithubID,
+		Repo:     repo,
+		Starred:  starred,
+	})
+}
@@ -0,0 +1,295 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zgsm-ai/oidc-auth/internal/config"
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
+	"github.com/zgsm-ai/oidc-auth/internal/outbox"
+	"github.com/zgsm-ai/oidc-auth/internal/repository"
+	"github.com/zgsm-ai/oidc-auth/pkg/log"
+)
+
+const (
+	claimBatch  = 50
+	emitTimeout = 5 * time.Second
+)
+
+// ErrDeliveryNotFound no delivery with the ID
+var ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+// Event the body posted to webhook endpoints
+type Event struct {
+	ID        uuid.UUID `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+var (
+	webhookCfg  *config.WebhookConfig
+	httpClient  *http.Client
+	wake        = make(chan struct{}, 1)
+	webhookOnce sync.Once
+)
+
+// Init sets the webhook config and the client deliveries are sent with
+func Init(cfg *config.WebhookConfig, client *http.Client) {
+	webhookOnce.Do(func() {
+		webhookCfg = cfg
+		httpClient = client
+		if cfg.Enabled {
+			log.Info(nil, "webhooks enabled for %d endpoints", len(cfg.Endpoints))
+		}
+	})
+}
+
+func enabled() bool {
+	return webhookCfg != nil && webhookCfg.Enabled && len(webhookCfg.Endpoints) > 0
+}
+
+// Emit queues an event for every endpoint subscribed to its type and wakes the dispatcher.
+// The action that raised the event already happened, so failures are logged rather than returned.
+func Emit(ctx context.Context, eventType string, data any) {
+	if !enabled() {
+		return
+	}
+	event := Event{ID: uuid.New(), Type: eventType, CreatedAt: time.Now(), Data: data}
+	if err := queue(ctx, event, false); err != nil {
+		log.Error(nil, "failed to queue %s event %s: %v", eventType, event.ID, err)
+	}
+}
+
+// Sink forwards the events the outbox publishes to the webhook endpoints subscribed to them
+type Sink struct{}
+
+func (Sink) Name() string {
+	return "webhooks"
+}
+
+func (Sink) Publish(ctx context.Context, event outbox.Event) error {
+	if !enabled() {
+		return nil
+	}
+	return queue(ctx, Event{ID: event.ID, Type: event.Type, CreatedAt: event.CreatedAt, Data: event.Data}, true)
+}
+
+// queue stores a delivery of an event for every subscribed endpoint. An event the outbox publishes
+// again is not queued twice for the same endpoint.
+func queue(ctx context.Context, event Event, republished bool) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", event.Type, err)
+	}
+	// queued even when the request that raised the event is timing out
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), emitTimeout)
+	defer cancel()
+	db := repository.GetDB()
+	var queued []string
+	if republished {
+		if queued, err = db.WebhookDeliveryEndpoints(ctx, event.ID); err != nil {
+			return err
+		}
+	}
+	var deliveries []repository.WebhookDelivery
+	now := time.Now()
+	for name, endpoint := range webhookCfg.Endpoints {
+		if (len(endpoint.Events) > 0 && !slices.Contains(endpoint.Events, event.Type)) || slices.Contains(queued, name) {
+			continue
+		}
+		deliveries = append(deliveries, repository.WebhookDelivery{
+			ID:            uuid.New(),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Endpoint:      name,
+			Payload:       string(payload),
+			Status:        constants.WebhookStatusPending,
+			NextAttemptAt: now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := db.CreateWebhookDeliveries(ctx, deliveries); err != nil {
+		return err
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run sends due deliveries until the context is done, looking for them every poll interval and
+// right after an event is emitted
+func Run(ctx context.Context) {
+	if !enabled() {
+		return
+	}
+	ticker := time.NewTicker(webhookCfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// deliverDue sends the due deliveries in batches until none are left
+func deliverDue(ctx context.Context) {
+	// a claimed delivery is not sent by another replica before every attempt of this one timed out
+	lease := webhookCfg.Timeout*claimBatch + time.Minute
+	for ctx.Err() == nil {
+		due, err := repository.GetDB().ClaimDueWebhookDeliveries(ctx, time.Now(), lease, claimBatch)
+		if err != nil {
+			log.Error(nil, "failed to claim webhook deliveries: %v", err)
+			return
+		}
+		for i := range due {
+			attempt(ctx, &due[i])
+		}
+		if len(due) < claimBatch {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and schedules the next attempt with exponential backoff when it fails
+func attempt(ctx context.Context, delivery *repository.WebhookDelivery) {
+	code, err := send(ctx, delivery)
+	now := time.Now()
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	switch {
+	case err == nil:
+		delivery.Status = constants.WebhookStatusDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	case delivery.Attempts >= webhookCfg.MaxAttempts:
+		delivery.Status = constants.WebhookStatusFailed
+		delivery.LastError = err.Error()
+		log.Warn(nil, "webhook delivery %s of %s to %s failed after %d attempts: %v",
+			delivery.ID, delivery.EventType, delivery.Endpoint, delivery.Attempts, err)
+	default:
+		delivery.NextAttemptAt = now.Add(backoff(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), emitTimeout)
+	defer cancel()
+	if err := repository.GetDB().SaveWebhookDeliveryResult(ctx, delivery); err != nil {
+		log.Error(nil, "webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// backoff the delay after a number of failed attempts: InitialBackoff doubled each time, up to MaxBackoff
+func backoff(attempts int) time.Duration {
+	delay := webhookCfg.InitialBackoff
+	for i := 1; i < attempts && delay < webhookCfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookCfg.MaxBackoff)
+}
+
+// send posts a delivery to its endpoint, signed like the SMS webhook: the timestamp is signed with
+// the body so a captured request cannot be replayed later. It returns the response status code.
+func send(ctx context.Context, delivery *repository.WebhookDelivery) (int, error) {
+	endpoint, ok := webhookCfg.Endpoints[delivery.Endpoint]
+	if !ok {
+		return 0, fmt.Errorf("endpoint %q is no longer configured", delivery.Endpoint)
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookCfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	for key, value := range endpoint.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-ID", delivery.EventID.String())
+	req.Header.Set("X-Webhook-Delivery", delivery.ID.String())
+	if endpoint.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+		mac.Write([]byte(timestamp + "." + delivery.Payload))
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("webhook failed with status %s: %s", resp.Status, body)
+	}
+	return resp.StatusCode, nil
+}
+
+// Replay queues a delivery again with fresh attempts, to resend a failed delivery once the
+// endpoint is fixed or to let a service catch up on an event
+func Replay(ctx context.Context, id string) (*repository.WebhookDelivery, error) {
+	deliveryID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrDeliveryNotFound
+	}
+	db := repository.GetDB()
+	replayed, err := db.ReplayWebhookDelivery(ctx, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if !replayed {
+		return nil, ErrDeliveryNotFound
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return GetDelivery(ctx, id)
+}
+
+// GetDelivery gets a delivery by ID
+func GetDelivery(ctx context.Context, id string) (*repository.WebhookDelivery, error) {
+	deliveryID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrDeliveryNotFound
+	}
+	delivery, err := repository.GetDB().GetWebhookDelivery(ctx, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if delivery == nil {
+		return nil, ErrDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+// ListDeliveries lists the most recently created deliveries matching the filter
+func ListDeliveries(ctx context.Context, filter repository.WebhookDeliveryFilter, limit int) ([]repository.WebhookDelivery, error) {
+	return repository.GetDB().ListWebhookDeliveries(ctx, filter, limit)
+}
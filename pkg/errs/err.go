@@ -19,6 +19,27 @@ const (
 	ErrBindAccount     = "oidc-auth.bindAccountFailed"
 	ErrTokenGenerate   = "oidc-auth.tokenGenerateFailed"
 	ErrAuthentication  = "oidc-auth.authenticationFailed"
+	ErrInvalidClient   = "oidc-auth.invalidClient"
+	ErrInvalidRedirect = "oidc-auth.invalidRedirect"
+	ErrSMSSend         = "oidc-auth.smsSendFailed"
+	ErrSMSCode         = "oidc-auth.smsCodeInvalid"
+	ErrEmailSend       = "oidc-auth.emailSendFailed"
+	ErrEmailCode       = "oidc-auth.emailCodeInvalid"
+	ErrCredentials     = "oidc-auth.invalidCredentials"
+	ErrAccountLocked   = "oidc-auth.accountLocked"
+	ErrPasswordPolicy  = "oidc-auth.passwordPolicy"
+	ErrUsernameTaken   = "oidc-auth.usernameTaken"
+	ErrMFACode         = "oidc-auth.mfaCodeInvalid"
+	ErrMFARequired     = "oidc-auth.mfaRequired"
+	ErrTooManyRequests = "oidc-auth.tooManyRequests"
+	ErrIdentityLinked  = "oidc-auth.identityLinked"
+	ErrLastLoginMethod = "oidc-auth.lastLoginMethod"
+	ErrUpstreamUnbind  = "oidc-auth.upstreamUnbindFailed"
+	ErrSessionLimit    = "oidc-auth.sessionLimitReached"
+	ErrDeviceProof     = "oidc-auth.deviceProofInvalid"
+	ErrStepUpRequired  = "oidc-auth.stepUpRequired"
+	ErrDeviceRevoked   = "oidc-auth.deviceRevoked"
+	ErrReauthRequired  = "oidc-auth.reauthenticationRequired"
 )
 
 func ParamNeedErr(name string) error {
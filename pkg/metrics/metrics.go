@@ -0,0 +1,80 @@
+// Package metrics keeps process counters and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a counter partitioned by the values of one label
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*CounterVec
+)
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+	return c
+}
+
+// Inc adds one to the counter of the label value
+func (c *CounterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+// Value returns the counter of the label value
+func (c *CounterVec) Value(labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, escapeLabel(v), c.values[v])
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Handler serves all registered counters
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		counters := append([]*CounterVec(nil), registry...)
+		registryMu.Unlock()
+		for _, c := range counters {
+			c.write(w)
+		}
+	})
+}
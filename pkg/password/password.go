@@ -0,0 +1,118 @@
+// Package password hashes and verifies passwords and checks them against a policy.
+// New hashes use argon2id in the PHC string format; bcrypt hashes are still verified.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// Params argon2id cost parameters
+type Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultParams the OWASP recommended argon2id parameters with a little headroom
+var DefaultParams = Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}
+
+func (p Params) orDefault() Params {
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return DefaultParams
+	}
+	return p
+}
+
+// Hash hashes a password with argon2id and a random salt
+func Hash(password string, p Params) (string, error) {
+	p = p.orDefault()
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks a password against a hash. needsRehash reports a correct password whose hash
+// uses another algorithm or weaker parameters than p, so the caller can store a fresh hash.
+func Verify(password, encoded string, p Params) (ok, needsRehash bool, err error) {
+	p = p.orDefault()
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		hashParams, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, hashParams.Iterations, hashParams.Memory,
+			hashParams.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false, nil
+		}
+		weaker := hashParams.Memory < p.Memory || hashParams.Iterations < p.Iterations ||
+			hashParams.Parallelism < p.Parallelism
+		return true, weaker, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	default:
+		return false, false, ErrUnsupportedHash
+	}
+}
+
+// IsHash reports whether a stored value is a hash Verify understands
+func IsHash(encoded string) bool {
+	for _, prefix := range []string{"$argon2id$", "$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeArgon2id(encoded string) (Params, []byte, []byte, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return Params{}, nil, nil, ErrUnsupportedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Params{}, nil, nil, ErrUnsupportedHash
+	}
+	var p Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Params{}, nil, nil, ErrUnsupportedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Params{}, nil, nil, ErrUnsupportedHash
+	}
+	return p, salt, key, nil
+}
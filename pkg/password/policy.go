@@ -0,0 +1,80 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minAllowedLength no policy accepts passwords shorter than this
+const minAllowedLength = 8
+
+// Policy the rules a new password has to satisfy
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// PolicyError lists the rules a password breaks
+type PolicyError struct {
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password " + strings.Join(e.Violations, ", ")
+}
+
+// Validate checks a password against the policy. Passwords equal to one of the user's
+// identifiers (username, email...) are rejected too.
+func (p Policy) Validate(password string, identifiers ...string) error {
+	minLength := max(p.MinLength, minAllowedLength)
+	var violations []string
+	length := utf8.RuneCountInString(password)
+	if length < minLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters", minLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters", p.MaxLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r), unicode.IsSymbol(r), unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, "must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, "must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+	for _, identifier := range identifiers {
+		if identifier != "" && strings.EqualFold(password, identifier) {
+			violations = append(violations, "must not equal the account name")
+			break
+		}
+	}
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Package phone parses phone numbers and normalizes them to E.164 (+<country code><national number>),
+// the only format phone numbers are stored, looked up and sent in.
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var ErrInvalid = errors.New("invalid phone number")
+
+// region numbering rules; lengths are of the national significant number (without trunk prefix)
+type region struct {
+	callingCode string
+	trunkPrefix string
+	minLength   int
+	maxLength   int
+}
+
+var regions = map[string]region{
+	"CN": {"86", "0", 7, 11},
+	"HK": {"852", "", 8, 8},
+	"MO": {"853", "", 8, 8},
+	"TW": {"886", "0", 8, 9},
+	"SG": {"65", "", 8, 8},
+	"MY": {"60", "0", 8, 10},
+	"TH": {"66", "0", 8, 9},
+	"VN": {"84", "0", 9, 10},
+	"PH": {"63", "0", 10, 10},
+	"ID": {"62", "0", 8, 12},
+	"JP": {"81", "0", 9, 10},
+	"KR": {"82", "0", 8, 10},
+	"IN": {"91", "0", 10, 10},
+	"AU": {"61", "0", 9, 9},
+	"US": {"1", "1", 10, 10},
+	"CA": {"1", "1", 10, 10},
+	"GB": {"44", "0", 9, 10},
+	"DE": {"49", "0", 6, 13},
+	"FR": {"33", "0", 9, 9},
+	"RU": {"7", "8", 10, 10},
+	"BR": {"55", "0", 10, 11},
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultRegion = "CN"
+)
+
+// SetDefaultRegion sets the region assumed for numbers written without a country code
+func SetDefaultRegion(regionCode string) error {
+	regionCode = strings.ToUpper(regionCode)
+	if _, ok := regions[regionCode]; !ok {
+		return fmt.Errorf("unsupported phone region: %s", regionCode)
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultRegion = regionCode
+	return nil
+}
+
+// DefaultRegion returns the region assumed for numbers written without a country code
+func DefaultRegion() string {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultRegion
+}
+
+// Normalize parses a phone number in the default region and returns it in E.164
+func Normalize(raw string) (string, error) {
+	return NormalizeIn(raw, DefaultRegion())
+}
+
+// NormalizeIn parses a phone number and returns it in E.164.
+// Numbers starting with "+" or "00" are international, anything else is read as a national
+// number of regionCode, with or without its trunk prefix or (unprefixed) calling code.
+func NormalizeIn(raw, regionCode string) (string, error) {
+	digits, international, err := clean(raw)
+	if err != nil {
+		return "", err
+	}
+	if international {
+		return validateInternational(digits)
+	}
+
+	r, ok := regions[strings.ToUpper(regionCode)]
+	if !ok {
+		return "", fmt.Errorf("%w: %q has no country code and region %q is unknown", ErrInvalid, raw, regionCode)
+	}
+	national := digits
+	if r.trunkPrefix != "" && len(national) > r.maxLength && strings.HasPrefix(national, r.trunkPrefix) {
+		national = strings.TrimPrefix(national, r.trunkPrefix)
+	} else if len(national) > r.maxLength && strings.HasPrefix(national, r.callingCode) {
+		// the calling code without "+", e.g. 8613800000000
+		national = strings.TrimPrefix(national, r.callingCode)
+	}
+	if len(national) < r.minLength || len(national) > r.maxLength {
+		return "", fmt.Errorf("%w: %q", ErrInvalid, raw)
+	}
+	return validateInternational(r.callingCode + national)
+}
+
+// Split returns the country calling code and national number of an E.164 number
+func Split(e164 string) (callingCode, national string, err error) {
+	digits, international, err := clean(e164)
+	if err != nil || !international {
+		return "", "", fmt.Errorf("%w: %q is not in E.164", ErrInvalid, e164)
+	}
+	callingCode = CallingCode(e164)
+	if callingCode == "" {
+		return "", "", fmt.Errorf("%w: unknown country code in %q", ErrInvalid, e164)
+	}
+	return callingCode, strings.TrimPrefix(digits, callingCode), nil
+}
+
+// CallingCode returns the country calling code of an E.164 number, or "" if it is not a known one
+func CallingCode(e164 string) string {
+	digits := strings.TrimPrefix(e164, "+")
+	best := ""
+	for _, r := range regions {
+		if strings.HasPrefix(digits, r.callingCode) && len(r.callingCode) > len(best) {
+			best = r.callingCode
+		}
+	}
+	return best
+}
+
+// RegionCallingCode returns the country calling code of a region, e.g. "86" for "CN"
+func RegionCallingCode(regionCode string) (string, bool) {
+	r, ok := regions[strings.ToUpper(regionCode)]
+	return r.callingCode, ok
+}
+
+// clean strips formatting characters and reports whether the number has an international prefix
+func clean(raw string) (digits string, international bool, err error) {
+	raw = strings.TrimSpace(raw)
+	international = strings.HasPrefix(raw, "+")
+	var b strings.Builder
+	for i, c := range raw {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == '+' && i == 0:
+		case c == ' ' || c == '-' || c == '(' || c == ')' || c == '.':
+		default:
+			return "", false, fmt.Errorf("%w: %q", ErrInvalid, raw)
+		}
+	}
+	digits = b.String()
+	if !international && strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+	if digits == "" {
+		return "", false, fmt.Errorf("%w: %q", ErrInvalid, raw)
+	}
+	return digits, international, nil
+}
+
+func validateInternational(digits string) (string, error) {
+	// E.164 allows at most 15 digits; anything under 8 is not a dialable subscriber number
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", fmt.Errorf("%w: +%s", ErrInvalid, digits)
+	}
+	return "+" + digits, nil
+}
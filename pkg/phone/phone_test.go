@@ -0,0 +1,160 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+// withDefaultRegion sets the default region for the test and restores it afterwards
+func withDefaultRegion(t *testing.T, region string) {
+	t.Helper()
+	previous := DefaultRegion()
+	t.Cleanup(func() { _ = SetDefaultRegion(previous) })
+	if err := SetDefaultRegion(region); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		region  string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"national", "CN", "13800138000", "+8613800138000", false},
+		{"formatted", "CN", " 138-0013 (8000) ", "+8613800138000", false},
+		{"legacy +86", "CN", "+86 138 0013 8000", "+8613800138000", false},
+		{"legacy +86 without spaces", "CN", "+8613800138000", "+8613800138000", false},
+		{"00 international prefix", "CN", "008613800138000", "+8613800138000", false},
+		{"calling code without +", "CN", "8613800138000", "+8613800138000", false},
+		{"trunk prefix", "CN", "013800138000", "+8613800138000", false},
+		{"international number in another region", "US", "+8613800138000", "+8613800138000", false},
+		{"US national", "US", "(202) 555-0143", "+12025550143", false},
+		{"US trunk prefix", "US", "1 202 555 0143", "+12025550143", false},
+		{"RU trunk prefix", "RU", "8 912 345 67 89", "+79123456789", false},
+		{"HK without trunk prefix", "HK", "9123 4567", "+85291234567", false},
+		{"empty", "CN", "", "", true},
+		{"only a plus", "CN", "+", "", true},
+		{"letters", "CN", "138abc38000", "", true},
+		{"plus inside the number", "CN", "138+0013800", "", true},
+		{"too short", "CN", "12345", "", true},
+		{"too long", "CN", "1380013800012345", "", true},
+		{"international too short", "CN", "+8612", "", true},
+		{"international too long", "CN", "+8613800138000123", "", true},
+		{"international leading zero", "CN", "+013800138000", "", true},
+		{"US too short", "US", "555-0143", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDefaultRegion(t, tt.region)
+			got, err := Normalize(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("err = %v, want ErrInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Normalize(%q): %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+			// an E.164 number normalizes to itself, in whatever region
+			for _, region := range []string{"CN", "US", "RU"} {
+				again, err := NormalizeIn(got, region)
+				if err != nil || again != got {
+					t.Errorf("NormalizeIn(%q, %s) = %q, %v; want it unchanged", got, region, again, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeInUnknownRegion(t *testing.T) {
+	if _, err := NormalizeIn("13800138000", "XX"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("err = %v, want ErrInvalid", err)
+	}
+	// the region is not needed for international numbers
+	if got, err := NormalizeIn("+8613800138000", "XX"); err != nil || got != "+8613800138000" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestDefaultRegion(t *testing.T) {
+	if got := DefaultRegion(); got != "CN" {
+		t.Fatalf("DefaultRegion() = %q, want CN", got)
+	}
+	withDefaultRegion(t, "us")
+	if got := DefaultRegion(); got != "US" {
+		t.Errorf("DefaultRegion() = %q, want US", got)
+	}
+	if err := SetDefaultRegion("XX"); err == nil {
+		t.Error("expected an unsupported region to be rejected")
+	}
+	if got := DefaultRegion(); got != "US" {
+		t.Errorf("DefaultRegion() = %q after a rejected region, want US", got)
+	}
+}
+
+func TestCallingCode(t *testing.T) {
+	tests := []struct {
+		e164 string
+		want string
+	}{
+		{"+8613800138000", "86"},
+		{"+12025550143", "1"},
+		{"+79123456789", "7"},
+		{"+85291234567", "852"}, // not 85, which is no calling code here
+		{"+886912345678", "886"},
+		{"8613800138000", "86"},
+		{"+99912345678", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.e164, func(t *testing.T) {
+			if got := CallingCode(tt.e164); got != tt.want {
+				t.Errorf("CallingCode(%q) = %q, want %q", tt.e164, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegionCallingCode(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+		wantOK bool
+	}{
+		{"CN", "86", true},
+		{"cn", "86", true},
+		{"US", "1", true},
+		{"CA", "1", true},
+		{"HK", "852", true},
+		{"XX", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			got, ok := RegionCallingCode(tt.region)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("RegionCallingCode(%q) = %q, %v; want %q, %v", tt.region, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	code, national, err := Split("+8613800138000")
+	if err != nil || code != "86" || national != "13800138000" {
+		t.Errorf("Split = %q, %q, %v", code, national, err)
+	}
+	if _, _, err := Split("13800138000"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Split of a national number: err = %v, want ErrInvalid", err)
+	}
+	if _, _, err := Split("+99912345678"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Split of an unknown country code: err = %v, want ErrInvalid", err)
+	}
+}
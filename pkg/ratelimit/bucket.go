@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy a token bucket holding up to Burst tokens, refilled at Rate tokens per second
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+// Bucket is the state of one token bucket
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Take refills the bucket up to now and takes one token.
+// When the bucket is empty it returns false and the time until a token is available.
+func (b *Bucket) Take(now time.Time, p Policy) (bool, time.Duration) {
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = float64(p.Burst)
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(p.Burst), b.Tokens+elapsed*p.Rate)
+	}
+	b.UpdatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	if p.Rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.Tokens) / p.Rate * float64(time.Second))
+}
+
+// Full reports whether a bucket left alone since its last update has refilled completely,
+// so forgetting it changes nothing
+func (b *Bucket) Full(now time.Time, p Policy) bool {
+	return p.Rate > 0 && b.Tokens+now.Sub(b.UpdatedAt).Seconds()*p.Rate >= float64(p.Burst)
+}
+
+// Store keeps token buckets by key
+type Store interface {
+	Take(ctx context.Context, key string, p Policy) (bool, time.Duration, error)
+}
+
+// MemoryStore keeps buckets in process memory; each replica limits on its own
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	policy Policy
+}
+
+// memorySweepInterval how often buckets that have refilled are dropped
+const memorySweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, p Policy) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= memorySweepInterval {
+		s.lastSweep = now
+		for k, b := range s.buckets {
+			if b.Full(now, b.policy) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	b.policy = p
+	allowed, retryAfter := b.Take(now, p)
+	return allowed, retryAfter, nil
+}
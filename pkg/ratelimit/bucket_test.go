@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	p := Policy{Rate: 2, Burst: 3}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name           string
+		after          time.Duration // since start
+		wantAllowed    bool
+		wantRetryAfter time.Duration
+	}{
+		{"starts full", 0, true, 0},
+		{"second of the burst", 0, true, 0},
+		{"last of the burst", 0, true, 0},
+		{"empty", 0, false, 500 * time.Millisecond},
+		{"partly refilled", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled one token", 500 * time.Millisecond, true, 0},
+		{"empty again", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"refill capped at the burst", time.Hour, true, 0},
+		{"second after the cap", time.Hour, true, 0},
+		{"third after the cap", time.Hour, true, 0},
+		{"no more than the burst", time.Hour, false, 500 * time.Millisecond},
+	}
+	var b Bucket
+	for _, step := range steps {
+		allowed, retryAfter := b.Take(start.Add(step.after), p)
+		if allowed != step.wantAllowed || retryAfter != step.wantRetryAfter {
+			t.Errorf("%s: Take = %v, %s; want %v, %s", step.name, allowed, retryAfter, step.wantAllowed, step.wantRetryAfter)
+		}
+	}
+}
+
+func TestBucketTakeWithoutRefill(t *testing.T) {
+	var b Bucket
+	now := time.Now()
+	if allowed, _ := b.Take(now, Policy{Burst: 1}); !allowed {
+		t.Fatal("first take rejected")
+	}
+	if allowed, retryAfter := b.Take(now.Add(time.Hour), Policy{Burst: 1}); allowed || retryAfter != time.Hour {
+		t.Errorf("Take = %v, %s; want a rejection retried after an hour", allowed, retryAfter)
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+	p := Policy{Rate: 1, Burst: 2}
+	now := time.Now()
+	b := Bucket{Tokens: 0, UpdatedAt: now}
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  bool
+	}{
+		{"just emptied", 0, false},
+		{"partly refilled", time.Second, false},
+		{"refilled", 2 * time.Second, true},
+		{"long idle", time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.Full(now.Add(tt.after), p); got != tt.want {
+				t.Errorf("Full = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if b.Full(now.Add(time.Hour), Policy{Burst: 2}) {
+		t.Error("a bucket that never refills reported full")
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	p := Policy{Rate: 0.001, Burst: 1}
+	if allowed, _, _ := s.Take(ctx, "a", p); !allowed {
+		t.Fatal("first take of a rejected")
+	}
+	if allowed, retryAfter, _ := s.Take(ctx, "a", p); allowed || retryAfter <= 0 {
+		t.Errorf("second take of a = %v, %s; want a rejection with a retry time", allowed, retryAfter)
+	}
+	if allowed, _, _ := s.Take(ctx, "b", p); !allowed {
+		t.Error("another key shared the bucket of a")
+	}
+}
@@ -0,0 +1,28 @@
+// Package ratelimit provides rate limiting primitives kept in memory or in a shared store.
+package ratelimit
+
+import (
+	"time"
+)
+
+// Window is the state of one fixed window counter
+type Window struct {
+	Start time.Time
+	Count int
+}
+
+// Add counts an event at now, starting over when now is past the window, and reports whether the
+// count is within limit. When it is not, it also returns the time until the window resets.
+// Windows are aligned to the epoch, so a 24h window resets at midnight UTC.
+func (w *Window) Add(now time.Time, limit int, length time.Duration) (bool, time.Duration) {
+	start := now.Truncate(length)
+	if !w.Start.Equal(start) {
+		w.Start = start
+		w.Count = 0
+	}
+	w.Count++
+	if w.Count > limit {
+		return false, start.Add(length).Sub(now)
+	}
+	return true, 0
+}
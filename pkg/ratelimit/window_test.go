@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowAdd(t *testing.T) {
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name           string
+		at             time.Time
+		wantAllowed    bool
+		wantRetryAfter time.Duration
+	}{
+		{"first", start.Add(10 * time.Minute), true, 0},
+		{"second", start.Add(20 * time.Minute), true, 0},
+		{"over the limit", start.Add(45 * time.Minute), false, 15 * time.Minute},
+		{"next window starts over", start.Add(time.Hour), true, 0},
+		{"second in the next window", start.Add(time.Hour + time.Minute), true, 0},
+		{"over in the next window", start.Add(time.Hour + 59*time.Minute), false, time.Minute},
+	}
+	var w Window
+	for _, step := range steps {
+		allowed, retryAfter := w.Add(step.at, 2, time.Hour)
+		if allowed != step.wantAllowed || retryAfter != step.wantRetryAfter {
+			t.Errorf("%s: Add = %v, %s; want %v, %s", step.name, allowed, retryAfter, step.wantAllowed, step.wantRetryAfter)
+		}
+	}
+}
+
+func TestWindowAlignedToMidnightUTC(t *testing.T) {
+	var w Window
+	now := time.Date(2026, 1, 1, 18, 0, 0, 0, time.UTC)
+	w.Add(now, 1, 24*time.Hour)
+	allowed, retryAfter := w.Add(now.Add(time.Hour), 1, 24*time.Hour)
+	if allowed || retryAfter != 5*time.Hour {
+		t.Errorf("Add = %v, %s; want a rejection until midnight", allowed, retryAfter)
+	}
+	if allowed, _ := w.Add(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), 1, 24*time.Hour); !allowed {
+		t.Error("the window did not start over at midnight")
+	}
+}
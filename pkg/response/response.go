@@ -22,12 +22,17 @@ func JSONSuccess(c *gin.Context, message, data any) {
 
 // JSONError returns error response (basic version)
 func JSONError(c *gin.Context, httpCode int, codeMsg, message string) {
+	JSONErrorWithData(c, httpCode, codeMsg, message, "")
+}
+
+// JSONErrorWithData returns error response with data telling the client how to go on
+func JSONErrorWithData(c *gin.Context, httpCode int, codeMsg, message string, data any) {
 	c.JSON(httpCode, gin.H{
 		"code":      codeMsg,
 		"success":   false,
 		"message":   message,
 		"timestamp": time.Now(),
-		"data":      "",
+		"data":      data,
 	})
 }
 
@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors the SHA-1 vectors of RFC 6238 appendix B, truncated from 8 to 6 digits
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeAtRFC6238(t *testing.T) {
+	for _, tt := range rfcVectors {
+		got, err := CodeAt(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("CodeAt(%d): %v", tt.unix, err)
+		}
+		if got != tt.code {
+			t.Errorf("CodeAt(%d) = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCodeAtAcceptsLowercaseSecret(t *testing.T) {
+	got, err := CodeAt(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Fatalf("CodeAt = %q, %v, want 287082", got, err)
+	}
+}
+
+func TestCodeAtInvalidSecret(t *testing.T) {
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Fatal("CodeAt accepted an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	codeAt := func(step int64) string {
+		code, err := CodeAt(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		wantOK   bool
+		wantStep int64
+	}{
+		{"current step", codeAt(current), 1, true, current},
+		{"spaces are ignored", codeAt(current)[:3] + " " + codeAt(current)[3:], 1, true, current},
+		{"previous step within skew", codeAt(current - 1), 1, true, current - 1},
+		{"next step within skew", codeAt(current + 1), 1, true, current + 1},
+		{"previous step without skew", codeAt(current - 1), 0, false, 0},
+		{"two steps back", codeAt(current - 2), 1, false, 0},
+		{"wrong code", "000000", 1, false, 0},
+		{"too short", codeAt(current)[:5], 1, false, 0},
+		{"too long", codeAt(current) + "0", 1, false, 0},
+		{"empty", "", 1, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, step, err := Validate(rfcSecret, tt.code, now, tt.skew)
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate(%q) = %v, %d, want %v, %d", tt.code, ok, step, tt.wantOK, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestGenerateSecretRoundTrips(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret %q has %d characters, want 32", secret, len(secret))
+	}
+	code, err := CodeAt(secret, Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := Validate(secret, code, time.Now(), 1); err != nil || !ok {
+		t.Errorf("Validate rejected the current code of a generated secret: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyProofType the typ header of key proofs, which use the format of DPoP proofs (RFC 9449)
+const KeyProofType = "dpop+jwt"
+
+// keyProofSigningMethods the algorithms a device key may sign proofs with; "none" and HMAC are never accepted
+var keyProofSigningMethods = []string{"RS256", "PS256", "ES256", "ES384", "EdDSA"}
+
+// KeyProof a proof of possession of a device-bound key: a JWT signed by the private key whose
+// public JWK it carries in its header, stating the request it was made for
+type KeyProof struct {
+	Key        JWK
+	Thumbprint string
+	ID         string
+	Method     string
+	URL        string
+	IssuedAt   time.Time
+	// AccessTokenHash is the ath claim of a proof presented with an access token
+	AccessTokenHash string
+}
+
+// ParseKeyProof checks the signature of a key proof with the key in its header and returns what it
+// states. Whether it is fresh, unused and made for the request is up to the caller.
+func ParseKeyProof(proof string) (*KeyProof, error) {
+	var key JWK
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (any, error) {
+		if typ, _ := token.Header["typ"].(string); typ != KeyProofType {
+			return nil, fmt.Errorf("proof type must be %s", KeyProofType)
+		}
+		raw, ok := token.Header["jwk"].(map[string]any)
+		if !ok {
+			return nil, errors.New("proof header has no jwk")
+		}
+		if _, private := raw["d"]; private {
+			return nil, errors.New("proof header carries a private key")
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("invalid proof jwk: %w", err)
+		}
+		// the key is the one in the header, never one a certificate chain points at
+		key.X5c = nil
+		return key.PublicKey()
+	},
+		jwt.WithValidMethods(keyProofSigningMethods),
+		jwt.WithoutClaimsValidation(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key proof: %w", err)
+	}
+	id, _ := claims["jti"].(string)
+	method, _ := claims["htm"].(string)
+	url, _ := claims["htu"].(string)
+	ath, _ := claims["ath"].(string)
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil || id == "" || method == "" || url == "" {
+		return nil, errors.New("invalid key proof: jti, htm, htu and iat are required")
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return nil, fmt.Errorf("invalid key proof: %w", err)
+	}
+	return &KeyProof{
+		Key:             key,
+		Thumbprint:      thumbprint,
+		ID:              id,
+		Method:          method,
+		URL:             url,
+		IssuedAt:        issuedAt.Time,
+		AccessTokenHash: ath,
+	}, nil
+}
+
+// AccessTokenHash the ath of an access token: its base64url encoded SHA-256 hash
+func AccessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
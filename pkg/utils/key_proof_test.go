@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func ecJWK(key *ecdsa.PublicKey) map[string]any {
+	return map[string]any{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func proofClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"jti": "proof-1",
+		"htm": "POST",
+		"htu": "https://auth.example.com/oidc-auth/api/v1/plugin/login/token",
+		"iat": time.Now().Unix(),
+		"ath": AccessTokenHash("token"),
+	}
+}
+
+// signProof signs the claims with the key, the header carrying jwk unless it is nil
+func signProof(t *testing.T, method jwt.SigningMethod, key any, jwk map[string]any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["typ"] = KeyProofType
+	if jwk != nil {
+		token.Header["jwk"] = jwk
+	}
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestParseKeyProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := ecJWK(&key.PublicKey)
+	want := JWK{Kty: "EC", Crv: "P-256", X: jwk["x"].(string), Y: jwk["y"].(string)}
+	wantThumbprint, err := want.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := proofClaims()
+	parsed, err := ParseKeyProof(signProof(t, jwt.SigningMethodES256, key, jwk, claims))
+	if err != nil {
+		t.Fatalf("ParseKeyProof: %v", err)
+	}
+	if parsed.Thumbprint != wantThumbprint {
+		t.Errorf("thumbprint = %s, want %s", parsed.Thumbprint, wantThumbprint)
+	}
+	if parsed.ID != "proof-1" || parsed.Method != "POST" || parsed.URL != claims["htu"] ||
+		parsed.AccessTokenHash != claims["ath"] || parsed.IssuedAt.Unix() != claims["iat"] {
+		t.Errorf("parsed proof = %+v, want the claims %v", parsed, claims)
+	}
+}
+
+func TestParseKeyProofEd25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := map[string]any{"kty": "OKP", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(public)}
+	if _, err := ParseKeyProof(signProof(t, jwt.SigningMethodEdDSA, private, jwk, proofClaims())); err != nil {
+		t.Fatalf("ParseKeyProof: %v", err)
+	}
+}
+
+func TestParseKeyProofRejects(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := ecJWK(&key.PublicKey)
+	without := func(claim string) jwt.MapClaims {
+		claims := proofClaims()
+		delete(claims, claim)
+		return claims
+	}
+	withPrivate := ecJWK(&key.PublicKey)
+	withPrivate["d"] = base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, proofClaims())
+	hmacToken.Header["typ"] = KeyProofType
+	hmacToken.Header["jwk"] = map[string]any{"kty": "oct", "k": base64.RawURLEncoding.EncodeToString([]byte("secret"))}
+	hmacProof, err := hmacToken.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noneToken := jwt.NewWithClaims(jwt.SigningMethodNone, proofClaims())
+	noneToken.Header["typ"] = KeyProofType
+	noneToken.Header["jwk"] = jwk
+	noneProof, err := noneToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongType := jwt.NewWithClaims(jwt.SigningMethodES256, proofClaims())
+	wrongType.Header["typ"] = "JWT"
+	wrongType.Header["jwk"] = jwk
+	wrongTypeProof, err := wrongType.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		proof string
+	}{
+		{"not a jwt", "not.a.proof"},
+		{"signed by another key", signProof(t, jwt.SigningMethodES256, other, jwk, proofClaims())},
+		{"no jwk", signProof(t, jwt.SigningMethodES256, key, nil, proofClaims())},
+		{"private key in the header", signProof(t, jwt.SigningMethodES256, key, withPrivate, proofClaims())},
+		{"wrong type", wrongTypeProof},
+		{"hmac", hmacProof},
+		{"unsigned", noneProof},
+		{"no jti", signProof(t, jwt.SigningMethodES256, key, jwk, without("jti"))},
+		{"no htm", signProof(t, jwt.SigningMethodES256, key, jwk, without("htm"))},
+		{"no htu", signProof(t, jwt.SigningMethodES256, key, jwk, without("htu"))},
+		{"no iat", signProof(t, jwt.SigningMethodES256, key, jwk, without("iat"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if parsed, err := ParseKeyProof(tt.proof); err == nil {
+				t.Errorf("ParseKeyProof = %+v, want an error", parsed)
+			}
+		})
+	}
+}
+
+func TestParseKeyProofTamperedClaims(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := signProof(t, jwt.SigningMethodES256, key, ecJWK(&key.PublicKey), proofClaims())
+	parts := strings.Split(proof, ".")
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"jti":"proof-1","htm":"POST","htu":"https://attacker.example.com/","iat":1}`))
+	if _, err := ParseKeyProof(parts[0] + "." + payload + "." + parts[2]); err == nil {
+		t.Error("ParseKeyProof accepted a proof whose claims were changed after signing")
+	}
+}
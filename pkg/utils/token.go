@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -9,19 +10,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
+	"github.com/zgsm-ai/oidc-auth/internal/constants"
 	"github.com/zgsm-ai/oidc-auth/internal/repository"
 )
 
 // TokenTypeBearer Token types
 const (
 	TokenTypeBearer = "Bearer"
+	TokenTypeDPoP   = "DPoP" // bound to the device key by the cnf claim (RFC 9449)
 )
 
+// ErrPendingMFA the device has not passed the second factor yet, so its tokens are not usable
+var ErrPendingMFA = errors.New("two-factor authentication is pending")
+
+// ErrSessionEvicted the device was signed out to respect the session limit of its user
+var ErrSessionEvicted = errors.New("signed out because the account logged in on too many devices")
+
 // AppClaims defines the payload of a AESEncrypt.
 type AppClaims struct {
 	Name          string   `json:"name,omitempty"`
@@ -141,6 +151,12 @@ func GenerateTokenPairWithOptions(subject, issuer string, audience []string, cus
 		"device_code": deviceCode,
 	}
 
+	tokenType := TokenTypeBearer
+	if cnf, ok := customClaims["cnf"]; ok {
+		refreshMapClaims["cnf"] = cnf
+		tokenType = TokenTypeDPoP
+	}
+
 	refreshToken, err := CreateToken(refreshMapClaims, privateKeyPEM)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
@@ -149,12 +165,18 @@ func GenerateTokenPairWithOptions(subject, issuer string, audience []string, cus
 	return &TokenPair{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
-		TokenType:    TokenTypeBearer,
+		TokenType:    tokenType,
 		ExpiresIn:    int64(options.AccessTokenExpiry.Seconds()),
 	}, nil
 }
 
 func GenerateTokenPairByUser(user *repository.AuthUser, deviceIndex int) (*TokenPair, error) {
+	return GenerateTokenPairByClient(user, deviceIndex, nil)
+}
+
+// GenerateTokenPairByClient generates tokens for a device, applying the token policy of its OAuth client.
+// A nil client uses the platform defaults.
+func GenerateTokenPairByClient(user *repository.AuthUser, deviceIndex int, client *repository.OAuthClient) (*TokenPair, error) {
 	device := user.Devices[deviceIndex]
 	platform := device.Platform
 	scope := platform + "_access"
@@ -179,16 +201,27 @@ func GenerateTokenPairByUser(user *repository.AuthUser, deviceIndex int) (*Token
 		"device_code": device.DeviceCode,
 		"key":         "user",
 	}
+	if thumbprint := device.Attestation.KeyThumbprint; thumbprint != "" {
+		// sender-constrained: the tokens are only accepted with a proof of the device key
+		webTokenClaims["cnf"] = map[string]string{"jkt": thumbprint}
+	}
 
 	tokenOptions := TokenOptions{
-		AccessTokenExpiry:  8 * time.Hour,
-		RefreshTokenExpiry: 30 * 24 * time.Hour,
+		AccessTokenExpiry:  constants.DefaultAccessTokenTTL,
+		RefreshTokenExpiry: constants.DefaultRefreshTokenTTL,
+	}
+	audience := []string{platform + "-app"}
+	if client != nil {
+		webTokenClaims["client_id"] = client.ClientID
+		tokenOptions.AccessTokenExpiry = client.AccessTokenExpiry()
+		tokenOptions.RefreshTokenExpiry = client.RefreshTokenExpiry()
+		audience = client.TokenAudience()
 	}
 
 	return GenerateTokenPairWithOptions(
 		user.ID.String(),
 		"oidc-auth-"+platform,
-		[]string{platform + "-app"},
+		audience,
 		webTokenClaims,
 		keyManager.GetPrivateKeyPEM(),
 		&tokenOptions,
@@ -201,11 +234,36 @@ func HashToken(token string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// HashSecret hashes a short-lived secret such as a one-time code with the server key,
+// so a leaked table cannot be brute forced offline
+func HashSecret(secret string) string {
+	var key string
+	if globalConfig != nil {
+		key = globalConfig.Encrypt.AesKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateNumericCode returns a random decimal code of the given length
+func GenerateNumericCode(length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %w", err)
+		}
+		b[i] = byte('0' + n.Int64())
+	}
+	return string(b), nil
+}
+
 func GenerateRandomString(length int) (string, error) {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, length)
 	if _, err := rand.Read(b); err != nil {
-		return "", fmt.Errorf("failed to generate random string: " + err.Error())
+		return "", fmt.Errorf("failed to generate random string: %w", err)
 	}
 	for i := range b {
 		b[i] = charset[int(b[i])%len(charset)]
@@ -256,6 +314,18 @@ func DecodeJWTPayloadUnverified(tokenStr string) (*JWTPayload, error) {
 	return &result, nil
 }
 
+// TokenKeyThumbprint the thumbprint of the key a token of this server is bound to by its cnf.jkt
+// claim, empty for a bearer token. The token is not verified; it is looked up by its hash anyway.
+func TokenKeyThumbprint(token string) string {
+	payload, err := DecodeJWTPayloadUnverified(token)
+	if err != nil {
+		return ""
+	}
+	cnf, _ := payload.CustomClaims["cnf"].(map[string]any)
+	thumbprint, _ := cnf["jkt"].(string)
+	return thumbprint
+}
+
 func GetTokenByTokenHash(ctx context.Context, tokenHash string) (*TokenPair, error) {
 	if tokenHash == "" {
 		return nil, errors.New("token cannot be empty")
@@ -278,6 +348,12 @@ func GetTokenByTokenHash(ctx context.Context, tokenHash string) (*TokenPair, err
 	if deviceIndex == -1 {
 		return nil, errors.New("matching device not found for the user (token might be expired or invalid)")
 	}
+	switch user.Devices[deviceIndex].Status {
+	case constants.LoginStatusPendingMFA:
+		return nil, ErrPendingMFA
+	case constants.LoginStatusEvicted:
+		return nil, ErrSessionEvicted
+	}
 	return &TokenPair{
 		AccessToken:  user.Devices[deviceIndex].AccessToken,
 		RefreshToken: user.Devices[deviceIndex].RefreshToken,
@@ -327,5 +403,12 @@ func GetUserByTokenHash(ctx context.Context, token, indexName string) (*reposito
 	if deviceIndex == -1 {
 		return nil, -1, errors.New("matching device not found for the user (token might be expired or invalid)")
 	}
+	if user.Devices[deviceIndex].Status == constants.LoginStatusPendingMFA {
+		return nil, -1, ErrPendingMFA
+	}
+	if user.Devices[deviceIndex].Status == constants.LoginStatusEvicted {
+		// the user comes along so the status endpoint can still answer the evicted device
+		return user, deviceIndex, ErrSessionEvicted
+	}
 	return user, deviceIndex, nil
 }
@@ -0,0 +1,109 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string // hex
+		want any
+	}{
+		{"small integer", "17", int64(23)},
+		{"one byte integer", "1818", int64(24)},
+		{"eight byte integer", "1b000000e8d4a51000", int64(1000000000000)},
+		{"negative integer", "3903e7", int64(-1000)},
+		{"byte string", "4401020304", []byte{1, 2, 3, 4}},
+		{"text string", "6449455446", "IETF"},
+		{"array", "83010203", []any{int64(1), int64(2), int64(3)}},
+		{"map", "a201020326", map[any]any{int64(1): int64(2), int64(3): int64(-7)}},
+		{"text keys", "a1616101", map[any]any{"a": int64(1)}},
+		{"false", "f4", false},
+		{"true", "f5", true},
+		{"null", "f6", nil},
+		{"half float", "f93c00", 1.0},
+		{"double", "fb3ff199999999999a", 1.1},
+		{"tagged item", "c11a514b67b0", int64(1363896240)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, _ := hex.DecodeString(tt.in)
+			got, rest, err := decodeCBOR(append(in, 0xff))
+			if err != nil {
+				t.Fatalf("decodeCBOR: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCBOR = %#v, want %#v", got, tt.want)
+			}
+			if !bytes.Equal(rest, []byte{0xff}) {
+				t.Errorf("rest = %x, want ff", rest)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string // hex
+	}{
+		{"empty", ""},
+		{"truncated argument", "19ff"},
+		{"truncated byte string", "4401"},
+		{"byte string longer than the input", "5bffffffffffffffff00"},
+		{"array longer than the input", "9affffffff00"},
+		{"map longer than the input", "bbffffffffffffffff00"},
+		{"truncated map value", "a101"},
+		{"array map key", "a1800102"},
+		{"integer overflow", "1bffffffffffffffff"},
+		{"negative integer overflow", "3bffffffffffffffff"},
+		{"indefinite length byte string", "5f4101ff"},
+		{"reserved additional information", "1c"},
+		{"unsupported simple value", "f820"},
+		{"truncated float", "fa3f80"},
+		{"nesting too deep", strings.Repeat("81", maxCBORDepth+2) + "01"},
+		{"tags too deep", strings.Repeat("c1", maxCBORDepth+2) + "01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, _ := hex.DecodeString(tt.in)
+			if got, _, err := decodeCBOR(in); err == nil {
+				t.Errorf("decodeCBOR(%s) = %#v, want an error", tt.in, got)
+			}
+		})
+	}
+}
+
+func TestParseAuthenticatorDataMalformed(t *testing.T) {
+	header := func(flags byte) []byte {
+		return append(make([]byte, 32), flags, 0, 0, 0, 1)
+	}
+	attested := func(idLength uint16, rest ...byte) []byte {
+		data := append(header(flagUserPresent|flagAttestedData), make([]byte, 16)...)
+		data = append(data, byte(idLength>>8), byte(idLength))
+		return append(data, rest...)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"too short", make([]byte, 36)},
+		{"attested data without credential", header(flagAttestedData)},
+		{"empty credential id", attested(0, 0xa0)},
+		{"oversized credential id", attested(1024, make([]byte, 1024)...)},
+		{"credential id longer than the data", attested(16, 1, 2, 3)},
+		{"truncated public key", attested(1, 7, 0xa2, 0x01)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseAuthenticatorData(tt.in); err == nil {
+				t.Error("ParseAuthenticatorData succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+// encodeCOSEKey encodes a map of integer labels to integer or byte string values
+func encodeCOSEKey(labels map[int64]any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	integer := func(v int64) []byte {
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	}
+	out := head(5, uint64(len(labels)))
+	for label, value := range labels {
+		out = append(out, integer(label)...)
+		switch v := value.(type) {
+		case int64:
+			out = append(out, integer(v)...)
+		case []byte:
+			out = append(append(out, head(2, uint64(len(v)))...), v...)
+		}
+	}
+	return out
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("signed data")
+	digest := sha256.Sum256(data)
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       map[int64]any
+		signature []byte
+	}{
+		{"ES256", map[int64]any{1: int64(coseKeyTypeEC2), 3: AlgES256, -1: int64(coseCurveP256),
+			-2: ecKey.X.FillBytes(make([]byte, 32)), -3: ecKey.Y.FillBytes(make([]byte, 32))}, ecSignature},
+		{"EdDSA", map[int64]any{1: int64(coseKeyTypeOKP), 3: AlgEdDSA, -1: int64(coseCurveEd25519),
+			-2: []byte(edPublic)}, ed25519.Sign(edPrivate, data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePublicKey(encodeCOSEKey(tt.key))
+			if err != nil {
+				t.Fatalf("ParsePublicKey: %v", err)
+			}
+			if !key.Verify(data, tt.signature) {
+				t.Error("Verify rejected a valid signature")
+			}
+			if key.Verify([]byte("other data"), tt.signature) {
+				t.Error("Verify accepted the signature of other data")
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyMalformed(t *testing.T) {
+	point := make([]byte, 32)
+	point[31] = 1
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"array", []byte{0x82, 0x01, 0x02}},
+		{"trailing data", append(encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeOKP), 3: AlgEdDSA,
+			-1: int64(coseCurveEd25519), -2: make([]byte, 32)}), 0x00)},
+		{"unsupported algorithm", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeEC2), 3: int64(-35),
+			-1: int64(2), -2: make([]byte, 48), -3: make([]byte, 48)})},
+		{"short EC2 coordinate", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeEC2), 3: AlgES256,
+			-1: int64(coseCurveP256), -2: make([]byte, 31), -3: make([]byte, 32)})},
+		{"point not on the curve", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeEC2), 3: AlgES256,
+			-1: int64(coseCurveP256), -2: point, -3: point})},
+		{"coordinate of the wrong type", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeEC2), 3: AlgES256,
+			-1: int64(coseCurveP256), -2: int64(1), -3: int64(1)})},
+		{"short Ed25519 key", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeOKP), 3: AlgEdDSA,
+			-1: int64(coseCurveEd25519), -2: make([]byte, 31)})},
+		{"short RSA modulus", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeRSA), 3: AlgRS256,
+			-1: make([]byte, 128), -2: []byte{1, 0, 1}})},
+		{"oversized RSA modulus", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeRSA), 3: AlgRS256,
+			-1: make([]byte, 4096), -2: []byte{1, 0, 1}})},
+		{"oversized RSA exponent", encodeCOSEKey(map[int64]any{1: int64(coseKeyTypeRSA), 3: AlgRS256,
+			-1: make([]byte, 256), -2: make([]byte, 5)})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key, err := ParsePublicKey(tt.in); err == nil {
+				t.Errorf("ParsePublicKey = %+v, want an error", key)
+			}
+		})
+	}
+}
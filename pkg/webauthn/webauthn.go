@@ -0,0 +1,234 @@
+// Package webauthn verifies WebAuthn registration and authentication ceremonies for relying parties
+// that request "none" attestation: a credential is trusted for its key, not for the make of the
+// authenticator, so attestation statements are not checked.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+)
+
+const challengeSize = 32
+
+var (
+	ErrInvalidClientData  = errors.New("invalid client data")
+	ErrChallengeMismatch  = errors.New("challenge does not match")
+	ErrOriginMismatch     = errors.New("origin is not allowed")
+	ErrRPIDMismatch       = errors.New("relying party id does not match")
+	ErrUserNotPresent     = errors.New("user presence was not confirmed")
+	ErrUserNotVerified    = errors.New("user verification is required")
+	ErrInvalidSignature   = errors.New("invalid assertion signature")
+	ErrSignCountRollback  = errors.New("signature counter went back, the authenticator may be cloned")
+	ErrInvalidAuthData    = errors.New("invalid authenticator data")
+	ErrMissingCredential  = errors.New("attestation has no credential data")
+	ErrInvalidAttestation = errors.New("invalid attestation object")
+)
+
+// RelyingParty the site credentials are scoped to
+type RelyingParty struct {
+	ID      string   // effective domain, e.g. "example.com"
+	Origins []string // allowed origins of the pages running the ceremonies, e.g. "https://app.example.com"
+}
+
+// Encoding is the base64url encoding WebAuthn uses for binary values in JSON
+var Encoding = base64.RawURLEncoding
+
+// NewChallenge returns a random ceremony challenge
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// AuthenticatorData the parsed authenticator data of a ceremony
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key, only set during registration
+}
+
+func (a *AuthenticatorData) UserPresent() bool    { return a.Flags&flagUserPresent != 0 }
+func (a *AuthenticatorData) UserVerified() bool   { return a.Flags&flagUserVerified != 0 }
+func (a *AuthenticatorData) BackupEligible() bool { return a.Flags&flagBackupEligible != 0 }
+func (a *AuthenticatorData) BackedUp() bool       { return a.Flags&flagBackedUp != 0 }
+
+// ParseAuthenticatorData parses the binary authenticator data
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrInvalidAuthData
+	}
+	ad := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, ErrInvalidAuthData
+	}
+	ad.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+		return nil, ErrInvalidAuthData
+	}
+	ad.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+	// the key is followed by extensions when those are present, its length is only known by decoding it
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAuthData, err)
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// Credential a newly registered credential
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte // COSE_Key
+	Algorithm      int64
+	SignCount      uint32
+	AAGUID         []byte
+	UserVerified   bool
+	BackupEligible bool
+	BackedUp       bool
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create and returns the new credential
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte,
+	requireUserVerification bool) (*Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, ErrInvalidAttestation
+	}
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidAttestation
+	}
+	ad, err := ParseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(ad, requireUserVerification); err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, ErrMissingCredential
+	}
+	key, err := ParsePublicKey(ad.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:             bytes.Clone(ad.CredentialID),
+		PublicKey:      bytes.Clone(ad.PublicKey),
+		Algorithm:      key.Algorithm,
+		SignCount:      ad.SignCount,
+		AAGUID:         bytes.Clone(ad.AAGUID),
+		UserVerified:   ad.UserVerified(),
+		BackupEligible: ad.BackupEligible(),
+		BackedUp:       ad.BackedUp(),
+	}, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get against the stored key and
+// signature counter of the credential, and returns the authenticator data to update them from
+func (rp *RelyingParty) VerifyAssertion(challenge, clientDataJSON, authenticatorData, signature, publicKey []byte,
+	storedSignCount uint32, requireUserVerification bool) (*AuthenticatorData, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+	ad, err := ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(ad, requireUserVerification); err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authenticatorData), clientDataHash[:]...)
+	if !key.Verify(signed, signature) {
+		return nil, ErrInvalidSignature
+	}
+	// authenticators without a counter always report 0
+	if (ad.SignCount != 0 || storedSignCount != 0) && ad.SignCount <= storedSignCount {
+		return nil, ErrSignCountRollback
+	}
+	return ad, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidClientData, err)
+	}
+	if clientData.Type != typ {
+		return fmt.Errorf("%w: unexpected type %q", ErrInvalidClientData, clientData.Type)
+	}
+	got, err := Encoding.DecodeString(clientData.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+	if clientData.CrossOrigin || !slices.Contains(rp.Origins, clientData.Origin) {
+		return fmt.Errorf("%w: %s", ErrOriginMismatch, clientData.Origin)
+	}
+	return nil
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(ad *AuthenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(ad.RPIDHash, rpIDHash[:]) != 1 {
+		return ErrRPIDMismatch
+	}
+	if !ad.UserPresent() {
+		return ErrUserNotPresent
+	}
+	if requireUserVerification && !ad.UserVerified() {
+		return ErrUserNotVerified
+	}
+	return nil
+}